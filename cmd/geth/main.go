@@ -362,7 +362,7 @@ func startNode(ctx *cli.Context, stack *node.Node) {
 			utils.Fatalf("Failed to start mining: %v", err)
 		}
 	}
-	if !ctx.GlobalBool(utils.VersionCheckFlag.Name) {
-		blockchain_parameters.SpawnCheck()
-	}
+	blockchain_parameters.SpawnCheck(blockchain_parameters.VersionCheckConfig{
+		Disabled: ctx.GlobalBool(utils.VersionCheckFlag.Name),
+	})
 }
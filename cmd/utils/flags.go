@@ -570,7 +570,7 @@ var (
 
 	VersionCheckFlag = cli.BoolFlag{
 		Name:  "disable-version-check",
-		Usage: "Disable version check. Use if the parameter is set erroneously",
+		Usage: "Disable version check entirely. Use on non-validating nodes such as RPC endpoints or indexers, or if the parameter is set erroneously",
 	}
 
 	// ATM the url is left to the user and deployment to
@@ -28,6 +28,13 @@ func (p *Prque) Pop() (interface{}, int64) {
 	return item.value, item.priority
 }
 
+// Returns the value with the greates priority and its priority without removing it.
+// The queue must not be empty.
+func (p *Prque) Peek() (interface{}, int64) {
+	item := p.cont.blocks[0][0]
+	return item.value, item.priority
+}
+
 // Pops only the item from the queue, dropping the associated priority value.
 func (p *Prque) PopItem() interface{} {
 	return heap.Pop(p.cont).(*item).value
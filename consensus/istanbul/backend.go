@@ -54,6 +54,9 @@ type Backend interface {
 	// Gossip sends a message to all validators (exclude self)
 	Gossip(valSet ValidatorSet, payload []byte, msgCode uint64, ignoreCache bool) error
 
+	// Send sends a message to the given validator only
+	Send(payload []byte, target common.Address) error
+
 	// Commit delivers an approved proposal to backend.
 	// The delivered proposal will be put into blockchain.
 	Commit(proposal Proposal, bitmap *big.Int, seals []byte) error
@@ -64,7 +67,9 @@ type Backend interface {
 
 	// Sign signs input data with the backend's private key
 	Sign([]byte) ([]byte, error)
-	SignBlockHeader([]byte) ([]byte, error)
+	// SignBlockHeader signs the data with the BLS key, mapping it to the curve with the composite
+	// hasher if useComposite is set
+	SignBlockHeader(data []byte, useComposite bool) ([]byte, error)
 
 	// CheckSignature verifies the signature by checking if it's signed by
 	// the given validator
@@ -102,4 +107,12 @@ type Backend interface {
 
 	// GetDataDir returns a read-write enabled data dir in which data will persist across restarts.
 	GetDataDir() string
+
+	// BlockPeriod returns the block period in seconds set on chain for the epoch of the block with
+	// the given number, or an error if it isn't set. The value is read once per epoch.
+	BlockPeriod(number uint64) (uint64, error)
+
+	// RegisteredBLSPublicKeys returns the BLS public keys the validators currently have registered
+	// in the validators contract, in the order of the given addresses
+	RegisteredBLSPublicKeys(addrs []common.Address) ([][]byte, error)
 }
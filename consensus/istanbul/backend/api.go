@@ -17,9 +17,14 @@
 package backend
 
 import (
+	"math/big"
+	"time"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	istanbulCore "github.com/ethereum/go-ethereum/consensus/istanbul/core"
+	"github.com/ethereum/go-ethereum/consensus/istanbul/validator"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rpc"
 )
@@ -77,6 +82,164 @@ func (api *API) GetValidators(number *rpc.BlockNumber) ([]common.Address, error)
 	return validatorsAddresses, nil
 }
 
+// ForceRoundChange makes the validator send a round change for the given round and wait for it,
+// going through the same path as a round change timeout.
+func (api *API) ForceRoundChange(round uint64) error {
+	if !api.istanbul.coreStarted {
+		return istanbul.ErrStoppedEngine
+	}
+	return api.istanbul.core.ForceRoundChange(new(big.Int).SetUint64(round))
+}
+
+// GetPendingRequests returns the number of requests queued for future sequences and the
+// highest-priority one.
+func (api *API) GetPendingRequests() (*istanbulCore.PendingRequestsInfo, error) {
+	if !api.istanbul.coreStarted {
+		return nil, istanbul.ErrStoppedEngine
+	}
+	info := api.istanbul.core.PendingRequests()
+	return &info, nil
+}
+
+// ValidatorOrdering is the ordered validator set of a view and its proposer
+type ValidatorOrdering struct {
+	Validators []common.Address `json:"validators"`
+	Proposer   common.Address   `json:"proposer"`
+}
+
+// GetValidatorSetForView returns the ordered validators of the current sequence and the proposer of
+// the given round of it.
+func (api *API) GetValidatorSetForView(sequence uint64, round uint64) (*ValidatorOrdering, error) {
+	if !api.istanbul.coreStarted {
+		return nil, istanbul.ErrStoppedEngine
+	}
+	view := &istanbul.View{
+		Sequence: new(big.Int).SetUint64(sequence),
+		Round:    new(big.Int).SetUint64(round),
+	}
+	validators, proposer, err := api.istanbul.core.ValidatorSetForView(view)
+	if err != nil {
+		return nil, err
+	}
+	return &ValidatorOrdering{Validators: validators, Proposer: proposer}, nil
+}
+
+// GetProposerSchedule returns the proposers designated for round 0 of the sequences from fromSeq to
+// toSeq included.
+func (api *API) GetProposerSchedule(fromSeq uint64, toSeq uint64) ([]common.Address, error) {
+	return api.istanbul.ProposerSchedule(fromSeq, toSeq)
+}
+
+// SimulateProposer returns the proposer of the given round of the next sequence if lastProposer
+// had proposed the head block, leaving the live validator set untouched.
+func (api *API) SimulateProposer(lastProposer common.Address, round uint64) common.Address {
+	valSet := api.istanbul.Validators(api.istanbul.currentBlock())
+	return validator.SimulateProposer(valSet, lastProposer, round)
+}
+
+// Health returns the consensus state, view and liveness of this node in a single call, for
+// monitors and load balancers.
+func (api *API) Health() (*istanbulCore.HealthInfo, error) {
+	if !api.istanbul.coreStarted {
+		return nil, istanbul.ErrStoppedEngine
+	}
+	health := api.istanbul.core.Health()
+	return &health, nil
+}
+
+// IsCatchingUp returns whether this node's consensus engine is catching up with blocks committed
+// without it, during which it isn't expected to contribute to each block.
+func (api *API) IsCatchingUp() (bool, error) {
+	if !api.istanbul.coreStarted {
+		return false, istanbul.ErrStoppedEngine
+	}
+	return api.istanbul.core.IsCatchingUp(), nil
+}
+
+// FinalizedHead is the last finalized block and, if known, the view it was committed in
+type FinalizedHead struct {
+	Number   *big.Int    `json:"number"`
+	Hash     common.Hash `json:"hash"`
+	Sequence *big.Int    `json:"sequence,omitempty"`
+	Round    *big.Int    `json:"round,omitempty"`
+}
+
+// GetLatestFinalized returns the last block finalized by this node and the view it was committed in,
+// or nil if none was finalized since startup. The view is omitted for blocks imported by sync.
+func (api *API) GetLatestFinalized() (*FinalizedHead, error) {
+	if !api.istanbul.coreStarted {
+		return nil, istanbul.ErrStoppedEngine
+	}
+	proposal, view := api.istanbul.LatestFinalized()
+	if proposal == nil {
+		return nil, nil
+	}
+	head := &FinalizedHead{
+		Number: proposal.Number(),
+		Hash:   proposal.Hash(),
+	}
+	if view != nil {
+		head.Sequence = view.Sequence
+		head.Round = view.Round
+	}
+	return head, nil
+}
+
+// GetLastRoundChangeReason returns why and for which view this node last sent a round change, or
+// nil if it hasn't since startup.
+func (api *API) GetLastRoundChangeReason() (*istanbulCore.RoundChangeInfo, error) {
+	if !api.istanbul.coreStarted {
+		return nil, istanbul.ErrStoppedEngine
+	}
+	return api.istanbul.core.LastRoundChange(), nil
+}
+
+// DidParticipate returns whether the given validator contributed a committed seal to the last block
+// committed by this node's consensus engine.
+func (api *API) DidParticipate(addr common.Address) (bool, error) {
+	if !api.istanbul.coreStarted {
+		return false, istanbul.ErrStoppedEngine
+	}
+	return api.istanbul.core.DidParticipate(addr)
+}
+
+// GetMissingFromLastCommit returns the validators that didn't contribute a committed seal to the last
+// block committed by this node's consensus engine.
+func (api *API) GetMissingFromLastCommit() ([]common.Address, error) {
+	if !api.istanbul.coreStarted {
+		return nil, istanbul.ErrStoppedEngine
+	}
+	return api.istanbul.core.MissingFromLastCommit()
+}
+
+// DumpMessageTrace returns the last consensus messages handled by this node's consensus engine,
+// oldest first, if the message trace is enabled.
+func (api *API) DumpMessageTrace() ([]istanbulCore.MessageTraceRecord, error) {
+	if !api.istanbul.coreStarted {
+		return nil, istanbul.ErrStoppedEngine
+	}
+	return api.istanbul.core.MessageTrace(), nil
+}
+
+// GetCurrentRoundTimeout returns how many milliseconds the node waits in the current round before
+// sending a round change.
+func (api *API) GetCurrentRoundTimeout() (uint64, error) {
+	if !api.istanbul.coreStarted {
+		return 0, istanbul.ErrStoppedEngine
+	}
+	return uint64(api.istanbul.core.CurrentRoundTimeout() / time.Millisecond), nil
+}
+
+// GetRoundChangeRate returns the average number of round changes per block among the blocks
+// finished by the node's consensus engine in the last window seconds. A sustained high rate
+// indicates an unstable network.
+func (api *API) GetRoundChangeRate(window uint64) (float64, error) {
+	if !api.istanbul.coreStarted {
+		return 0, istanbul.ErrStoppedEngine
+	}
+	return api.istanbul.core.RoundChangeRate(time.Duration(window) * time.Second), nil
+}
+
 // GetValidatorsAtHash retrieves the state snapshot at a given block.
 func (api *API) GetValidatorsAtHash(hash common.Hash) ([]common.Address, error) {
 	header := api.chain.GetHeaderByHash(hash)
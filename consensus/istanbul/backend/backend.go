@@ -21,6 +21,7 @@ import (
 	"errors"
 	"math/big"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts"
@@ -29,6 +30,7 @@ import (
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
 	istanbulCore "github.com/ethereum/go-ethereum/consensus/istanbul/core"
 	"github.com/ethereum/go-ethereum/consensus/istanbul/validator"
+	"github.com/ethereum/go-ethereum/contract_comm/blockchain_parameters"
 	"github.com/ethereum/go-ethereum/contract_comm/election"
 	"github.com/ethereum/go-ethereum/contract_comm/validators"
 	"github.com/ethereum/go-ethereum/core"
@@ -47,6 +49,11 @@ const (
 	fetcherID = "istanbul"
 )
 
+// stateReader is implemented by the chains able to open the state as of one of their blocks.
+type stateReader interface {
+	StateAt(root common.Hash) (*state.StateDB, error)
+}
+
 var (
 	// errInvalidSigningFn is returned when the consensus signing function is invalid.
 	errInvalidSigningFn = errors.New("invalid signing function for istanbul messages")
@@ -74,6 +81,7 @@ func New(config *istanbul.Config, db ethdb.Database, dataDir string) consensus.I
 		coreStarted:          false,
 		recentMessages:       recentMessages,
 		knownMessages:        knownMessages,
+		messageRateLimiter:   newMessageRateLimiter(),
 		announceWg:           new(sync.WaitGroup),
 		announceQuit:         make(chan struct{}),
 		lastAnnounceGossiped: make(map[common.Address]*AnnounceGossipTimestamp),
@@ -123,6 +131,17 @@ type Backend struct {
 	recentMessages *lru.ARCCache // the cache of peer's messages
 	knownMessages  *lru.ARCCache // the cache of self messages
 
+	messageRateLimiter  *messageRateLimiter // limits the rate of consensus messages from each peer
+	rateLimitValidators *epochValidators    // validators of the current epoch, getting the validator rate limit
+
+	// the block period set on chain and the epoch it was read for, 0 if not read yet
+	blockPeriod      uint64
+	blockPeriodEpoch uint64
+	blockPeriodMu    sync.Mutex
+
+	// the uptime lookback window set on chain as of the last epoch boundary seen, 0 if not read yet
+	lookbackWindow uint64
+
 	lastAnnounceGossiped   map[common.Address]*AnnounceGossipTimestamp
 	lastAnnounceGossipedMu sync.RWMutex
 
@@ -156,7 +175,41 @@ func (sb *Backend) Close() error {
 
 // Validators implements istanbul.Backend.Validators
 func (sb *Backend) Validators(proposal istanbul.Proposal) istanbul.ValidatorSet {
-	return sb.getValidators(proposal.Number().Uint64(), proposal.Hash())
+	valSet := sb.getValidators(proposal.Number().Uint64(), proposal.Hash())
+	if sb.config.ProposerPolicy == istanbul.RoundRobinWithSkip {
+		valSet = valSet.Copy()
+		valSet.SetActiveValidators(sb.recentCommitters(valSet, proposal.Number().Uint64(), proposal.Hash()))
+	}
+	return valSet
+}
+
+// recentCommitters returns the validators whose commits were aggregated into the seals of the
+// last proposerSkipWindow blocks up to the given one, or nil if none of those blocks were
+// committed by the given validator set. Blocks before the last epoch change are not considered,
+// as they were committed by a different validator set.
+func (sb *Backend) recentCommitters(valSet istanbul.ValidatorSet, number uint64, hash common.Hash) map[common.Address]bool {
+	var active map[common.Address]bool
+	header := sb.chain.GetHeader(hash, number)
+	window := sb.proposerSkipWindow()
+	for i := uint64(0); i < window && header != nil; i++ {
+		if header.Number.Sign() == 0 || istanbul.IsLastBlockOfEpoch(header.Number.Uint64(), sb.config.Epoch) {
+			break
+		}
+		if extra, err := types.ExtractIstanbulExtra(header); err == nil && extra.Bitmap != nil {
+			if active == nil {
+				active = make(map[common.Address]bool)
+			}
+			for j := 0; j < extra.Bitmap.BitLen(); j++ {
+				if extra.Bitmap.Bit(j) == 1 {
+					if val := valSet.GetByIndex(uint64(j)); val != nil {
+						active[val.Address()] = true
+					}
+				}
+			}
+		}
+		header = sb.chain.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+	}
+	return active
 }
 
 func (sb *Backend) GetValidators(blockNumber *big.Int, headerHash common.Hash) []istanbul.Validator {
@@ -222,6 +275,17 @@ func (sb *Backend) Gossip(valSet istanbul.ValidatorSet, payload []byte, msgCode
 	return nil
 }
 
+// Send implements istanbul.Backend.Send
+func (sb *Backend) Send(payload []byte, target common.Address) error {
+	if sb.broadcaster == nil {
+		return nil
+	}
+	for _, p := range sb.broadcaster.FindPeers(map[common.Address]bool{target: true}) {
+		go p.Send(istanbulMsg, payload)
+	}
+	return nil
+}
+
 func (sb *Backend) Enode() *enode.Node {
 	if sb.broadcaster != nil {
 		return sb.broadcaster.GetLocalNode()
@@ -242,6 +306,74 @@ func (sb *Backend) GetDataDir() string {
 	return sb.dataDir
 }
 
+// BlockPeriod implements istanbul.Backend.BlockPeriod. The block period of an epoch is the one set
+// as of the last block of the previous epoch, so that it doesn't depend on the node's chain head.
+func (sb *Backend) BlockPeriod(number uint64) (uint64, error) {
+	epoch := istanbul.GetEpochNumber(number, sb.config.Epoch)
+	sb.blockPeriodMu.Lock()
+	defer sb.blockPeriodMu.Unlock()
+	if sb.blockPeriod != 0 && sb.blockPeriodEpoch == epoch {
+		return sb.blockPeriod, nil
+	}
+	header, state, err := sb.epochBoundaryState(epoch)
+	if err != nil {
+		return 0, err
+	}
+	blockPeriod, err := blockchain_parameters.GetBlockPeriod(header, state)
+	if err != nil {
+		return 0, err
+	}
+	sb.blockPeriod = blockPeriod
+	sb.blockPeriodEpoch = epoch
+	return blockPeriod, nil
+}
+
+// epochBoundaryState returns the header and state of the last block before the given epoch, the
+// genesis block for the first one.
+func (sb *Backend) epochBoundaryState(epoch uint64) (*types.Header, *state.StateDB, error) {
+	var number uint64
+	if epoch > 1 {
+		first, _ := istanbul.GetEpochFirstBlockNumber(epoch, sb.config.Epoch)
+		number = first - 1
+	}
+	header := sb.chain.GetHeaderByNumber(number)
+	if header == nil {
+		return nil, nil, errUnknownBlock
+	}
+	chain, ok := sb.chain.(stateReader)
+	if !ok {
+		return nil, nil, errNoChainState
+	}
+	state, err := chain.StateAt(header.Root)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, state, nil
+}
+
+// effectiveBlockPeriod returns the block period in effect for the block with the given number,
+// falling back to the configured BlockPeriod if the chain doesn't provide one.
+func (sb *Backend) effectiveBlockPeriod(number uint64) uint64 {
+	blockPeriod, err := sb.BlockPeriod(number)
+	if err != nil {
+		return sb.config.BlockPeriod
+	}
+	return blockPeriod
+}
+
+// RegisteredBLSPublicKeys implements istanbul.Backend.RegisteredBLSPublicKeys
+func (sb *Backend) RegisteredBLSPublicKeys(addrs []common.Address) ([][]byte, error) {
+	validatorData, err := validators.GetValidatorData(nil, nil, addrs)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, len(validatorData))
+	for i, data := range validatorData {
+		keys[i] = data.BLSPublicKey
+	}
+	return keys, nil
+}
+
 // Commit implements istanbul.Backend.Commit
 func (sb *Backend) Commit(proposal istanbul.Proposal, bitmap *big.Int, seals []byte) error {
 	// Check if the proposal is a valid block
@@ -260,6 +392,9 @@ func (sb *Backend) Commit(proposal istanbul.Proposal, bitmap *big.Int, seals []b
 	}
 	// update block's header
 	block = block.WithSeal(h)
+	if sb.config.MinQuorumEndpoints > 0 {
+		sb.checkQuorumEndpoints(block.Number().Uint64(), sb.committers(block, bitmap), sb.validatorEndpoint)
+	}
 
 	sb.logger.Info("Committed", "address", sb.Address(), "hash", proposal.Hash(), "number", proposal.Number().Uint64())
 	// - if the proposed and committed blocks are the same, send the proposed hash
@@ -280,11 +415,79 @@ func (sb *Backend) Commit(proposal istanbul.Proposal, bitmap *big.Int, seals []b
 	return nil
 }
 
+// committers returns the validators of the block's parent whose commits were aggregated into
+// the seal with the given bitmap.
+func (sb *Backend) committers(block *types.Block, bitmap *big.Int) []common.Address {
+	valSet := sb.getValidators(block.Number().Uint64()-1, block.ParentHash())
+	var committers []common.Address
+	for i := 0; i < bitmap.BitLen(); i++ {
+		if bitmap.Bit(i) == 1 {
+			if val := valSet.GetByIndex(uint64(i)); val != nil {
+				committers = append(committers, val.Address())
+			}
+		}
+	}
+	return committers
+}
+
+// validatorEndpoint returns the IP address of the validator's node, or "" if it is unknown.
+func (sb *Backend) validatorEndpoint(address common.Address) string {
+	if address == sb.Address() {
+		if node := sb.Enode(); node != nil && node.IP() != nil {
+			return node.IP().String()
+		}
+		return ""
+	}
+	return sb.valEnodeTable.getEndpoint(address)
+}
+
+// checkQuorumEndpoints reports the number of distinct network endpoints among the committers of a
+// block and warns when they are fewer than MinQuorumEndpoints, hinting that a single operator may
+// run several of the validators. Committers with an unknown endpoint are counted as distinct ones.
+// This is observability only, the block is committed regardless. Returns whether the quorum was
+// reported as concentrated.
+func (sb *Backend) checkQuorumEndpoints(number uint64, committers []common.Address, endpointOf func(common.Address) string) bool {
+	if sb.config.MinQuorumEndpoints == 0 {
+		return false
+	}
+	endpoints := make(map[string]bool)
+	unknown := 0
+	for _, addr := range committers {
+		if endpoint := endpointOf(addr); endpoint != "" {
+			endpoints[endpoint] = true
+		} else {
+			unknown++
+		}
+	}
+	distinct := len(endpoints) + unknown
+	quorumEndpointsGauge.Update(int64(distinct))
+
+	if uint64(distinct) >= sb.config.MinQuorumEndpoints {
+		return false
+	}
+	concentratedQuorumMeter.Mark(1)
+	sb.logger.Warn("Committed quorum concentrated on few network endpoints", "number", number, "committers", len(committers), "endpoints", distinct, "min", sb.config.MinQuorumEndpoints)
+	return true
+}
+
+// LatestFinalized returns the last block finalized by Istanbul, which finalizes on commit, along
+// with the view it was committed in. High rounds hint at an unstable network. The view is nil if the
+// block was imported without this node's consensus.
+func (sb *Backend) LatestFinalized() (istanbul.Proposal, *istanbul.View) {
+	return sb.core.LatestFinalized()
+}
+
 // EventMux implements istanbul.Backend.EventMux
 func (sb *Backend) EventMux() *event.TypeMux {
 	return sb.istanbulEventMux
 }
 
+// SubscribeCommitted registers a subscription for the proposals committed by consensus, along
+// with their aggregated seal and the bitmap of the validators that signed it.
+func (sb *Backend) SubscribeCommitted(ch chan<- istanbul.CommittedEvent) event.Subscription {
+	return sb.core.SubscribeCommitted(ch)
+}
+
 // Verify implements istanbul.Backend.Verify
 func (sb *Backend) Verify(proposal istanbul.Proposal) (time.Duration, error) {
 	// Check if the proposal is a valid block
@@ -357,6 +560,8 @@ func (sb *Backend) Verify(proposal istanbul.Proposal) (time.Duration, error) {
 
 	// verify the validator set diff if this is the last block of the epoch
 	if istanbul.IsLastBlockOfEpoch(block.Header().Number.Uint64(), sb.config.Epoch) {
+		sb.checkEpochSize(block.Header(), state)
+		sb.updateLookbackWindow(block.Header(), state)
 		if err := sb.verifyValSetDiff(proposal, block, state); err != nil {
 			log.Error("verify - Error in verifying the val set diff", "err", err)
 			return 0, err
@@ -366,6 +571,39 @@ func (sb *Backend) Verify(proposal istanbul.Proposal) (time.Duration, error) {
 	return 0, err
 }
 
+// checkEpochSize warns if the epoch size set on chain differs from the configured one, as the
+// node would then disagree with the network on the epoch boundaries.
+func (sb *Backend) checkEpochSize(header *types.Header, state *state.StateDB) {
+	epochSize, err := blockchain_parameters.GetEpochSize(header, state)
+	if err != nil {
+		log.Trace("Unable to read the epoch size from the chain", "err", err)
+		return
+	}
+	if epochSize != sb.config.Epoch {
+		log.Error("Configured epoch size differs from the epoch size on chain", "configured", sb.config.Epoch, "chain", epochSize, "number", header.Number)
+	}
+}
+
+// updateLookbackWindow reads the uptime lookback window set on chain at an epoch boundary.
+func (sb *Backend) updateLookbackWindow(header *types.Header, state *state.StateDB) {
+	lookbackWindow, err := blockchain_parameters.GetLookbackWindow(header, state)
+	if err != nil {
+		log.Trace("Unable to read the lookback window from the chain", "err", err)
+		return
+	}
+	atomic.StoreUint64(&sb.lookbackWindow, lookbackWindow)
+}
+
+// proposerSkipWindow returns the number of recent blocks a validator must have signed a commit in
+// to be picked as proposer by the RoundRobinWithSkip policy. That's the uptime lookback window set
+// on chain, or the configured ProposerSkipWindow until it has been read at an epoch boundary.
+func (sb *Backend) proposerSkipWindow() uint64 {
+	if lookbackWindow := atomic.LoadUint64(&sb.lookbackWindow); lookbackWindow != 0 {
+		return lookbackWindow
+	}
+	return sb.config.ProposerSkipWindow
+}
+
 func (sb *Backend) getNewValidatorSet(header *types.Header, state *state.StateDB) ([]istanbul.ValidatorData, error) {
 	newValSetAddresses, err := election.GetElectedValidators(header, state)
 	if err != nil {
@@ -431,12 +669,20 @@ func (sb *Backend) Sign(data []byte) ([]byte, error) {
 	return sb.signFn(accounts.Account{Address: sb.address}, hashData)
 }
 
-func (sb *Backend) SignBlockHeader(data []byte) ([]byte, error) {
+// SignBlockHeader implements istanbul.Backend.SignBlockHeader
+func (sb *Backend) SignBlockHeader(data []byte, useComposite bool) ([]byte, error) {
+	sb.signFnMu.RLock()
+	defer sb.signFnMu.RUnlock()
+	if useComposite {
+		// the message signer maps to the curve with the composite hasher
+		if sb.signMessageBLSFn == nil {
+			return nil, errInvalidSigningFn
+		}
+		return sb.signMessageBLSFn(accounts.Account{Address: sb.address}, data, []byte{})
+	}
 	if sb.signHashBLSFn == nil {
 		return nil, errInvalidSigningFn
 	}
-	sb.signFnMu.RLock()
-	defer sb.signFnMu.RUnlock()
 	return sb.signHashBLSFn(accounts.Account{Address: sb.address}, data)
 }
 
@@ -468,6 +714,87 @@ func (sb *Backend) GetProposer(number uint64) common.Address {
 	return common.Address{}
 }
 
+// ProposerSchedule returns the proposers designated for round 0 of the sequences from fromSeq to
+// toSeq included, which may span up to two epochs. Sequences beyond the chain head assume that
+// each block is proposed by its designated proposer, and can't go past the end of the epoch of the
+// next block as the validator sets of later epochs aren't known yet.
+func (sb *Backend) ProposerSchedule(fromSeq, toSeq uint64) ([]common.Address, error) {
+	head := sb.currentBlock().Header()
+	valSetAt := func(number uint64) (istanbul.ValidatorSet, error) {
+		header := sb.chain.GetHeaderByNumber(number)
+		if header == nil {
+			return nil, errUnknownBlock
+		}
+		return sb.Validators(types.NewBlockWithHeader(header)), nil
+	}
+	authorAt := func(number uint64) (common.Address, error) {
+		if number == 0 {
+			return common.Address{}, nil
+		}
+		header := sb.chain.GetHeaderByNumber(number)
+		if header == nil {
+			return common.Address{}, errUnknownBlock
+		}
+		return sb.Author(header)
+	}
+	return proposerSchedule(fromSeq, toSeq, head.Number.Uint64(), sb.config.Epoch, valSetAt, authorAt)
+}
+
+// proposerSchedule computes the proposers designated for round 0 of the sequences from fromSeq to
+// toSeq, given the validator set after each block and the author of each block up to head.
+func proposerSchedule(fromSeq, toSeq, head, epoch uint64, valSetAt func(number uint64) (istanbul.ValidatorSet, error), authorAt func(number uint64) (common.Address, error)) ([]common.Address, error) {
+	if fromSeq == 0 || toSeq < fromSeq || toSeq-fromSeq >= 2*epoch {
+		return nil, errInvalidScheduleRange
+	}
+	// The validator set changes after the last block of each epoch
+	nextEpochEnd := head + epoch - istanbul.GetNumberWithinEpoch(head, epoch)
+	if nextEpochEnd == head {
+		nextEpochEnd += epoch
+	}
+	if toSeq > nextEpochEnd {
+		return nil, errUnknownValidatorSet
+	}
+
+	// Beyond the head, the proposer of each sequence follows from the designated proposer of the
+	// previous one, so start from the sequence after the head at the latest
+	start := fromSeq
+	if start > head+1 {
+		start = head + 1
+	}
+	schedule := make([]common.Address, 0, toSeq-fromSeq+1)
+	var lastProposer common.Address
+	var headValSet istanbul.ValidatorSet
+	for seq := start; seq <= toSeq; seq++ {
+		var valSet istanbul.ValidatorSet
+		if seq-1 <= head {
+			author, err := authorAt(seq - 1)
+			if err != nil {
+				return nil, err
+			}
+			lastProposer = author
+			if valSet, err = valSetAt(seq - 1); err != nil {
+				return nil, err
+			}
+			if seq-1 == head {
+				headValSet = valSet
+			}
+		} else {
+			valSet = headValSet
+		}
+		valSet = valSet.Copy()
+		valSet.CalcProposer(lastProposer, 0)
+		proposer := valSet.GetProposer()
+		if proposer == nil {
+			return nil, errUnknownValidatorSet
+		}
+		lastProposer = proposer.Address()
+		if seq >= fromSeq {
+			schedule = append(schedule, lastProposer)
+		}
+	}
+	return schedule, nil
+}
+
 // ParentValidators implements istanbul.Backend.GetParentValidators
 func (sb *Backend) ParentValidators(proposal istanbul.Proposal) istanbul.ValidatorSet {
 	if block, ok := proposal.(*types.Block); ok {
@@ -21,6 +21,7 @@ import (
 	"crypto/ecdsa"
 	"fmt"
 	"math/big"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -214,21 +215,7 @@ func generateInvalidPrivateKey() (*ecdsa.PrivateKey, error) {
 }
 
 func newTestValidatorSet(n int) (istanbul.ValidatorSet, []*ecdsa.PrivateKey) {
-	// generate validators
-	keys := make(Keys, n)
-	validators := make([]istanbul.ValidatorData, n)
-	for i := 0; i < n; i++ {
-		privateKey, _ := crypto.GenerateKey()
-		blsPrivateKey, _ := blscrypto.ECDSAToBLS(privateKey)
-		blsPublicKey, _ := blscrypto.PrivateToPublic(blsPrivateKey)
-		keys[i] = privateKey
-		validators[i] = istanbul.ValidatorData{
-			crypto.PubkeyToAddress(privateKey.PublicKey),
-			blsPublicKey,
-		}
-	}
-	vset := validator.NewSet(validators, istanbul.RoundRobin)
-	return vset, keys
+	return validator.NewTestValidatorSet(n)
 }
 
 type Keys []*ecdsa.PrivateKey
@@ -314,3 +301,124 @@ func signerFnInvalid(_ accounts.Account, data []byte) ([]byte, error) {
 	key, _ := generateInvalidPrivateKey()
 	return crypto.Sign(data, key)
 }
+
+func TestProposerSchedule(t *testing.T) {
+	const epoch = 4
+	const head = 5
+	newValSet := func(n int) istanbul.ValidatorSet {
+		validators := make([]istanbul.ValidatorData, n)
+		for i := range validators {
+			key, _ := crypto.GenerateKey()
+			validators[i] = istanbul.ValidatorData{Address: crypto.PubkeyToAddress(key.PublicKey)}
+		}
+		return validator.NewSet(validators, istanbul.RoundRobin)
+	}
+	// The validator set changes with the last block of the first epoch
+	epochValSets := []istanbul.ValidatorSet{newValSet(4), newValSet(3)}
+	valSetAt := func(number uint64) (istanbul.ValidatorSet, error) {
+		if number > head {
+			return nil, errUnknownBlock
+		}
+		if number < epoch {
+			return epochValSets[0], nil
+		}
+		return epochValSets[1], nil
+	}
+	// Blocks were not all proposed by their designated proposers
+	authors := []common.Address{
+		{},
+		epochValSets[0].GetByIndex(2).Address(),
+		epochValSets[0].GetByIndex(0).Address(),
+		epochValSets[0].GetByIndex(0).Address(),
+		epochValSets[0].GetByIndex(3).Address(),
+		epochValSets[1].GetByIndex(1).Address(),
+	}
+	authorAt := func(number uint64) (common.Address, error) {
+		if number > head {
+			return common.Address{}, errUnknownBlock
+		}
+		return authors[number], nil
+	}
+
+	// Compute the proposer of each block from the block before, or from the designated proposer
+	// of the block before beyond the head
+	want := make([]common.Address, 2*epoch+1)
+	for seq := uint64(1); seq <= 2*epoch; seq++ {
+		valSet, lastProposer := epochValSets[1], want[seq-1]
+		if seq-1 <= head {
+			valSet, _ = valSetAt(seq - 1)
+			lastProposer, _ = authorAt(seq - 1)
+		}
+		valSet = valSet.Copy()
+		valSet.CalcProposer(lastProposer, 0)
+		want[seq] = valSet.GetProposer().Address()
+	}
+
+	testCases := []struct {
+		from, to uint64
+		err      error
+	}{
+		{1, 2 * epoch, nil},
+		{3, 6, nil},
+		// Beyond the head only
+		{7, 2 * epoch, nil},
+		{0, 2, errInvalidScheduleRange},
+		{3, 2, errInvalidScheduleRange},
+		{1, 2*epoch + 1, errInvalidScheduleRange},
+		// The validator set of the third epoch isn't known yet
+		{2, 2*epoch + 1, errUnknownValidatorSet},
+	}
+	for _, test := range testCases {
+		schedule, err := proposerSchedule(test.from, test.to, head, epoch, valSetAt, authorAt)
+		if err != test.err {
+			t.Errorf("[%d, %d]: error mismatch: have %v, want %v", test.from, test.to, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(schedule, want[test.from:test.to+1]) {
+			t.Errorf("[%d, %d]: schedule mismatch: have %v, want %v", test.from, test.to, schedule, want[test.from:test.to+1])
+		}
+	}
+}
+
+func TestCheckQuorumEndpoints(t *testing.T) {
+	b := newBackend()
+	config := *b.config
+	config.MinQuorumEndpoints = 3
+	b.config = &config
+
+	committers := []common.Address{
+		common.HexToAddress("0x01"),
+		common.HexToAddress("0x02"),
+		common.HexToAddress("0x03"),
+	}
+	testCases := []struct {
+		name      string
+		endpoints map[common.Address]string
+		want      bool
+	}{
+		{"distinct endpoints", map[common.Address]string{committers[0]: "10.0.0.1", committers[1]: "10.0.0.2", committers[2]: "10.0.0.3"}, false},
+		{"shared endpoint", map[common.Address]string{committers[0]: "10.0.0.1", committers[1]: "10.0.0.1", committers[2]: "10.0.0.2"}, true},
+		{"single endpoint", map[common.Address]string{committers[0]: "10.0.0.1", committers[1]: "10.0.0.1", committers[2]: "10.0.0.1"}, true},
+		{"unknown endpoints", map[common.Address]string{committers[0]: "10.0.0.1", committers[1]: "10.0.0.1"}, true},
+		{"unknown endpoints counted as distinct", map[common.Address]string{committers[0]: "10.0.0.1"}, false},
+	}
+	for _, test := range testCases {
+		endpointOf := func(addr common.Address) string { return test.endpoints[addr] }
+		if got := b.checkQuorumEndpoints(1, committers, endpointOf); got != test.want {
+			t.Errorf("%s: concentrated mismatch: have %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// The check is disabled by default, without looking up any endpoint
+	b.config.MinQuorumEndpoints = 0
+	endpointOf := func(common.Address) string {
+		t.Errorf("endpoint looked up with the check disabled")
+		return "10.0.0.1"
+	}
+	if b.checkQuorumEndpoints(1, committers, endpointOf) {
+		t.Errorf("concentrated quorum reported with the check disabled")
+	}
+}
@@ -127,6 +127,15 @@ var (
 	// errUnauthorizedAnnounceMessage is returned when the received announce message is from
 	// an unregistered validator
 	errUnauthorizedAnnounceMessage = errors.New("unauthorized announce message")
+	// errInvalidScheduleRange is returned when a proposer schedule is requested for an empty range,
+	// one starting at the genesis block or one longer than two epochs
+	errInvalidScheduleRange = errors.New("invalid proposer schedule range")
+	// errUnknownValidatorSet is returned when a proposer schedule is requested beyond the epoch of the
+	// next block, whose validator set isn't known yet
+	errUnknownValidatorSet = errors.New("validator set not known yet")
+	// errNoChainState is returned when a parameter has to be read from the state as of a block of
+	// a chain that doesn't give access to its states
+	errNoChainState = errors.New("chain state not available")
 )
 
 var (
@@ -225,7 +234,7 @@ func (sb *Backend) verifyCascadingFields(chain consensus.ChainReader, header *ty
 		if parent == nil || parent.Number.Uint64() != number-1 || parent.Hash() != header.ParentHash {
 			return consensus.ErrUnknownAncestor
 		}
-		if parent.Time.Uint64()+sb.config.BlockPeriod > header.Time.Uint64() {
+		if parent.Time.Uint64()+sb.effectiveBlockPeriod(number) > header.Time.Uint64() {
 			return errInvalidTimestamp
 		}
 		// Verify validators in extraData. Validators in snapshot and extraData should be the same.
@@ -317,34 +326,50 @@ func (sb *Backend) verifyCommittedSeals(chain consensus.ChainReader, header *typ
 		return errEmptyCommittedSeals
 	}
 
-	validators := snap.ValSet.Copy()
 	// Check whether the committed seals are generated by parent's validators
+	if err := sb.VerifyAggregatedSeal(header, snap.ValSet); err != nil {
+		return err
+	}
+	if myValidatorIndex, _ := snap.ValSet.GetByAddress(sb.Address()); myValidatorIndex >= 0 && extra.Bitmap.Bit(myValidatorIndex) == 1 {
+		sb.logger.Debug("Our backend participated in consensus", "number", number)
+	}
+	return nil
+}
+
+// VerifyAggregatedSeal verifies the aggregated committed seal in the header's istanbul extra data
+// against the BLS public keys of the members of the given validator set flagged in its bitmap. The
+// validator set must be the one that committed the block, that of its parent. This lets finalized
+// blocks be audited with the same primitives commit() seals them with.
+func (sb *Backend) VerifyAggregatedSeal(header *types.Header, valSet istanbul.ValidatorSet) error {
+	extra, err := types.ExtractIstanbulExtra(header)
+	if err != nil {
+		return err
+	}
+	if len(extra.CommittedSeal) == 0 {
+		return errEmptyCommittedSeals
+	}
 
-	proposalSeal := istanbulCore.PrepareCommittedSeal(header.Hash())
-	// 1. Get committed seals from current header
-	myValidatorIndex, myValidator := validators.GetByAddress(sb.Address())
 	publicKeys := [][]byte{}
-	for i := 0; i < snap.ValSet.PaddedSize(); i++ {
+	for i := 0; i < valSet.PaddedSize(); i++ {
 		if extra.Bitmap.Bit(i) == 1 {
-			pubKey := validators.GetByIndex(uint64(i)).BLSPublicKey()
-			if myValidatorIndex >= 0 && bytes.Equal(pubKey, myValidator.BLSPublicKey()) {
-				sb.logger.Debug("Our backend participated in consensus", "number", number)
+			val := valSet.GetByIndex(uint64(i))
+			if val == nil {
+				return errInvalidCommittedSeals
 			}
-			publicKeys = append(publicKeys, pubKey)
+			publicKeys = append(publicKeys, val.BLSPublicKey())
 		}
 	}
 
 	// The length of validSeal should be larger than number of faulty node + 1
-	if len(publicKeys) < snap.ValSet.MinQuorumSize() {
-		sb.logger.Error("not enough signatures to form a quorum", "public keys", len(publicKeys), "minimum quorum size", snap.ValSet.MinQuorumSize())
+	if len(publicKeys) < valSet.MinQuorumSize() {
+		sb.logger.Error("not enough signatures to form a quorum", "public keys", len(publicKeys), "minimum quorum size", valSet.MinQuorumSize())
 		return errInvalidCommittedSeals
 	}
-	err = blscrypto.VerifyAggregatedSignature(publicKeys, proposalSeal, []byte{}, extra.CommittedSeal, false)
-	if err != nil {
+	proposalSeal := istanbulCore.PrepareCommittedSeal(header.Hash())
+	if err := blscrypto.VerifyAggregatedSignature(publicKeys, proposalSeal, []byte{}, extra.CommittedSeal, sb.config.CommittedSealHasher.UseComposite()); err != nil {
 		sb.logger.Error("couldn't verify aggregated signature", "err", err)
 		return errInvalidSignature
 	}
-
 	return nil
 }
 
@@ -382,7 +407,7 @@ func (sb *Backend) Prepare(chain consensus.ChainReader, header *types.Header) er
 	header.Difficulty = defaultDifficulty
 
 	// set header's timestamp
-	header.Time = new(big.Int).Add(parent.Time, new(big.Int).SetUint64(sb.config.BlockPeriod))
+	header.Time = new(big.Int).Add(parent.Time, new(big.Int).SetUint64(sb.effectiveBlockPeriod(number)))
 	if header.Time.Int64() < time.Now().Unix() {
 		header.Time = big.NewInt(time.Now().Unix())
 	}
@@ -398,6 +423,8 @@ func (sb *Backend) UpdateValSetDiff(chain consensus.ChainReader, header *types.H
 	// If this is the last block of the epoch, then get the validator set diff, to save into the header
 	log.Trace("Called UpdateValSetDiff", "number", header.Number.Uint64(), "epoch", sb.config.Epoch)
 	if istanbul.IsLastBlockOfEpoch(header.Number.Uint64(), sb.config.Epoch) {
+		sb.checkEpochSize(header, state)
+		sb.updateLookbackWindow(header, state)
 		newValSet, err := sb.getNewValidatorSet(header, state)
 		if err != nil {
 			log.Error("Istanbul.Finalize - Error in retrieving the validator set. Using the previous epoch's validator set", "err", err)
@@ -34,6 +34,7 @@ import (
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	istanbulCore "github.com/ethereum/go-ethereum/consensus/istanbul/core"
 	"github.com/ethereum/go-ethereum/contract_comm"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
@@ -309,6 +310,51 @@ func TestPrepare(t *testing.T) {
 	}
 }
 
+func TestBlockPeriodFromChain(t *testing.T) {
+	chain, engine := newBlockChain(1, true)
+	// Pretend the chain set a longer block period for the first epoch
+	blockPeriod := engine.config.BlockPeriod + 5
+	engine.blockPeriod = blockPeriod
+	engine.blockPeriodEpoch = istanbul.GetEpochNumber(1, engine.config.Epoch)
+
+	header := makeHeader(chain.Genesis(), engine.config)
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatalf("error mismatch: have %v, want nil", err)
+	}
+	if want := chain.Genesis().Time().Uint64() + blockPeriod; header.Time.Uint64() < want {
+		t.Errorf("timestamp mismatch: have %v, want at least %v", header.Time, want)
+	}
+
+	// A block respecting only the configured block period is too early
+	block := makeBlockWithoutSeal(chain, engine, chain.Genesis())
+	header = block.Header()
+	header.Time = new(big.Int).Add(chain.Genesis().Time(), new(big.Int).SetUint64(blockPeriod-1))
+	if err := engine.VerifyHeader(chain, header, false); err != errInvalidTimestamp {
+		t.Errorf("error mismatch: have %v, want %v", err, errInvalidTimestamp)
+	}
+}
+
+func TestEpochBoundaryState(t *testing.T) {
+	chain, engine := newBlockChain(1, true)
+
+	// The block period of the first epoch is read as of the genesis block
+	header, state, err := engine.epochBoundaryState(1)
+	if err != nil {
+		t.Fatalf("error mismatch: have %v, want nil", err)
+	}
+	if header.Hash() != chain.Genesis().Hash() {
+		t.Errorf("header mismatch: have %v, want the genesis block %v", header.Hash(), chain.Genesis().Hash())
+	}
+	if state == nil {
+		t.Errorf("no state for the genesis block")
+	}
+
+	// The last block of the first epoch isn't in the chain yet
+	if _, _, err := engine.epochBoundaryState(2); err != errUnknownBlock {
+		t.Errorf("error mismatch: have %v, want %v", err, errUnknownBlock)
+	}
+}
+
 func TestSealReturns(t *testing.T) {
 	chain, engine := newBlockChain(2, true)
 	block := makeBlockWithoutSeal(chain, engine, chain.Genesis())
@@ -769,3 +815,50 @@ func TestWriteCommittedSeals(t *testing.T) {
 		t.Errorf("error mismatch: have %v, want %v", err, errInvalidCommittedSeals)
 	}
 }
+
+func TestVerifyAggregatedSeal(t *testing.T) {
+	chain, engine := newBlockChain(1, true)
+	valSet, keys := newTestValidatorSet(4)
+
+	block := makeBlockWithoutSeal(chain, engine, chain.Genesis())
+	header := block.Header()
+	seal := istanbulCore.PrepareCommittedSeal(header.Hash())
+
+	// The first three validators of the set commit the block
+	var seals [][]byte
+	bitmap := new(big.Int)
+	for _, key := range keys {
+		index, _ := valSet.GetByAddress(crypto.PubkeyToAddress(key.PublicKey))
+		if index >= 3 {
+			continue
+		}
+		privateKeyBytes, _ := blscrypto.ECDSAToBLS(key)
+		privateKey, _ := bls.DeserializePrivateKey(privateKeyBytes)
+		signature, _ := privateKey.SignMessage(seal, []byte{}, false)
+		signatureBytes, _ := signature.Serialize()
+		signature.Destroy()
+		privateKey.Destroy()
+		seals = append(seals, signatureBytes)
+		bitmap.SetBit(bitmap, index, 1)
+	}
+	aggregatedSeal, err := blscrypto.AggregateSignatures(seals)
+	if err != nil {
+		t.Fatalf("failed to aggregate seals: %v", err)
+	}
+	if err := writeCommittedSeals(header, bitmap, aggregatedSeal); err != nil {
+		t.Fatalf("failed to write committed seals: %v", err)
+	}
+	if err := engine.VerifyAggregatedSeal(header, valSet); err != nil {
+		t.Errorf("error mismatch: have %v, want nil", err)
+	}
+
+	// Flip a bit of the bitmap, swapping a committer for a validator that didn't commit
+	flipped := new(big.Int).SetBit(new(big.Int).Set(bitmap), 0, 0)
+	flipped.SetBit(flipped, 3, 1)
+	if err := writeCommittedSeals(header, flipped, aggregatedSeal); err != nil {
+		t.Fatalf("failed to write committed seals: %v", err)
+	}
+	if err := engine.VerifyAggregatedSeal(header, valSet); err != errInvalidSignature {
+		t.Errorf("error mismatch: have %v, want %v", err, errInvalidSignature)
+	}
+}
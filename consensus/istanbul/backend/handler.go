@@ -18,22 +18,38 @@ package backend
 
 import (
 	"errors"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/contract_comm"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/p2p"
 	lru "github.com/hashicorp/golang-lru"
 )
 
 const (
-	istanbulMsg         = 0x11
+	istanbulMsg         = istanbul.ConsensusMsgCode
 	istanbulAnnounceMsg = 0x12
 )
 
 var (
 	// errDecodeFailed is returned when decode message fails
 	errDecodeFailed = errors.New("fail to decode istanbul message")
+	// errMessageTooLarge is returned when a message is larger than the configured MaxMessageSize
+	errMessageTooLarge = errors.New("istanbul message too large")
+)
+
+var (
+	// oversizedMessageMeter records the rate of messages rejected for exceeding MaxMessageSize
+	oversizedMessageMeter = metrics.NewRegisteredMeter("consensus/istanbul/backend/oversized", nil)
+	// rateLimitedMessageMeter records the rate of messages dropped for exceeding the peer's rate limit
+	rateLimitedMessageMeter = metrics.NewRegisteredMeter("consensus/istanbul/backend/ratelimited", nil)
+	// quorumEndpointsGauge reports the number of distinct network endpoints among the committers of the last committed block
+	quorumEndpointsGauge = metrics.NewRegisteredGauge("consensus/istanbul/backend/quorum/endpoints", nil)
+	// concentratedQuorumMeter records the rate of committed blocks whose committers share fewer than MinQuorumEndpoints endpoints
+	concentratedQuorumMeter = metrics.NewRegisteredMeter("consensus/istanbul/backend/quorum/concentrated", nil)
 )
 
 // Protocol implements consensus.Engine.Protocol
@@ -56,6 +72,12 @@ func (sb *Backend) HandleMsg(addr common.Address, msg p2p.Msg) (bool, error) {
 			return true, istanbul.ErrStoppedEngine
 		}
 
+		if sb.config.MaxMessageSize > 0 && uint64(msg.Size) > sb.config.MaxMessageSize {
+			sb.logger.Debug("Rejecting oversized message", "from", addr, "size", msg.Size, "max", sb.config.MaxMessageSize)
+			oversizedMessageMeter.Mark(1)
+			return true, errMessageTooLarge
+		}
+
 		var data []byte
 		if err := msg.Decode(&data); err != nil {
 			return true, errDecodeFailed
@@ -78,6 +100,14 @@ func (sb *Backend) HandleMsg(addr common.Address, msg p2p.Msg) (bool, error) {
 		if _, ok := sb.knownMessages.Get(hash); ok {
 			return true, nil
 		}
+
+		// Only new messages count towards the peer's rate limit. Those over it are dropped without
+		// an error, as honest peers relaying a burst of gossip would be disconnected otherwise.
+		if !sb.allowMessage(addr) {
+			sb.logger.Trace("Dropping rate limited message", "from", addr)
+			rateLimitedMessageMeter.Mark(1)
+			return true, nil
+		}
 		sb.knownMessages.Add(hash, true)
 
 		if msg.Code == istanbulMsg {
@@ -93,6 +123,35 @@ func (sb *Backend) HandleMsg(addr common.Address, msg p2p.Msg) (bool, error) {
 	return false, nil
 }
 
+// allowMessage returns whether a message from the given peer is within its rate limit. Peers
+// in the current validator set are subject to the validator limit, others to the peer limit.
+func (sb *Backend) allowMessage(addr common.Address) bool {
+	if sb.config.ValidatorMessageRate == 0 && sb.config.PeerMessageRate == 0 {
+		return true
+	}
+	rate, burst := sb.config.PeerMessageRate, sb.config.PeerMessageBurst
+	if sb.isEpochValidator(addr) {
+		rate, burst = sb.config.ValidatorMessageRate, sb.config.ValidatorMessageBurst
+	}
+	return sb.messageRateLimiter.allow(addr, rate, burst, time.Now())
+}
+
+// isEpochValidator returns whether the given address is in the validator set of the next block.
+// That set only changes at epoch boundaries, so it is cached until the epoch changes.
+// The caller must hold coreMu.
+func (sb *Backend) isEpochValidator(addr common.Address) bool {
+	block := sb.currentBlock()
+	epoch := istanbul.GetEpochNumber(block.Number().Uint64()+1, sb.config.Epoch)
+	if sb.rateLimitValidators == nil || sb.rateLimitValidators.epoch != epoch {
+		addresses := make(map[common.Address]bool)
+		for _, val := range sb.getValidators(block.Number().Uint64(), block.Hash()).List() {
+			addresses[val.Address()] = true
+		}
+		sb.rateLimitValidators = &epochValidators{epoch: epoch, addresses: addresses}
+	}
+	return sb.rateLimitValidators.addresses[addr]
+}
+
 // SetBroadcaster implements consensus.Handler.SetBroadcaster
 func (sb *Backend) SetBroadcaster(broadcaster consensus.Broadcaster) {
 	sb.broadcaster = broadcaster
@@ -118,6 +177,7 @@ func (sb *Backend) NewChainHead() error {
 			sb.logger.Info("Validators Election Results: Node IN ValidatorSet")
 		}
 		go sb.RefreshValPeers(valset)
+		contract_comm.OnEpochChange(istanbul.GetEpochNumber(currentBlock.Number().Uint64()+1, sb.config.Epoch))
 	}
 
 	go sb.istanbulEventMux.Post(istanbul.FinalCommittedEvent{})
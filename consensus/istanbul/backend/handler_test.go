@@ -17,6 +17,7 @@
 package backend
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -66,6 +67,80 @@ func TestIstanbulMessage(t *testing.T) {
 	}
 }
 
+func TestOversizedIstanbulMessage(t *testing.T) {
+	_, backend := newBlockChain(1, true)
+	config := *backend.config
+	config.MaxMessageSize = 64
+	backend.config = &config
+
+	data := make([]byte, 128)
+	hash := istanbul.RLPHash(data)
+	msg := makeMsg(istanbulMsg, data)
+	addr := common.BytesToAddress([]byte("address"))
+
+	handled, err := backend.HandleMsg(addr, msg)
+	if !handled {
+		t.Errorf("oversized message should be handled by istanbul")
+	}
+	if err != errMessageTooLarge {
+		t.Errorf("error mismatch: have %v, want %v", err, errMessageTooLarge)
+	}
+	// The message is rejected before it is decoded and cached
+	if _, ok := backend.knownMessages.Get(hash); ok {
+		t.Errorf("oversized message should not be cached")
+	}
+
+	// Messages within the limit are still accepted
+	if _, err := backend.HandleMsg(addr, makeMsg(istanbulMsg, make([]byte, 32))); err != nil {
+		t.Errorf("handle message failed: %v", err)
+	}
+}
+
+func TestRateLimitedIstanbulMessages(t *testing.T) {
+	_, backend := newBlockChain(1, true)
+	config := *backend.config
+	config.ValidatorMessageRate = 1
+	config.ValidatorMessageBurst = 5
+	config.PeerMessageRate = 1
+	config.PeerMessageBurst = 2
+	backend.config = &config
+
+	flood := func(addr common.Address, count int) int {
+		accepted := 0
+		for i := 0; i < count; i++ {
+			data := []byte(fmt.Sprintf("%v-%d", addr, i))
+			// Messages over the limit are dropped without an error, so the peer isn't disconnected
+			if _, err := backend.HandleMsg(addr, makeMsg(istanbulMsg, data)); err != nil {
+				t.Fatalf("failed to handle message: %v", err)
+			}
+			if _, ok := backend.knownMessages.Get(istanbul.RLPHash(data)); ok {
+				accepted++
+			}
+		}
+		return accepted
+	}
+
+	// A sender outside the validator set is throttled after its burst
+	if accepted := flood(common.BytesToAddress([]byte("address")), 10); accepted != 2 {
+		t.Errorf("accepted messages from unknown sender mismatch: have %v, want %v", accepted, 2)
+	}
+	// A validator gets a higher limit
+	if accepted := flood(backend.Address(), 10); accepted != 5 {
+		t.Errorf("accepted messages from validator mismatch: have %v, want %v", accepted, 5)
+	}
+
+	// Duplicates of a known message don't use up the sender's budget
+	sender := common.BytesToAddress([]byte("duplicates"))
+	for i := 0; i < 10; i++ {
+		if _, err := backend.HandleMsg(sender, makeMsg(istanbulMsg, []byte("duplicate"))); err != nil {
+			t.Fatalf("failed to handle duplicate message: %v", err)
+		}
+	}
+	if accepted := flood(sender, 10); accepted != 1 {
+		t.Errorf("accepted messages after duplicates mismatch: have %v, want %v", accepted, 1)
+	}
+}
+
 func makeMsg(msgcode uint64, data interface{}) p2p.Msg {
 	size, r, _ := rlp.EncodeToReader(data)
 	return p2p.Msg{Code: msgcode, Size: uint32(size), Payload: r}
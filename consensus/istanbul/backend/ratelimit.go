@@ -0,0 +1,85 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// rateLimitedPeers is the number of peers whose token buckets are remembered
+const rateLimitedPeers = 1000
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second. Each message takes a token.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// epochValidators holds the addresses of the validators of an epoch
+type epochValidators struct {
+	epoch     uint64
+	addresses map[common.Address]bool
+}
+
+// messageRateLimiter limits the rate of consensus messages accepted from each peer
+type messageRateLimiter struct {
+	mu      sync.Mutex
+	buckets *lru.Cache // peer address -> *tokenBucket
+}
+
+func newMessageRateLimiter() *messageRateLimiter {
+	buckets, _ := lru.New(rateLimitedPeers)
+	return &messageRateLimiter{buckets: buckets}
+}
+
+// allow takes a token from the bucket of the given peer, and returns false if it's empty.
+// A rate of 0 disables the limit.
+func (l *messageRateLimiter) allow(addr common.Address, rate, burst uint64, now time.Time) bool {
+	if rate == 0 {
+		return true
+	}
+	capacity := float64(burst)
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var bucket *tokenBucket
+	if b, ok := l.buckets.Get(addr); ok {
+		bucket = b.(*tokenBucket)
+		bucket.tokens += now.Sub(bucket.last).Seconds() * float64(rate)
+		if bucket.tokens > capacity {
+			bucket.tokens = capacity
+		}
+	} else {
+		bucket = &tokenBucket{tokens: capacity}
+		l.buckets.Add(addr, bucket)
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
 )
 
 // Entries for the valEnodeTable
@@ -72,6 +73,21 @@ func (vet *validatorEnodeTable) getUsingAddress(address common.Address) *validat
 	return vet.valEnodeTable[address]
 }
 
+// getEndpoint returns the IP address announced by the validator, or "" if it is unknown.
+func (vet *validatorEnodeTable) getEndpoint(address common.Address) string {
+	vet.valEnodeTableMu.RLock()
+	defer vet.valEnodeTableMu.RUnlock()
+	entry, ok := vet.valEnodeTable[address]
+	if !ok {
+		return ""
+	}
+	node, err := enode.ParseV4(entry.enodeURL)
+	if err != nil || node.IP() == nil {
+		return ""
+	}
+	return node.IP().String()
+}
+
 func (vet *validatorEnodeTable) getUsingEnodeURL(enodeURL string) (common.Address, *validatorEnode) {
 	if address, ok := vet.reverseValEnodeTable[enodeURL]; ok {
 		return address, vet.getUsingAddress(address)
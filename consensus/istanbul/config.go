@@ -21,18 +21,127 @@ type ProposerPolicy uint64
 const (
 	RoundRobin ProposerPolicy = iota
 	Sticky
+	RoundRobinWithSkip
 )
 
+type TimeoutBackoffPolicy uint64
+
+const (
+	ExponentialBackoff TimeoutBackoffPolicy = iota
+	LinearBackoff
+)
+
+// CommittedSealHasher selects the BLS hash-to-curve suite committed seals are signed and verified with
+type CommittedSealHasher uint64
+
+const (
+	// DirectHasher maps the seal to the curve by try-and-increment, the BLS library's default
+	DirectHasher CommittedSealHasher = iota
+	// CompositeHasher hashes the seal with a Pedersen hash composed with Blake2s before mapping it
+	// to the curve, which is cheaper to verify in SNARKs
+	CompositeHasher
+)
+
+// UseComposite returns whether the suite uses the BLS library's composite hasher
+func (h CommittedSealHasher) UseComposite() bool {
+	return h == CompositeHasher
+}
+
 type Config struct {
 	RequestTimeout uint64         `toml:",omitempty"` // The timeout for each Istanbul round in milliseconds.
 	BlockPeriod    uint64         `toml:",omitempty"` // Default minimum difference between two consecutive block's timestamps in second
 	ProposerPolicy ProposerPolicy `toml:",omitempty"` // The policy for proposer selection
 	Epoch          uint64         `toml:",omitempty"` // The number of blocks after which to checkpoint and reset the pending votes
+
+	TimeoutBackoffPolicy    TimeoutBackoffPolicy `toml:",omitempty"` // The policy for growing the round change timeout in rounds > 0
+	TimeoutBackoffIncrement uint64               `toml:",omitempty"` // The number of seconds added to the round change timeout per round with linear backoff
+
+	EmptyBlockPeriod uint64 `toml:",omitempty"` // Minimum difference in seconds between two consecutive empty blocks, ignored unless greater than BlockPeriod
+
+	ProposerSelfCheckPercent uint64 `toml:",omitempty"` // Percentage of the block period after which a proposer that hasn't sent a preprepare gives up the round, 0 disables the check
+
+	MaxMessageSize uint64 `toml:",omitempty"` // Maximum size in bytes of an incoming consensus message, 0 disables the check
+
+	VerifyAggregatedSeal bool `toml:",omitempty"` // Verify the aggregated committed seal against the committers' public keys before committing
+	VerifyCommittedSeals bool `toml:",omitempty"` // Verify each committed seal against the hash of the proposal before aggregating it, leaving out those that don't sign it
+	VerifyRegisteredKeys bool `toml:",omitempty"` // Check the BLS public key of each committer against the one currently registered in the validators contract before aggregating its seal, leaving out those signed with a rotated-out key
+
+	ProposerSkipWindow uint64 `toml:",omitempty"` // Number of recent blocks a validator must have signed a commit in to be picked as proposer by the RoundRobinWithSkip policy, until the uptime lookback window set on chain has been read
+
+	MaxTransactionsPerBlock uint64 `toml:",omitempty"` // Reject proposals with more transactions than this, 0 disables the check
+
+	ProposalSizeSoftLimit uint64 `toml:",omitempty"` // Size in bytes of proposals beyond which they are reported while still accepted, to warn before MaxMessageSize rejects them; 0 disables the warning
+
+	ProposerWarmupBlocks uint64 `toml:",omitempty"` // Number of sequences after startup during which the node gives up its proposer turns, 0 disables the warmup
+
+	CommitSealBatchWindow uint64 `toml:",omitempty"` // Milliseconds during which the committed seals of incoming COMMIT messages are collected to be verified as a batch, 0 verifies each seal on arrival
+
+	CommitBroadcastDelay uint64 `toml:",omitempty"` // Milliseconds our COMMIT is held back after a quorum of prepares to coalesce with other gossip, capped at a tenth of the round timeout; 0 broadcasts it immediately
+
+	ValidatorMessageRate  uint64 `toml:",omitempty"` // Consensus messages per second accepted from each peer in the active validator set, 0 disables the limit
+	ValidatorMessageBurst uint64 `toml:",omitempty"` // Number of consensus messages a peer in the active validator set may send at once beyond its rate
+	PeerMessageRate       uint64 `toml:",omitempty"` // Consensus messages per second accepted from each peer outside the active validator set, 0 disables the limit
+	PeerMessageBurst      uint64 `toml:",omitempty"` // Number of consensus messages a peer outside the active validator set may send at once beyond its rate
+
+	EnforceBlockPeriodFloor       bool `toml:",omitempty"` // Reject proposals whose timestamp is earlier than the parent's timestamp plus BlockPeriod
+	SkipBlockPeriodFloorOnCatchUp bool `toml:",omitempty"` // Don't enforce the block period floor for proposals in rounds > 0
+
+	MaxProposalFutureSkew uint64 `toml:",omitempty"` // Reject proposals whose timestamp is more than this many seconds ahead of the local clock, 0 disables the check
+
+	InconsistentSubjectThreshold uint64 `toml:",omitempty"` // Number of messages with inconsistent subjects accepted from a validator in a sequence, beyond which its messages are ignored until the next sequence; 0 disables the check
+
+	AsyncProposalVerification bool `toml:",omitempty"` // Verify the proposals of incoming preprepares in a worker instead of on the consensus goroutine
+	AsyncProposalAssembly     bool `toml:",omitempty"` // Encode and persist our preprepares in a worker, abandoning them if the view moves on meanwhile
+
+	MaxPendingRequests uint64 `toml:",omitempty"` // Maximum number of requests waiting for their sequence, beyond which the lowest-priority request is dropped; 0 disables the limit
+
+	MessageTraceSize uint64 `toml:",omitempty"` // Number of the last handled consensus messages kept in memory for post-mortem analysis, 0 disables the trace
+
+	RoundChangeGraceMultiplier float64 `toml:",omitempty"` // Multiplier of the timeout of the first round after a round change in a sequence, giving its proposer extra time; 1 (or 0) leaves it unchanged
+
+	PreprepareResendPercent uint64 `toml:",omitempty"` // Percentage of the round timeout after which a proposer without a quorum of PREPAREs re-broadcasts its preprepare once, 0 disables the resend
+
+	CommittedSealHasher CommittedSealHasher `toml:"-"` // The BLS hash-to-curve suite committed seals are signed and verified with, set from the chain config as all nodes must agree on it
+
+	CommitRetries      uint64 `toml:",omitempty"` // Number of times committing a proposal with the backend is retried before giving up with a round change, 0 disables retries
+	CommitRetryBackoff uint64 `toml:",omitempty"` // Milliseconds before the first retry of a failed commit, doubled for each subsequent retry
+
+	RequestViewSync bool `toml:",omitempty"` // Whether to ask the other validators for their view and round changes when starting or lagging behind their round
+
+	MaxFutureSequences uint64 `toml:",omitempty"` // Number of sequences beyond the current one messages are backlogged for, later ones are rejected; 0 disables the limit
+
+	OldRoundTolerance uint64 `toml:",omitempty"` // Number of rounds before the current one whose late PREPARE and COMMIT messages for the current proposal are gathered into a prepared certificate of their round, if none is held from a later round; 0 discards them as old
+
+	MaxRoundChangeMessages uint64 `toml:",omitempty"` // Number of ROUND CHANGE messages kept across all rounds of a sequence, beyond which the rounds superseded by a validator's higher round, then the lowest rounds, are evicted; 0 disables the limit
+
+	InvariantCheckInterval uint64 `toml:",omitempty"` // Milliseconds between checks of the invariants of the round state, whose violations are logged and counted; 0 disables the checks
+
+	MessageStoreCompactionInterval uint64 `toml:",omitempty"` // Milliseconds between removals of the stored messages of the sequences already finalized, left over by rounds that weren't torn down; 0 disables the compaction
+
+	MinQuorumEndpoints uint64 `toml:",omitempty"` // Number of distinct network endpoints among the committers of a block below which its quorum is reported as concentrated; 0 disables the warning
+
+	SealVerificationConcurrency uint64 `toml:",omitempty"` // Maximum number of committed seals verified at once when they're verified one by one; 0 uses GOMAXPROCS
 }
 
+// defaultMaxMessageSize leaves room for the largest legitimate message, a PREPREPARE carrying a full
+// block and a round change certificate from 100 validators whose round changes carry their own
+// prepared certificates, while staying below the 10MB cap of the eth protocol.
+const defaultMaxMessageSize = 8 * 1024 * 1024
+
 var DefaultConfig = &Config{
 	RequestTimeout: 3000,
 	BlockPeriod:    1,
 	ProposerPolicy: RoundRobin,
 	Epoch:          30000,
+
+	TimeoutBackoffPolicy:    ExponentialBackoff,
+	TimeoutBackoffIncrement: 3,
+
+	MaxMessageSize: defaultMaxMessageSize,
+
+	ProposerSkipWindow: 10,
+
+	RoundChangeGraceMultiplier: 1.0,
+
+	MaxFutureSequences: 100,
 }
@@ -17,10 +17,23 @@
 package core
 
 import (
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/prque"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
 )
 
+const (
+	// maxBacklogWorkers is the number of validator backlogs that are reprocessed concurrently
+	maxBacklogWorkers = 8
+	// maxEarlyMessages is the number of messages kept from before the validator set is known
+	maxEarlyMessages = 1024
+	// maxEarlyMessagesPerSender is the number of those messages kept for a single sender
+	maxEarlyMessagesPerSender = 64
+)
+
 var (
 	// msgPriority is defined for calculating processing priority to speedup consensus
 	// istanbul.MsgPreprepare > istanbul.MsgCommit > istanbul.MsgPrepare
@@ -36,36 +49,81 @@ var (
 // return errFutureMessage if the message view is larger than current view
 // return errOldMessage if the message view is smaller than current view
 func (c *core) checkMessage(msgCode uint64, view *istanbul.View) error {
+	snapshot := consensusSnapshot{
+		view:         c.currentView(),
+		desiredRound: c.current.DesiredRound(),
+		state:        c.state,
+	}
+	if c.config != nil {
+		snapshot.maxFutureSequences = c.config.MaxFutureSequences
+	}
+	return snapshot.checkMessage(msgCode, view)
+}
+
+// consensusSnapshot is a copy of the parts of the round state that decide whether a message
+// can be handled, so that it can be consulted off the consensus goroutine.
+type consensusSnapshot struct {
+	view         *istanbul.View
+	desiredRound *big.Int
+	state        State
+	// the number of sequences ahead messages are backlogged for, 0 for no limit
+	maxFutureSequences uint64
+}
+
+// backlogSnapshot returns a copy of the current round state for reprocessing the backlogs.
+func (c *core) backlogSnapshot() *consensusSnapshot {
+	snapshot := &consensusSnapshot{
+		view:  c.currentView(),
+		state: c.state,
+	}
+	if c.config != nil {
+		snapshot.maxFutureSequences = c.config.MaxFutureSequences
+	}
+	if desiredRound := c.current.DesiredRound(); desiredRound != nil {
+		snapshot.desiredRound = new(big.Int).Set(desiredRound)
+	}
+	return snapshot
+}
+
+func (s *consensusSnapshot) checkMessage(msgCode uint64, view *istanbul.View) error {
 	if view == nil || view.Sequence == nil || view.Round == nil {
 		return errInvalidMessage
 	}
 
+	// Messages too far ahead can't become relevant soon, so they aren't worth keeping in the backlog
+	if s.maxFutureSequences > 0 {
+		horizon := new(big.Int).Add(s.view.Sequence, new(big.Int).SetUint64(s.maxFutureSequences))
+		if view.Sequence.Cmp(horizon) > 0 {
+			return errFarFutureMessage
+		}
+	}
+
 	// Round change messages should be in the same sequence but be >= the desired round
 	if msgCode == istanbul.MsgRoundChange {
-		if view.Sequence.Cmp(c.currentView().Sequence) > 0 {
+		if view.Sequence.Cmp(s.view.Sequence) > 0 {
 			return errFutureMessage
-		} else if view.Round.Cmp(c.current.DesiredRound()) < 0 {
+		} else if view.Round.Cmp(s.desiredRound) < 0 {
 			return errOldMessage
 		}
 		return nil
 	}
 
-	if view.Cmp(c.currentView()) > 0 {
+	if view.Cmp(s.view) > 0 {
 		return errFutureMessage
 	}
 
-	if view.Cmp(c.currentView()) < 0 {
+	if view.Cmp(s.view) < 0 {
 		return errOldMessage
 	}
 
 	// Round change messages are already let through.
-	if c.state == StateWaitingForNewRound {
+	if s.state == StateWaitingForNewRound {
 		return errFutureMessage
 	}
 
 	// StateAcceptRequest only accepts istanbul.MsgPreprepare
 	// other messages are future messages
-	if c.state == StateAcceptRequest {
+	if s.state == StateAcceptRequest {
 		if msgCode > istanbul.MsgPreprepare {
 			return errFutureMessage
 		}
@@ -78,12 +136,7 @@ func (c *core) checkMessage(msgCode uint64, view *istanbul.View) error {
 }
 
 func (c *core) storeBacklog(msg *istanbul.Message, src istanbul.Validator) {
-	logger := c.logger.New("from", msg.Address, "state", c.state, "func", "storeBacklog")
-	if c.current != nil {
-		logger = logger.New("cur_seq", c.current.Sequence(), "cur_round", c.current.Round())
-	} else {
-		logger = logger.New("cur_seq", 0, "cur_round", -1)
-	}
+	logger := c.NewLogger("from", msg.Address, "func", "storeBacklog")
 
 	if msg.Address == c.Address() {
 		logger.Warn("Backlog from self")
@@ -124,70 +177,225 @@ func (c *core) storeBacklog(msg *istanbul.Message, src istanbul.Validator) {
 	c.backlogs[src] = backlog
 }
 
+// storeEarlyMessage keeps a message received before the validator set is known, by the sender it
+// claims, until handleEarlyMessages can check it. Its signature isn't verified yet, so the number
+// of messages kept is bounded.
+func (c *core) storeEarlyMessage(payload []byte) error {
+	msg := new(istanbul.Message)
+	if err := msg.FromPayload(payload, nil); err != nil {
+		recordUndecodableMsg()
+		return err
+	}
+	if c.earlyMessageCount >= maxEarlyMessages || len(c.earlyMessages[msg.Address]) >= maxEarlyMessagesPerSender {
+		c.NewLogger("func", "storeEarlyMessage", "from", msg.Address).Debug("Dropping message received before the validator set is initialized", "code", msg.Code)
+		return errTooManyEarlyMessages
+	}
+	if c.earlyMessages == nil {
+		c.earlyMessages = make(map[common.Address][][]byte)
+	}
+	c.earlyMessages[msg.Address] = append(c.earlyMessages[msg.Address], payload)
+	c.earlyMessageCount++
+	return errFutureMessage
+}
+
+// handleEarlyMessages handles the messages received before the validator set was known, in the
+// order each sender sent them. Those signed by a validator that can't be handled yet end up in
+// its backlog.
+func (c *core) handleEarlyMessages() {
+	early := c.earlyMessages
+	c.earlyMessages, c.earlyMessageCount = nil, 0
+	for _, payloads := range early {
+		for _, payload := range payloads {
+			if err := c.handlePayload(payload); err != nil && err != errFutureMessage {
+				c.NewLogger("func", "handleEarlyMessages").Debug("Failed to handle message received before the validator set was initialized", "err", err)
+			}
+		}
+	}
+}
+
+// processBacklog reprocesses the backlogs against the current round state. The backlog of each
+// validator is queued for a long-lived pool of workers so that decoding the messages doesn't
+// block the consensus goroutine, while messages from a single validator are still handled in
+// order. A backlog already queued is reprocessed once, against the latest round state.
 func (c *core) processBacklog() {
-	c.backlogsMu.Lock()
-	defer c.backlogsMu.Unlock()
+	snapshot := c.backlogSnapshot()
 
+	c.backlogsMu.Lock()
+	c.backlogQueueSnapshot = snapshot
+	if c.backlogQueued == nil {
+		c.backlogQueued = make(map[istanbul.Validator]bool)
+	}
+	queued := 0
 	for src, backlog := range c.backlogs {
-		if backlog == nil {
+		if backlog == nil || backlog.Empty() || c.backlogQueued[src] {
 			continue
 		}
+		c.backlogQueue = append(c.backlogQueue, src)
+		c.backlogQueued[src] = true
+		queued++
+	}
+	c.backlogWg.Add(queued)
+	c.backlogsMu.Unlock()
 
-		logger := c.logger.New("from", src, "state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "processBacklog")
-		isFuture := false
-
-		// We stop processing if
-		//   1. backlog is empty
-		//   2. The first message in queue is a future message
-		for !(backlog.Empty() || isFuture) {
-			m, prio := backlog.Pop()
-			msg := m.(*istanbul.Message)
-			var view *istanbul.View
-			switch msg.Code {
-			case istanbul.MsgPreprepare:
-				var m *istanbul.Preprepare
-				err := msg.Decode(&m)
-				if err == nil {
-					view = m.View
-				}
-			case istanbul.MsgPrepare:
-				fallthrough
-			case istanbul.MsgCommit:
-				var sub *istanbul.Subject
-				err := msg.Decode(&sub)
-				if err == nil {
-					view = sub.View
-				}
-			case istanbul.MsgRoundChange:
-				var rc *istanbul.RoundChange
-				err := msg.Decode(&rc)
-				if err == nil {
-					view = rc.View
-				}
-			}
-			if view == nil {
-				logger.Debug("Nil view", "msg", msg)
-				continue
-			}
-			// Push back if it's a future message
-			err := c.checkMessage(msg.Code, view)
-			if err != nil {
-				if err == errFutureMessage {
-					logger.Trace("Stop processing backlog", "msg", msg)
-					backlog.Push(msg, prio)
-					isFuture = true
+	if c.backlogWakeup == nil {
+		c.startBacklogWorkers()
+	}
+	// Each worker woken up works through the queue until it's empty, so there's no need to queue
+	// more wakeups than there are workers
+	for i := 0; i < queued; i++ {
+		select {
+		case c.backlogWakeup <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// startBacklogWorkers starts the pool of workers reprocessing the queued backlogs.
+func (c *core) startBacklogWorkers() {
+	workers := c.backlogWorkers
+	if workers <= 0 {
+		workers = maxBacklogWorkers
+	}
+	c.backlogWakeup = make(chan struct{}, workers)
+	c.backlogWorkersStop = make(chan struct{})
+	c.backlogWorkersWg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go c.runBacklogWorker(c.backlogWakeup, c.backlogWorkersStop)
+	}
+}
+
+// stopBacklogWorkers waits for the queued backlogs to be reprocessed, then stops the workers.
+func (c *core) stopBacklogWorkers() {
+	if c.backlogWakeup == nil {
+		return
+	}
+	c.backlogWg.Wait()
+	close(c.backlogWorkersStop)
+	c.backlogWorkersWg.Wait()
+	c.backlogWakeup, c.backlogWorkersStop = nil, nil
+}
+
+// runBacklogWorker reprocesses the queued backlogs each time it's woken up, until stopped.
+func (c *core) runBacklogWorker(wakeup, stop chan struct{}) {
+	defer c.backlogWorkersWg.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-wakeup:
+			for {
+				src, snapshot := c.nextQueuedBacklog()
+				if src == nil {
 					break
 				}
-				logger.Trace("Skip the backlog event", "msg", msg, "err", err)
-				continue
+				c.processValidatorBacklog(src, snapshot)
+				c.backlogWg.Done()
 			}
-			logger.Trace("Post backlog event", "msg", msg)
+		}
+	}
+}
+
+// nextQueuedBacklog takes the next validator off the backlog queue, along with the round state
+// to reprocess its backlog against. It returns nil once the queue is empty.
+func (c *core) nextQueuedBacklog() (istanbul.Validator, *consensusSnapshot) {
+	c.backlogsMu.Lock()
+	defer c.backlogsMu.Unlock()
+
+	if len(c.backlogQueue) == 0 {
+		return nil, nil
+	}
+	src := c.backlogQueue[0]
+	c.backlogQueue[0] = nil
+	c.backlogQueue = c.backlogQueue[1:]
+	delete(c.backlogQueued, src)
+	return src, c.backlogQueueSnapshot
+}
 
-			go c.sendEvent(backlogEvent{
-				src: src,
-				msg: msg,
-			})
+// backlogLock returns the lock serializing the reprocessing of a validator's backlog.
+// The caller must hold backlogsMu.
+func (c *core) backlogLock(src istanbul.Validator) *sync.Mutex {
+	if c.backlogLocks == nil {
+		c.backlogLocks = make(map[istanbul.Validator]*sync.Mutex)
+	}
+	lock := c.backlogLocks[src]
+	if lock == nil {
+		lock = new(sync.Mutex)
+		c.backlogLocks[src] = lock
+	}
+	return lock
+}
+
+func (c *core) processValidatorBacklog(src istanbul.Validator, snapshot *consensusSnapshot) {
+	c.backlogsMu.Lock()
+	lock := c.backlogLock(src)
+	c.backlogsMu.Unlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger := c.logger.New("from", src, "func", "processBacklog", "cur_seq", snapshot.view.Sequence, "cur_round", snapshot.view.Round, "state", snapshot.state)
+
+	// We stop processing if
+	//   1. backlog is empty
+	//   2. The first message in queue is a future message
+	for {
+		c.backlogsMu.Lock()
+		backlog := c.backlogs[src]
+		if backlog == nil || backlog.Empty() {
+			c.backlogsMu.Unlock()
+			return
 		}
+		m, prio := backlog.Pop()
+		c.backlogsMu.Unlock()
+
+		msg := m.(*istanbul.Message)
+		var view *istanbul.View
+		switch msg.Code {
+		case istanbul.MsgPreprepare:
+			var m *istanbul.Preprepare
+			err := msg.Decode(&m)
+			if err == nil {
+				view = m.View
+			}
+		case istanbul.MsgPrepare:
+			fallthrough
+		case istanbul.MsgCommit:
+			var sub *istanbul.Subject
+			err := msg.Decode(&sub)
+			if err == nil {
+				view = sub.View
+			}
+		case istanbul.MsgRoundChange:
+			var rc *istanbul.RoundChange
+			err := msg.Decode(&rc)
+			if err == nil {
+				view = rc.View
+			}
+		}
+		if view == nil {
+			logger.Debug("Nil view", "msg", msg)
+			continue
+		}
+		// Push back if it's a future message
+		err := snapshot.checkMessage(msg.Code, view)
+		if err != nil {
+			if err == errFutureMessage {
+				logger.Trace("Stop processing backlog", "msg", msg)
+				c.backlogsMu.Lock()
+				backlog.Push(msg, prio)
+				c.backlogsMu.Unlock()
+				return
+			}
+			logger.Trace("Skip the backlog event", "msg", msg, "err", err)
+			continue
+		}
+		logger.Trace("Post backlog event", "msg", msg)
+
+		c.sendEvent(backlogEvent{
+			src: src,
+			msg: msg,
+		})
 	}
 }
 
@@ -19,6 +19,7 @@ package core
 import (
 	"math/big"
 	"reflect"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -243,16 +244,18 @@ func TestProcessFutureBacklog(t *testing.T) {
 	}
 	testLogger.SetHandler(elog.StdoutHandler)
 	c := &core{
-		logger:     testLogger,
-		backlogs:   make(map[istanbul.Validator]*prque.Prque),
-		backlogsMu: new(sync.Mutex),
-		backend:    backend,
+		logger:         testLogger,
+		backlogs:       make(map[istanbul.Validator]*prque.Prque),
+		backlogsMu:     new(sync.Mutex),
+		backlogWorkers: maxBacklogWorkers,
+		backend:        backend,
 		current: newRoundState(&istanbul.View{
 			Sequence: big.NewInt(1),
 			Round:    big.NewInt(0),
 		}, newTestValidatorSet(4), nil, nil, istanbul.EmptyPreparedCertificate(), nil),
 		state: StateAcceptRequest,
 	}
+	defer c.stopBacklogWorkers()
 	c.subscribeEvents()
 	defer c.unsubscribeEvents()
 
@@ -347,16 +350,18 @@ func testProcessBacklog(t *testing.T, msg *istanbul.Message) {
 	}
 	testLogger.SetHandler(elog.StdoutHandler)
 	c := &core{
-		logger:     testLogger,
-		backlogs:   make(map[istanbul.Validator]*prque.Prque),
-		backlogsMu: new(sync.Mutex),
-		backend:    backend,
-		state:      State(msg.Code),
+		logger:         testLogger,
+		backlogs:       make(map[istanbul.Validator]*prque.Prque),
+		backlogsMu:     new(sync.Mutex),
+		backlogWorkers: maxBacklogWorkers,
+		backend:        backend,
+		state:          State(msg.Code),
 		current: newRoundState(&istanbul.View{
 			Sequence: big.NewInt(1),
 			Round:    big.NewInt(0),
 		}, newTestValidatorSet(4), nil, nil, istanbul.EmptyPreparedCertificate(), nil),
 	}
+	defer c.stopBacklogWorkers()
 	c.subscribeEvents()
 	defer c.unsubscribeEvents()
 
@@ -379,3 +384,184 @@ func testProcessBacklog(t *testing.T, msg *istanbul.Message) {
 		t.Error("unexpected timeout occurs")
 	}
 }
+
+func TestBacklogBeforeRoundState(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+	// Neither the validator set nor the round state are set up until the core is started
+	c.current = nil
+	c.valSet = nil
+
+	msg, err := sys.backends[1].getRoundChangeMessage(istanbul.View{
+		Round:    big.NewInt(1),
+		Sequence: big.NewInt(1),
+	}, istanbul.EmptyPreparedCertificate())
+	if err != nil {
+		t.Fatalf("failed to create round change message: %v", err)
+	}
+	payload, _ := msg.Payload()
+	if err := c.handleMsg(payload); err != errFutureMessage {
+		t.Fatalf("error mismatch: have %v, want %v", err, errFutureMessage)
+	}
+
+	// The round change is checked and reprocessed once startNewRound has set up the validator set
+	closer := sys.Run(true)
+	<-time.After(500 * time.Millisecond)
+	// The round change set is replaced by the engine, so stop it before reading
+	closer()
+
+	if round := c.roundChangeSet.MaxRound(1); round == nil || round.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("round change not reprocessed: have max round %v, want 1", round)
+	}
+}
+
+func TestEarlyMessageLimit(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+	c.current = nil
+	c.valSet = nil
+
+	for round := 0; round <= maxEarlyMessagesPerSender; round++ {
+		msg, err := sys.backends[1].getRoundChangeMessage(istanbul.View{
+			Round:    big.NewInt(int64(round)),
+			Sequence: big.NewInt(1),
+		}, istanbul.EmptyPreparedCertificate())
+		if err != nil {
+			t.Fatalf("failed to create round change message: %v", err)
+		}
+		payload, _ := msg.Payload()
+		want := errFutureMessage
+		if round == maxEarlyMessagesPerSender {
+			want = errTooManyEarlyMessages
+		}
+		if err := c.handleMsg(payload); err != want {
+			t.Fatalf("error mismatch for round %v: have %v, want %v", round, err, want)
+		}
+	}
+	if c.earlyMessageCount != maxEarlyMessagesPerSender {
+		t.Errorf("early message count mismatch: have %v, want %v", c.earlyMessageCount, maxEarlyMessagesPerSender)
+	}
+}
+
+func TestRejectFarFutureMessages(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+	config := *c.config
+	config.MaxFutureSequences = 10
+	c.config = &config
+	_, src := c.valSet.GetByAddress(sys.backends[1].Address())
+
+	backlogSize := func() int {
+		c.backlogsMu.Lock()
+		defer c.backlogsMu.Unlock()
+		if c.backlogs[src] == nil {
+			return 0
+		}
+		return c.backlogs[src].Size()
+	}
+
+	testCases := []struct {
+		sequence int64
+		want     error
+		backlog  int
+	}{
+		// Within the horizon of the current sequence 1
+		{11, errFutureMessage, 1},
+		{12, errFarFutureMessage, 1},
+		{10000, errFarFutureMessage, 1},
+	}
+	for _, test := range testCases {
+		msg, err := sys.backends[1].getRoundChangeMessage(istanbul.View{
+			Round:    big.NewInt(0),
+			Sequence: big.NewInt(test.sequence),
+		}, istanbul.EmptyPreparedCertificate())
+		if err != nil {
+			t.Fatalf("failed to create round change message: %v", err)
+		}
+		payload, _ := msg.Payload()
+		if err := c.handleMsg(payload); err != test.want {
+			t.Errorf("sequence %d: error mismatch: have %v, want %v", test.sequence, err, test.want)
+		}
+		if have := backlogSize(); have != test.backlog {
+			t.Errorf("sequence %d: backlog size mismatch: have %d, want %d", test.sequence, have, test.backlog)
+		}
+	}
+}
+
+func BenchmarkProcessBacklog(b *testing.B) {
+	b.Run("Sequential", func(b *testing.B) { benchmarkProcessBacklog(b, 1, 1) })
+	b.Run("Pooled", func(b *testing.B) { benchmarkProcessBacklog(b, maxBacklogWorkers, 1) })
+	b.Run("Burst", func(b *testing.B) { benchmarkProcessBacklog(b, maxBacklogWorkers, 100) })
+}
+
+// benchmarkProcessBacklog measures the time until every backlog has been reprocessed after calls
+// to processBacklog in a row, as when the round state changes in quick succession. It reports the
+// time the consensus goroutine is blocked in processBacklog as consensus-ns/op, and the most
+// goroutines running once the calls returned as peak-goroutines.
+func benchmarkProcessBacklog(b *testing.B, workers, calls int) {
+	const (
+		numValidators = 100
+		numMessages   = 50
+	)
+	logger := elog.New()
+	logger.SetHandler(elog.DiscardHandler())
+	c := &core{
+		logger:         logger,
+		backlogs:       make(map[istanbul.Validator]*prque.Prque),
+		backlogsMu:     new(sync.Mutex),
+		backlogWorkers: workers,
+		backend: &testSystemBackend{
+			events: new(event.TypeMux),
+		},
+		state: StatePrepared,
+		current: newRoundState(&istanbul.View{
+			Sequence: big.NewInt(1),
+			Round:    big.NewInt(0),
+		}, newTestValidatorSet(4), nil, nil, istanbul.EmptyPreparedCertificate(), nil),
+	}
+	defer c.stopBacklogWorkers()
+
+	subject := &istanbul.Subject{
+		View: &istanbul.View{
+			Sequence: big.NewInt(1),
+			Round:    big.NewInt(0),
+		},
+		Digest: common.BytesToHash([]byte("1234567890")),
+	}
+	subjectPayload, _ := Encode(subject)
+	validators := make([]istanbul.Validator, numValidators)
+	for i := range validators {
+		validators[i] = validator.New(common.BigToAddress(big.NewInt(int64(i+1))), []byte{})
+	}
+
+	var (
+		blocked    time.Duration
+		goroutines int
+	)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for _, src := range validators {
+			for j := 0; j < numMessages; j++ {
+				c.storeBacklog(&istanbul.Message{
+					Code:    istanbul.MsgCommit,
+					Msg:     subjectPayload,
+					Address: src.Address(),
+				}, src)
+			}
+		}
+		b.StartTimer()
+
+		start := time.Now()
+		for j := 0; j < calls; j++ {
+			c.processBacklog()
+		}
+		blocked += time.Since(start)
+		if n := runtime.NumGoroutine(); n > goroutines {
+			goroutines = n
+		}
+		c.backlogWg.Wait()
+	}
+	b.ReportMetric(float64(blocked.Nanoseconds())/float64(b.N), "consensus-ns/op")
+	b.ReportMetric(float64(goroutines), "peak-goroutines")
+}
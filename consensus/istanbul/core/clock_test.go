@@ -0,0 +1,156 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+)
+
+// fakeClock is a Clock whose time only moves when advanced by the test
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	when    time.Time
+	f       func()
+	stopped bool
+	fired   bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward, firing the timers that became due in their own goroutines.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.stopped {
+			continue
+		}
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.fired = true
+		due = append(due, t)
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	for _, t := range due {
+		go t.f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if t.stopped || t.fired {
+		return false
+	}
+	t.stopped = true
+	return true
+}
+
+func TestRoundChangeTimerFakeClock(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	backend := sys.backends[0]
+	c := backend.engine.(*core)
+	clock := newFakeClock()
+	c.clock = clock
+
+	sub := backend.EventMux().Subscribe(timeoutEvent{})
+	defer sub.Unsubscribe()
+
+	c.newRoundChangeTimer()
+	timeout := c.roundChangeTimeout(c.currentView())
+
+	clock.Advance(timeout - time.Millisecond)
+	select {
+	case <-sub.Chan():
+		t.Fatalf("round change timer fired before the timeout")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	var ev timeoutEvent
+	select {
+	case event := <-sub.Chan():
+		ev = event.Data.(timeoutEvent)
+	case <-time.After(time.Second):
+		t.Fatalf("round change timer did not fire after the timeout")
+	}
+	if ev.view.Cmp(c.currentView()) != 0 {
+		t.Errorf("view mismatch: have %v, want %v", ev.view, c.currentView())
+	}
+
+	// Handling the timeout moves to the next round
+	c.handleTimeoutMsg(ev.view)
+	if len(backend.sentMsgs) != 1 {
+		t.Fatalf("sent message count mismatch: have %v, want 1", len(backend.sentMsgs))
+	}
+	msg := new(istanbul.Message)
+	if err := msg.FromPayload(backend.sentMsgs[0], nil); err != nil {
+		t.Fatalf("failed to decode sent message: %v", err)
+	}
+	var rc *istanbul.RoundChange
+	if err := msg.Decode(&rc); err != nil || msg.Code != istanbul.MsgRoundChange {
+		t.Fatalf("sent message is not a round change: code %v, err %v", msg.Code, err)
+	}
+	if rc.View.Round.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("round change round mismatch: have %v, want 1", rc.View.Round)
+	}
+
+	// A stopped timer never fires
+	c.stopTimer()
+	clock.Advance(time.Hour)
+	select {
+	case <-sub.Chan():
+		t.Errorf("stopped round change timer fired")
+	default:
+	}
+}
@@ -17,20 +17,65 @@
 package core
 
 import (
+	"bytes"
 	"reflect"
+	"runtime"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
 	"github.com/ethereum/go-ethereum/crypto/bls"
 )
 
 func (c *core) sendCommit() {
-	logger := c.logger.New("state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "sendCommit")
+	logger := c.NewLogger("func", "sendCommit")
 	logger.Trace("Sending commit")
 	sub := c.current.Subject()
 	c.broadcastCommit(sub)
 }
 
+// maxCommitBroadcastDelayDivisor bounds the CommitBroadcastDelay to a fraction of the round timeout,
+// leaving the rest of the round to gather the commits.
+const maxCommitBroadcastDelayDivisor = 10
+
+// commitBroadcastDelay returns how long our COMMIT for the current view is held back.
+func (c *core) commitBroadcastDelay() time.Duration {
+	if c.config == nil || c.config.CommitBroadcastDelay == 0 {
+		return 0
+	}
+	delay := time.Duration(c.config.CommitBroadcastDelay) * time.Millisecond
+	if max := c.roundChangeTimerTimeout(c.currentView()) / maxCommitBroadcastDelayDivisor; delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// deferCommit broadcasts our COMMIT for the current view once the CommitBroadcastDelay has
+// elapsed, or right away if there is no delay.
+func (c *core) deferCommit() {
+	delay := c.commitBroadcastDelay()
+	if delay == 0 {
+		c.sendCommit()
+		return
+	}
+
+	c.stopCommitBroadcastTimer()
+	view := c.currentView()
+	c.commitBroadcastTimer = c.clock.AfterFunc(delay, func() {
+		c.sendEvent(commitBroadcastEvent{view})
+	})
+}
+
+// handleCommitBroadcast sends the COMMIT deferred by deferCommit, unless the view has moved on.
+func (c *core) handleCommitBroadcast(view *istanbul.View) {
+	if c.current == nil || view.Cmp(c.currentView()) != 0 || c.state.Cmp(StatePrepared) < 0 {
+		return
+	}
+	c.sendCommit()
+}
+
 func (c *core) sendCommitForOldBlock(view *istanbul.View, digest common.Hash) {
 	sub := &istanbul.Subject{
 		View:   view,
@@ -41,7 +86,7 @@ func (c *core) sendCommitForOldBlock(view *istanbul.View, digest common.Hash) {
 
 func (c *core) generateCommittedSeal(digest common.Hash) ([]byte, error) {
 	seal := PrepareCommittedSeal(digest)
-	committedSeal, err := c.backend.SignBlockHeader(seal)
+	committedSeal, err := c.backend.SignBlockHeader(seal, c.config.CommittedSealHasher.UseComposite())
 	if err != nil {
 		return nil, err
 	}
@@ -49,7 +94,7 @@ func (c *core) generateCommittedSeal(digest common.Hash) ([]byte, error) {
 }
 
 func (c *core) broadcastCommit(sub *istanbul.Subject) {
-	logger := c.logger.New("state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence())
+	logger := c.NewLogger()
 
 	encodedSubject, err := Encode(sub)
 	if err != nil {
@@ -72,7 +117,6 @@ func (c *core) broadcastCommit(sub *istanbul.Subject) {
 }
 
 func (c *core) handleCommit(msg *istanbul.Message) error {
-	logger := c.logger.New("state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "handleCommit", "tag", "handleMsg")
 	// Decode COMMIT message
 	var commit *istanbul.Subject
 	err := msg.Decode(&commit)
@@ -81,6 +125,9 @@ func (c *core) handleCommit(msg *istanbul.Message) error {
 	}
 
 	if err := c.checkMessage(istanbul.MsgCommit, commit.View); err != nil {
+		if err == errOldMessage {
+			return c.acceptOldRoundMessage(msg, commit)
+		}
 		return err
 	}
 
@@ -93,10 +140,23 @@ func (c *core) handleCommit(msg *istanbul.Message) error {
 		return errInvalidValidatorAddress
 	}
 
-	if err := c.verifyCommittedSeal(commit.Digest, msg.CommittedSeal, validator); err != nil {
+	if c.config.CommitSealBatchWindow > 0 {
+		c.queueCommitSeal(&pendingCommitSeal{msg: msg, commit: commit, validator: validator})
+		return errMessageQueued
+	}
+
+	if err := verifyCommittedSeal(commit.Digest, msg.CommittedSeal, validator, c.config.CommittedSealHasher.UseComposite()); err != nil {
 		return errInvalidCommittedSeal
 	}
 
+	return c.handleVerifiedCommit(msg)
+}
+
+// handleVerifiedCommit accepts a COMMIT message whose committed seal has been verified
+// and commits the proposal once there is a quorum.
+func (c *core) handleVerifiedCommit(msg *istanbul.Message) error {
+	logger := c.NewLogger("func", "handleVerifiedCommit", "tag", "handleMsg")
+
 	c.acceptCommit(msg)
 	numberOfCommits := c.current.Commits.Size()
 	minQuorumSize := c.valSet.MinQuorumSize()
@@ -116,6 +176,9 @@ func (c *core) handleCommit(msg *istanbul.Message) error {
 			logger.Error("Failed to create and set preprared certificate", "err", err)
 			return err
 		}
+		if err := c.saveRoundStateToDisk(); err != nil {
+			logger.Error("Failed to write round state to the disk", "err", err)
+		}
 	}
 
 	return nil
@@ -123,7 +186,7 @@ func (c *core) handleCommit(msg *istanbul.Message) error {
 
 // verifyCommit verifies if the received COMMIT message is equivalent to our subject
 func (c *core) verifyCommit(commit *istanbul.Subject) error {
-	logger := c.logger.New("state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "verifyCommit")
+	logger := c.NewLogger("func", "verifyCommit")
 
 	sub := c.current.Subject()
 	if !reflect.DeepEqual(commit, sub) {
@@ -134,14 +197,201 @@ func (c *core) verifyCommit(commit *istanbul.Subject) error {
 	return nil
 }
 
-// verifyCommittedSeal verifies the commit seal in the received COMMIT message
-func (c *core) verifyCommittedSeal(digest common.Hash, committedSeal []byte, src istanbul.Validator) error {
+// verifyCommittedSeal verifies the commit seal in the received COMMIT message, mapped to the curve
+// with the composite hasher if useComposite is set
+func verifyCommittedSeal(digest common.Hash, committedSeal []byte, src istanbul.Validator, useComposite bool) error {
 	seal := PrepareCommittedSeal(digest)
-	return blscrypto.VerifySignature(src.BLSPublicKey(), seal, []byte{}, committedSeal, false)
+	return blscrypto.VerifySignature(src.BLSPublicKey(), seal, []byte{}, committedSeal, useComposite)
+}
+
+// commitsSigning returns the COMMIT messages of the current round whose committed seal signs the
+// given proposal hash, logging and leaving out the others.
+func (c *core) commitsSigning(hash common.Hash) *messageSet {
+	logger := c.NewLogger("func", "commitsSigning")
+	commits := newMessageSet(c.current.Commits.valSet)
+	var batch []*pendingCommitSeal
+	for _, msg := range c.current.Commits.Values() {
+		if _, val := commits.valSet.GetByAddress(msg.Address); val != nil {
+			batch = append(batch, &pendingCommitSeal{msg: msg, validator: val})
+		}
+	}
+	errs := verifyCommittedSeals(hash, batch, c.config.CommittedSealHasher.UseComposite(), c.sealVerificationWorkers())
+	for i, pending := range batch {
+		if errs[i] != nil {
+			logger.Warn("Leaving out a committed seal not signing the proposal", "from", pending.msg.Address, "hash", hash, "err", errs[i])
+			continue
+		}
+		commits.addVerifiedMessage(pending.msg)
+	}
+	return commits
+}
+
+// commitsWithRegisteredKeys returns the given COMMIT messages from the validators whose public key
+// in the validator set is the one they currently have registered in the validators contract,
+// logging and leaving out the others. The validator set may predate a key rotation, leaving seals
+// signed with a rotated-out key. The committers are all kept if the registered keys can't be read.
+func (c *core) commitsWithRegisteredKeys(commits *messageSet) *messageSet {
+	logger := c.NewLogger("func", "commitsWithRegisteredKeys")
+	var (
+		msgs       []*istanbul.Message
+		publicKeys [][]byte
+		addrs      []common.Address
+	)
+	for _, msg := range commits.Values() {
+		publicKey, err := commits.GetAddressPublicKey(msg.Address)
+		if err != nil {
+			continue
+		}
+		msgs = append(msgs, msg)
+		publicKeys = append(publicKeys, publicKey)
+		addrs = append(addrs, msg.Address)
+	}
+
+	registered := newMessageSet(commits.valSet)
+	registeredKeys, err := c.backend.RegisteredBLSPublicKeys(addrs)
+	if err != nil || len(registeredKeys) != len(addrs) {
+		logger.Warn("Failed to read the registered public keys of the committers", "committers", len(addrs), "err", err)
+		for _, msg := range msgs {
+			registered.addVerifiedMessage(msg)
+		}
+		return registered
+	}
+	for i, msg := range msgs {
+		if !bytes.Equal(publicKeys[i], registeredKeys[i]) {
+			logger.Warn("Leaving out a committed seal from a validator whose public key isn't the registered one", "from", msg.Address, "key", hexutil.Bytes(publicKeys[i]), "registered", hexutil.Bytes(registeredKeys[i]))
+			continue
+		}
+		registered.addVerifiedMessage(msg)
+	}
+	return registered
+}
+
+// sealVerificationWorkers returns the maximum number of committed seals verified at once.
+func (c *core) sealVerificationWorkers() int {
+	if c.config.SealVerificationConcurrency > 0 {
+		return int(c.config.SealVerificationConcurrency)
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// verifyCommittedSeals verifies the committed seals of a batch of COMMIT messages for the given
+// digest one by one, with at most workers verifications running at once. It returns the error of
+// each seal, nil if it's valid.
+func verifyCommittedSeals(digest common.Hash, batch []*pendingCommitSeal, useComposite bool, workers int) []error {
+	errs := make([]error, len(batch))
+	forEachConcurrently(len(batch), workers, func(i int) {
+		errs[i] = verifyCommittedSeal(digest, batch[i].msg.CommittedSeal, batch[i].validator, useComposite)
+	})
+	return errs
+}
+
+// forEachConcurrently calls fn with every index below n from at most workers goroutines at once,
+// and returns once all calls have returned.
+func forEachConcurrently(n, workers int, fn func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// pendingCommitSeal is a COMMIT message whose committed seal awaits batch verification
+type pendingCommitSeal struct {
+	msg       *istanbul.Message
+	commit    *istanbul.Subject
+	validator istanbul.Validator
+}
+
+// queueCommitSeal adds a COMMIT message to the batch of committed seals to verify. The batch
+// is verified once the window elapses, or right away once it could complete a quorum so as
+// not to delay the commit.
+func (c *core) queueCommitSeal(pending *pendingCommitSeal) {
+	c.pendingCommitSeals = append(c.pendingCommitSeals, pending)
+	if c.current.Commits.Size()+len(c.pendingCommitSeals) >= c.valSet.MinQuorumSize() {
+		c.verifyCommitSealBatch()
+		return
+	}
+	if len(c.pendingCommitSeals) == 1 {
+		c.commitSealBatchTimer = c.clock.AfterFunc(time.Duration(c.config.CommitSealBatchWindow)*time.Millisecond, func() {
+			c.sendEvent(commitSealBatchEvent{})
+		})
+	}
+}
+
+// verifyCommitSealBatch verifies the pending committed seals and handles the COMMIT messages
+// carrying a valid one. Each seal is verified on its own, as an aggregate of seals can be valid
+// while the seals in it aren't, e.g. if colluding validators offset each other's seal.
+func (c *core) verifyCommitSealBatch() {
+	logger := c.NewLogger("func", "verifyCommitSealBatch")
+
+	c.stopCommitSealBatchTimer()
+	pendings := c.pendingCommitSeals
+	c.pendingCommitSeals = nil
+
+	// The round state may have moved on since the messages were queued
+	batches := make(map[common.Hash][]*pendingCommitSeal)
+	for _, pending := range pendings {
+		if err := c.checkMessage(istanbul.MsgCommit, pending.commit.View); err != nil {
+			logger.Trace("Dropping queued commit", "from", pending.msg.Address, "err", err)
+			c.recordQueuedMsg(pending.msg, err)
+			continue
+		}
+		if err := c.verifyCommit(pending.commit); err != nil {
+			logger.Trace("Dropping queued commit", "from", pending.msg.Address, "err", err)
+			c.recordQueuedMsg(pending.msg, err)
+			continue
+		}
+		batches[pending.commit.Digest] = append(batches[pending.commit.Digest], pending)
+	}
+
+	useComposite := c.config.CommittedSealHasher.UseComposite()
+	for digest, batch := range batches {
+		var valid []*pendingCommitSeal
+		errs := verifyCommittedSeals(digest, batch, useComposite, c.sealVerificationWorkers())
+		for i, pending := range batch {
+			if errs[i] != nil {
+				logger.Warn("Invalid committed seal in batch", "from", pending.msg.Address, "err", errInvalidCommittedSeal)
+				c.recordQueuedMsg(pending.msg, errInvalidCommittedSeal)
+				continue
+			}
+			valid = append(valid, pending)
+		}
+		for _, pending := range valid {
+			if err := c.checkMessage(istanbul.MsgCommit, pending.commit.View); err != nil {
+				c.recordQueuedMsg(pending.msg, err)
+				continue
+			}
+			err := c.handleVerifiedCommit(pending.msg)
+			if err != nil {
+				logger.Warn("Failed to handle verified commit", "from", pending.msg.Address, "err", err)
+			}
+			c.recordQueuedMsg(pending.msg, err)
+		}
+	}
 }
 
 func (c *core) acceptCommit(msg *istanbul.Message) error {
-	logger := c.logger.New("from", msg.Address, "state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "acceptCommit")
+	logger := c.NewLogger("from", msg.Address, "func", "acceptCommit")
 
 	// Add the COMMIT message to current round state
 	if err := c.current.Commits.Add(msg); err != nil {
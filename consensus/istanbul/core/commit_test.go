@@ -17,13 +17,19 @@
 package core
 
 import (
+	"fmt"
 	"math/big"
+	"math/rand"
+	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/celo-org/bls-zexe/go"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
 	"github.com/ethereum/go-ethereum/consensus/istanbul/validator"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/crypto/bls"
 )
@@ -325,3 +331,591 @@ func TestVerifyCommit(t *testing.T) {
 		}
 	}
 }
+
+func TestCommitVerifiesAggregatedSeal(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+	view := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+
+	testCases := []struct {
+		corrupt   bool
+		committed bool
+	}{
+		{false, true},
+		{true, false},
+	}
+	for _, test := range testCases {
+		sys := NewTestSystemWithBackend(N, F)
+		for _, backend := range sys.backends {
+			c := backend.engine.(*core)
+			c.valSet = backend.peers
+			c.current = newTestRoundState(&view, c.valSet)
+		}
+		closer := sys.Run(false)
+
+		v0 := sys.backends[0]
+		c := v0.engine.(*core)
+		config := *istanbul.DefaultConfig
+		config.VerifyAggregatedSeal = true
+		c.config = &config
+
+		var commits []istanbul.Message
+		for _, backend := range sys.backends[:c.valSet.MinQuorumSize()] {
+			msg, err := backend.getCommitMessage(view, c.current.Proposal())
+			if err != nil {
+				t.Fatalf("failed to create commit message: %v", err)
+			}
+			commits = append(commits, msg)
+		}
+		if test.corrupt {
+			// A valid seal attributed to the wrong validator
+			commits[1].CommittedSeal = commits[0].CommittedSeal
+		}
+		for i := range commits {
+			c.current.Commits.Add(&commits[i])
+		}
+		c.commit()
+		closer()
+
+		if committed := len(v0.committedMsgs) == 1; committed != test.committed {
+			t.Errorf("corrupt %v: committed mismatch: have %v, want %v", test.corrupt, committed, test.committed)
+		}
+		if !test.committed {
+			if len(v0.sentMsgs) != 1 {
+				t.Fatalf("corrupt %v: the number of sent messages mismatch: have %v, want 1", test.corrupt, len(v0.sentMsgs))
+			}
+			msg := new(istanbul.Message)
+			if err := msg.FromPayload(v0.sentMsgs[0], nil); err != nil || msg.Code != istanbul.MsgRoundChange {
+				t.Errorf("corrupt %v: expected a round change, have code %v (err %v)", test.corrupt, msg.Code, err)
+			}
+		}
+	}
+}
+
+func TestCommitVerifiesCommittedSeals(t *testing.T) {
+	view := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+
+	testCases := []struct {
+		name      string
+		commits   int // number of COMMITs, the last one of which signs the wrong hash
+		committed bool
+	}{
+		{"quorum left", 4, true},
+		{"below quorum", 3, false},
+	}
+	for _, test := range testCases {
+		sys := NewTestSystemWithBackend(4, 1)
+		for _, backend := range sys.backends {
+			c := backend.engine.(*core)
+			c.valSet = backend.peers
+			c.current = newTestRoundState(&view, c.valSet)
+		}
+		closer := sys.Run(false)
+
+		v0 := sys.backends[0]
+		c := v0.engine.(*core)
+		config := *istanbul.DefaultConfig
+		config.VerifyCommittedSeals = true
+		c.config = &config
+
+		for i, backend := range sys.backends[:test.commits] {
+			proposal := c.current.Proposal()
+			if i == test.commits-1 {
+				proposal = makeBlock(2)
+			}
+			msg, err := backend.getCommitMessage(view, proposal)
+			if err != nil {
+				t.Fatalf("%s: failed to create commit message: %v", test.name, err)
+			}
+			c.current.Commits.Add(&msg)
+		}
+		c.commit()
+		closer()
+
+		if committed := len(v0.committedMsgs) == 1; committed != test.committed {
+			t.Fatalf("%s: committed mismatch: have %v, want %v", test.name, committed, test.committed)
+		}
+		if test.committed {
+			// The seal over the wrong hash is left out of the bitmap
+			want := new(big.Int)
+			for _, backend := range sys.backends[:test.commits-1] {
+				i, _ := c.valSet.GetByAddress(backend.Address())
+				want.SetBit(want, i, 1)
+			}
+			if bitmap := v0.committedMsgs[0].bitmap; bitmap.Cmp(want) != 0 {
+				t.Errorf("%s: bitmap mismatch: have %b, want %b", test.name, bitmap, want)
+			}
+		} else {
+			msg := new(istanbul.Message)
+			if len(v0.sentMsgs) != 1 || msg.FromPayload(v0.sentMsgs[0], nil) != nil || msg.Code != istanbul.MsgRoundChange {
+				t.Errorf("%s: expected a round change", test.name)
+			}
+		}
+	}
+}
+
+func TestCommitVerifiesRegisteredKeys(t *testing.T) {
+	view := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+
+	testCases := []struct {
+		name      string
+		commits   int // number of COMMITs, the last one of which is from a validator whose registered key was rotated
+		committed bool
+	}{
+		{"quorum left", 4, true},
+		{"below quorum", 3, false},
+	}
+	for _, test := range testCases {
+		sys := NewTestSystemWithBackend(4, 1)
+		for _, backend := range sys.backends {
+			c := backend.engine.(*core)
+			c.valSet = backend.peers
+			c.current = newTestRoundState(&view, c.valSet)
+		}
+		closer := sys.Run(false)
+
+		v0 := sys.backends[0]
+		c := v0.engine.(*core)
+		config := *istanbul.DefaultConfig
+		config.VerifyRegisteredKeys = true
+		c.config = &config
+		rotated := sys.backends[test.commits-1]
+		v0.registeredKeys = map[common.Address][]byte{rotated.Address(): make([]byte, blscrypto.PUBLICKEYBYTES)}
+
+		for _, backend := range sys.backends[:test.commits] {
+			msg, err := backend.getCommitMessage(view, c.current.Proposal())
+			if err != nil {
+				t.Fatalf("%s: failed to create commit message: %v", test.name, err)
+			}
+			c.current.Commits.Add(&msg)
+		}
+		c.commit()
+		closer()
+
+		if committed := len(v0.committedMsgs) == 1; committed != test.committed {
+			t.Fatalf("%s: committed mismatch: have %v, want %v", test.name, committed, test.committed)
+		}
+		if test.committed {
+			// The seal of the validator with a rotated key is left out of the bitmap
+			want := new(big.Int)
+			for _, backend := range sys.backends[:test.commits-1] {
+				i, _ := c.valSet.GetByAddress(backend.Address())
+				want.SetBit(want, i, 1)
+			}
+			if bitmap := v0.committedMsgs[0].bitmap; bitmap.Cmp(want) != 0 {
+				t.Errorf("%s: bitmap mismatch: have %b, want %b", test.name, bitmap, want)
+			}
+		} else {
+			msg := new(istanbul.Message)
+			if len(v0.sentMsgs) != 1 || msg.FromPayload(v0.sentMsgs[0], nil) != nil || msg.Code != istanbul.MsgRoundChange {
+				t.Errorf("%s: expected a round change", test.name)
+			}
+		}
+	}
+}
+
+func TestCommitRefusesMismatchedProposal(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+	view := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+
+	testCases := []struct {
+		name       string
+		preprepare *istanbul.Preprepare
+		certified  istanbul.Proposal
+		committed  bool
+	}{
+		{"matching proposal", newTestPreprepare(&view), makeBlock(1), true},
+		{"regressed number", &istanbul.Preprepare{View: &view, Proposal: makeBlock(0)}, nil, false},
+		{"uncertified proposal", newTestPreprepare(&view), makeBlockWithDifficulty(1, 2), false},
+	}
+	for _, test := range testCases {
+		sys := NewTestSystemWithBackend(N, F)
+		for _, backend := range sys.backends {
+			c := backend.engine.(*core)
+			c.valSet = backend.peers
+			c.current = newTestRoundState(&view, c.valSet)
+		}
+		closer := sys.Run(false)
+
+		v0 := sys.backends[0]
+		c := v0.engine.(*core)
+		c.current.SetPreprepare(test.preprepare)
+		if test.certified != nil {
+			c.current.SetPreparedCertificate(sys.getPreparedCertificate(t, view, test.certified))
+		}
+
+		for _, backend := range sys.backends[:c.valSet.MinQuorumSize()] {
+			msg, err := backend.getCommitMessage(view, test.preprepare.Proposal)
+			if err != nil {
+				t.Fatalf("failed to create commit message: %v", err)
+			}
+			c.current.Commits.Add(&msg)
+		}
+		c.commit()
+		closer()
+
+		if committed := len(v0.committedMsgs) == 1; committed != test.committed {
+			t.Errorf("%s: committed mismatch: have %v, want %v", test.name, committed, test.committed)
+		}
+		if !test.committed {
+			if len(v0.sentMsgs) != 1 {
+				t.Fatalf("%s: the number of sent messages mismatch: have %v, want 1", test.name, len(v0.sentMsgs))
+			}
+			msg := new(istanbul.Message)
+			if err := msg.FromPayload(v0.sentMsgs[0], nil); err != nil || msg.Code != istanbul.MsgRoundChange {
+				t.Errorf("%s: expected a round change, have code %v (err %v)", test.name, msg.Code, err)
+			}
+		}
+	}
+}
+
+func TestCommittedSealHasher(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	digest := makeBlock(1).Hash()
+	c := sys.backends[0].engine.(*core)
+	_, validator := c.valSet.GetByAddress(c.address)
+
+	sealWith := func(hasher istanbul.CommittedSealHasher) []byte {
+		config := *istanbul.DefaultConfig
+		config.CommittedSealHasher = hasher
+		c.config = &config
+		seal, err := c.generateCommittedSeal(digest)
+		if err != nil {
+			t.Fatalf("failed to generate committed seal: %v", err)
+		}
+		return seal
+	}
+	directSeal := sealWith(istanbul.DirectHasher)
+	compositeSeal := sealWith(istanbul.CompositeHasher)
+
+	// The default suite round-trips
+	if istanbul.DefaultConfig.CommittedSealHasher != istanbul.DirectHasher {
+		t.Errorf("default hasher mismatch: have %v, want %v", istanbul.DefaultConfig.CommittedSealHasher, istanbul.DirectHasher)
+	}
+	if err := verifyCommittedSeal(digest, directSeal, validator, false); err != nil {
+		t.Errorf("failed to verify seal of the default suite: %v", err)
+	}
+	if err := verifyCommittedSeal(digest, compositeSeal, validator, true); err != nil {
+		t.Errorf("failed to verify seal of the composite suite: %v", err)
+	}
+
+	// Seals of one suite are rejected by nodes using the other
+	if err := verifyCommittedSeal(digest, compositeSeal, validator, false); err == nil {
+		t.Errorf("verified a composite seal with the default suite")
+	}
+	if err := verifyCommittedSeal(digest, directSeal, validator, true); err == nil {
+		t.Errorf("verified a default seal with the composite suite")
+	}
+
+	// Prepared certificates are checked with the suite of the verifier
+	view := istanbul.View{Round: big.NewInt(0), Sequence: big.NewInt(1)}
+	c.config = istanbul.DefaultConfig
+	certificate := sys.getPreparedCertificate(t, view, makeBlock(1))
+	if err := VerifyPreparedCertificate(certificate, c.valSet, istanbul.DirectHasher); err != nil {
+		t.Errorf("failed to verify prepared certificate with the default suite: %v", err)
+	}
+	if err := VerifyPreparedCertificate(certificate, c.valSet, istanbul.CompositeHasher); err == nil {
+		t.Errorf("verified prepared certificate of the default suite with the composite suite")
+	}
+}
+
+func TestCommitSealBatch(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+	view := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+
+	sys := NewTestSystemWithBackend(N, F)
+	for _, backend := range sys.backends {
+		c := backend.engine.(*core)
+		c.valSet = backend.peers
+		c.current = newTestRoundState(&view, c.valSet)
+		c.state = StatePrepared
+	}
+	closer := sys.Run(false)
+	defer closer()
+
+	v0 := sys.backends[0]
+	c := v0.engine.(*core)
+	config := *istanbul.DefaultConfig
+	// Long enough for the batch to only be verified once it could complete a quorum
+	config.CommitSealBatchWindow = 60 * 1000
+	c.config = &config
+	c.messageTrace = newMessageTrace(8)
+
+	var commits []istanbul.Message
+	for _, backend := range sys.backends {
+		msg, err := backend.getCommitMessage(view, c.current.Proposal())
+		if err != nil {
+			t.Fatalf("failed to create commit message: %v", err)
+		}
+		commits = append(commits, msg)
+	}
+	// A valid seal attributed to the wrong validator
+	commits[3].CommittedSeal = commits[1].CommittedSeal
+
+	for i := 1; i < len(commits); i++ {
+		if err := c.handleCommit(&commits[i]); err != errMessageQueued {
+			t.Fatalf("error mismatch: have %v, want %v", err, errMessageQueued)
+		}
+		if i < 3 && len(c.pendingCommitSeals) != i {
+			t.Errorf("pending commit seals mismatch: have %v, want %v", len(c.pendingCommitSeals), i)
+		}
+	}
+
+	// Only the good seals of the batch are accepted
+	if len(c.pendingCommitSeals) != 0 {
+		t.Errorf("pending commit seals mismatch: have %v, want 0", len(c.pendingCommitSeals))
+	}
+	if c.current.Commits.Size() != 2 {
+		t.Errorf("accepted commits mismatch: have %v, want 2", c.current.Commits.Size())
+	}
+	if c.current.Commits.Get(commits[3].Address) != nil {
+		t.Errorf("commit with an invalid seal was accepted")
+	}
+	// Queued commits are only traced once their seal has been verified
+	trace := c.MessageTrace()
+	if len(trace) != 3 {
+		t.Fatalf("trace length mismatch: have %v, want 3", len(trace))
+	}
+	for _, record := range trace {
+		if accepted := record.From != commits[3].Address; record.Accepted != accepted {
+			t.Errorf("trace of commit from %v: accepted mismatch: have %v, want %v", record.From, record.Accepted, accepted)
+		}
+	}
+
+	if err := c.handleCommit(&commits[0]); err != errMessageQueued {
+		t.Fatalf("error mismatch: have %v, want %v", err, errMessageQueued)
+	}
+	if len(v0.committedMsgs) != 1 {
+		t.Errorf("committed messages mismatch: have %v, want 1", len(v0.committedMsgs))
+	}
+}
+
+func TestCommitSealBatchRejectsOffsetSeals(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+	view := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+
+	sys := NewTestSystemWithBackend(N, F)
+	for _, backend := range sys.backends {
+		c := backend.engine.(*core)
+		c.valSet = backend.peers
+		c.current = newTestRoundState(&view, c.valSet)
+		c.state = StatePrepared
+	}
+	closer := sys.Run(false)
+	defer closer()
+
+	c := sys.backends[0].engine.(*core)
+	config := *istanbul.DefaultConfig
+	config.CommitSealBatchWindow = 60 * 1000
+	c.config = &config
+
+	var commits []istanbul.Message
+	for _, backend := range sys.backends {
+		msg, err := backend.getCommitMessage(view, c.current.Proposal())
+		if err != nil {
+			t.Fatalf("failed to create commit message: %v", err)
+		}
+		commits = append(commits, msg)
+	}
+	// Swapped seals are both invalid, but aggregate to the same signature as the valid ones
+	commits[2].CommittedSeal, commits[3].CommittedSeal = commits[3].CommittedSeal, commits[2].CommittedSeal
+
+	for i := 1; i < len(commits); i++ {
+		if err := c.handleCommit(&commits[i]); err != errMessageQueued {
+			t.Fatalf("error mismatch: have %v, want %v", err, errMessageQueued)
+		}
+	}
+	if c.current.Commits.Size() != 1 {
+		t.Errorf("accepted commits mismatch: have %v, want 1", c.current.Commits.Size())
+	}
+	for _, commit := range commits[2:] {
+		if c.current.Commits.Get(commit.Address) != nil {
+			t.Errorf("commit from %v with an invalid seal was accepted", commit.Address)
+		}
+	}
+}
+
+func BenchmarkVerifyCommittedSeals(b *testing.B) {
+	N := uint64(100)
+	F := uint64(33)
+	view := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+
+	sys := NewTestSystemWithBackend(N, F)
+	var batch []*pendingCommitSeal
+	for _, backend := range sys.backends {
+		c := backend.engine.(*core)
+		c.valSet = backend.peers
+		c.current = newTestRoundState(&view, c.valSet)
+	}
+	proposal := sys.backends[0].engine.(*core).current.Proposal()
+	for _, backend := range sys.backends {
+		msg, err := backend.getCommitMessage(view, proposal)
+		if err != nil {
+			b.Fatalf("failed to create commit message: %v", err)
+		}
+		_, validator := backend.peers.GetByAddress(msg.Address)
+		batch = append(batch, &pendingCommitSeal{msg: &msg, validator: validator})
+	}
+
+	b.Run("Individual", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, pending := range batch {
+				if err := verifyCommittedSeal(proposal.Hash(), pending.msg.CommittedSeal, pending.validator, false); err != nil {
+					b.Fatalf("failed to verify committed seal: %v", err)
+				}
+			}
+		}
+	})
+	for _, workers := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("Concurrent/%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, err := range verifyCommittedSeals(proposal.Hash(), batch, false, workers) {
+					if err != nil {
+						b.Fatalf("failed to verify committed seal: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestForEachConcurrently(t *testing.T) {
+	for _, workers := range []int{0, 1, 3, 8, 100} {
+		var running, maxRunning int32
+		calls := make([]int32, 20)
+		forEachConcurrently(len(calls), workers, func(i int) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&calls[i], 1)
+			atomic.AddInt32(&running, -1)
+		})
+
+		limit := int32(workers)
+		if limit < 1 {
+			limit = 1
+		}
+		if maxRunning > limit {
+			t.Errorf("concurrent calls with %d workers: have %v, want at most %v", workers, maxRunning, limit)
+		}
+		for i, n := range calls {
+			if n != 1 {
+				t.Errorf("calls for index %d with %d workers: have %v, want 1", i, workers, n)
+			}
+		}
+	}
+}
+
+// assembleCommittedSealsCopying assembles the committed seals the way commit did before
+// assembleCommittedSeals, copying every seal and looking up each signer twice.
+func assembleCommittedSealsCopying(commits *messageSet) ([][]byte, *big.Int, [][]byte, []common.Address) {
+	bitmap := big.NewInt(0)
+	publicKeys := [][]byte{}
+	addresses := []common.Address{}
+	committedSeals := make([][]byte, commits.Size())
+	for i, v := range commits.Values() {
+		committedSeals[i] = make([]byte, types.IstanbulExtraCommittedSeal)
+		copy(committedSeals[i][:], v.CommittedSeal[:])
+		j, _ := commits.GetAddressIndex(v.Address)
+		publicKey, _ := commits.GetAddressPublicKey(v.Address)
+		publicKeys = append(publicKeys, publicKey)
+		addresses = append(addresses, v.Address)
+		bitmap.SetBit(bitmap, int(j), 1)
+	}
+	return committedSeals, bitmap, publicKeys, addresses
+}
+
+// newTestCommits returns a set of COMMIT messages with random seals from n validators, one of
+// them with a short seal.
+func newTestCommits(n int) *messageSet {
+	valSet, _ := validator.NewTestValidatorSet(n)
+	commits := newMessageSet(valSet)
+	for i, val := range valSet.List() {
+		seal := make([]byte, types.IstanbulExtraCommittedSeal)
+		if i == 0 {
+			seal = seal[:types.IstanbulExtraCommittedSeal/2]
+		}
+		rand.Read(seal)
+		commits.Add(&istanbul.Message{
+			Code:          istanbul.MsgCommit,
+			Address:       val.Address(),
+			CommittedSeal: seal,
+		})
+	}
+	return commits
+}
+
+func TestAssembleCommittedSeals(t *testing.T) {
+	commits := newTestCommits(10)
+	seals, bitmap, publicKeys, addresses := assembleCommittedSeals(commits)
+	wantSeals, wantBitmap, wantPublicKeys, wantAddresses := assembleCommittedSealsCopying(commits)
+	if bitmap.Cmp(wantBitmap) != 0 {
+		t.Errorf("bitmap mismatch: have %v, want %v", bitmap, wantBitmap)
+	}
+	if len(addresses) != len(wantAddresses) {
+		t.Fatalf("committer count mismatch: have %v, want %v", len(addresses), len(wantAddresses))
+	}
+	// The messages come out of a map, compare them by address
+	for i, addr := range wantAddresses {
+		j := 0
+		for j < len(addresses) && addresses[j] != addr {
+			j++
+		}
+		if j == len(addresses) {
+			t.Errorf("missing committer %v", addr.Hex())
+			continue
+		}
+		if !reflect.DeepEqual(seals[j], wantSeals[i]) {
+			t.Errorf("committed seal mismatch for %v", addr.Hex())
+		}
+		if !reflect.DeepEqual(publicKeys[j], wantPublicKeys[i]) {
+			t.Errorf("public key mismatch for %v", addr.Hex())
+		}
+	}
+}
+
+func BenchmarkAssembleCommittedSeals(b *testing.B) {
+	commits := newTestCommits(200)
+
+	b.Run("Copying", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			assembleCommittedSealsCopying(commits)
+		}
+	})
+	b.Run("Referencing", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			assembleCommittedSeals(commits)
+		}
+	})
+}
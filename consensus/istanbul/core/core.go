@@ -20,39 +20,87 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
+	"math/bits"
 	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/common/prque"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/crypto/bls"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	// verifiedProposalsCacheSize is the number of proposal hashes remembered as verified in the current sequence
+	verifiedProposalsCacheSize = 16
+	// verifiedSignaturesCacheSize is the number of message signatures remembered as verified in the current sequence
+	verifiedSignaturesCacheSize = 1024
+
+	// maxTimeoutRound is the round beyond which round timeouts stop growing
+	maxTimeoutRound = 1 << 16
+	// maxRoundTimeout caps round timeouts, whatever the round and config
+	maxRoundTimeout = 24 * time.Hour
+	// startRoundRetryDelay is how long starting a round waits for the backend to have a last proposal
+	startRoundRetryDelay = 500 * time.Millisecond
 )
 
 // New creates an Istanbul consensus core
 func New(backend istanbul.Backend, config *istanbul.Config) Engine {
+	verifiedProposals, _ := lru.New(verifiedProposalsCacheSize)
+	verifiedSignatures, _ := lru.New(verifiedSignaturesCacheSize)
 	c := &core{
-		config:             config,
-		address:            backend.Address(),
-		state:              StateAcceptRequest,
-		handlerWg:          new(sync.WaitGroup),
-		logger:             log.New("address", backend.Address()),
-		backend:            backend,
-		backlogs:           make(map[istanbul.Validator]*prque.Prque),
-		backlogsMu:         new(sync.Mutex),
-		pendingRequests:    prque.New(nil),
-		pendingRequestsMu:  new(sync.Mutex),
-		consensusTimestamp: time.Time{},
-		roundMeter:         metrics.NewRegisteredMeter("consensus/istanbul/core/round", nil),
-		sequenceMeter:      metrics.NewRegisteredMeter("consensus/istanbul/core/sequence", nil),
-		consensusTimer:     metrics.NewRegisteredTimer("consensus/istanbul/core/consensus", nil),
+		config:                         config,
+		address:                        backend.Address(),
+		state:                          StateAcceptRequest,
+		handlerWg:                      new(sync.WaitGroup),
+		logger:                         log.New("address", backend.Address()),
+		backend:                        backend,
+		backlogs:                       make(map[istanbul.Validator]*prque.Prque),
+		backlogsMu:                     new(sync.Mutex),
+		backlogWorkers:                 maxBacklogWorkers,
+		pendingRequests:                prque.New(nil),
+		pendingRequestsMu:              new(sync.Mutex),
+		clock:                          realClock{},
+		consensusTimestamp:             time.Time{},
+		verifiedProposals:              verifiedProposals,
+		verifiedSignatures:             verifiedSignatures,
+		inconsistentSubjects:           make(map[subjectSender]uint64),
+		oldRoundMessages:               make(map[uint64]*messageSet),
+		roundMeter:                     metrics.NewRegisteredMeter("consensus/istanbul/core/round", nil),
+		sequenceMeter:                  metrics.NewRegisteredMeter("consensus/istanbul/core/sequence", nil),
+		consensusTimer:                 metrics.NewRegisteredTimer("consensus/istanbul/core/consensus", nil),
+		roundChangeFormationTimer:      metrics.NewRegisteredTimer("consensus/istanbul/core/roundchange/formation", nil),
+		sameProposerRoundChangeCounter: metrics.NewRegisteredCounter("consensus/istanbul/core/sameproposerroundchange", nil),
+		sequenceBehindCounter:          metrics.NewRegisteredCounter("consensus/istanbul/core/sequencebehind", nil),
+		commitSignersGauge:             metrics.NewRegisteredGauge("consensus/istanbul/core/commit/signers", nil),
+		commitQuorumSizeGauge:          metrics.NewRegisteredGauge("consensus/istanbul/core/commit/quorumsize", nil),
+		commitValSetSizeGauge:          metrics.NewRegisteredGauge("consensus/istanbul/core/commit/valsetsize", nil),
+		roundGapGauge:                  metrics.NewRegisteredGauge("consensus/istanbul/core/round/gap", nil),
+		bareQuorumCommitCounter:        metrics.NewRegisteredCounter("consensus/istanbul/core/commit/barequorum", nil),
+		badProposalCounter:             metrics.NewRegisteredCounter("consensus/istanbul/core/badproposal", nil),
+		mutedMessageCounter:            metrics.NewRegisteredCounter("consensus/istanbul/core/mutedmessages", nil),
+		droppedRequestCounter:          metrics.NewRegisteredCounter("consensus/istanbul/core/droppedrequests", nil),
+		signFailureCounter:             metrics.NewRegisteredCounter("consensus/istanbul/core/finalize/signfailure", nil),
+		encodeFailureCounter:           metrics.NewRegisteredCounter("consensus/istanbul/core/finalize/encodefailure", nil),
+		invariantViolationCounter:      metrics.NewRegisteredCounter("consensus/istanbul/core/invariantviolations", nil),
+		invalidSignatureCounter:        metrics.NewRegisteredCounter("consensus/istanbul/core/invalidsignatures", nil),
+		proposalSizeHistogram:          metrics.NewRegisteredHistogram("consensus/istanbul/core/proposal/size", nil, metrics.NewExpDecaySample(1028, 0.015)),
+		roundHistory:                   newRoundHistory(roundHistorySize),
 	}
+	if config.MessageTraceSize > 0 {
+		c.messageTrace = newMessageTrace(config.MessageTraceSize)
+	}
+	c.messageStore = NewDiskMessageStore(backend.GetDataDir())
 	c.validateFn = c.checkValidatorSignature
 	return c
 }
@@ -69,23 +117,133 @@ type core struct {
 	events                *event.TypeMuxSubscription
 	finalCommittedSub     *event.TypeMuxSubscription
 	timeoutSub            *event.TypeMuxSubscription
-	futurePreprepareTimer *time.Timer
+	futurePreprepareTimer Timer
+	emptyBlockTimer       Timer
+	// timer to give up the round if we are its proposer and fail to send a preprepare
+	proposerSelfCheckTimer Timer
+	// timer to re-broadcast our preprepare if we are the proposer and haven't got a quorum of prepares
+	preprepareResendTimer Timer
+	// the last view we re-broadcast our preprepare in
+	preprepareResent *istanbul.View
+	// timer to retry committing a proposal the backend failed to commit
+	commitRetryTimer Timer
+	// closed to stop the periodic checks of the invariants of the round state
+	invariantCheckStop chan struct{}
+	// closed to stop the periodic compaction of the message store
+	messageStoreCompactionStop chan struct{}
+	// timer to broadcast the COMMIT held back by the CommitBroadcastDelay
+	commitBroadcastTimer Timer
+	// timer to retry starting a round the backend had no last proposal for
+	startRoundRetryTimer Timer
 
 	valSet     istanbul.ValidatorSet
 	validateFn func([]byte, []byte) (common.Address, error)
 
 	backlogs   map[istanbul.Validator]*prque.Prque
 	backlogsMu *sync.Mutex
+	// per-validator locks keeping the reprocessing of each backlog in order, guarded by backlogsMu
+	backlogLocks map[istanbul.Validator]*sync.Mutex
+	// number of workers reprocessing the backlogs
+	backlogWorkers int
+	// validators whose backlog awaits a worker, and the round state to reprocess them against,
+	// guarded by backlogsMu
+	backlogQueue         []istanbul.Validator
+	backlogQueued        map[istanbul.Validator]bool
+	backlogQueueSnapshot *consensusSnapshot
+	// wakes up the backlog workers and stops them, nil while they aren't running
+	backlogWakeup      chan struct{}
+	backlogWorkersStop chan struct{}
+	backlogWorkersWg   sync.WaitGroup
+	// number of queued backlogs not reprocessed yet
+	backlogWg sync.WaitGroup
+	// raw messages received before the validator set is known, by claimed sender, and their count
+	earlyMessages     map[common.Address][][]byte
+	earlyMessageCount int
 
 	current   *roundState
 	handlerWg *sync.WaitGroup
+	// held by the handler goroutine while it handles an event, and by the API calls reading the
+	// round state or the validator set from other goroutines
+	roundStateMu sync.RWMutex
 
 	roundChangeSet   *roundChangeSet
-	roundChangeTimer *time.Timer
+	roundChangeTimer Timer
+	// the highest view we broadcast a round change for
+	roundChangeSent *istanbul.View
+	// the view whose round change timer got the grace multiplier, the first round after a round change in its sequence
+	roundChangeGraceView *istanbul.View
+	// the last view we requested a view sync in
+	viewSyncRequested *istanbul.View
 
 	pendingRequests   *prque.Prque
 	pendingRequestsMu *sync.Mutex
 
+	// COMMIT messages whose committed seals await batch verification
+	pendingCommitSeals   []*pendingCommitSeal
+	commitSealBatchTimer Timer
+
+	// feed of the proposals successfully committed by consensus
+	committedFeed event.Feed
+
+	// the last proposal committed by consensus, the view it was committed in, the bitmap of its
+	// committed seals and the validator set that committed it
+	lastCommittedProposal istanbul.Proposal
+	lastCommittedView     *istanbul.View
+	lastCommittedBitmap   *big.Int
+	lastCommittedValSet   istanbul.ValidatorSet
+	lastCommittedMu       sync.RWMutex
+
+	// whether the last sequence advance skipped sequences committed without us
+	catchingUp   bool
+	catchingUpMu sync.RWMutex
+
+	// when the node last moved on to a new sequence because the previous one was committed
+	lastCommitTime   time.Time
+	lastCommitTimeMu sync.RWMutex
+
+	// why and for which view we last sent a ROUND CHANGE, nil if we haven't since startup
+	lastRoundChange   *RoundChangeInfo
+	lastRoundChangeMu sync.RWMutex
+
+	// the first sequence worked on since startup, used for the proposer warmup
+	startSequence *big.Int
+
+	// the block period in effect and the epoch it was read for
+	blockPeriod      uint64
+	blockPeriodEpoch uint64
+
+	// hashes of the proposals already verified by the backend in the current sequence
+	verifiedProposals *lru.Cache
+	// signatures of the certificate messages already verified in the current sequence
+	verifiedSignatures *lru.Cache
+	// number of messages with subjects inconsistent with ours received from each validator in the current sequence, by message type
+	inconsistentSubjects map[subjectSender]uint64
+	// late PREPARE and COMMIT messages for the current proposal from earlier rounds of the current sequence, by round
+	oldRoundMessages map[uint64]*messageSet
+	// view of the preprepare whose proposal is being verified asynchronously, if any
+	pendingVerification *istanbul.View
+	// the view after the imported state, to move to once started, nil if no state was imported
+	importedResumeView *istanbul.View
+	// the preprepare being assembled in a worker, nil if none
+	proposalAssembly *proposalAssembly
+
+	// the last consensus messages handled, nil if the trace is disabled
+	messageTrace *messageTrace
+	// the final rounds of the last sequences finished
+	roundHistory *roundHistory
+	// where every message received or broadcast is teed to, nil if disabled
+	messageSink   io.Writer
+	messageSinkMu sync.Mutex
+
+	// the source of the current time and timers
+	clock Clock
+
+	// optional hook on outgoing broadcasts, for tests and network simulations
+	broadcastInterceptor BroadcastInterceptor
+
+	// where the sent messages and the round state are persisted across restarts
+	messageStore MessageStore
+
 	consensusTimestamp time.Time
 	// the meter to record the round change rate
 	roundMeter metrics.Meter
@@ -93,21 +251,52 @@ type core struct {
 	sequenceMeter metrics.Meter
 	// the timer to record consensus duration (from accepting a preprepare to final committed stage)
 	consensusTimer metrics.Timer
+	// the timer to record the time from the first round change message of a round to its round change certificate
+	roundChangeFormationTimer metrics.Timer
+	// the counter to record round changes that did not rotate to a different proposer
+	sameProposerRoundChangeCounter metrics.Counter
+	// the counter to record new rounds started with a last proposal behind the current sequence
+	sequenceBehindCounter metrics.Counter
+	// the gauges to record the number of validators whose seals are aggregated in the last committed
+	// block, against the quorum size and validator set size
+	commitSignersGauge    metrics.Gauge
+	commitQuorumSizeGauge metrics.Gauge
+	commitValSetSizeGauge metrics.Gauge
+	// how many rounds the desired round is ahead of the current round
+	roundGapGauge metrics.Gauge
+	// the counter to record blocks committed with no more seals than the quorum size
+	bareQuorumCommitCounter metrics.Counter
+	// the counter to record preprepares rejected because their proposal is a known bad block
+	badProposalCounter metrics.Counter
+	// the counter to record messages ignored from validators muted for sending inconsistent subjects
+	mutedMessageCounter metrics.Counter
+	// the counter to record requests dropped because the pending requests queue was full
+	droppedRequestCounter metrics.Counter
+	// the counters to record outgoing messages that couldn't be signed or encoded
+	signFailureCounter   metrics.Counter
+	encodeFailureCounter metrics.Counter
+	// the counter to record violations of the invariants of the round state
+	invariantViolationCounter metrics.Counter
+	// the counter to record messages whose signature doesn't verify against their claimed sender
+	invalidSignatureCounter metrics.Counter
+	// the histogram to record the serialized size of incoming proposals
+	proposalSizeHistogram metrics.Histogram
 }
 
 // Appends the current view and state to the given context.
 func (c *core) NewLogger(ctx ...interface{}) log.Logger {
-	var seq, round *big.Int
+	var seq, round, desired *big.Int
 	state := c.state
 	if c.current != nil {
 		seq = c.current.Sequence()
 		round = c.current.Round()
+		desired = c.current.DesiredRound()
 	} else {
 		seq = common.Big0
 		round = big.NewInt(-1)
+		desired = big.NewInt(-1)
 	}
-	tmp := c.logger.New(ctx...)
-	return tmp.New("cur_seq", seq, "cur_round", round, "state", state)
+	return c.logger.New(append(ctx, "cur_seq", seq, "cur_round", round, "desired_round", desired, "state", state)...)
 }
 
 func (c *core) SetAddress(address common.Address) {
@@ -115,6 +304,17 @@ func (c *core) SetAddress(address common.Address) {
 	c.logger = log.New("address", address)
 }
 
+// finalizeError is returned by finalizeMessage, its category tells whether signing or encoding
+// the message failed.
+type finalizeError struct {
+	category error // errSignFailed or errEncodeFailed
+	err      error
+}
+
+func (e *finalizeError) Error() string {
+	return e.category.Error() + ": " + e.err.Error()
+}
+
 func (c *core) finalizeMessage(msg *istanbul.Message) ([]byte, error) {
 	var err error
 	// Add sender address
@@ -123,38 +323,107 @@ func (c *core) finalizeMessage(msg *istanbul.Message) ([]byte, error) {
 	// Sign message
 	data, err := msg.PayloadNoSig()
 	if err != nil {
-		return nil, err
+		return nil, &finalizeError{errEncodeFailed, err}
 	}
 	msg.Signature, err = c.backend.Sign(data)
 	if err != nil {
-		return nil, err
+		return nil, &finalizeError{errSignFailed, err}
 	}
 
 	// Convert to payload
 	payload, err := msg.Payload()
 	if err != nil {
-		return nil, err
+		return nil, &finalizeError{errEncodeFailed, err}
 	}
 
 	return payload, nil
 }
 
 func (c *core) broadcast(msg *istanbul.Message) {
-	logger := c.logger.New("state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence())
+	logger := c.NewLogger()
 
-	payload, err := c.finalizeMessage(msg)
-	if err != nil {
-		logger.Error("Failed to finalize message", "msg", msg, "err", err)
+	payload := c.broadcastPayload(msg, logger)
+	if payload == nil {
 		return
 	}
 
 	// Broadcast payload
-	if err = c.backend.Broadcast(c.valSet, payload); err != nil {
+	if err := c.backend.Broadcast(c.valSet, payload); err != nil {
 		logger.Error("Failed to broadcast message", "msg", msg, "err", err)
 		return
 	}
 }
 
+// rebroadcast sends a message to the other validators only, bypassing the backend's record of the
+// messages sent to each peer which would skip those that missed it, or asked for it again.
+func (c *core) rebroadcast(msg *istanbul.Message) {
+	logger := c.NewLogger()
+
+	payload := c.broadcastPayload(msg, logger)
+	if payload == nil {
+		return
+	}
+
+	if err := c.backend.Gossip(c.valSet, payload, istanbul.ConsensusMsgCode, true); err != nil {
+		logger.Error("Failed to rebroadcast message", "msg", msg, "err", err)
+		return
+	}
+}
+
+// send sends a message to the given validator only.
+func (c *core) send(msg *istanbul.Message, target common.Address) {
+	logger := c.NewLogger()
+
+	payload := c.broadcastPayload(msg, logger)
+	if payload == nil {
+		return
+	}
+
+	if err := c.backend.Send(payload, target); err != nil {
+		logger.Error("Failed to send message", "msg", msg, "target", target, "err", err)
+		return
+	}
+}
+
+// broadcastPayload finalizes the message to broadcast, returning nil if it can't be sent or is
+// dropped by the broadcast interceptor.
+func (c *core) broadcastPayload(msg *istanbul.Message, logger log.Logger) []byte {
+	// The round state and validator set are not set before the first round starts
+	if c.current == nil || c.valSet == nil {
+		logger.Warn("Dropping message broadcast before the round state is initialized", "msg", msg)
+		return nil
+	}
+
+	payload, err := c.finalizeMessage(msg)
+	if err != nil {
+		if fe, ok := err.(*finalizeError); ok && fe.category == errSignFailed {
+			c.signFailureCounter.Inc(1)
+			logger.Error("Failed to sign message, check the signer", "msg", msg, "err", err)
+		} else {
+			c.encodeFailureCounter.Inc(1)
+			logger.Error("Failed to encode message", "msg", msg, "err", err)
+		}
+		return nil
+	}
+
+	if c.broadcastInterceptor != nil && c.broadcastInterceptor(c.valSet, payload) {
+		logger.Trace("Broadcast dropped by the interceptor", "msg", msg)
+		return nil
+	}
+	c.writeToMessageSink(payload, true)
+	return payload
+}
+
+// SetBroadcastInterceptor implements core.Engine.SetBroadcastInterceptor
+func (c *core) SetBroadcastInterceptor(interceptor BroadcastInterceptor) {
+	c.broadcastInterceptor = interceptor
+}
+
+// SetMessageStore implements core.Engine.SetMessageStore
+func (c *core) SetMessageStore(store MessageStore) {
+	c.messageStore = store
+}
+
 func (c *core) currentView() *istanbul.View {
 	return &istanbul.View{
 		Sequence: new(big.Int).Set(c.current.Sequence()),
@@ -171,41 +440,372 @@ func (c *core) isProposer() bool {
 }
 
 func (c *core) commit() {
+	if c.current == nil || c.valSet == nil {
+		c.NewLogger("func", "commit").Warn("Cannot commit before the round state is initialized")
+		return
+	}
 	c.setState(StateCommitted)
 
 	proposal := c.current.Proposal()
-	bitmap := big.NewInt(0)
-	publicKeys := [][]byte{}
 	if proposal != nil {
-		committedSeals := make([][]byte, c.current.Commits.Size())
-		for i, v := range c.current.Commits.Values() {
-			committedSeals[i] = make([]byte, types.IstanbulExtraCommittedSeal)
-			copy(committedSeals[i][:], v.CommittedSeal[:])
-			j, err := c.current.Commits.GetAddressIndex(v.Address)
-			if err != nil {
-				panic(fmt.Sprintf("commit: couldn't get address index for address %s", hex.EncodeToString(v.Address[:])))
+		if err := c.verifyCommittableProposal(proposal); err != nil {
+			c.NewLogger("func", "commit").Error("Refusing to commit proposal, sending round change", "err", err, "number", proposal.Number(), "hash", proposal.Hash())
+			c.sendNextRoundChange(RoundChangeCommitFailure)
+			return
+		}
+
+		commits := c.current.Commits
+		if c.config.VerifyCommittedSeals {
+			commits = c.commitsSigning(proposal.Hash())
+			if commits.Size() < c.valSet.MinQuorumSize() {
+				c.NewLogger("func", "commit").Error("Not enough committed seals sign the proposal, sending round change", "hash", proposal.Hash(), "valid", commits.Size(), "quorum", c.valSet.MinQuorumSize())
+				c.sendNextRoundChange(RoundChangeCommitFailure)
+				return
 			}
-			publicKey, err := c.current.Commits.GetAddressPublicKey(v.Address)
-			if err != nil {
-				panic(fmt.Sprintf("commit: couldn't get public key for address %s", hex.EncodeToString(v.Address[:])))
+		}
+		if c.config.VerifyRegisteredKeys {
+			commits = c.commitsWithRegisteredKeys(commits)
+			if commits.Size() < c.valSet.MinQuorumSize() {
+				c.NewLogger("func", "commit").Error("Not enough committers with their registered public key, sending round change", "hash", proposal.Hash(), "valid", commits.Size(), "quorum", c.valSet.MinQuorumSize())
+				c.sendNextRoundChange(RoundChangeCommitFailure)
+				return
 			}
-
-			publicKeys = append(publicKeys, publicKey)
-
-			bitmap.SetBit(bitmap, int(j), 1)
 		}
+		committedSeals, bitmap, publicKeys, addresses := assembleCommittedSeals(commits)
 		asig, err := blscrypto.AggregateSignatures(committedSeals)
 		if err != nil {
 			panic("commit: couldn't aggregate signatures which have been verified in the commit phase")
 		}
 
-		if err := c.backend.Commit(proposal, bitmap, asig); err != nil {
-			c.sendNextRoundChange()
+		// Catch mismatches between the seals, bitmap and public keys before committing a bad seal
+		if c.config.VerifyAggregatedSeal {
+			if err := blscrypto.VerifyAggregatedSignature(publicKeys, PrepareCommittedSeal(proposal.Hash()), []byte{}, asig, c.config.CommittedSealHasher.UseComposite()); err != nil {
+				c.NewLogger("func", "commit").Error("Aggregated committed seal failed verification, sending round change", "err", err, "hash", proposal.Hash(), "bitmap", bitmap, "committers", addresses)
+				c.sendNextRoundChange(RoundChangeCommitFailure)
+				return
+			}
+		}
+
+		c.commitProposal(proposal, bitmap, asig)
+	}
+}
+
+// verifyCommittableProposal checks that the proposal about to be committed is for the current
+// sequence and, if we hold a prepared certificate for the current view, that it is the proposal
+// it certifies. Certificates from earlier rounds may legitimately certify another proposal.
+func (c *core) verifyCommittableProposal(proposal istanbul.Proposal) error {
+	if proposal.Number().Cmp(c.current.Sequence()) != 0 {
+		return errCommitSequenceMismatch
+	}
+	preparedCertificate := c.current.PreparedCertificate()
+	if view := preparedCertificate.View(); view != nil && view.Cmp(c.currentView()) == 0 && preparedCertificate.Proposal.Hash() != proposal.Hash() {
+		return errCommitProposalMismatch
+	}
+	return nil
+}
+
+// assembleCommittedSeals returns the committed seals of the given COMMIT messages, along with the
+// bitmap, BLS public keys and addresses of their signers. Seals of the expected length are passed
+// on as they are, only seals of a different length are copied into a buffer of the expected length.
+func assembleCommittedSeals(commits *messageSet) ([][]byte, *big.Int, [][]byte, []common.Address) {
+	messages := commits.Values()
+	committedSeals := make([][]byte, len(messages))
+	publicKeys := make([][]byte, len(messages))
+	addresses := make([]common.Address, len(messages))
+	bitmap := big.NewInt(0)
+	for i, v := range messages {
+		if len(v.CommittedSeal) == types.IstanbulExtraCommittedSeal {
+			committedSeals[i] = v.CommittedSeal
+		} else {
+			committedSeals[i] = make([]byte, types.IstanbulExtraCommittedSeal)
+			copy(committedSeals[i], v.CommittedSeal)
+		}
+		j, val := commits.valSet.GetByAddress(v.Address)
+		if val == nil {
+			panic(fmt.Sprintf("commit: couldn't get validator for address %s", hex.EncodeToString(v.Address[:])))
+		}
+		publicKeys[i] = val.BLSPublicKey()
+		addresses[i] = v.Address
+		bitmap.SetBit(bitmap, j, 1)
+	}
+	return committedSeals, bitmap, publicKeys, addresses
+}
+
+// commitProposal commits the proposal with the backend and notifies the subscribers of the
+// committed feed. If the backend fails to commit it, the commit is retried up to CommitRetries
+// times before sending a round change.
+func (c *core) commitProposal(proposal istanbul.Proposal, bitmap *big.Int, aggregatedSeal []byte) {
+	c.tryCommitProposal(proposal, bitmap, aggregatedSeal, 0)
+}
+
+func (c *core) tryCommitProposal(proposal istanbul.Proposal, bitmap *big.Int, aggregatedSeal []byte, attempt uint64) {
+	if err := c.backend.Commit(proposal, bitmap, aggregatedSeal); err != nil {
+		logger := c.NewLogger("func", "tryCommitProposal", "number", proposal.Number(), "hash", proposal.Hash())
+		if attempt >= c.config.CommitRetries {
+			logger.Error("Failed to commit proposal, sending round change", "err", err, "attempts", attempt+1)
+			c.sendNextRoundChange(RoundChangeCommitFailure)
+			return
+		}
+		backoff := time.Duration(c.config.CommitRetryBackoff) * time.Millisecond
+		if attempt < 16 {
+			backoff <<= attempt
+		}
+		logger.Warn("Failed to commit proposal, retrying", "err", err, "attempt", attempt+1, "backoff", backoff)
+		ev := commitRetryEvent{
+			view:           c.currentView(),
+			proposal:       proposal,
+			bitmap:         bitmap,
+			aggregatedSeal: aggregatedSeal,
+			attempt:        attempt + 1,
+		}
+		c.stopCommitRetryTimer()
+		c.commitRetryTimer = c.clock.AfterFunc(backoff, func() {
+			c.sendEvent(ev)
+		})
+		return
+	}
+	c.proposalCommitted(proposal, bitmap, aggregatedSeal)
+}
+
+// handleCommitRetry retries committing a proposal the backend failed to commit, unless consensus
+// moved on in the meantime.
+func (c *core) handleCommitRetry(ev commitRetryEvent) {
+	if c.current == nil || ev.view.Cmp(c.currentView()) != 0 || c.state != StateCommitted {
+		return
+	}
+	// A failed commit may still have reached the chain, don't apply it twice
+	if c.backend.HasProposal(ev.proposal.Hash(), ev.proposal.Number()) {
+		c.NewLogger("func", "handleCommitRetry").Info("Proposal reached the chain despite the failed commit, not retrying", "number", ev.proposal.Number(), "hash", ev.proposal.Hash())
+		c.proposalCommitted(ev.proposal, ev.bitmap, ev.aggregatedSeal)
+		return
+	}
+	c.tryCommitProposal(ev.proposal, ev.bitmap, ev.aggregatedSeal, ev.attempt)
+}
+
+// proposalCommitted records the proposal committed by the backend and notifies the subscribers of
+// the committed feed.
+func (c *core) proposalCommitted(proposal istanbul.Proposal, bitmap *big.Int, aggregatedSeal []byte) {
+	c.recordCommitSigners(proposal, bitmap)
+	c.lastCommittedMu.Lock()
+	c.lastCommittedProposal = proposal
+	c.lastCommittedView = c.currentView()
+	c.lastCommittedBitmap = bitmap
+	c.lastCommittedValSet = c.valSet
+	c.lastCommittedMu.Unlock()
+	c.committedFeed.Send(istanbul.CommittedEvent{
+		Proposal:       proposal,
+		Bitmap:         bitmap,
+		AggregatedSeal: aggregatedSeal,
+		View:           c.currentView(),
+	})
+}
+
+// chainHeadAdvanced records a chain head that was committed without this node's consensus, e.g.
+// imported by the downloader, as the latest finalized proposal. Its view, committers and validator
+// set are unknown to the core.
+func (c *core) chainHeadAdvanced(head istanbul.Proposal) {
+	c.lastCommittedMu.Lock()
+	defer c.lastCommittedMu.Unlock()
+	if c.lastCommittedProposal != nil && head.Number().Cmp(c.lastCommittedProposal.Number()) <= 0 {
+		return
+	}
+	c.lastCommittedProposal = head
+	c.lastCommittedView = nil
+	c.lastCommittedBitmap = nil
+	c.lastCommittedValSet = nil
+}
+
+// runPeriodically calls fn every interval of the core's clock until stop is closed.
+func (c *core) runPeriodically(interval time.Duration, stop chan struct{}, fn func()) {
+	for {
+		due := make(chan struct{})
+		timer := c.clock.AfterFunc(interval, func() { close(due) })
+		select {
+		case <-stop:
+			timer.Stop()
 			return
+		case <-due:
+			fn()
 		}
 	}
 }
 
+func (c *core) setCatchingUp(catchingUp bool) {
+	c.catchingUpMu.Lock()
+	defer c.catchingUpMu.Unlock()
+	c.catchingUp = catchingUp
+}
+
+// IsCatchingUp implements core.Engine.IsCatchingUp
+func (c *core) IsCatchingUp() bool {
+	c.catchingUpMu.RLock()
+	defer c.catchingUpMu.RUnlock()
+	return c.catchingUp
+}
+
+// ValidatorSetForView implements core.Engine.ValidatorSetForView
+func (c *core) ValidatorSetForView(view *istanbul.View) ([]common.Address, common.Address, error) {
+	c.roundStateMu.RLock()
+	defer c.roundStateMu.RUnlock()
+	return c.validatorSetForView(view)
+}
+
+// validatorSetForView returns the ordered validators and the proposer of the given view of the
+// current sequence. It's only called from the handler goroutine, or with roundStateMu held.
+func (c *core) validatorSetForView(view *istanbul.View) ([]common.Address, common.Address, error) {
+	if c.current == nil || c.valSet == nil {
+		return nil, common.Address{}, istanbul.ErrStoppedEngine
+	}
+	if view.Sequence.Cmp(c.current.Sequence()) != 0 {
+		return nil, common.Address{}, errNotCurrentSequence
+	}
+	if !view.Round.IsUint64() {
+		return nil, common.Address{}, errInvalidMessage
+	}
+
+	// Compute the proposer on a copy so as not to change the proposer of the current round
+	valSet := c.valSet.Copy()
+	_, lastProposer := c.backend.LastProposal()
+	valSet.CalcProposer(lastProposer, view.Round.Uint64())
+
+	validators := valSet.List()
+	addresses := make([]common.Address, len(validators))
+	for i, val := range validators {
+		addresses[i] = val.Address()
+	}
+	return addresses, valSet.GetProposer().Address(), nil
+}
+
+// Health implements core.Engine.Health
+func (c *core) Health() HealthInfo {
+	c.roundStateMu.RLock()
+	defer c.roundStateMu.RUnlock()
+
+	if c.current == nil {
+		return HealthInfo{State: c.state.String()}
+	}
+	info := HealthInfo{
+		State:        c.state.String(),
+		Sequence:     new(big.Int).Set(c.current.Sequence()),
+		Round:        new(big.Int).Set(c.current.Round()),
+		DesiredRound: new(big.Int).Set(c.current.DesiredRound()),
+		IsProposer:   c.isProposer(),
+	}
+	info.RoundChangeInProgress = c.state == StateWaitingForNewRound || info.DesiredRound.Cmp(info.Round) > 0
+	info.RoundGap = c.roundGap()
+
+	c.lastCommitTimeMu.RLock()
+	defer c.lastCommitTimeMu.RUnlock()
+	if !c.lastCommitTime.IsZero() {
+		since := uint64(c.clock.Now().Sub(c.lastCommitTime) / time.Second)
+		info.SecondsSinceLastCommit = &since
+	}
+	return info
+}
+
+// LatestFinalized implements core.Engine.LatestFinalized
+func (c *core) LatestFinalized() (istanbul.Proposal, *istanbul.View) {
+	c.lastCommittedMu.RLock()
+	defer c.lastCommittedMu.RUnlock()
+	return c.lastCommittedProposal, c.lastCommittedView
+}
+
+// LastRoundChange implements core.Engine.LastRoundChange
+func (c *core) LastRoundChange() *RoundChangeInfo {
+	c.lastRoundChangeMu.RLock()
+	defer c.lastRoundChangeMu.RUnlock()
+	return c.lastRoundChange
+}
+
+// DidParticipate implements core.Engine.DidParticipate
+func (c *core) DidParticipate(addr common.Address) (bool, error) {
+	c.lastCommittedMu.RLock()
+	defer c.lastCommittedMu.RUnlock()
+
+	if c.lastCommittedBitmap == nil || c.lastCommittedValSet == nil {
+		return false, errNoCommittedProposal
+	}
+	index, val := c.lastCommittedValSet.GetByAddress(addr)
+	if val == nil {
+		return false, errNotInCommittedValidatorSet
+	}
+	return c.lastCommittedBitmap.Bit(index) == 1, nil
+}
+
+// MissingFromLastCommit implements core.Engine.MissingFromLastCommit
+func (c *core) MissingFromLastCommit() ([]common.Address, error) {
+	c.lastCommittedMu.RLock()
+	defer c.lastCommittedMu.RUnlock()
+
+	if c.lastCommittedBitmap == nil || c.lastCommittedValSet == nil {
+		return nil, errNoCommittedProposal
+	}
+	missing := []common.Address{}
+	for i, val := range c.lastCommittedValSet.List() {
+		if c.lastCommittedBitmap.Bit(i) == 0 {
+			missing = append(missing, val.Address())
+		}
+	}
+	return missing, nil
+}
+
+// recordCommitSigners records how many validators contributed to the aggregated seal of a committed
+// proposal compared to the quorum size, as blocks committed with a bare quorum indicate fragile liveness.
+func (c *core) recordCommitSigners(proposal istanbul.Proposal, bitmap *big.Int) {
+	signers := 0
+	for _, word := range bitmap.Bits() {
+		signers += bits.OnesCount(uint(word))
+	}
+	quorumSize := c.valSet.MinQuorumSize()
+	c.commitSignersGauge.Update(int64(signers))
+	c.commitQuorumSizeGauge.Update(int64(quorumSize))
+	c.commitValSetSizeGauge.Update(int64(c.valSet.Size()))
+	if signers <= quorumSize {
+		c.bareQuorumCommitCounter.Inc(1)
+	}
+	c.NewLogger("func", "recordCommitSigners").Debug("Committed proposal", "number", proposal.Number(), "hash", proposal.Hash(), "signers", signers, "quorum_size", quorumSize, "valset_size", c.valSet.Size(), "bitmap", hexutil.EncodeBig(bitmap))
+}
+
+// isSoleValidator returns whether this node is the only validator, in which case quorum
+// is trivially met and there is no need to exchange any consensus messages.
+func (c *core) isSoleValidator() bool {
+	return c.valSet != nil && c.valSet.Size() == 1 && c.isProposer()
+}
+
+// commitAsSoleValidator commits the request immediately, skipping the PREPREPARE, PREPARE and COMMIT phases.
+func (c *core) commitAsSoleValidator(request *istanbul.Request) {
+	logger := c.NewLogger("func", "commitAsSoleValidator")
+
+	if c.current == nil || c.valSet == nil {
+		logger.Warn("Cannot commit before the round state is initialized")
+		return
+	}
+	proposal := request.Proposal
+	if c.current.Sequence().Cmp(proposal.Number()) != 0 {
+		return
+	}
+	committedSeal, err := c.generateCommittedSeal(proposal.Hash())
+	if err != nil {
+		logger.Error("Failed to generate committed seal", "err", err)
+		return
+	}
+	i, _ := c.valSet.GetByAddress(c.address)
+	bitmap := new(big.Int).SetBit(big.NewInt(0), i, 1)
+	asig, err := blscrypto.AggregateSignatures([][]byte{committedSeal})
+	if err != nil {
+		logger.Error("Failed to aggregate committed seal", "err", err)
+		return
+	}
+
+	logger.Trace("Committing proposal as the sole validator", "number", proposal.Number(), "hash", proposal.Hash())
+	c.acceptPreprepare(&istanbul.Preprepare{
+		View:     c.currentView(),
+		Proposal: proposal,
+	})
+	c.setState(StateCommitted)
+	c.commitProposal(proposal, bitmap, asig)
+}
+
 // Generates the next preprepare request and associated round change certificate
 func (c *core) getPreprepareWithRoundChangeCertificate(round *big.Int) (*istanbul.Request, istanbul.RoundChangeCertificate, error) {
 	roundChangeCertificate, err := c.roundChangeSet.getCertificate(round, c.valSet.MinQuorumSize())
@@ -216,21 +816,37 @@ func (c *core) getPreprepareWithRoundChangeCertificate(round *big.Int) (*istanbu
 	request := c.current.pendingRequest
 	// Search for a valid request in round change messages.
 	// The proposal must come from the prepared certificate with the highest round number.
-	// All pre-prepared certificates from the same round are assumed to be the same proposal or no proposal (guaranteed by quorum intersection)
+	// All pre-prepared certificates from the same round must be for the same proposal or no proposal (guaranteed by quorum intersection),
+	// anything else is a safety violation.
 	maxRound := big.NewInt(-1)
+	conflicting := false
 	for _, message := range roundChangeCertificate.RoundChangeMessages {
 		var roundChangeMsg *istanbul.RoundChange
 		if err := message.Decode(&roundChangeMsg); err != nil {
 			continue
 		}
+		// Reject messages for other sequences so that round changes can't be replayed across sequences
+		if roundChangeMsg.View == nil || roundChangeMsg.View.Sequence == nil || roundChangeMsg.View.Sequence.Cmp(c.current.Sequence()) != 0 {
+			return &istanbul.Request{}, istanbul.RoundChangeCertificate{}, errInvalidRoundChangeCertificateSequence
+		}
 		preparedCertificateView := roundChangeMsg.PreparedCertificate.View()
-		if roundChangeMsg.HasPreparedCertificate() && preparedCertificateView != nil && preparedCertificateView.Round.Cmp(maxRound) > 0 {
+		if !roundChangeMsg.HasPreparedCertificate() || preparedCertificateView == nil {
+			continue
+		}
+		if cmp := preparedCertificateView.Round.Cmp(maxRound); cmp > 0 {
 			maxRound = preparedCertificateView.Round
 			request = &istanbul.Request{
 				Proposal: roundChangeMsg.PreparedCertificate.Proposal,
 			}
+			conflicting = false
+		} else if cmp == 0 && roundChangeMsg.PreparedCertificate.Proposal.Hash() != request.Proposal.Hash() {
+			c.NewLogger("func", "getPreprepareWithRoundChangeCertificate").Error("Conflicting prepared certificates in round change certificate", "prepared_round", maxRound, "hash", request.Proposal.Hash(), "other_hash", roundChangeMsg.PreparedCertificate.Proposal.Hash(), "from", message.Address)
+			conflicting = true
 		}
 	}
+	if conflicting {
+		return &istanbul.Request{}, istanbul.RoundChangeCertificate{}, errConflictingPreparedCertificates
+	}
 	return request, roundChangeCertificate, nil
 }
 
@@ -240,21 +856,38 @@ func (c *core) startNewRound(round *big.Int) {
 	if c.current == nil {
 		logger = c.logger.New("cur_round", -1, "cur_seq", 0, "next_round", 0, "next_seq", 0, "func", "startNewRound", "tag", "stateTransition")
 	} else {
-		logger = c.logger.New("cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "startNewRound", "tag", "stateTransition")
+		logger = c.NewLogger("func", "startNewRound", "tag", "stateTransition")
 	}
 
 	roundChange := false
 	// Try to get last proposal
 	lastProposal, lastProposer := c.backend.LastProposal()
+	if lastProposal == nil {
+		logger.Error("No last proposal to start the round from, retrying", "new_round", round, "retry_in", startRoundRetryDelay)
+		c.newStartRoundRetryTimer(round)
+		return
+	}
+	c.stopStartRoundRetryTimer()
 	if c.current == nil {
 		logger.Trace("Start the initial round")
 	} else if lastProposal.Number().Cmp(c.current.Sequence()) >= 0 {
 		// Want to be working on the block 1 beyond the last committed block.
 		diff := new(big.Int).Sub(lastProposal.Number(), c.current.Sequence())
 		c.sequenceMeter.Mark(new(big.Int).Add(diff, common.Big1).Int64())
+		// Blocks beyond our sequence were committed without us, e.g. imported by the downloader
+		c.setCatchingUp(diff.Sign() > 0)
+		c.chainHeadAdvanced(lastProposal)
+		c.lastCommitTimeMu.Lock()
+		c.lastCommitTime = c.clock.Now()
+		c.lastCommitTimeMu.Unlock()
+		c.roundHistory.add(roundHistoryEntry{
+			sequence: c.current.Sequence().Uint64(),
+			round:    c.current.Round().Uint64(),
+			time:     c.clock.Now(),
+		})
 
 		if !c.consensusTimestamp.IsZero() {
-			c.consensusTimer.UpdateSince(c.consensusTimestamp)
+			c.consensusTimer.Update(c.clock.Now().Sub(c.consensusTimestamp))
 			c.consensusTimestamp = time.Time{}
 		}
 		logger.Trace("Catch up to the latest proposal.", "number", lastProposal.Number().Uint64(), "hash", lastProposal.Hash())
@@ -269,7 +902,10 @@ func (c *core) startNewRound(round *big.Int) {
 		}
 		roundChange = true
 	} else {
-		logger.Warn("New sequence should be larger than current sequence", "new_seq", lastProposal.Number().Int64())
+		// The last proposal is behind the sequence we're working on, which may indicate a reorg or a chain sync problem
+		behind := new(big.Int).Sub(new(big.Int).Sub(c.current.Sequence(), common.Big1), lastProposal.Number())
+		c.sequenceBehindCounter.Inc(1)
+		logger.Warn("New sequence should be larger than current sequence", "new_seq", lastProposal.Number().Int64(), "behind", behind)
 		return
 	}
 
@@ -290,37 +926,82 @@ func (c *core) startNewRound(round *big.Int) {
 			return
 		}
 	} else {
+		if err := c.swapValidatorSet(c.backend.Validators(lastProposal)); err != nil {
+			logger.Error("Invalid validator set for the new sequence, retrying", "err", err, "number", lastProposal.Number(), "retry_in", startRoundRetryDelay)
+			c.newStartRoundRetryTimer(round)
+			return
+		}
+		c.handleEarlyMessages()
 		if c.current != nil {
 			request = c.current.pendingRequest
-			c.deleteMessageFromDisk(c.current.Round(), c.current.Sequence())
+			if err := c.messageStore.Delete(c.currentView()); err != nil {
+				logger.Error("Failed to delete the messages of the previous round", "err", err)
+			}
 		}
 		newView = &istanbul.View{
 			Sequence: new(big.Int).Add(lastProposal.Number(), common.Big1),
 			Round:    new(big.Int),
 		}
-		c.valSet = c.backend.Validators(lastProposal)
+		c.verifiedProposals.Purge()
+		c.verifiedSignatures.Purge()
+		c.inconsistentSubjects = make(map[subjectSender]uint64)
+		c.oldRoundMessages = make(map[uint64]*messageSet)
+		if epoch := istanbul.GetEpochNumber(newView.Sequence.Uint64(), c.config.Epoch); epoch != c.blockPeriodEpoch {
+			c.updateBlockPeriod(newView.Sequence.Uint64(), epoch)
+		}
+	}
+	if c.startSequence == nil {
+		c.startSequence = new(big.Int).Set(newView.Sequence)
 	}
 
 	// Update logger
 	logger = logger.New("old_proposer", c.valSet.GetProposer())
 	// Clear invalid ROUND CHANGE messages
-	c.roundChangeSet = newRoundChangeSet(c.valSet)
+	c.roundChangeSet = newRoundChangeSet(c.valSet, c.clock, c.roundChangeFormationTimer, c.config.MaxRoundChangeMessages)
 	// New snapshot for new round
 	c.updateRoundState(newView, c.valSet, roundChange)
+	if !roundChange {
+		// A new sequence starts at round 0, whatever round we were waiting for in the previous one
+		c.current.SetDesiredRound(common.Big0)
+	}
+	c.roundGapGauge.Update(int64(c.roundGap()))
+	if err := c.saveRoundStateToDisk(); err != nil {
+		logger.Error("Failed to write round state to the disk", "err", err)
+	}
 	// Calculate new proposer
 	c.valSet.CalcProposer(lastProposer, newView.Round.Uint64())
 	c.setState(StateAcceptRequest)
-	if roundChange && c.isProposer() && c.current != nil && request != nil {
-		c.sendPreprepare(request, roundChangeCertificate)
-	}
 	c.newRoundChangeTimer()
+	if c.isProposer() && c.proposerWarmingUp() {
+		logger.Info("Relinquishing proposer turn during warmup", "start_seq", c.startSequence, "warmup_blocks", c.config.ProposerWarmupBlocks)
+		c.sendNextRoundChange(RoundChangeProposerWarmup)
+	} else {
+		c.newProposerSelfCheckTimer()
+		if roundChange && c.isProposer() && c.current != nil && request != nil {
+			c.sendPreprepare(request, roundChangeCertificate)
+		}
+	}
 
-	logger.Debug("New round", "new_round", newView.Round, "new_seq", newView.Sequence, "new_proposer", c.valSet.GetProposer(), "valSet", c.valSet.List(), "size", c.valSet.Size(), "isProposer", c.isProposer())
+	// The validator list is only built if the record also passes the log handler's filters
+	logger.Debug("New round", "new_round", newView.Round, "new_seq", newView.Sequence, "new_proposer", c.valSet.GetProposer(), "valSet", log.Lazy{Fn: c.valSet.List}, "size", c.valSet.Size(), "isProposer", c.isProposer())
+}
+
+// roundGap returns how many rounds the desired round is ahead of the current round, i.e. how far
+// the node is trying to jump. A large or growing gap means it can't gather a round change quorum.
+func (c *core) roundGap() uint64 {
+	if c.current == nil {
+		return 0
+	}
+	gap := new(big.Int).Sub(c.current.DesiredRound(), c.current.Round())
+	if gap.Sign() <= 0 {
+		return 0
+	}
+	return gap.Uint64()
 }
 
 // All actions that occur when transitioning to waiting for round change state.
-func (c *core) waitForDesiredRound(r *big.Int) {
-	logger := c.logger.New("func", "waitForDesiredRound", "cur_round", c.current.Round(), "old_desired_round", c.current.DesiredRound(), "new_desired_round", r)
+func (c *core) waitForDesiredRound(r *big.Int, reason RoundChangeReason) {
+	logger := c.NewLogger("func", "waitForDesiredRound", "new_desired_round", r)
 	// Don't wait for an older round
 	if c.current.DesiredRound().Cmp(r) >= 0 {
 		logger.Debug("New desired round not greater than current desired round")
@@ -335,15 +1016,75 @@ func (c *core) waitForDesiredRound(r *big.Int) {
 	// Perform all of the updates
 	c.setState(StateWaitingForNewRound)
 	c.current.SetDesiredRound(r)
+	c.roundGapGauge.Update(int64(c.roundGap()))
 	_, lastProposer := c.backend.LastProposal()
+	oldProposer := c.valSet.GetProposer()
 	c.valSet.CalcProposer(lastProposer, desiredView.Round.Uint64())
+	newProposer := c.valSet.GetProposer()
+	if oldProposer != nil && newProposer != nil && oldProposer.Address() == newProposer.Address() {
+		c.sameProposerRoundChangeCounter.Inc(1)
+	}
+	logger.Debug("Calculated proposer for desired round", "old_proposer", oldProposer, "new_proposer", newProposer)
 	c.newRoundChangeTimerForView(desiredView)
 
 	// Send round change
-	c.sendRoundChange(desiredView.Round)
+	c.sendRoundChange(desiredView.Round, reason)
+}
+
+// swapValidatorSet replaces the validator set with the given one, which must be non-empty with a
+// quorum it can reach. The backlogged and queued messages of the validators in both sets are kept
+// for their validator in the new set, those of the removed validators are discarded.
+func (c *core) swapValidatorSet(newSet istanbul.ValidatorSet) error {
+	if newSet == nil || newSet.Size() == 0 {
+		return errEmptyValidatorSet
+	}
+	if quorum := newSet.MinQuorumSize(); quorum <= 0 || quorum > newSet.Size() {
+		return errInvalidQuorumSize
+	}
+
+	removed := 0
+	c.backlogsMu.Lock()
+	backlogs := make(map[istanbul.Validator]*prque.Prque, len(c.backlogs))
+	for src, backlog := range c.backlogs {
+		if _, val := newSet.GetByAddress(src.Address()); val != nil {
+			backlogs[val] = backlog
+		} else if backlog != nil {
+			removed += backlog.Size()
+		}
+	}
+	c.backlogs = backlogs
+	// The locks move along with the backlogs, so that a worker still reprocessing a validator's
+	// backlog under its old key keeps the next one waiting
+	backlogLocks := make(map[istanbul.Validator]*sync.Mutex, len(c.backlogLocks))
+	for src, lock := range c.backlogLocks {
+		if _, val := newSet.GetByAddress(src.Address()); val != nil {
+			backlogLocks[val] = lock
+		}
+	}
+	c.backlogLocks = backlogLocks
+	c.backlogsMu.Unlock()
+
+	pendingCommitSeals := c.pendingCommitSeals[:0]
+	for _, pending := range c.pendingCommitSeals {
+		if _, val := newSet.GetByAddress(pending.msg.Address); val != nil {
+			pending.validator = val
+			pendingCommitSeals = append(pendingCommitSeals, pending)
+		} else {
+			removed++
+		}
+	}
+	c.pendingCommitSeals = pendingCommitSeals
+
+	if removed > 0 {
+		c.NewLogger("func", "swapValidatorSet").Debug("Discarded the pending messages of removed validators", "count", removed)
+	}
+	c.valSet = newSet
+	return nil
 }
 
 func (c *core) updateRoundState(view *istanbul.View, validatorSet istanbul.ValidatorSet, roundChange bool) {
+	// A preprepare still being assembled is for the view we leave
+	c.cancelProposalAssembly()
 	// TODO(Joshua): Include desired round here.
 	if roundChange && c.current != nil {
 		c.current = newRoundState(view, validatorSet, nil, c.current.pendingRequest, c.current.preparedCertificate, c.backend.HasBadProposal)
@@ -372,8 +1113,63 @@ func (c *core) stopFuturePreprepareTimer() {
 	}
 }
 
+func (c *core) stopEmptyBlockTimer() {
+	if c.emptyBlockTimer != nil {
+		c.emptyBlockTimer.Stop()
+	}
+}
+
+func (c *core) stopProposerSelfCheckTimer() {
+	if c.proposerSelfCheckTimer != nil {
+		c.proposerSelfCheckTimer.Stop()
+	}
+}
+
+func (c *core) stopPreprepareResendTimer() {
+	if c.preprepareResendTimer != nil {
+		c.preprepareResendTimer.Stop()
+	}
+}
+
+func (c *core) stopCommitRetryTimer() {
+	if c.commitRetryTimer != nil {
+		c.commitRetryTimer.Stop()
+	}
+}
+
+func (c *core) stopCommitBroadcastTimer() {
+	if c.commitBroadcastTimer != nil {
+		c.commitBroadcastTimer.Stop()
+	}
+}
+
+func (c *core) newStartRoundRetryTimer(round *big.Int) {
+	c.stopStartRoundRetryTimer()
+	round = new(big.Int).Set(round)
+	c.startRoundRetryTimer = c.clock.AfterFunc(startRoundRetryDelay, func() {
+		c.sendEvent(startRoundRetryEvent{round})
+	})
+}
+
+func (c *core) stopStartRoundRetryTimer() {
+	if c.startRoundRetryTimer != nil {
+		c.startRoundRetryTimer.Stop()
+	}
+}
+
+func (c *core) stopCommitSealBatchTimer() {
+	if c.commitSealBatchTimer != nil {
+		c.commitSealBatchTimer.Stop()
+	}
+}
+
 func (c *core) stopTimer() {
 	c.stopFuturePreprepareTimer()
+	c.stopEmptyBlockTimer()
+	c.stopProposerSelfCheckTimer()
+	c.stopPreprepareResendTimer()
+	c.stopCommitRetryTimer()
+	c.stopCommitBroadcastTimer()
 	if c.roundChangeTimer != nil {
 		c.roundChangeTimer.Stop()
 	}
@@ -386,25 +1182,243 @@ func (c *core) newRoundChangeTimer() {
 func (c *core) newRoundChangeTimerForView(view *istanbul.View) {
 	c.stopTimer()
 
-	timeout := time.Duration(c.config.RequestTimeout) * time.Millisecond
-	round := view.Round.Uint64()
+	if c.roundChangeGraceApplies(view) {
+		c.roundChangeGraceView = &istanbul.View{
+			Sequence: new(big.Int).Set(view.Sequence),
+			Round:    new(big.Int).Set(view.Round),
+		}
+	}
+	c.roundChangeTimer = c.clock.AfterFunc(c.roundChangeTimerTimeout(view), func() {
+		c.sendEvent(timeoutEvent{view})
+	})
+}
+
+// CurrentRoundTimeout implements core.Engine.CurrentRoundTimeout
+func (c *core) CurrentRoundTimeout() time.Duration {
+	c.roundStateMu.RLock()
+	defer c.roundStateMu.RUnlock()
+
+	if c.current == nil {
+		return 0
+	}
+	return c.roundChangeTimerTimeout(c.currentView())
+}
+
+// roundChangeGraceApplies returns whether the round change timer for the given view gets the
+// grace multiplier. Only the first round entered through a round change in a sequence does,
+// later rounds of the sequence fall back to the normal backoff.
+func (c *core) roundChangeGraceApplies(view *istanbul.View) bool {
+	if m := c.config.RoundChangeGraceMultiplier; m <= 0 || m == 1 || view.Round.Sign() == 0 {
+		return false
+	}
+	grace := c.roundChangeGraceView
+	return grace == nil || grace.Sequence.Cmp(view.Sequence) != 0 || grace.Round.Cmp(view.Round) == 0
+}
+
+// roundChangeTimerTimeout returns the timeout of the round change timer for the given view,
+// including the grace multiplier if the view got it.
+func (c *core) roundChangeTimerTimeout(view *istanbul.View) time.Duration {
+	timeout := c.roundChangeTimeout(view)
+	if c.roundChangeGraceView != nil && c.roundChangeGraceView.Cmp(view) == 0 {
+		timeout = scaleTimeout(timeout, c.config.RoundChangeGraceMultiplier)
+	}
+	return timeout
+}
+
+// roundChangeTimeout returns how long to wait in the given view before sending a round change.
+func (c *core) roundChangeTimeout(view *istanbul.View) time.Duration {
+	blockPeriod := c.effectiveBlockPeriod()
+	round := uint64(maxTimeoutRound)
+	if view.Round.IsUint64() {
+		round = view.Round.Uint64()
+	}
+	timeout := roundTimeout(c.config, blockPeriod, round)
+	if view.Round.Cmp(common.Big0) == 0 && c.emptyBlockPeriodApplies() {
+		// the proposer may hold back an empty block until EmptyBlockPeriod has passed
+		timeout = addSeconds(timeout, c.config.EmptyBlockPeriod-blockPeriod)
+	}
+	return timeout
+}
+
+// newProposerSelfCheckTimer starts the proposer self-check for the current round if it's enabled
+// and we are the proposer.
+func (c *core) newProposerSelfCheckTimer() {
+	c.stopProposerSelfCheckTimer()
+	if c.config.ProposerSelfCheckPercent == 0 || !c.isProposer() {
+		return
+	}
+
+	period := c.effectiveBlockPeriod()
+	if c.emptyBlockPeriodApplies() {
+		period = c.config.EmptyBlockPeriod
+	}
+	timeout := time.Duration(period) * time.Second * time.Duration(c.config.ProposerSelfCheckPercent) / 100
+	view := c.currentView()
+	c.proposerSelfCheckTimer = c.clock.AfterFunc(timeout, func() {
+		c.sendEvent(proposerSelfCheckEvent{view})
+	})
+}
+
+// newPreprepareResendTimer starts the timer to re-broadcast the preprepare we sent for the current
+// round if it's enabled.
+func (c *core) newPreprepareResendTimer() {
+	c.stopPreprepareResendTimer()
+	if c.config.PreprepareResendPercent == 0 {
+		return
+	}
+
+	view := c.currentView()
+	timeout := c.roundChangeTimerTimeout(view) / 100 * time.Duration(c.config.PreprepareResendPercent)
+	c.preprepareResendTimer = c.clock.AfterFunc(timeout, func() {
+		c.sendEvent(preprepareResendEvent{view})
+	})
+}
+
+// updateBlockPeriod reads the block period for the epoch of the given sequence from the chain,
+// falling back to the configured BlockPeriod if the chain doesn't provide one.
+func (c *core) updateBlockPeriod(sequence uint64, epoch uint64) {
+	blockPeriod, err := c.backend.BlockPeriod(sequence)
+	if err != nil {
+		c.logger.Debug("Using configured block period", "epoch", epoch, "block_period", c.config.BlockPeriod, "err", err)
+		blockPeriod = c.config.BlockPeriod
+	} else if blockPeriod != c.config.BlockPeriod {
+		c.logger.Info("Using block period set on chain", "epoch", epoch, "block_period", blockPeriod, "configured", c.config.BlockPeriod)
+	}
+	c.blockPeriod = blockPeriod
+	c.blockPeriodEpoch = epoch
+}
+
+// effectiveBlockPeriod returns the block period in effect for the current epoch.
+func (c *core) effectiveBlockPeriod() uint64 {
+	if c.blockPeriodEpoch == 0 {
+		return c.config.BlockPeriod
+	}
+	return c.blockPeriod
+}
+
+// roundTimeout returns how long to wait in the given round before sending a round change, which
+// is at most maxRoundTimeout.
+func roundTimeout(config *istanbul.Config, blockPeriod uint64, round uint64) time.Duration {
+	timeout := maxRoundTimeout
+	if config.RequestTimeout < uint64(maxRoundTimeout/time.Millisecond) {
+		timeout = time.Duration(config.RequestTimeout) * time.Millisecond
+	}
 	if round == 0 {
 		// timeout for first round takes into account expected block period
-		timeout += time.Duration(c.config.BlockPeriod) * time.Second
-	} else {
+		return addSeconds(timeout, blockPeriod)
+	}
+	if round > maxTimeoutRound {
+		round = maxTimeoutRound
+	}
+
+	switch config.TimeoutBackoffPolicy {
+	case istanbul.LinearBackoff:
+		// timeout for subsequent rounds adds a fixed increment per round
+		hi, increment := bits.Mul64(round, config.TimeoutBackoffIncrement)
+		if hi != 0 {
+			return maxRoundTimeout
+		}
+		return addSeconds(timeout, increment)
+	default:
 		// timeout for subsequent rounds adds an exponential backup, capped at 2**5 = 32s
-		timeout += time.Duration(math.Pow(2, math.Min(float64(round), 5.))) * time.Second
+		return addSeconds(timeout, uint64(math.Pow(2, math.Min(float64(round), 5.))))
 	}
+}
 
-	c.roundChangeTimer = time.AfterFunc(timeout, func() {
-		c.sendEvent(timeoutEvent{view})
-	})
+// addSeconds adds the given number of seconds to the timeout, saturating at maxRoundTimeout.
+func addSeconds(timeout time.Duration, seconds uint64) time.Duration {
+	if seconds > uint64((maxRoundTimeout-timeout)/time.Second) {
+		return maxRoundTimeout
+	}
+	return timeout + time.Duration(seconds)*time.Second
+}
+
+// scaleTimeout multiplies the timeout by the given factor, saturating at maxRoundTimeout.
+func scaleTimeout(timeout time.Duration, factor float64) time.Duration {
+	scaled := float64(timeout) * factor
+	if scaled >= float64(maxRoundTimeout) {
+		return maxRoundTimeout
+	}
+	return time.Duration(scaled)
+}
+
+// proposerWarmingUp returns true if the current sequence is within the first
+// ProposerWarmupBlocks sequences since startup. A sole validator never warms up, as
+// nobody else could propose in its place.
+func (c *core) proposerWarmingUp() bool {
+	if c.config.ProposerWarmupBlocks == 0 || c.startSequence == nil || c.isSoleValidator() {
+		return false
+	}
+	warmupEnd := new(big.Int).Add(c.startSequence, new(big.Int).SetUint64(c.config.ProposerWarmupBlocks))
+	return c.current.Sequence().Cmp(warmupEnd) < 0
+}
+
+// emptyBlockPeriodApplies returns true if EmptyBlockPeriod is enabled and the last committed
+// block was empty.
+func (c *core) emptyBlockPeriodApplies() bool {
+	if c.config.EmptyBlockPeriod <= c.effectiveBlockPeriod() {
+		return false
+	}
+	lastProposal, _ := c.backend.LastProposal()
+	parent, ok := lastProposal.(*types.Block)
+	return ok && len(parent.Transactions()) == 0
+}
+
+// emptyBlockDelay returns how long the proposer should wait before proposing the given block.
+// This is only non-zero for an empty block on top of an empty parent, which is held back until
+// EmptyBlockPeriod seconds after the parent's timestamp.
+func (c *core) emptyBlockDelay(proposal istanbul.Proposal) time.Duration {
+	block, ok := proposal.(*types.Block)
+	if !ok || len(block.Transactions()) != 0 || !c.emptyBlockPeriodApplies() {
+		return 0
+	}
+	lastProposal, _ := c.backend.LastProposal()
+	parent := lastProposal.(*types.Block)
+	if new(big.Int).Add(parent.Number(), common.Big1).Cmp(block.Number()) != 0 {
+		return 0
+	}
+	proposeAt := time.Unix(new(big.Int).Add(parent.Time(), new(big.Int).SetUint64(c.config.EmptyBlockPeriod)).Int64(), 0)
+	return proposeAt.Sub(c.clock.Now())
+}
+
+// verifyProposal verifies the proposal with the backend, unless a proposal with the same hash
+// was already verified in the current sequence.
+func (c *core) verifyProposal(proposal istanbul.Proposal) (time.Duration, error) {
+	if c.verifiedProposals.Contains(proposal.Hash()) {
+		return 0, nil
+	}
+	duration, err := c.backend.Verify(proposal)
+	if err == nil {
+		c.verifiedProposals.Add(proposal.Hash(), true)
+	}
+	return duration, err
 }
 
 func (c *core) checkValidatorSignature(data []byte, sig []byte) (common.Address, error) {
 	return istanbul.CheckValidatorSignature(c.valSet, data, sig)
 }
 
+// signatureCacheKey identifies a signed message by the hash of its payload and its claimed signer.
+type signatureCacheKey struct {
+	payloadHash common.Hash
+	signer      common.Address
+}
+
+// checkCachedMessageSignature returns the validator that signed the message with the given
+// payload, skipping the signature recovery if the same signature was already verified in the
+// current sequence.
+func (c *core) checkCachedMessageSignature(data []byte, message *istanbul.Message) (common.Address, error) {
+	key := signatureCacheKey{payloadHash: crypto.Keccak256Hash(data), signer: message.Address}
+	if sig, ok := c.verifiedSignatures.Get(key); ok && bytes.Equal(sig.([]byte), message.Signature) {
+		return message.Address, nil
+	}
+	signer, err := c.validateFn(data, message.Signature)
+	if err == nil && signer == message.Address {
+		c.verifiedSignatures.Add(key, message.Signature)
+	}
+	return signer, err
+}
+
 // PrepareCommittedSeal returns a committed seal for the given hash
 func PrepareCommittedSeal(hash common.Hash) []byte {
 	var buf bytes.Buffer
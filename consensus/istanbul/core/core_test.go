@@ -17,14 +17,24 @@
 package core
 
 import (
+	"errors"
+	"io/ioutil"
+	"math"
 	"math/big"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/consensus/istanbul/validator"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	elog "github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 func makeBlock(number int64) *types.Block {
@@ -88,3 +98,1093 @@ func TestNewRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestRoundTimeout(t *testing.T) {
+	exponential := &istanbul.Config{
+		RequestTimeout:       3000,
+		BlockPeriod:          1,
+		TimeoutBackoffPolicy: istanbul.ExponentialBackoff,
+	}
+	linear := &istanbul.Config{
+		RequestTimeout:          3000,
+		BlockPeriod:             1,
+		TimeoutBackoffPolicy:    istanbul.LinearBackoff,
+		TimeoutBackoffIncrement: 3,
+	}
+
+	testCases := []struct {
+		round               uint64
+		expectedExponential time.Duration
+		expectedLinear      time.Duration
+	}{
+		{0, 4 * time.Second, 4 * time.Second},
+		{1, 5 * time.Second, 6 * time.Second},
+		{2, 7 * time.Second, 9 * time.Second},
+		{3, 11 * time.Second, 12 * time.Second},
+		{4, 19 * time.Second, 15 * time.Second},
+		{5, 35 * time.Second, 18 * time.Second},
+		{6, 35 * time.Second, 21 * time.Second},
+		{7, 35 * time.Second, 24 * time.Second},
+		{8, 35 * time.Second, 27 * time.Second},
+		{9, 35 * time.Second, 30 * time.Second},
+		{10, 35 * time.Second, 33 * time.Second},
+	}
+
+	for _, test := range testCases {
+		if timeout := roundTimeout(exponential, exponential.BlockPeriod, test.round); timeout != test.expectedExponential {
+			t.Errorf("exponential timeout mismatch for round %d: have %v, want %v", test.round, timeout, test.expectedExponential)
+		}
+		if timeout := roundTimeout(linear, linear.BlockPeriod, test.round); timeout != test.expectedLinear {
+			t.Errorf("linear timeout mismatch for round %d: have %v, want %v", test.round, timeout, test.expectedLinear)
+		}
+	}
+}
+
+func TestRoundTimeoutOverflow(t *testing.T) {
+	exponential := &istanbul.Config{
+		RequestTimeout:       3000,
+		BlockPeriod:          1,
+		TimeoutBackoffPolicy: istanbul.ExponentialBackoff,
+	}
+	linear := &istanbul.Config{
+		RequestTimeout:          3000,
+		BlockPeriod:             1,
+		TimeoutBackoffPolicy:    istanbul.LinearBackoff,
+		TimeoutBackoffIncrement: math.MaxUint64 / 2,
+	}
+	huge := &istanbul.Config{
+		RequestTimeout:       math.MaxUint64,
+		BlockPeriod:          math.MaxUint64,
+		TimeoutBackoffPolicy: istanbul.ExponentialBackoff,
+	}
+
+	testCases := []struct {
+		name   string
+		config *istanbul.Config
+		round  uint64
+		want   time.Duration
+	}{
+		{"exponential", exponential, math.MaxUint64, 35 * time.Second},
+		{"linear", linear, math.MaxUint64, maxRoundTimeout},
+		{"linear increment overflow", linear, 3, maxRoundTimeout},
+		{"huge request timeout", huge, math.MaxUint64, maxRoundTimeout},
+		{"huge block period", huge, 0, maxRoundTimeout},
+	}
+	for _, test := range testCases {
+		if timeout := roundTimeout(test.config, test.config.BlockPeriod, test.round); timeout != test.want {
+			t.Errorf("%s: timeout mismatch for round %d: have %v, want %v", test.name, test.round, timeout, test.want)
+		}
+	}
+
+	// Rounds beyond uint64 get the timeout of the largest round
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+	round := new(big.Int).Lsh(common.Big1, 70)
+	view := &istanbul.View{Round: round, Sequence: c.current.Sequence()}
+	if timeout := c.roundChangeTimeout(view); timeout != 35*time.Second {
+		t.Errorf("timeout mismatch for round %v: have %v, want %v", round, timeout, 35*time.Second)
+	}
+}
+
+func TestRoundChangeGraceMultiplier(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+	config := *c.config
+	config.RoundChangeGraceMultiplier = 2
+	c.config = &config
+	c.clock = newFakeClock()
+	defer c.stopTimer()
+
+	timerTimeout := func(seq, round int64) time.Duration {
+		view := &istanbul.View{Sequence: big.NewInt(seq), Round: big.NewInt(round)}
+		c.newRoundChangeTimerForView(view)
+		return c.roundChangeTimer.(*fakeTimer).when.Sub(c.clock.Now())
+	}
+	normal := func(round int64) time.Duration {
+		return c.roundChangeTimeout(&istanbul.View{Sequence: common.Big1, Round: big.NewInt(round)})
+	}
+
+	testCases := []struct {
+		name  string
+		seq   int64
+		round int64
+		want  time.Duration
+	}{
+		{"first round", 1, 0, normal(0)},
+		{"round after a round change", 1, 1, 2 * normal(1)},
+		{"same round timed again", 1, 1, 2 * normal(1)},
+		{"next round change", 1, 2, normal(2)},
+		{"round change in the next sequence", 2, 3, 2 * normal(3)},
+	}
+	for _, test := range testCases {
+		if timeout := timerTimeout(test.seq, test.round); timeout != test.want {
+			t.Errorf("%s: timeout mismatch: have %v, want %v", test.name, timeout, test.want)
+		}
+	}
+
+	// The default multiplier leaves the timeout unchanged
+	c.config.RoundChangeGraceMultiplier = istanbul.DefaultConfig.RoundChangeGraceMultiplier
+	if timeout := timerTimeout(3, 1); timeout != normal(1) {
+		t.Errorf("timeout mismatch with the default multiplier: have %v, want %v", timeout, normal(1))
+	}
+}
+
+func TestBlockPeriodFromChain(t *testing.T) {
+	testCases := []struct {
+		name           string
+		blockPeriod    uint64
+		blockPeriodErr error
+		want           uint64
+	}{
+		{"on-chain override", 5, nil, 5},
+		{"read fails", 5, errors.New("contract not deployed"), istanbul.DefaultConfig.BlockPeriod},
+		{"not set on chain", 0, nil, istanbul.DefaultConfig.BlockPeriod},
+	}
+
+	for _, test := range testCases {
+		sys := NewTestSystemWithBackend(4, 1)
+		closer := sys.Run(false)
+
+		backend := sys.backends[0]
+		backend.blockPeriod = test.blockPeriod
+		backend.blockPeriodErr = test.blockPeriodErr
+		c := backend.engine.(*core)
+		c.current = nil
+		c.startNewRound(common.Big0)
+
+		if blockPeriod := c.effectiveBlockPeriod(); blockPeriod != test.want {
+			t.Errorf("%s: block period mismatch: have %v, want %v", test.name, blockPeriod, test.want)
+		}
+		want := time.Duration(c.config.RequestTimeout)*time.Millisecond + time.Duration(test.want)*time.Second
+		if timeout := c.roundChangeTimeout(c.currentView()); timeout != want {
+			t.Errorf("%s: round change timeout mismatch: have %v, want %v", test.name, timeout, want)
+		}
+		c.stopTimer()
+		closer()
+	}
+}
+
+func TestCurrentRoundTimeout(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+
+	// RequestTimeout of 3s plus the block period of 1s
+	if timeout := c.CurrentRoundTimeout(); timeout != 4*time.Second {
+		t.Errorf("round 0 timeout mismatch: have %v, want %v", timeout, 4*time.Second)
+	}
+	// RequestTimeout of 3s plus an exponential backoff of 8s
+	c.current.SetRound(big.NewInt(3))
+	if timeout := c.CurrentRoundTimeout(); timeout != 11*time.Second {
+		t.Errorf("round 3 timeout mismatch: have %v, want %v", timeout, 11*time.Second)
+	}
+	if timeout, want := c.CurrentRoundTimeout(), c.roundChangeTimeout(c.currentView()); timeout != want {
+		t.Errorf("timeout differs from the round change timer: have %v, want %v", timeout, want)
+	}
+
+	c.current = nil
+	if timeout := c.CurrentRoundTimeout(); timeout != 0 {
+		t.Errorf("timeout before the round state is initialized: have %v, want 0", timeout)
+	}
+}
+
+func TestSoleValidatorCommitsWithoutMessages(t *testing.T) {
+	sys := NewTestSystemWithBackend(1, 0)
+
+	close := sys.Run(true)
+
+	sys.backends[0].NewRequest(makeBlock(1))
+
+	<-time.After(1 * time.Second)
+	// The backend records are written by the engine, so stop it before reading them
+	close()
+
+	backend := sys.backends[0]
+	if len(backend.committedMsgs) != 1 {
+		t.Fatalf("the number of executed requests mismatch: have %v, want 1", len(backend.committedMsgs))
+	}
+	if backend.committedMsgs[0].commitProposal.Number().Cmp(common.Big1) != 0 {
+		t.Errorf("committed proposal number mismatch: have %v, want 1", backend.committedMsgs[0].commitProposal.Number())
+	}
+	if backend.committedMsgs[0].bitmap.Cmp(common.Big1) != 0 {
+		t.Errorf("bitmap mismatch: have %v, want 1", backend.committedMsgs[0].bitmap)
+	}
+	if len(backend.sentMsgs) != 0 {
+		t.Errorf("the number of sent messages mismatch: have %v, want 0", len(backend.sentMsgs))
+	}
+}
+
+func TestBroadcastBeforeRoundState(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	backend := sys.backends[0]
+	c := backend.engine.(*core)
+	c.current = nil
+
+	c.broadcast(&istanbul.Message{Code: istanbul.MsgPrepare})
+	c.sendNextRoundChange(RoundChangeTimeout)
+	c.commit()
+	c.commitAsSoleValidator(&istanbul.Request{Proposal: makeBlock(1)})
+
+	c.valSet = nil
+	c.broadcast(&istanbul.Message{Code: istanbul.MsgPrepare})
+
+	if len(backend.sentMsgs) != 0 {
+		t.Errorf("sent messages mismatch: have %v, want %v", len(backend.sentMsgs), 0)
+	}
+	if len(backend.committedMsgs) != 0 {
+		t.Errorf("committed messages mismatch: have %v, want %v", len(backend.committedMsgs), 0)
+	}
+}
+
+func TestIsCatchingUp(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	backend := sys.backends[0]
+	c := backend.engine.(*core)
+	c.current = nil
+	c.startNewRound(common.Big0)
+	if c.IsCatchingUp() {
+		t.Errorf("catching up after the initial round")
+	}
+
+	// Blocks 1 to 5 are imported without us
+	for i := int64(1); i <= 5; i++ {
+		backend.committedMsgs = append(backend.committedMsgs, testCommittedMsgs{commitProposal: makeBlock(i)})
+	}
+	c.startNewRound(common.Big0)
+	if !c.IsCatchingUp() {
+		t.Errorf("not catching up after a jump in the last proposal")
+	}
+	if seq := c.current.Sequence(); seq.Cmp(big.NewInt(6)) != 0 {
+		t.Errorf("sequence mismatch: have %v, want 6", seq)
+	}
+
+	// Block 6 is the one we were working on
+	backend.committedMsgs = append(backend.committedMsgs, testCommittedMsgs{commitProposal: makeBlock(6)})
+	c.startNewRound(common.Big0)
+	if c.IsCatchingUp() {
+		t.Errorf("still catching up after moving to the next sequence")
+	}
+	c.stopTimer()
+}
+
+func TestNewSequenceResetsDesiredRound(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	backend := sys.backends[0]
+	c := backend.engine.(*core)
+	c.current = nil
+	c.startNewRound(common.Big0)
+
+	c.waitForDesiredRound(big.NewInt(5), RoundChangeTimeout)
+	if c.state != StateWaitingForNewRound || c.current.DesiredRound().Cmp(big.NewInt(5)) != 0 {
+		t.Fatalf("not waiting for round 5: state %v, desired round %v", c.state, c.current.DesiredRound())
+	}
+
+	// Block 1 is finalized while waiting for round 5
+	backend.committedMsgs = append(backend.committedMsgs, testCommittedMsgs{commitProposal: makeBlock(1)})
+	c.startNewRound(common.Big0)
+	if seq := c.current.Sequence(); seq.Cmp(big.NewInt(2)) != 0 {
+		t.Errorf("sequence mismatch: have %v, want 2", seq)
+	}
+	if round := c.current.Round(); round.Sign() != 0 {
+		t.Errorf("round mismatch: have %v, want 0", round)
+	}
+	if desired := c.current.DesiredRound(); desired.Sign() != 0 {
+		t.Errorf("desired round mismatch: have %v, want 0", desired)
+	}
+	if c.state != StateAcceptRequest {
+		t.Errorf("state mismatch: have %v, want %v", c.state, StateAcceptRequest)
+	}
+	c.stopTimer()
+}
+
+func TestValidatorSetForView(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+	proposer := c.valSet.GetProposer()
+	_, lastProposer := c.backend.LastProposal()
+
+	for round := uint64(0); round < 6; round++ {
+		view := &istanbul.View{Sequence: c.current.Sequence(), Round: new(big.Int).SetUint64(round)}
+		validators, got, err := c.ValidatorSetForView(view)
+		if err != nil {
+			t.Fatalf("round %d: failed to get validator set: %v", round, err)
+		}
+
+		valSet := c.valSet.Copy()
+		valSet.CalcProposer(lastProposer, round)
+		if want := valSet.GetProposer().Address(); got != want {
+			t.Errorf("round %d: proposer mismatch: have %v, want %v", round, got, want)
+		}
+		for i, val := range valSet.List() {
+			if validators[i] != val.Address() {
+				t.Errorf("round %d: validator %d mismatch: have %v, want %v", round, i, validators[i], val.Address())
+			}
+		}
+	}
+	if c.valSet.GetProposer() != proposer {
+		t.Errorf("proposer of the current round changed: have %v, want %v", c.valSet.GetProposer(), proposer)
+	}
+
+	view := &istanbul.View{Sequence: new(big.Int).Add(c.current.Sequence(), common.Big1), Round: common.Big0}
+	if _, _, err := c.ValidatorSetForView(view); err != errNotCurrentSequence {
+		t.Errorf("error mismatch: have %v, want %v", err, errNotCurrentSequence)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	backend := sys.backends[0]
+	c := backend.engine.(*core)
+	clock := newFakeClock()
+	c.clock = clock
+	defer c.stopTimer()
+
+	health := c.Health()
+	if health.State != StateAcceptRequest.String() || health.Sequence.Cmp(common.Big1) != 0 || health.Round.Sign() != 0 {
+		t.Errorf("health mismatch: have %+v, want state %v at sequence 1 round 0", health, StateAcceptRequest)
+	}
+	if health.SecondsSinceLastCommit != nil {
+		t.Errorf("seconds since last commit mismatch: have %v, want nil", *health.SecondsSinceLastCommit)
+	}
+	if health.IsProposer != c.isProposer() {
+		t.Errorf("proposer mismatch: have %v, want %v", health.IsProposer, c.isProposer())
+	}
+	if health.RoundChangeInProgress {
+		t.Errorf("round change in progress without a round change")
+	}
+
+	// Commit the sequence and let some time pass
+	backend.committedMsgs = append(backend.committedMsgs, testCommittedMsgs{commitProposal: makeBlock(1)})
+	c.startNewRound(common.Big0)
+	clock.Advance(7 * time.Second)
+	c.waitForDesiredRound(common.Big1, RoundChangeTimeout)
+
+	health = c.Health()
+	if health.Sequence.Cmp(common.Big2) != 0 || health.DesiredRound.Cmp(common.Big1) != 0 {
+		t.Errorf("view mismatch: have sequence %v desired round %v, want sequence 2 desired round 1", health.Sequence, health.DesiredRound)
+	}
+	if health.SecondsSinceLastCommit == nil || *health.SecondsSinceLastCommit != 7 {
+		t.Errorf("seconds since last commit mismatch: have %v, want 7", health.SecondsSinceLastCommit)
+	}
+	if !health.RoundChangeInProgress {
+		t.Errorf("no round change in progress while waiting for a round")
+	}
+}
+
+// callWhileCommitting calls fn over and over from another goroutine while a sole validator
+// commits a block, for the race detector to catch unsynchronized reads of the round state. The
+// engine is set up with setup, if given, before it's started.
+func callWhileCommitting(t *testing.T, setup func(c *core), fn func(c *core)) {
+	sys := NewTestSystemWithBackend(1, 0)
+	c := sys.backends[0].engine.(*core)
+	if setup != nil {
+		setup(c)
+	}
+	closer := sys.Run(true)
+	defer closer()
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				fn(c)
+			}
+		}
+	}()
+	sys.backends[0].NewRequest(makeBlock(1))
+	<-time.After(500 * time.Millisecond)
+	close(stop)
+	<-done
+}
+
+func TestCurrentRoundTimeoutWhileCommitting(t *testing.T) {
+	callWhileCommitting(t, nil, func(c *core) { c.CurrentRoundTimeout() })
+}
+
+func TestPendingRequestsWhileCommitting(t *testing.T) {
+	// A request of a later sequence stays pending throughout
+	setup := func(c *core) { c.storeRequestMsg(&istanbul.Request{Proposal: makeBlock(3)}) }
+	callWhileCommitting(t, setup, func(c *core) { c.PendingRequests() })
+}
+
+func TestValidatorSetForViewWhileCommitting(t *testing.T) {
+	view := &istanbul.View{Sequence: common.Big1, Round: common.Big1}
+	callWhileCommitting(t, nil, func(c *core) { c.ValidatorSetForView(view) })
+}
+
+func TestHealthWhileCommitting(t *testing.T) {
+	callWhileCommitting(t, nil, func(c *core) { c.Health() })
+}
+
+func TestDidParticipate(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	c := sys.backends[0].engine.(*core)
+	if _, err := c.DidParticipate(c.valSet.GetByIndex(0).Address()); err != errNoCommittedProposal {
+		t.Errorf("error mismatch: have %v, want %v", err, errNoCommittedProposal)
+	}
+
+	bitmap := new(big.Int).SetBit(big.NewInt(0), 0, 1)
+	bitmap.SetBit(bitmap, 2, 1)
+	c.commitProposal(makeBlock(1), bitmap, []byte{})
+
+	for i := 0; i < c.valSet.Size(); i++ {
+		participated, err := c.DidParticipate(c.valSet.GetByIndex(uint64(i)).Address())
+		if err != nil {
+			t.Fatalf("failed to check participation: %v", err)
+		}
+		if want := i == 0 || i == 2; participated != want {
+			t.Errorf("validator %d: participation mismatch: have %v, want %v", i, participated, want)
+		}
+	}
+	if _, err := c.DidParticipate(common.HexToAddress("0x1234")); err != errNotInCommittedValidatorSet {
+		t.Errorf("error mismatch: have %v, want %v", err, errNotInCommittedValidatorSet)
+	}
+}
+
+func TestMissingFromLastCommit(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	c := sys.backends[0].engine.(*core)
+	if _, err := c.MissingFromLastCommit(); err != errNoCommittedProposal {
+		t.Errorf("error mismatch: have %v, want %v", err, errNoCommittedProposal)
+	}
+
+	// A partial quorum of validators 0, 1 and 3
+	bitmap := new(big.Int).SetBit(big.NewInt(0), 0, 1)
+	bitmap.SetBit(bitmap, 1, 1)
+	bitmap.SetBit(bitmap, 3, 1)
+	c.commitProposal(makeBlock(1), bitmap, []byte{})
+
+	missing, err := c.MissingFromLastCommit()
+	if err != nil {
+		t.Fatalf("failed to get missing validators: %v", err)
+	}
+	if want := []common.Address{c.valSet.GetByIndex(2).Address()}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing validators mismatch: have %v, want %v", missing, want)
+	}
+
+	// All validators contributed
+	bitmap.SetBit(bitmap, 2, 1)
+	c.commitProposal(makeBlock(2), bitmap, []byte{})
+	if missing, _ := c.MissingFromLastCommit(); len(missing) != 0 {
+		t.Errorf("missing validators mismatch: have %v, want none", missing)
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	primary := sys.backends[0].engine.(*core)
+	standby := sys.backends[1].engine.(*core)
+
+	// The primary waits for round 3 after ROUND CHANGEs for rounds 2 and 3
+	view := &istanbul.View{Sequence: big.NewInt(1), Round: big.NewInt(2)}
+	primary.updateRoundState(view, primary.valSet, true)
+	primary.current.SetDesiredRound(big.NewInt(3))
+	for i, backend := range sys.backends {
+		rcView := istanbul.View{Sequence: big.NewInt(1), Round: big.NewInt(int64(2 + i%2))}
+		msg, err := backend.getRoundChangeMessage(rcView, istanbul.EmptyPreparedCertificate())
+		if err != nil {
+			t.Fatalf("failed to create round change message: %v", err)
+		}
+		if _, err := primary.roundChangeSet.Add(rcView.Round, &msg); err != nil {
+			t.Fatalf("failed to add round change message: %v", err)
+		}
+	}
+
+	data, err := primary.ExportState()
+	if err != nil {
+		t.Fatalf("failed to export state: %v", err)
+	}
+
+	// A state building on another chain head is rejected
+	var mismatched exportedState
+	if err := rlp.DecodeBytes(data, &mismatched); err != nil {
+		t.Fatalf("failed to decode exported state: %v", err)
+	}
+	mismatched.ParentHash = common.HexToHash("0x01")
+	mismatchedData, _ := rlp.EncodeToBytes(&mismatched)
+	if err := standby.ImportState(mismatchedData); err != errImportedStateMismatch {
+		t.Errorf("error mismatch: have %v, want %v", err, errImportedStateMismatch)
+	}
+	if standby.currentView().Cmp(view) == 0 {
+		t.Errorf("mismatched state was imported")
+	}
+
+	if err := standby.ImportState(data); err != nil {
+		t.Fatalf("failed to import state: %v", err)
+	}
+	if have := standby.currentView(); have.Cmp(view) != 0 {
+		t.Errorf("view mismatch: have %v, want %v", have, view)
+	}
+	if have := standby.current.DesiredRound(); have.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("desired round mismatch: have %v, want 3", have)
+	}
+	for round := int64(2); round <= 3; round++ {
+		have, want := len(standby.roundChangeSet.messages(big.NewInt(round))), len(primary.roundChangeSet.messages(big.NewInt(round)))
+		if have != want {
+			t.Errorf("round %d: round change messages mismatch: have %d, want %d", round, have, want)
+		}
+	}
+	_, lastProposer := sys.backends[1].LastProposal()
+	if have, want := standby.valSet.GetProposer().Address(), validator.SimulateProposer(standby.valSet, lastProposer, 2); have != want {
+		t.Errorf("proposer mismatch: have %v, want %v", have.Hex(), want.Hex())
+	}
+	// Nothing is signed in the imported view, where the primary may have signed already
+	if standby.state != StateWaitingForNewRound {
+		t.Errorf("state mismatch: have %v, want %v", standby.state, StateWaitingForNewRound)
+	}
+	if standby.roundChangeTimer != nil {
+		t.Errorf("round change timer started before the engine")
+	}
+
+	// Once started, the standby moves on to the round after the primary's desired round
+	if err := standby.Start(); err != nil {
+		t.Fatalf("failed to start the standby: %v", err)
+	}
+	defer standby.Stop()
+	want := &istanbul.View{Sequence: big.NewInt(1), Round: big.NewInt(4)}
+	if info := standby.LastRoundChange(); info == nil || info.Reason != RoundChangeResumed.String() || info.View.Cmp(want) != 0 {
+		t.Errorf("round change mismatch: have %v, want %v for %v", info, RoundChangeResumed, want)
+	}
+}
+
+func TestLatestFinalized(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	backend := sys.backends[0]
+	c := backend.engine.(*core)
+
+	if proposal, view := c.LatestFinalized(); proposal != nil || view != nil {
+		t.Errorf("latest finalized mismatch: have %v at %v, want none", proposal, view)
+	}
+
+	view := &istanbul.View{Round: big.NewInt(3), Sequence: big.NewInt(1)}
+	c.current = newTestRoundState(view, c.valSet)
+	c.commitProposal(makeBlock(1), big.NewInt(7), []byte{})
+
+	proposal, finalizedView := c.LatestFinalized()
+	if proposal == nil || proposal.Hash() != makeBlock(1).Hash() {
+		t.Errorf("latest finalized proposal mismatch: have %v, want %v", proposal, makeBlock(1))
+	}
+	if finalizedView == nil || finalizedView.Cmp(view) != 0 {
+		t.Errorf("latest finalized view mismatch: have %v, want %v", finalizedView, view)
+	}
+
+	// A chain head imported without consensus supersedes it, but has no known view
+	c.chainHeadAdvanced(makeBlock(3))
+	proposal, finalizedView = c.LatestFinalized()
+	if proposal == nil || proposal.Hash() != makeBlock(3).Hash() {
+		t.Errorf("latest finalized proposal mismatch: have %v, want %v", proposal, makeBlock(3))
+	}
+	if finalizedView != nil {
+		t.Errorf("latest finalized view mismatch: have %v, want none", finalizedView)
+	}
+
+	// An older chain head doesn't replace it
+	c.chainHeadAdvanced(makeBlock(2))
+	if proposal, _ = c.LatestFinalized(); proposal.Hash() != makeBlock(3).Hash() {
+		t.Errorf("latest finalized proposal mismatch: have %v, want %v", proposal, makeBlock(3))
+	}
+}
+
+func TestFinalizeMessageSignFailure(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	backend := sys.backends[0]
+	c := backend.engine.(*core)
+
+	msg := &istanbul.Message{Code: istanbul.MsgPrepare, Msg: []byte{}}
+	if _, err := c.finalizeMessage(msg); err != nil {
+		t.Fatalf("failed to finalize message: %v", err)
+	}
+
+	backend.signErr = errors.New("signer unavailable")
+	_, err := c.finalizeMessage(msg)
+	fe, ok := err.(*finalizeError)
+	if !ok {
+		t.Fatalf("error type mismatch: have %T, want *finalizeError", err)
+	}
+	if fe.category != errSignFailed || fe.err != backend.signErr {
+		t.Errorf("error mismatch: have %v, want category %v caused by %v", err, errSignFailed, backend.signErr)
+	}
+}
+
+func TestSubscribeCommitted(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+
+	ch := make(chan istanbul.CommittedEvent, 1)
+	sub := sys.backends[1].engine.SubscribeCommitted(ch)
+	defer sub.Unsubscribe()
+
+	close := sys.Run(true)
+	defer close()
+
+	sys.backends[0].NewRequest(makeBlock(1))
+
+	select {
+	case ev := <-ch:
+		if ev.Proposal.Number().Cmp(common.Big1) != 0 {
+			t.Errorf("committed proposal number mismatch: have %v, want 1", ev.Proposal.Number())
+		}
+		if ev.View.Sequence.Cmp(common.Big1) != 0 {
+			t.Errorf("committed view sequence mismatch: have %v, want 1", ev.View.Sequence)
+		}
+		if ev.Bitmap.Sign() == 0 || len(ev.AggregatedSeal) == 0 {
+			t.Errorf("missing committed seal: bitmap %v, aggregated seal %x", ev.Bitmap, ev.AggregatedSeal)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("timed out waiting for committed event")
+	}
+}
+
+func TestSubscribeCommittedFailure(t *testing.T) {
+	sys := NewTestSystemWithBackend(1, 0)
+	sys.backends[0].commitErr = errors.New("commit failed")
+
+	ch := make(chan istanbul.CommittedEvent, 1)
+	sub := sys.backends[0].engine.SubscribeCommitted(ch)
+	defer sub.Unsubscribe()
+
+	close := sys.Run(true)
+	defer close()
+
+	sys.backends[0].NewRequest(makeBlock(1))
+
+	select {
+	case ev := <-ch:
+		t.Errorf("unexpected committed event for failed commit: %v", ev)
+	case <-time.After(1 * time.Second):
+	}
+}
+
+func TestCommitRetry(t *testing.T) {
+	sys := NewTestSystemWithBackend(1, 0)
+	backend := sys.backends[0]
+	backend.commitErr = errors.New("commit failed")
+	backend.commitErrs = 1
+
+	c := backend.engine.(*core)
+	config := *c.config
+	config.CommitRetries = 2
+	config.CommitRetryBackoff = 100
+	c.config = &config
+	clock := newFakeClock()
+	c.clock = clock
+
+	ch := make(chan istanbul.CommittedEvent, 1)
+	sub := c.SubscribeCommitted(ch)
+	defer sub.Unsubscribe()
+
+	close := sys.Run(true)
+	defer close()
+
+	backend.NewRequest(makeBlock(1))
+
+	// The first attempt fails, the proposal is committed when retried after the backoff
+	select {
+	case ev := <-ch:
+		t.Fatalf("unexpected committed event for failed commit: %v", ev)
+	case <-time.After(500 * time.Millisecond):
+	}
+	clock.Advance(100 * time.Millisecond)
+	select {
+	case ev := <-ch:
+		if ev.Proposal.Hash() != makeBlock(1).Hash() {
+			t.Errorf("committed proposal mismatch: have %v, want %v", ev.Proposal.Hash(), makeBlock(1).Hash())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the retried commit")
+	}
+	for _, payload := range backend.sentMsgs {
+		msg := new(istanbul.Message)
+		if err := msg.FromPayload(payload, nil); err == nil && msg.Code == istanbul.MsgRoundChange {
+			t.Errorf("sent a round change for a commit that succeeded on retry")
+		}
+	}
+	if len(backend.committedMsgs) != 1 {
+		t.Errorf("committed proposals mismatch: have %v, want 1", len(backend.committedMsgs))
+	}
+}
+
+func TestVerifyProposalCache(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	backend := sys.backends[0]
+	c := backend.engine.(*core)
+
+	proposal := makeBlock(1)
+	if _, err := c.verifyProposal(proposal); err != nil {
+		t.Fatalf("failed to verify proposal: %v", err)
+	}
+
+	// The same proposal carried into the next round should not be verified again
+	c.current.SetRound(big.NewInt(1))
+	if _, err := c.verifyProposal(proposal); err != nil {
+		t.Fatalf("failed to verify proposal: %v", err)
+	}
+	if backend.verifyCount != 1 {
+		t.Errorf("verify count mismatch: have %v, want 1", backend.verifyCount)
+	}
+
+	// A different proposal still goes through the backend
+	if _, err := c.verifyProposal(makeBlock(2)); err != nil {
+		t.Fatalf("failed to verify proposal: %v", err)
+	}
+	if backend.verifyCount != 2 {
+		t.Errorf("verify count mismatch: have %v, want 2", backend.verifyCount)
+	}
+}
+
+func TestProposerWarmup(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	config := *istanbul.DefaultConfig
+	config.ProposerWarmupBlocks = 1
+	for _, backend := range sys.backends {
+		c := backend.engine.(*core)
+		c.config = &config
+		// Start the initial round as a freshly started node would
+		c.current = nil
+	}
+
+	closer := sys.Run(true)
+	defer closer()
+
+	for _, backend := range sys.backends {
+		backend.NewRequest(makeBlock(1))
+	}
+	<-time.After(1 * time.Second)
+
+	// Only the proposer of the first sequence gives up its turn, and nothing is proposed
+	var proposer *testSystemBackend
+	for _, backend := range sys.backends {
+		for _, payload := range backend.sentMessages() {
+			msg := new(istanbul.Message)
+			if err := msg.FromPayload(payload, nil); err != nil {
+				t.Fatalf("failed to decode sent message: %v", err)
+			}
+			if msg.Code != istanbul.MsgRoundChange {
+				t.Errorf("message code mismatch: have %v, want %v", msg.Code, istanbul.MsgRoundChange)
+			}
+			if proposer != nil && proposer != backend {
+				t.Fatalf("more than one backend sent a round change")
+			}
+			proposer = backend
+		}
+	}
+	if proposer == nil {
+		t.Fatalf("warming proposer did not relinquish its turn")
+	}
+
+	// Once the first block is committed the warmup is over and the same node proposes
+	for _, backend := range sys.backends {
+		backend.addCommitted(testCommittedMsgs{commitProposal: makeBlock(1)})
+		backend.events.Post(istanbul.FinalCommittedEvent{})
+	}
+	<-time.After(100 * time.Millisecond)
+	proposer.NewRequest(makeBlock(2))
+	<-time.After(1 * time.Second)
+
+	preprepares := 0
+	for _, payload := range proposer.sentMessages() {
+		msg := new(istanbul.Message)
+		if err := msg.FromPayload(payload, nil); err != nil {
+			t.Fatalf("failed to decode sent message: %v", err)
+		}
+		if msg.Code == istanbul.MsgPreprepare {
+			preprepares++
+		}
+	}
+	if preprepares != 1 {
+		t.Errorf("preprepare count mismatch: have %v, want %v", preprepares, 1)
+	}
+}
+
+func TestProposerSelfCheck(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+
+	testCases := []struct {
+		percent    uint64
+		relinquish bool
+	}{
+		{50, true},
+		{0, false},
+	}
+	for _, test := range testCases {
+		sys := NewTestSystemWithBackend(N, F)
+		config := *istanbul.DefaultConfig
+		config.BlockPeriod = 1
+		config.ProposerSelfCheckPercent = test.percent
+		for _, backend := range sys.backends {
+			c := backend.engine.(*core)
+			c.config = &config
+			// Start the initial round as a freshly started node would
+			c.current = nil
+		}
+
+		// No request is sent, so the proposer never has anything to propose
+		closer := sys.Run(true)
+		<-time.After(1 * time.Second)
+		closer()
+
+		roundChanges := 0
+		for _, backend := range sys.backends {
+			for _, payload := range backend.sentMsgs {
+				msg := new(istanbul.Message)
+				if err := msg.FromPayload(payload, nil); err != nil {
+					t.Fatalf("failed to decode sent message: %v", err)
+				}
+				if msg.Code != istanbul.MsgRoundChange {
+					t.Errorf("message code mismatch: have %v, want %v", msg.Code, istanbul.MsgRoundChange)
+				}
+				roundChanges++
+			}
+		}
+
+		expected := 0
+		if test.relinquish {
+			expected = 1
+		}
+		if roundChanges != expected {
+			t.Errorf("percent %d: round change count mismatch: have %v, want %v", test.percent, roundChanges, expected)
+		}
+	}
+}
+
+func BenchmarkStartNewRound(b *testing.B) {
+	b.Run("TraceEnabled", func(b *testing.B) { benchmarkStartNewRound(b, elog.LvlTrace) })
+	b.Run("TraceDisabled", func(b *testing.B) { benchmarkStartNewRound(b, elog.LvlInfo) })
+}
+
+// benchmarkStartNewRound measures starting the initial round with the given log handler level.
+func benchmarkStartNewRound(b *testing.B, handlerLvl elog.Lvl) {
+	sys := NewTestSystemWithBackend(100, 33)
+	closer := sys.Run(false)
+	defer closer()
+
+	c := sys.backends[0].engine.(*core)
+	c.logger = elog.New()
+	c.logger.SetHandler(elog.LvlFilterHandler(handlerLvl, elog.StreamHandler(ioutil.Discard, elog.TerminalFormat(false))))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.current = nil
+		c.startNewRound(common.Big0)
+	}
+	b.StopTimer()
+	c.stopTimer()
+}
+
+func TestStartNewRoundWithoutLastProposal(t *testing.T) {
+	sys := NewTestSystemWithBackendAndCurrentRoundState(4, 1, func(vset istanbul.ValidatorSet) *roundState { return nil })
+	clock := newFakeClock()
+	v0 := sys.backends[0]
+	c := v0.engine.(*core)
+	c.clock = clock
+	v0.nilLastProposals = 1
+
+	closer := sys.Run(true)
+	defer closer()
+
+	// The round isn't started, and so never persisted, until the backend has a last proposal
+	if state, err := c.getRoundStateFromDisk(); err != nil || state != nil {
+		t.Fatalf("round started without a last proposal: %v, err %v", state, err)
+	}
+	clock.Advance(startRoundRetryDelay)
+	<-time.After(100 * time.Millisecond)
+
+	// Stop the engine before reading what the retry persisted
+	v0.engine.Stop()
+	state, err := c.getRoundStateFromDisk()
+	if err != nil {
+		t.Fatalf("failed to load the round state: %v", err)
+	}
+	if state == nil {
+		t.Fatalf("round not started after the retry")
+	}
+	if seq := state.Sequence(); seq.Cmp(common.Big1) != 0 {
+		t.Errorf("sequence mismatch: have %v, want 1", seq)
+	}
+	if c.state != StateAcceptRequest {
+		t.Errorf("state mismatch: have %v, want %v", c.state, StateAcceptRequest)
+	}
+}
+
+func TestInvariantChecks(t *testing.T) {
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = false }()
+
+	sys := NewTestSystemWithBackend(4, 1)
+	clock := newFakeClock()
+	c := sys.backends[0].engine.(*core)
+	config := *c.config
+	config.InvariantCheckInterval = 1000
+	c.config = &config
+	c.clock = clock
+	c.invariantViolationCounter = metrics.NewCounter()
+
+	closer := sys.Run(true)
+	defer closer()
+
+	clock.Advance(time.Second)
+	<-time.After(100 * time.Millisecond)
+	if count := c.invariantViolationCounter.Count(); count != 0 {
+		t.Fatalf("invariant violations reported for a consistent round state: %v", count)
+	}
+
+	// The round moves beyond the desired round
+	c.current.SetRound(big.NewInt(5))
+	clock.Advance(time.Second)
+	<-time.After(100 * time.Millisecond)
+	if count := c.invariantViolationCounter.Count(); count != 1 {
+		t.Errorf("invariant violations mismatch: have %v, want 1", count)
+	}
+}
+
+func TestCheckInvariants(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+	if violations := c.checkInvariants(); len(violations) != 0 {
+		t.Fatalf("invariant violations for a consistent round state: %v", violations)
+	}
+
+	// A commit from outside the validator set
+	key, _ := crypto.GenerateKey()
+	c.current.Commits.addVerifiedMessage(&istanbul.Message{
+		Code:    istanbul.MsgCommit,
+		Address: crypto.PubkeyToAddress(key.PublicKey),
+	})
+	if violations := c.checkInvariants(); len(violations) != 1 || !strings.Contains(violations[0], "commit") {
+		t.Errorf("invariant violations mismatch: have %v, want a commit from outside the validator set", violations)
+	}
+}
+
+func TestRoundChangeRate(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	backend := sys.backends[0]
+	c := backend.engine.(*core)
+	clock := newFakeClock()
+	c.clock = clock
+	defer c.stopTimer()
+
+	// Only the last four of six sequences finished a minute apart are kept
+	c.roundHistory = newRoundHistory(4)
+	for i, round := range []uint64{0, 3, 0, 1, 2, 0} {
+		clock.Advance(time.Minute)
+		c.roundHistory.add(roundHistoryEntry{sequence: uint64(i + 1), round: round, time: clock.Now()})
+	}
+	clock.Advance(30 * time.Second)
+	testCases := []struct {
+		window time.Duration
+		rate   float64
+	}{
+		{time.Hour, 0.75},
+		{2 * time.Minute, 1},
+		{time.Minute, 0},
+		{10 * time.Second, 0},
+	}
+	for _, test := range testCases {
+		if rate := c.RoundChangeRate(test.window); rate != test.rate {
+			t.Errorf("rate over %v mismatch: have %v, want %v", test.window, rate, test.rate)
+		}
+	}
+
+	// Starting the next sequence records the round the current one was finished in
+	c.roundHistory = newRoundHistory(roundHistorySize)
+	c.current = newTestRoundState(&istanbul.View{Sequence: big.NewInt(1), Round: big.NewInt(2)}, c.valSet)
+	backend.committedMsgs = append(backend.committedMsgs, testCommittedMsgs{commitProposal: makeBlock(1)})
+	c.startNewRound(common.Big0)
+	if rate := c.RoundChangeRate(time.Minute); rate != 2 {
+		t.Errorf("rate after a sequence finished in round 2 mismatch: have %v, want %v", rate, 2)
+	}
+}
+
+func TestSwapValidatorSet(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+	oldSet := c.valSet
+
+	// Backlog a future message and queue a committed seal from each of the other validators
+	future := istanbul.View{Round: big.NewInt(0), Sequence: big.NewInt(2)}
+	for _, backend := range sys.backends[1:] {
+		msg, err := backend.getPrepareMessage(future, common.Hash{})
+		if err != nil {
+			t.Fatalf("failed to create prepare message: %v", err)
+		}
+		_, src := oldSet.GetByAddress(backend.Address())
+		c.storeBacklog(&msg, src)
+		c.pendingCommitSeals = append(c.pendingCommitSeals, &pendingCommitSeal{msg: &msg, validator: src})
+	}
+	locks := make(map[common.Address]*sync.Mutex)
+	for src := range c.backlogs {
+		locks[src.Address()] = c.backlogLock(src)
+	}
+
+	if err := c.swapValidatorSet(validator.NewSet(nil, istanbul.RoundRobin)); err != errEmptyValidatorSet {
+		t.Errorf("error mismatch for an empty set: have %v, want %v", err, errEmptyValidatorSet)
+	}
+	if c.valSet != oldSet {
+		t.Errorf("validator set replaced by an invalid one")
+	}
+
+	// The last validator is replaced by a new one
+	removed := sys.backends[3].Address()
+	validators, _, _ := generateValidators(1)
+	for _, val := range oldSet.List() {
+		if val.Address() != removed {
+			validators = append(validators, istanbul.ValidatorData{Address: val.Address(), BLSPublicKey: val.BLSPublicKey()})
+		}
+	}
+	newSet := validator.NewSet(validators, istanbul.RoundRobin)
+	if err := c.swapValidatorSet(newSet); err != nil {
+		t.Fatalf("failed to swap the validator set: %v", err)
+	}
+	if c.valSet != newSet {
+		t.Errorf("validator set not replaced")
+	}
+
+	for src, backlog := range c.backlogs {
+		if src.Address() == removed {
+			t.Errorf("backlog of removed validator %v kept", removed)
+			continue
+		}
+		if _, val := newSet.GetByAddress(src.Address()); val != src {
+			t.Errorf("backlog of %v not keyed by its validator in the new set", src.Address())
+		}
+		if backlog.Size() != 1 {
+			t.Errorf("backlog size of %v mismatch: have %v, want 1", src.Address(), backlog.Size())
+		}
+		// A worker reprocessing the backlog under its old key holds the same lock
+		if c.backlogLocks[src] != locks[src.Address()] {
+			t.Errorf("backlog lock of %v not kept for its validator in the new set", src.Address())
+		}
+	}
+	if want := 2; len(c.backlogs) != want {
+		t.Errorf("backlogs mismatch: have %v, want %v", len(c.backlogs), want)
+	}
+	if want := 2; len(c.pendingCommitSeals) != want {
+		t.Errorf("queued committed seals mismatch: have %v, want %v", len(c.pendingCommitSeals), want)
+	}
+	for _, pending := range c.pendingCommitSeals {
+		if _, val := newSet.GetByAddress(pending.msg.Address); val != pending.validator {
+			t.Errorf("queued committed seal of %v not for its validator in the new set", pending.msg.Address)
+		}
+	}
+}
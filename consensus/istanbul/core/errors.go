@@ -22,9 +22,9 @@ var (
 	// errInconsistentSubject is returned when received subject is different from
 	// current subject.
 	errInconsistentSubject = errors.New("inconsistent subjects")
-	// errNotFromProposer is returned when received message is supposed to be from
-	// proposer.
-	errNotFromProposer = errors.New("message does not come from proposer")
+	// errPreprepareNotFromProposer is returned when a preprepare of the current sequence doesn't
+	// come from the proposer of its view.
+	errPreprepareNotFromProposer = errors.New("preprepare does not come from the proposer of its view")
 	// errFutureMessage is returned when current view is earlier than the
 	// view of the received message.
 	errFutureMessage = errors.New("future message")
@@ -53,8 +53,14 @@ var (
 	errInvalidPreparedCertificateMsgView = errors.New("message in PREPARED certificate for wrong view")
 	// errInvalidPreparedCertificateDigestMismatch is returned when the PREPARED certificate proposal doesn't match one of the messages.
 	errInvalidPreparedCertificateDigestMismatch = errors.New("message in PREPARED certificate for different digest than proposal")
+	// errInvalidPreparedCertificateMsgMix is returned when the PREPARE and COMMIT messages of the PREPARED certificate
+	// weren't sent in the same round.
+	errInvalidPreparedCertificateMsgMix = errors.New("PREPARE and COMMIT messages in PREPARED certificate for different rounds")
 	// errInvalidRoundChangeViewMismatch is returned when the PREPARED certificate view is greater than the round change view
 	errInvalidRoundChangeViewMismatch = errors.New("View for PREPARED certificate is greater than the view in the round change message")
+	// errConflictingPreparedCertificates is returned when the ROUND CHANGE certificate carries PREPARED certificates for
+	// different proposals in its highest prepared round, which quorum intersection should rule out.
+	errConflictingPreparedCertificates = errors.New("conflicting PREPARED certificates in ROUND CHANGE certificate")
 
 	// errInvalidRoundChangeCertificateNumMsgs is returned when the ROUND CHANGE certificate has an incorrect number of ROUND CHANGE messages.
 	errInvalidRoundChangeCertificateNumMsgs = errors.New("invalid number of ROUND CHANGE messages in certificate")
@@ -66,6 +72,8 @@ var (
 	errInvalidRoundChangeCertificateMsgCode = errors.New("non-ROUND CHANGE message in ROUND CHANGE certificate")
 	// errInvalidRoundChangeCertificateMsgView is returned when the ROUND CHANGE certificate contains a message for the wrong view
 	errInvalidRoundChangeCertificateMsgView = errors.New("message in ROUND CHANGE certificate for wrong view")
+	// errInvalidRoundChangeCertificateSequence is returned when the ROUND CHANGE certificate contains a message for a different sequence
+	errInvalidRoundChangeCertificateSequence = errors.New("message in ROUND CHANGE certificate for wrong sequence")
 
 	// errInvalidCommittedSeal is returned when a COMMIT message has an invalid committed seal.
 	errInvalidCommittedSeal = errors.New("invalid committed seal in COMMIT message")
@@ -80,4 +88,81 @@ var (
 	// errInvalidValidatorAddress is returned when the COMMIT message address doesn't
 	// correspond to a validator in the current set.
 	errInvalidValidatorAddress = errors.New("failed to find an existing validator by address")
+	// errProposalTooEarly is returned when a proposal's timestamp is less than its parent's
+	// timestamp plus the block period.
+	errProposalTooEarly = errors.New("proposal timestamp earlier than parent timestamp plus block period")
+	// errInvalidTargetRound is returned when a forced round change targets a round that is not
+	// greater than the current desired round.
+	errInvalidTargetRound = errors.New("target round not greater than current desired round")
+	// errTooManyTransactions is returned when a proposal carries more transactions than
+	// MaxTransactionsPerBlock.
+	errTooManyTransactions = errors.New("proposal exceeds the maximum number of transactions")
+	// errCorruptRoundState is returned when the round state persisted to disk cannot be
+	// decoded or does not match its stored hash.
+	errCorruptRoundState = errors.New("persisted round state is corrupt")
+	// errNoCommittedProposal is returned when querying the last committed proposal before any
+	// proposal has been committed by consensus.
+	errNoCommittedProposal = errors.New("no proposal committed yet")
+	// errNotInCommittedValidatorSet is returned when querying the participation of an address that
+	// wasn't in the validator set of the last committed proposal.
+	errNotInCommittedValidatorSet = errors.New("address not in the validator set of the last committed proposal")
+	// errTooManyEarlyMessages is returned when a message arrives before the validator set is known
+	// and too many such messages are kept already.
+	errTooManyEarlyMessages = errors.New("too many messages received before the validator set is known")
+	// errBadProposal is returned when the proposal of a PREPREPARE is a known bad block.
+	errBadProposal = errors.New("proposal is a known bad block")
+	// errCommitSequenceMismatch is returned when the proposal about to be committed is not for the
+	// current sequence.
+	errCommitSequenceMismatch = errors.New("proposal number does not match the current sequence")
+	// errCommitProposalMismatch is returned when the proposal about to be committed is not the one
+	// certified by the prepared certificate.
+	errCommitProposalMismatch = errors.New("proposal does not match the prepared certificate")
+	// errMutedValidator is returned when a message comes from a validator muted for the rest of the
+	// sequence after sending too many messages of its type with inconsistent subjects.
+	errMutedValidator = errors.New("validator muted for sending inconsistent subjects")
+	// errMessageQueued is returned by a handler that queued the message for verification off the
+	// consensus goroutine, its outcome is only known once it has been handled.
+	errMessageQueued = errors.New("message queued for verification")
+	// errVerificationPending is returned when a preprepare arrives for a view whose proposal is
+	// already being verified asynchronously.
+	errVerificationPending = errors.New("proposal verification already in progress for this view")
+	// errSignFailed is the category of the error returned when an outgoing message can't be signed.
+	errSignFailed = errors.New("failed to sign message")
+	// errProposalTooFarInFuture is returned when a proposal's timestamp is further ahead of the
+	// local clock than MaxProposalFutureSkew.
+	errProposalTooFarInFuture = errors.New("proposal timestamp too far in the future")
+	// errEncodeFailed is the category of the error returned when an outgoing message can't be encoded.
+	errEncodeFailed = errors.New("failed to encode message")
+	// errNotCurrentSequence is returned when querying a view for a sequence other than the current one
+	errNotCurrentSequence = errors.New("view not for the current sequence")
+	// errProposalAssemblyCancelled is returned when the assembly of a preprepare is cancelled by
+	// the view moving on.
+	errProposalAssemblyCancelled = errors.New("proposal assembly cancelled")
+	// errFarFutureMessage is returned when a message's sequence is further ahead of the current
+	// one than MaxFutureSequences, too far to be worth backlogging.
+	errFarFutureMessage = errors.New("message sequence too far in the future")
+	// errInvalidViewSyncSequence is returned when a view sync response or one of its ROUND CHANGE
+	// messages is for a sequence other than the current one.
+	errInvalidViewSyncSequence = errors.New("view sync response not for the current sequence")
+	// errInvalidViewSyncMsgCode is returned when a view sync response carries a message other than
+	// a ROUND CHANGE.
+	errInvalidViewSyncMsgCode = errors.New("invalid message code in view sync response")
+	// errInvalidViewSyncMsgSignature is returned when a view sync response carries a message not
+	// signed by its sender.
+	errInvalidViewSyncMsgSignature = errors.New("invalid message signature in view sync response")
+	// errInvalidMessageSignature is returned when a message's signature doesn't verify against the
+	// key of the validator it claims to come from.
+	errInvalidMessageSignature = errors.New("message signature does not match its sender")
+	// errNoRoundState is returned when exporting the round state before the first round started.
+	errNoRoundState = errors.New("no round state")
+	// errInvalidImportedState is returned when an imported round state cannot be decoded.
+	errInvalidImportedState = errors.New("invalid imported round state")
+	// errImportedStateMismatch is returned when an imported round state or one of its ROUND CHANGE
+	// messages doesn't build on the local chain head.
+	errImportedStateMismatch = errors.New("imported round state does not match the chain head")
+	// errEmptyValidatorSet is returned when swapping to a validator set without validators.
+	errEmptyValidatorSet = errors.New("empty validator set")
+	// errInvalidQuorumSize is returned when swapping to a validator set whose quorum size is
+	// not between one and its size.
+	errInvalidQuorumSize = errors.New("invalid quorum size")
 )
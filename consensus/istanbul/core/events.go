@@ -17,6 +17,9 @@
 package core
 
 import (
+	"math/big"
+	"time"
+
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
 )
 
@@ -28,3 +31,48 @@ type backlogEvent struct {
 type timeoutEvent struct {
 	view *istanbul.View
 }
+
+type proposerSelfCheckEvent struct {
+	view *istanbul.View
+}
+
+type preprepareResendEvent struct {
+	view *istanbul.View
+}
+
+type commitBroadcastEvent struct {
+	view *istanbul.View
+}
+
+type commitRetryEvent struct {
+	view           *istanbul.View
+	proposal       istanbul.Proposal
+	bitmap         *big.Int
+	aggregatedSeal []byte
+	attempt        uint64
+}
+
+type startRoundRetryEvent struct {
+	round *big.Int
+}
+
+type invariantCheckEvent struct{}
+
+type forceRoundChangeEvent struct {
+	round *big.Int
+}
+
+type commitSealBatchEvent struct{}
+
+type proposalAssembledEvent struct {
+	assembly   *proposalAssembly
+	preprepare []byte
+	err        error
+}
+
+type proposalVerifiedEvent struct {
+	msg        *istanbul.Message
+	preprepare *istanbul.Preprepare
+	duration   time.Duration
+	err        error
+}
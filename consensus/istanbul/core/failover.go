@@ -0,0 +1,132 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// exportedState is the round state and ROUND CHANGE messages handed over by ExportState to the
+// ImportState of a standby validator. ParentHash is the hash of the last proposal they build on.
+type exportedState struct {
+	ParentHash          common.Hash
+	View                *istanbul.View
+	DesiredRound        *big.Int
+	PreparedCertificate istanbul.PreparedCertificate
+	RoundChanges        []istanbul.Message
+}
+
+// ExportState returns the current round state and ROUND CHANGE messages, for a standby validator
+// taking over from this one to resume from with ImportState.
+func (c *core) ExportState() ([]byte, error) {
+	if c.current == nil {
+		return nil, errNoRoundState
+	}
+	lastProposal, _ := c.backend.LastProposal()
+	if lastProposal == nil {
+		return nil, errNoRoundState
+	}
+	return rlp.EncodeToBytes(&exportedState{
+		ParentHash:          lastProposal.Hash(),
+		View:                c.currentView(),
+		DesiredRound:        c.current.DesiredRound(),
+		PreparedCertificate: c.current.PreparedCertificate(),
+		RoundChanges:        c.roundChangeSet.allMessages(),
+	})
+}
+
+// ImportState resumes from a state returned by the ExportState of another validator, which must
+// build on the same chain head as ours. It is meant to seed a standby validator before its engine
+// is started, so that it doesn't start cold from round 0. As the other validator may have signed
+// messages up to its desired round, the engine moves on to the round after it once started, without
+// signing anything in the imported view.
+func (c *core) ImportState(data []byte) error {
+	var state exportedState
+	if err := rlp.DecodeBytes(data, &state); err != nil || state.View == nil || state.View.Round == nil || state.View.Sequence == nil || state.DesiredRound == nil {
+		return errInvalidImportedState
+	}
+	lastProposal, lastProposer := c.backend.LastProposal()
+	if lastProposal == nil || lastProposal.Hash() != state.ParentHash || new(big.Int).Add(lastProposal.Number(), common.Big1).Cmp(state.View.Sequence) != 0 {
+		return errImportedStateMismatch
+	}
+
+	valSet := c.backend.Validators(lastProposal)
+	if !state.PreparedCertificate.IsEmpty() {
+		if err := VerifyPreparedCertificate(state.PreparedCertificate, valSet, c.config.CommittedSealHasher); err != nil {
+			return err
+		}
+	}
+	roundChangeSet := newRoundChangeSet(valSet, c.clock, c.roundChangeFormationTimer, c.config.MaxRoundChangeMessages)
+	for i := range state.RoundChanges {
+		msg := &state.RoundChanges[i]
+		round, err := c.verifyImportedRoundChange(msg, state.View.Sequence)
+		if err != nil {
+			return err
+		}
+		if _, err := roundChangeSet.Add(round, msg); err != nil {
+			return err
+		}
+	}
+
+	c.valSet = valSet
+	c.roundChangeSet = roundChangeSet
+	c.updateRoundState(state.View, valSet, false)
+	c.current.SetDesiredRound(state.DesiredRound)
+	c.roundGapGauge.Update(int64(c.roundGap()))
+	c.current.SetPreparedCertificate(state.PreparedCertificate)
+	if err := c.saveRoundStateToDisk(); err != nil {
+		c.NewLogger("func", "ImportState").Error("Failed to write round state to the disk", "err", err)
+	}
+	c.valSet.CalcProposer(lastProposer, state.View.Round.Uint64())
+	c.setState(StateWaitingForNewRound)
+	lastSigned := state.DesiredRound
+	if lastSigned.Cmp(state.View.Round) < 0 {
+		lastSigned = state.View.Round
+	}
+	c.importedResumeView = &istanbul.View{
+		Sequence: new(big.Int).Set(state.View.Sequence),
+		Round:    new(big.Int).Add(lastSigned, common.Big1),
+	}
+	return nil
+}
+
+// verifyImportedRoundChange checks that the imported message is a ROUND CHANGE of the given
+// sequence signed by its sender, and returns its round.
+func (c *core) verifyImportedRoundChange(msg *istanbul.Message, sequence *big.Int) (*big.Int, error) {
+	if msg.Code != istanbul.MsgRoundChange {
+		return nil, errInvalidRoundChangeCertificateMsgCode
+	}
+	data, err := msg.PayloadNoSig()
+	if err != nil {
+		return nil, err
+	}
+	if signer, err := c.validateFn(data, msg.Signature); err != nil || signer != msg.Address {
+		return nil, errInvalidMessageSignature
+	}
+	var roundChange *istanbul.RoundChange
+	if err := msg.Decode(&roundChange); err != nil {
+		return nil, err
+	}
+	if roundChange.View == nil || roundChange.View.Sequence == nil || roundChange.View.Round == nil || roundChange.View.Sequence.Cmp(sequence) != 0 {
+		return nil, errImportedStateMismatch
+	}
+	return roundChange.View.Round, nil
+}
@@ -21,28 +21,59 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/event"
 )
 
 // Start implements core.Engine.Start
 func (c *core) Start() error {
+	c.roundStateMu.Lock()
+	defer c.roundStateMu.Unlock()
+
+	// Load the round state persisted by a previous run, discarding it if corrupt
+	state, err := c.getRoundStateFromDisk()
+	if err != nil {
+		c.NewLogger("func", "Start").Warn("Failed to load persisted round state", "err", err)
+	}
+
 	// Start a new round from last sequence + 1
 	c.startNewRound(common.Big0)
+	if state != nil {
+		c.resumeRoundState(state)
+	}
+	if view := c.importedResumeView; view != nil {
+		if c.current != nil && view.Sequence.Cmp(c.current.Sequence()) == 0 {
+			c.waitForDesiredRound(view.Round, RoundChangeResumed)
+		}
+		c.importedResumeView = nil
+	}
 
 	// Tests will handle events itself, so we have to make subscribeEvents()
 	// be able to call in test.
 	c.subscribeEvents()
+	// Ask the other validators for their view once the responses can be received
+	c.sendViewSyncRequest()
+	c.handlerWg.Add(1)
 	go c.handleEvents()
+	c.startInvariantChecks()
+	c.startMessageStoreCompaction()
 
 	return nil
 }
 
 // Stop implements core.Engine.Stop
 func (c *core) Stop() error {
-	c.stopTimer()
+	c.stopInvariantChecks()
+	c.stopMessageStoreCompaction()
 	c.unsubscribeEvents()
 
 	// Make sure the handler goroutine exits
 	c.handlerWg.Wait()
+	// The timers are only touched by the handler goroutine, so they're stopped once it's gone
+	c.stopTimer()
+	c.stopCommitSealBatchTimer()
+	c.stopStartRoundRetryTimer()
+	// Stop the backlog workers once done, their events are dropped now that we unsubscribed
+	c.stopBacklogWorkers()
 	return nil
 }
 
@@ -50,6 +81,27 @@ func (c *core) CurrentView() *istanbul.View {
 	return c.currentView()
 }
 
+// SubscribeCommitted implements core.Engine.SubscribeCommitted
+func (c *core) SubscribeCommitted(ch chan<- istanbul.CommittedEvent) event.Subscription {
+	return c.committedFeed.Subscribe(ch)
+}
+
+// ForceRoundChange implements core.Engine.ForceRoundChange
+func (c *core) ForceRoundChange(round *big.Int) error {
+	if c.current == nil {
+		return istanbul.ErrStoppedEngine
+	}
+	if round.Cmp(c.current.DesiredRound()) <= 0 {
+		return errInvalidTargetRound
+	}
+
+	// Let the event loop perform the round change, as it owns the round state
+	c.sendEvent(forceRoundChangeEvent{
+		round: new(big.Int).Set(round),
+	})
+	return nil
+}
+
 // ----------------------------------------------------------------------------
 
 // Subscribe both internal and external events
@@ -60,9 +112,19 @@ func (c *core) subscribeEvents() {
 		istanbul.MessageEvent{},
 		// internal events
 		backlogEvent{},
+		forceRoundChangeEvent{},
+		commitSealBatchEvent{},
+		proposalVerifiedEvent{},
+		proposalAssembledEvent{},
+		invariantCheckEvent{},
 	)
 	c.timeoutSub = c.backend.EventMux().Subscribe(
 		timeoutEvent{},
+		proposerSelfCheckEvent{},
+		preprepareResendEvent{},
+		commitRetryEvent{},
+		commitBroadcastEvent{},
+		startRoundRetryEvent{},
 	)
 	c.finalCommittedSub = c.backend.EventMux().Subscribe(
 		istanbul.FinalCommittedEvent{},
@@ -79,18 +141,19 @@ func (c *core) unsubscribeEvents() {
 func (c *core) handleEvents() {
 	// Clear state
 	defer func() {
+		c.roundStateMu.Lock()
 		c.current = nil
+		c.roundStateMu.Unlock()
 		c.handlerWg.Done()
 	}()
 
-	c.handlerWg.Add(1)
-
 	for {
 		select {
 		case event, ok := <-c.events.Chan():
 			if !ok {
 				return
 			}
+			c.roundStateMu.Lock()
 			// A real event arrived, process interesting content
 			switch ev := event.Data.(type) {
 			case istanbul.RequestEvent:
@@ -110,23 +173,49 @@ func (c *core) handleEvents() {
 				if err := c.handleCheckedMsg(ev.msg, ev.src); err != nil {
 					c.logger.Warn("Error in handling istanbul message that was sent from a backlog event", "err", err)
 				}
+			case forceRoundChangeEvent:
+				c.NewLogger("func", "handleEvents", "target_round", ev.round).Info("Forcing round change")
+				c.waitForDesiredRound(ev.round, RoundChangeManual)
+			case commitSealBatchEvent:
+				c.verifyCommitSealBatch()
+			case proposalVerifiedEvent:
+				c.handleProposalVerified(ev)
+			case proposalAssembledEvent:
+				c.handleProposalAssembled(ev)
+			case invariantCheckEvent:
+				c.handleInvariantCheck()
 			}
+			c.roundStateMu.Unlock()
 		case event, ok := <-c.timeoutSub.Chan():
 			if !ok {
 				return
 			}
+			c.roundStateMu.Lock()
 			switch ev := event.Data.(type) {
 			case timeoutEvent:
 				c.handleTimeoutMsg(ev.view)
+			case proposerSelfCheckEvent:
+				c.handleProposerSelfCheck(ev.view)
+			case preprepareResendEvent:
+				c.resendPreprepare(ev.view)
+			case commitRetryEvent:
+				c.handleCommitRetry(ev)
+			case commitBroadcastEvent:
+				c.handleCommitBroadcast(ev.view)
+			case startRoundRetryEvent:
+				c.startNewRound(ev.round)
 			}
+			c.roundStateMu.Unlock()
 		case event, ok := <-c.finalCommittedSub.Chan():
 			if !ok {
 				return
 			}
+			c.roundStateMu.Lock()
 			switch event.Data.(type) {
 			case istanbul.FinalCommittedEvent:
 				c.handleFinalCommitted()
 			}
+			c.roundStateMu.Unlock()
 		}
 	}
 }
@@ -137,47 +226,100 @@ func (c *core) sendEvent(ev interface{}) {
 }
 
 func (c *core) handleMsg(payload []byte) error {
-	logger := c.logger.New("func", "handleMsg")
-	if c.current != nil {
-		logger = logger.New("cur_seq", c.current.Sequence(), "cur_round", c.current.Round())
-	} else {
-		logger = logger.New("cur_seq", 0, "cur_round", -1)
+	c.writeToMessageSink(payload, false)
+
+	// The signer can't be checked against the validator set until it's known
+	if c.valSet == nil {
+		return c.storeEarlyMessage(payload)
 	}
+	return c.handlePayload(payload)
+}
+
+// handlePayload decodes a message and handles it if it was signed by a validator.
+func (c *core) handlePayload(payload []byte) error {
+	logger := c.NewLogger("func", "handlePayload")
 
 	// Decode message and check its signature
 	msg := new(istanbul.Message)
-	if err := msg.FromPayload(payload, c.validateFn); err != nil {
+	if err := msg.FromPayload(payload, nil); err != nil {
 		logger.Error("Failed to decode message from payload", "err", err)
+		recordUndecodableMsg()
 		return err
 	}
+	if err := c.verifyMessageSignature(msg); err != nil {
+		logger.Warn("Message signature does not verify against its sender", "claimed_sender", msg.Address, "code", msg.Code, "err", err)
+		c.invalidSignatureCounter.Inc(1)
+		recordMsgSignatureFailure(msg.Code)
+		return errInvalidMessageSignature
+	}
 
 	// Only accept message if the address is valid
 	_, src := c.valSet.GetByAddress(msg.Address)
 	if src == nil {
 		logger.Error("Invalid address in message", "msg", msg)
+		recordMsg(msg.Code, istanbul.ErrUnauthorizedAddress)
 		return istanbul.ErrUnauthorizedAddress
 	}
 
 	return c.handleCheckedMsg(msg, src)
 }
 
-func (c *core) handleCheckedMsg(msg *istanbul.Message, src istanbul.Validator) error {
-	logger := c.logger.New("address", c.address, "from", msg.Address, "func", "handleCheckedMsg")
-	if c.current != nil {
-		logger = logger.New("cur_seq", c.current.Sequence(), "cur_round", c.current.Round())
-	} else {
-		logger = logger.New("cur_seq", 0, "cur_round", -1)
+// verifyMessageSignature checks that the message was signed by the address it claims to come from,
+// whether or not that address is a validator.
+func (c *core) verifyMessageSignature(msg *istanbul.Message) error {
+	data, err := msg.PayloadNoSig()
+	if err != nil {
+		return err
+	}
+	signer, err := istanbul.GetSignatureAddress(data, msg.Signature)
+	if err != nil {
+		return err
+	}
+	if signer != msg.Address {
+		return istanbul.ErrInvalidSigner
 	}
+	return nil
+}
+
+func (c *core) handleCheckedMsg(msg *istanbul.Message, src istanbul.Validator) (err error) {
+	logger := c.NewLogger("address", c.address, "from", msg.Address, "func", "handleCheckedMsg")
+
+	defer func() {
+		// Messages queued for verification are recorded by recordQueuedMsg once handled
+		if err == errMessageQueued {
+			err = nil
+		} else if c.messageTrace != nil {
+			c.messageTrace.add(newMessageTraceRecord(msg, err))
+		}
+	}()
 
 	// Store the message if it's a future message
 	testBacklog := func(err error) error {
+		if err != errMessageQueued {
+			recordMsg(msg.Code, err)
+		}
 		if err == errFutureMessage {
 			c.storeBacklog(msg, src)
+			c.requestViewSyncForFutureMessage(msg)
+		} else if err == errInconsistentSubject {
+			c.recordInconsistentSubject(msg.Address, msg.Code)
 		}
 
 		return err
 	}
 
+	// A message may arrive before the first round has started. Keep it in the backlog, which
+	// is reprocessed once startNewRound has set up the round state.
+	if c.current == nil {
+		logger.Debug("Storing message received before the round state is initialized", "code", msg.Code)
+		return testBacklog(errFutureMessage)
+	}
+
+	if c.isMuted(msg.Address, msg.Code) {
+		c.mutedMessageCounter.Inc(1)
+		return errMutedValidator
+	}
+
 	switch msg.Code {
 	case istanbul.MsgPreprepare:
 		return testBacklog(c.handlePreprepare(msg))
@@ -187,6 +329,10 @@ func (c *core) handleCheckedMsg(msg *istanbul.Message, src istanbul.Validator) e
 		return testBacklog(c.handleCommit(msg))
 	case istanbul.MsgRoundChange:
 		return testBacklog(c.handleRoundChange(msg))
+	case istanbul.MsgViewSyncRequest:
+		return testBacklog(c.handleViewSyncRequest(msg))
+	case istanbul.MsgViewSyncResponse:
+		return testBacklog(c.handleViewSyncResponse(msg))
 	default:
 		logger.Error("Invalid message", "msg", msg)
 	}
@@ -194,10 +340,56 @@ func (c *core) handleCheckedMsg(msg *istanbul.Message, src istanbul.Validator) e
 	return errInvalidMessage
 }
 
+// recordQueuedMsg records the outcome of a message that was queued for verification by its
+// handler, once it has been handled.
+func (c *core) recordQueuedMsg(msg *istanbul.Message, err error) {
+	recordMsg(msg.Code, err)
+	if c.messageTrace != nil {
+		c.messageTrace.add(newMessageTraceRecord(msg, err))
+	}
+}
+
+// subjectSender identifies the messages of one type sent by one validator.
+type subjectSender struct {
+	addr common.Address
+	code uint64
+}
+
+// recordInconsistentSubject counts a message of the given type from the given validator whose
+// subject is inconsistent with ours, and mutes that type of message from the validator for the
+// rest of the sequence once it exceeds the threshold. Its other messages, in particular its
+// ROUND CHANGEs, are still handled so that it can help the network move to another round.
+func (c *core) recordInconsistentSubject(addr common.Address, code uint64) {
+	if c.config.InconsistentSubjectThreshold == 0 || addr == c.address {
+		return
+	}
+	sender := subjectSender{addr, code}
+	c.inconsistentSubjects[sender]++
+	if c.inconsistentSubjects[sender] == c.config.InconsistentSubjectThreshold+1 {
+		c.NewLogger("func", "recordInconsistentSubject").Warn("Muting validator sending inconsistent subjects until the next sequence", "validator", addr, "code", code, "count", c.inconsistentSubjects[sender])
+	}
+}
+
+// isMuted returns whether messages of the given type from the given validator are ignored for the
+// rest of the sequence, for having sent too many inconsistent subjects.
+func (c *core) isMuted(addr common.Address, code uint64) bool {
+	return c.config.InconsistentSubjectThreshold > 0 && c.inconsistentSubjects[subjectSender{addr, code}] > c.config.InconsistentSubjectThreshold
+}
+
 func (c *core) handleTimeoutMsg(timeoutView *istanbul.View) {
 	logger := c.NewLogger("func", "handleTimeoutMsg", "round", timeoutView.Round)
 	logger.Trace("Timed out, trying to wait for next round")
 
 	nextRound := new(big.Int).Add(timeoutView.Round, common.Big1)
-	c.waitForDesiredRound(nextRound)
+	c.waitForDesiredRound(nextRound, RoundChangeTimeout)
+}
+
+// handleProposerSelfCheck gives up the round if we are its proposer and still haven't sent a
+// preprepare for it.
+func (c *core) handleProposerSelfCheck(view *istanbul.View) {
+	if c.current == nil || view.Cmp(c.currentView()) != 0 || c.state != StateAcceptRequest || !c.isProposer() {
+		return
+	}
+	c.NewLogger("func", "handleProposerSelfCheck", "has_request", c.current.pendingRequest != nil).Error("Failed to propose within the block period, relinquishing round")
+	c.sendNextRoundChange(RoundChangeProposerSelfCheck)
 }
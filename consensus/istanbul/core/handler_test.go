@@ -17,11 +17,15 @@
 package core
 
 import (
+	"bytes"
 	"math/big"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/metrics"
 )
 
 // notice: the normal case have been tested in integration tests.
@@ -125,3 +129,278 @@ func TestHandleMsg(t *testing.T) {
 		t.Errorf("error mismatch: have %v, want nil", err)
 	}
 }
+
+func TestMuteInconsistentSubjects(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+	view := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+
+	sys := NewTestSystemWithBackend(N, F)
+	for _, backend := range sys.backends {
+		c := backend.engine.(*core)
+		c.valSet = backend.peers
+		c.current = newTestRoundState(&view, c.valSet)
+		c.state = StatePreprepared
+	}
+	closer := sys.Run(false)
+	defer closer()
+
+	v0 := sys.backends[0]
+	c := v0.engine.(*core)
+	config := *istanbul.DefaultConfig
+	config.InconsistentSubjectThreshold = 3
+	c.config = &config
+
+	spammer, honest := sys.backends[1], sys.backends[2]
+	handle := func(backend *testSystemBackend, digest common.Hash) error {
+		msg, err := backend.getPrepareMessage(view, digest)
+		if err != nil {
+			t.Fatalf("failed to create prepare message: %v", err)
+		}
+		payload, err := msg.Payload()
+		if err != nil {
+			t.Fatalf("failed to encode prepare message: %v", err)
+		}
+		return c.handleMsg(payload)
+	}
+
+	for i := 0; i < 10; i++ {
+		want := errInconsistentSubject
+		if uint64(i) > config.InconsistentSubjectThreshold {
+			want = errMutedValidator
+		}
+		if err := handle(spammer, common.BytesToHash([]byte{byte(i)})); err != want {
+			t.Errorf("inconsistent prepare %d: error mismatch: have %v, want %v", i, err, want)
+		}
+	}
+	// Even consistent messages from the muted validator are ignored
+	if err := handle(spammer, c.current.Proposal().Hash()); err != errMutedValidator {
+		t.Errorf("error mismatch: have %v, want %v", err, errMutedValidator)
+	}
+	if err := handle(honest, c.current.Proposal().Hash()); err != nil {
+		t.Errorf("error mismatch for an unmuted validator: have %v, want nil", err)
+	}
+
+	// Only the type of message that was inconsistent is muted, round changes are still handled
+	c.current.desiredRound = view.Round
+	roundChange, err := spammer.getRoundChangeMessage(istanbul.View{Round: big.NewInt(1), Sequence: view.Sequence}, istanbul.EmptyPreparedCertificate())
+	if err != nil {
+		t.Fatalf("failed to create round change message: %v", err)
+	}
+	payload, err := roundChange.Payload()
+	if err != nil {
+		t.Fatalf("failed to encode round change message: %v", err)
+	}
+	if err := c.handleMsg(payload); err != nil {
+		t.Errorf("error mismatch for a round change from the muted validator: have %v, want nil", err)
+	}
+
+	// The validator is unmuted once the sequence advances
+	v0.committedMsgs = append(v0.committedMsgs, testCommittedMsgs{commitProposal: c.current.Proposal()})
+	c.startNewRound(common.Big0)
+	if c.isMuted(spammer.Address(), istanbul.MsgPrepare) {
+		t.Errorf("validator still muted after a new sequence")
+	}
+}
+
+func TestHandleMsgInvalidSignature(t *testing.T) {
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = false }()
+
+	view := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+	sys := NewTestSystemWithBackend(4, 1)
+	for _, backend := range sys.backends {
+		c := backend.engine.(*core)
+		c.valSet = backend.peers
+		c.current = newTestRoundState(&view, c.valSet)
+		c.state = StatePreprepared
+	}
+	closer := sys.Run(false)
+	defer closer()
+
+	c := sys.backends[0].engine.(*core)
+	c.invalidSignatureCounter = metrics.NewCounter()
+
+	// A PREPARE signed by one validator but claiming to come from another
+	msg, err := sys.backends[1].getPrepareMessage(view, c.current.Proposal().Hash())
+	if err != nil {
+		t.Fatalf("failed to create prepare message: %v", err)
+	}
+	msg.Address = sys.backends[2].Address()
+	payload, err := msg.Payload()
+	if err != nil {
+		t.Fatalf("failed to encode prepare message: %v", err)
+	}
+	if err := c.handleMsg(payload); err != errInvalidMessageSignature {
+		t.Errorf("error mismatch: have %v, want %v", err, errInvalidMessageSignature)
+	}
+	if count := c.invalidSignatureCounter.Count(); count != 1 {
+		t.Errorf("invalid signature count mismatch: have %v, want 1", count)
+	}
+	if c.current.Prepares.Size() != 0 {
+		t.Errorf("prepare with an invalid signature was accepted")
+	}
+
+	// Malformed payloads aren't counted as invalid signatures
+	if err := c.handleMsg([]byte{1}); err == nil || err == errInvalidMessageSignature {
+		t.Errorf("error mismatch: have %v, want a decoding error", err)
+	}
+	if count := c.invalidSignatureCounter.Count(); count != 1 {
+		t.Errorf("invalid signature count mismatch: have %v, want 1", count)
+	}
+
+	// Nor are messages correctly signed by a non-validator
+	key, _ := crypto.GenerateKey()
+	msg, err = sys.backends[1].getPrepareMessage(view, c.current.Proposal().Hash())
+	if err != nil {
+		t.Fatalf("failed to create prepare message: %v", err)
+	}
+	msg.Address = crypto.PubkeyToAddress(key.PublicKey)
+	data, err := msg.PayloadNoSig()
+	if err != nil {
+		t.Fatalf("failed to encode prepare message: %v", err)
+	}
+	if msg.Signature, err = crypto.Sign(crypto.Keccak256(data), key); err != nil {
+		t.Fatalf("failed to sign prepare message: %v", err)
+	}
+	if payload, err = msg.Payload(); err != nil {
+		t.Fatalf("failed to encode prepare message: %v", err)
+	}
+	if err := c.handleMsg(payload); err != istanbul.ErrUnauthorizedAddress {
+		t.Errorf("error mismatch: have %v, want %v", err, istanbul.ErrUnauthorizedAddress)
+	}
+	if count := c.invalidSignatureCounter.Count(); count != 1 {
+		t.Errorf("invalid signature count mismatch: have %v, want 1", count)
+	}
+}
+
+func TestMessageTrace(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	v0 := sys.backends[0]
+	v1 := sys.backends[1]
+	c := v0.engine.(*core)
+	if trace := c.MessageTrace(); len(trace) != 0 {
+		t.Errorf("trace mismatch while disabled: have %v, want none", trace)
+	}
+	c.messageTrace = newMessageTrace(3)
+
+	_, src := c.valSet.GetByAddress(v1.Address())
+	for seq := int64(1); seq <= 5; seq++ {
+		view := istanbul.View{Round: big.NewInt(0), Sequence: big.NewInt(seq)}
+		msg, err := v1.getPrepareMessage(view, common.Hash{})
+		if err != nil {
+			t.Fatalf("failed to create prepare message: %v", err)
+		}
+		c.handleCheckedMsg(&msg, src)
+	}
+
+	// Only the last three messages are kept, oldest first
+	trace := c.MessageTrace()
+	if len(trace) != 3 {
+		t.Fatalf("trace size mismatch: have %v, want 3", len(trace))
+	}
+	for i, record := range trace {
+		wantSeq := int64(i + 3)
+		if record.View == nil || record.View.Sequence.Int64() != wantSeq {
+			t.Errorf("record %d: view mismatch: have %v, want sequence %v", i, record.View, wantSeq)
+		}
+		if record.Code != istanbul.MsgPrepare || record.From != v1.Address() {
+			t.Errorf("record %d: message mismatch: have code %v from %v", i, record.Code, record.From)
+		}
+		if record.Accepted || record.Error != errFutureMessage.Error() {
+			t.Errorf("record %d: outcome mismatch: have accepted %v with error %q, want %q", i, record.Accepted, record.Error, errFutureMessage)
+		}
+	}
+}
+
+func TestMessageSink(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+	sink := new(bytes.Buffer)
+	c.SetMessageSink(sink)
+
+	newBlocks := sys.backends[0].EventMux().Subscribe(istanbul.FinalCommittedEvent{})
+	defer newBlocks.Unsubscribe()
+
+	closer := sys.Run(true)
+	sys.backends[0].NewRequest(makeBlock(1))
+	select {
+	case <-newBlocks.Chan():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("block not committed")
+	}
+	closer()
+
+	records, err := ReadMessageSink(sink)
+	if err != nil {
+		t.Fatalf("failed to read the message sink: %v", err)
+	}
+	received := make(map[uint64]int)
+	sent := make(map[uint64]int)
+	for i, record := range records {
+		msg := new(istanbul.Message)
+		if err := msg.FromPayload(record.Payload, c.validateFn); err != nil {
+			t.Fatalf("record %d: failed to decode message: %v", i, err)
+		}
+		if record.Outgoing {
+			if msg.Address != c.Address() {
+				t.Errorf("record %d: outgoing message from %v", i, msg.Address)
+			}
+			sent[msg.Code]++
+		} else {
+			received[msg.Code]++
+		}
+	}
+	for _, code := range []uint64{istanbul.MsgPreprepare, istanbul.MsgPrepare, istanbul.MsgCommit} {
+		if received[code] == 0 {
+			t.Errorf("no received message with code %v in the sink", code)
+		}
+	}
+	for _, code := range []uint64{istanbul.MsgPrepare, istanbul.MsgCommit} {
+		if sent[code] == 0 {
+			t.Errorf("no sent message with code %v in the sink", code)
+		}
+	}
+}
+
+func TestSetMessageSinkWhileRunning(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+
+	newBlocks := sys.backends[0].EventMux().Subscribe(istanbul.FinalCommittedEvent{})
+	defer newBlocks.Unsubscribe()
+
+	closer := sys.Run(true)
+	defer closer()
+
+	// The sink is swapped while the engine tees messages to it
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.SetMessageSink(new(bytes.Buffer))
+			}
+		}
+	}()
+	sys.backends[0].NewRequest(makeBlock(1))
+	select {
+	case <-newBlocks.Chan():
+	case <-time.After(5 * time.Second):
+		t.Errorf("block not committed")
+	}
+	close(stop)
+	<-done
+}
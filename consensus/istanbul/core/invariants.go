@@ -0,0 +1,88 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// startInvariantChecks starts asking the event loop to check the invariants of the round state
+// every InvariantCheckInterval, if enabled.
+func (c *core) startInvariantChecks() {
+	if c.config == nil || c.config.InvariantCheckInterval == 0 {
+		return
+	}
+	c.invariantCheckStop = make(chan struct{})
+	go c.runPeriodically(time.Duration(c.config.InvariantCheckInterval)*time.Millisecond, c.invariantCheckStop, func() {
+		c.sendEvent(invariantCheckEvent{})
+	})
+}
+
+func (c *core) stopInvariantChecks() {
+	if c.invariantCheckStop != nil {
+		close(c.invariantCheckStop)
+		c.invariantCheckStop = nil
+	}
+}
+
+// handleInvariantCheck logs and counts the invariants of the round state that don't hold. They
+// point at a bug rather than at misbehaving peers, so the node carries on regardless.
+func (c *core) handleInvariantCheck() {
+	for _, violation := range c.checkInvariants() {
+		c.invariantViolationCounter.Inc(1)
+		c.NewLogger("func", "handleInvariantCheck").Error("Consensus invariant violated", "violation", violation)
+	}
+}
+
+// checkInvariants returns a description of each invariant of the round state that doesn't hold.
+func (c *core) checkInvariants() []string {
+	if c.current == nil || c.valSet == nil {
+		return nil
+	}
+	var violations []string
+
+	round, desiredRound := c.current.Round(), c.current.DesiredRound()
+	if round.Cmp(desiredRound) > 0 {
+		violations = append(violations, fmt.Sprintf("round %v beyond desired round %v", round, desiredRound))
+	}
+
+	sequence := c.current.Sequence()
+	preparedCertificate := c.current.PreparedCertificate()
+	if view := preparedCertificate.View(); view != nil && view.Sequence.Cmp(sequence) != 0 {
+		violations = append(violations, fmt.Sprintf("prepared certificate for sequence %v in sequence %v", view.Sequence, sequence))
+	}
+	if preprepare := c.current.Preprepare; preprepare != nil && preprepare.View.Sequence.Cmp(sequence) != 0 {
+		violations = append(violations, fmt.Sprintf("preprepare for sequence %v in sequence %v", preprepare.View.Sequence, sequence))
+	}
+
+	sets := []struct {
+		name     string
+		messages *messageSet
+	}{
+		{"prepare", c.current.Prepares},
+		{"commit", c.current.Commits},
+	}
+	for _, set := range sets {
+		for _, msg := range set.messages.Values() {
+			if index, _ := c.valSet.GetByAddress(msg.Address); index < 0 {
+				violations = append(violations, fmt.Sprintf("%s from %v outside the validator set", set.name, msg.Address.Hex()))
+			}
+		}
+	}
+	return violations
+}
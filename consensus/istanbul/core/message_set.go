@@ -95,6 +95,7 @@ func (ms *messageSet) Values() (result []*istanbul.Message) {
 	ms.messagesMu.Lock()
 	defer ms.messagesMu.Unlock()
 
+	result = make([]*istanbul.Message, 0, len(ms.messages))
 	for _, v := range ms.messages {
 		result = append(result, v)
 	}
@@ -114,6 +115,13 @@ func (ms *messageSet) Get(addr common.Address) *istanbul.Message {
 	return ms.messages[addr]
 }
 
+// remove deletes the message of the given address, if any
+func (ms *messageSet) remove(addr common.Address) {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+	delete(ms.messages, addr)
+}
+
 // ----------------------------------------------------------------------------
 
 func (ms *messageSet) verify(msg *istanbul.Message) error {
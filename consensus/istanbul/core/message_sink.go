@@ -0,0 +1,72 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"io"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// MessageSinkRecord is a consensus message teed to the message sink, in the order it was handled
+// or broadcast. The stream of RLP encoded records can be read back with ReadMessageSink to replay
+// the messages.
+type MessageSinkRecord struct {
+	Outgoing bool   // Whether the message was broadcast by the node rather than received
+	Time     uint64 // When the message was handled or broadcast, in nanoseconds since the Unix epoch
+	Payload  []byte // The message as received or broadcast, including its signature
+}
+
+// ReadMessageSink decodes the records written to a message sink, oldest first.
+func ReadMessageSink(r io.Reader) ([]MessageSinkRecord, error) {
+	s := rlp.NewStream(r, 0)
+	var records []MessageSinkRecord
+	for {
+		var record MessageSinkRecord
+		if err := s.Decode(&record); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+// SetMessageSink implements core.Engine.SetMessageSink
+func (c *core) SetMessageSink(sink io.Writer) {
+	c.messageSinkMu.Lock()
+	defer c.messageSinkMu.Unlock()
+	c.messageSink = sink
+}
+
+// writeToMessageSink tees a received or broadcast message payload to the message sink, if any.
+func (c *core) writeToMessageSink(payload []byte, outgoing bool) {
+	c.messageSinkMu.Lock()
+	defer c.messageSinkMu.Unlock()
+
+	if c.messageSink == nil {
+		return
+	}
+	record := MessageSinkRecord{
+		Outgoing: outgoing,
+		Time:     uint64(c.clock.Now().UnixNano()),
+		Payload:  payload,
+	}
+	if err := rlp.Encode(c.messageSink, &record); err != nil {
+		c.logger.Warn("Failed to write message to the message sink", "err", err)
+	}
+}
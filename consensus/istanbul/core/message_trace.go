@@ -0,0 +1,98 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// messageTrace is a ring buffer of the last consensus messages handled by the core, kept for
+// post-mortem analysis of a stuck validator.
+type messageTrace struct {
+	mu      sync.Mutex
+	records []MessageTraceRecord
+	next    int  // index of the next record to overwrite
+	full    bool // whether the buffer wrapped around
+}
+
+func newMessageTrace(size uint64) *messageTrace {
+	return &messageTrace{records: make([]MessageTraceRecord, size)}
+}
+
+// add records a handled message, evicting the oldest record if the buffer is full.
+func (t *messageTrace) add(record MessageTraceRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.records[t.next] = record
+	t.next++
+	if t.next == len(t.records) {
+		t.next = 0
+		t.full = true
+	}
+}
+
+// list returns the records in the buffer, oldest first.
+func (t *messageTrace) list() []MessageTraceRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.full {
+		return append([]MessageTraceRecord{}, t.records[:t.next]...)
+	}
+	return append(append([]MessageTraceRecord{}, t.records[t.next:]...), t.records[:t.next]...)
+}
+
+// newMessageTraceRecord returns the trace record of a message handled with the given error.
+func newMessageTraceRecord(msg *istanbul.Message, err error) MessageTraceRecord {
+	record := MessageTraceRecord{
+		Code:     msg.Code,
+		View:     messageView(msg),
+		From:     msg.Address,
+		Accepted: err == nil,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// messageView returns the view of a consensus message, or nil if it can't be decoded. The view is
+// the first field of all consensus messages, so the rest of the message isn't decoded.
+func messageView(msg *istanbul.Message) *istanbul.View {
+	s := rlp.NewStream(bytes.NewReader(msg.Msg), uint64(len(msg.Msg)))
+	if _, err := s.List(); err != nil {
+		return nil
+	}
+	var view *istanbul.View
+	if err := s.Decode(&view); err != nil {
+		return nil
+	}
+	return view
+}
+
+// MessageTrace implements core.Engine.MessageTrace
+func (c *core) MessageTrace() []MessageTraceRecord {
+	if c.messageTrace == nil {
+		return []MessageTraceRecord{}
+	}
+	return c.messageTrace.list()
+}
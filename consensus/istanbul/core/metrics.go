@@ -0,0 +1,109 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	// msgMetrics holds the traffic counters for each consensus message type
+	msgMetrics = map[uint64]*msgCounters{
+		istanbul.MsgPreprepare:       newMsgCounters("preprepare"),
+		istanbul.MsgPrepare:          newMsgCounters("prepare"),
+		istanbul.MsgCommit:           newMsgCounters("commit"),
+		istanbul.MsgRoundChange:      newMsgCounters("roundchange"),
+		istanbul.MsgViewSyncRequest:  newMsgCounters("viewsyncrequest"),
+		istanbul.MsgViewSyncResponse: newMsgCounters("viewsyncresponse"),
+	}
+
+	// undecodableMsgCounter counts the messages whose payload could not be decoded, so that their type is unknown
+	undecodableMsgCounter = metrics.NewRegisteredCounter("consensus/istanbul/core/msg/undecodable", nil)
+)
+
+// msgCounters counts the accepted and rejected messages of a single type, with
+// rejections split by the category of the error.
+type msgCounters struct {
+	accepted     metrics.Counter
+	future       metrics.Counter
+	farFuture    metrics.Counter
+	nonProposer  metrics.Counter
+	old          metrics.Counter
+	inconsistent metrics.Counter
+	signature    metrics.Counter
+	nonValidator metrics.Counter
+	other        metrics.Counter
+}
+
+func newMsgCounters(msgType string) *msgCounters {
+	prefix := "consensus/istanbul/core/msg/" + msgType
+	return &msgCounters{
+		accepted:     metrics.NewRegisteredCounter(prefix+"/accepted", nil),
+		future:       metrics.NewRegisteredCounter(prefix+"/rejected/future", nil),
+		farFuture:    metrics.NewRegisteredCounter(prefix+"/rejected/farfuture", nil),
+		nonProposer:  metrics.NewRegisteredCounter(prefix+"/rejected/nonproposer", nil),
+		old:          metrics.NewRegisteredCounter(prefix+"/rejected/old", nil),
+		inconsistent: metrics.NewRegisteredCounter(prefix+"/rejected/inconsistent", nil),
+		signature:    metrics.NewRegisteredCounter(prefix+"/rejected/signature", nil),
+		nonValidator: metrics.NewRegisteredCounter(prefix+"/rejected/nonvalidator", nil),
+		other:        metrics.NewRegisteredCounter(prefix+"/rejected/other", nil),
+	}
+}
+
+func (m *msgCounters) record(err error) {
+	switch err {
+	case nil:
+		m.accepted.Inc(1)
+	case errFutureMessage:
+		m.future.Inc(1)
+	case errFarFutureMessage:
+		m.farFuture.Inc(1)
+	case errPreprepareNotFromProposer:
+		m.nonProposer.Inc(1)
+	case errOldMessage:
+		m.old.Inc(1)
+	case errInconsistentSubject:
+		m.inconsistent.Inc(1)
+	case errInvalidCommittedSeal, errInvalidMessageSignature, istanbul.ErrInvalidSigner:
+		m.signature.Inc(1)
+	case istanbul.ErrUnauthorizedAddress:
+		m.nonValidator.Inc(1)
+	default:
+		m.other.Inc(1)
+	}
+}
+
+// recordMsg updates the traffic counters for a handled message of the given type.
+func recordMsg(code uint64, err error) {
+	if m, ok := msgMetrics[code]; ok {
+		m.record(err)
+	}
+}
+
+// recordMsgSignatureFailure updates the traffic counters for a message of the given type that
+// failed authentication before reaching its handler.
+func recordMsgSignatureFailure(code uint64) {
+	if m, ok := msgMetrics[code]; ok {
+		m.signature.Inc(1)
+	}
+}
+
+// recordUndecodableMsg updates the traffic counters for a message whose payload could not be decoded.
+func recordUndecodableMsg() {
+	undecodableMsgCounter.Inc(1)
+}
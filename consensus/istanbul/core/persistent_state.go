@@ -2,81 +2,323 @@ package core
 
 import (
 	"fmt"
+	"math/big"
+	"strings"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
 	"io/ioutil"
-	"math/big"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
-func (c *core) savePrepareMessageToDisk(
-	messageType uint64,
-	roundNumber *big.Int,
-	sequenceNumber *big.Int,
-	msg []byte) error {
-	fileName, err := c.generateFileName(messageType, roundNumber, sequenceNumber)
+// roundStateFileName is the name of the file in the data directory holding the
+// persisted round state.
+const roundStateFileName = "geth_istanbul_roundstate"
+
+// persistedRoundState is the on-disk form of the round state. Hash is the
+// roundState.Hash() at the time it was written and is compared against the hash
+// recomputed on load. PendingProposal holds at most one block, as a nil block cannot
+// be RLP encoded.
+type persistedRoundState struct {
+	Hash                common.Hash
+	View                *istanbul.View
+	PendingProposal     []*types.Block
+	PreparedCertificate istanbul.PreparedCertificate
+}
+
+// saveRoundStateToDisk writes the current round state together with its hash to the disk.
+func (c *core) saveRoundStateToDisk() error {
+	c.current.mu.RLock()
+	persisted := &persistedRoundState{
+		Hash:                c.current.hash(),
+		View:                &istanbul.View{Round: c.current.round, Sequence: c.current.sequence},
+		PreparedCertificate: c.current.preparedCertificate,
+	}
+	if c.current.pendingRequest != nil {
+		if block, ok := c.current.pendingRequest.Proposal.(*types.Block); ok && block != nil {
+			persisted.PendingProposal = []*types.Block{block}
+		}
+	}
+	data, err := rlp.EncodeToBytes(persisted)
+	c.current.mu.RUnlock()
 	if err != nil {
 		return err
 	}
-	err2 := writeToDisk(fileName, msg)
-	log.Debug("savePrepareMessageToDisk/wrote file to the disk", "file", fileName, "error", err2)
-	return err2
+	return c.messageStore.SaveRoundState(data)
 }
 
-// getPreprepareMessageFromDisk returns the prepared message
-// If the file does not exist, it returns (nil, nil).
-// It returns an error for all other failure cases.
-func (c *core) getPreprepareMessageFromDisk(
-	messageType uint64,
-	roundNumber *big.Int,
-	sequenceNumber *big.Int) ([]byte, error) {
-	fileName, err := c.generateFileName(messageType, roundNumber, sequenceNumber)
+// getRoundStateFromDisk returns the round state persisted by saveRoundStateToDisk.
+// If there is none, it returns (nil, nil).
+// If the persisted state cannot be decoded or its hash does not match the recomputed
+// hash, it is deleted and errCorruptRoundState is returned.
+func (c *core) getRoundStateFromDisk() (*roundState, error) {
+	data, err := c.messageStore.LoadRoundState()
 	if err != nil {
 		return nil, err
+	} else if data == nil {
+		log.Debug("getRoundStateFromDisk/no round state stored")
+		return nil, nil
 	}
+
+	var persisted persistedRoundState
+	if err := rlp.DecodeBytes(data, &persisted); err != nil || persisted.View == nil || persisted.View.Round == nil || persisted.View.Sequence == nil {
+		log.Error("Discarding undecodable round state", "err", err)
+		c.messageStore.DeleteRoundState()
+		return nil, errCorruptRoundState
+	}
+
+	var request *istanbul.Request
+	if len(persisted.PendingProposal) > 0 {
+		request = &istanbul.Request{Proposal: persisted.PendingProposal[0]}
+	}
+	state := newRoundState(persisted.View, c.valSet, nil, request, persisted.PreparedCertificate, c.backend.HasBadProposal)
+	if hash := state.Hash(); hash != persisted.Hash {
+		log.Error("Discarding corrupt round state", "expected", persisted.Hash, "got", hash)
+		c.messageStore.DeleteRoundState()
+		return nil, errCorruptRoundState
+	}
+	log.Debug("getRoundStateFromDisk/round state found")
+	return state, nil
+}
+
+// resumeRoundState carries the round state persisted by a previous run over to the round we
+// started in, if they are of the same sequence. The PREPARED certificate is kept so that we stay
+// locked on its proposal, and we move on to the round after the persisted one, as we may have
+// signed messages in that view before the restart.
+func (c *core) resumeRoundState(state *roundState) {
+	logger := c.NewLogger("func", "resumeRoundState", "persisted_round", state.Round(), "persisted_seq", state.Sequence())
+	if c.current == nil || state.Sequence().Cmp(c.current.Sequence()) != 0 {
+		logger.Debug("Ignoring persisted round state of another sequence")
+		return
+	}
+	current, persisted := c.current.PreparedCertificate(), state.PreparedCertificate()
+	if current.IsEmpty() && !persisted.IsEmpty() {
+		c.current.SetPreparedCertificate(persisted)
+	}
+	logger.Info("Resuming from persisted round state")
+	c.waitForDesiredRound(new(big.Int).Add(state.Round(), common.Big1), RoundChangeResumed)
+}
+
+// startMessageStoreCompaction starts removing the stored messages of finalized sequences every
+// MessageStoreCompactionInterval, if enabled.
+func (c *core) startMessageStoreCompaction() {
+	if c.config == nil || c.config.MessageStoreCompactionInterval == 0 {
+		return
+	}
+	c.messageStoreCompactionStop = make(chan struct{})
+	go c.runPeriodically(time.Duration(c.config.MessageStoreCompactionInterval)*time.Millisecond, c.messageStoreCompactionStop, c.compactMessageStore)
+}
+
+func (c *core) stopMessageStoreCompaction() {
+	if c.messageStoreCompactionStop != nil {
+		close(c.messageStoreCompactionStop)
+		c.messageStoreCompactionStop = nil
+	}
+}
+
+// compactMessageStore removes the stored messages of the sequences up to the last finalized one,
+// which the rounds torn down without deleting their messages leave behind.
+func (c *core) compactMessageStore() {
+	lastProposal, _ := c.backend.LastProposal()
+	if lastProposal == nil {
+		return
+	}
+	if err := c.messageStore.DeleteBefore(new(big.Int).Add(lastProposal.Number(), common.Big1)); err != nil {
+		log.Error("Failed to compact the message store", "err", err)
+	}
+}
+
+// diskMessageStore is the default MessageStore, keeping each message and the round state in its
+// own file of the data directory.
+type diskMessageStore struct {
+	dir string
+}
+
+// NewDiskMessageStore returns a MessageStore keeping its files in the given directory
+func NewDiskMessageStore(dir string) MessageStore {
+	return &diskMessageStore{dir: dir}
+}
+
+func (s *diskMessageStore) fileName(view *istanbul.View, code uint64) string {
+	fileName := fmt.Sprintf("geth_istanbul_sequence_%s_round_%s_type_%d",
+		view.Sequence.String(), view.Round.String(), code)
+	return filepath.Join(s.dir, fileName)
+}
+
+// Save implements MessageStore.Save
+func (s *diskMessageStore) Save(view *istanbul.View, code uint64, data []byte) error {
+	fileName := s.fileName(view, code)
+	err := writeToDisk(fileName, data)
+	log.Debug("diskMessageStore/wrote file to the disk", "file", fileName, "error", err)
+	return err
+}
+
+// Load implements MessageStore.Load
+func (s *diskMessageStore) Load(view *istanbul.View, code uint64) ([]byte, error) {
+	fileName := s.fileName(view, code)
 	data, err := ioutil.ReadFile(fileName)
 	if os.IsNotExist(err) {
-		log.Debug("getPreprepareMessageFromDisk/file does not exist", "file", fileName)
+		log.Debug("diskMessageStore/file does not exist", "file", fileName)
 		return nil, nil
 	}
-	log.Debug("getPreprepareMessageFromDisk/file found on the disk", "file", fileName)
+	log.Debug("diskMessageStore/file found on the disk", "file", fileName)
 	return data, err
 }
 
-// deleteMessageFromDisk deletes all files from this round and the sequence number `sequenceNumber`
-func (c *core) deleteMessageFromDisk(
-	roundNumber *big.Int, sequenceNumber *big.Int) error {
-	dir := c.backend.GetDataDir()
-	// This pattern must be  similar to the filenames generated by
-	// generateFileName function.
-	filePattern := filepath.Join(dir,
-		fmt.Sprintf("geth_istanbul_sequence_%s_round_%s_type_.*",
-			sequenceNumber.String(), roundNumber.String()))
+// Delete implements MessageStore.Delete, deleting all files of the view
+func (s *diskMessageStore) Delete(view *istanbul.View) error {
+	// This pattern must be similar to the filenames generated by fileName
+	filePattern := filepath.Join(s.dir,
+		fmt.Sprintf("geth_istanbul_sequence_%s_round_%s_type_*",
+			view.Sequence.String(), view.Round.String()))
 	files, err := filepath.Glob(filePattern)
 	if err != nil {
-		panic("File pattern is bad: " + filePattern)
+		return err
 	}
 	for i, file := range files {
 		log.Debug("Deleting file", "file", file, "index", i, "total", len(files))
-		err := os.Remove(file)
-		if err == nil {
-			log.Debug("Deleted file", "file", file)
-		} else {
-			log.Error("Failed to delete file", "file", file)
+		if err := os.Remove(file); err != nil {
+			log.Error("Failed to delete file", "file", file, "err", err)
+			continue
 		}
+		log.Debug("Deleted file", "file", file)
 	}
 	return nil
 }
 
-func (c *core) generateFileName(
-	messageType uint64,
-	roundNumber *big.Int,
-	sequenceNumber *big.Int) (string, error) {
-	dir := c.backend.GetDataDir()
-	fileName := fmt.Sprintf("geth_istanbul_sequence_%s_round_%s_type_%d",
-		sequenceNumber.String(), roundNumber.String(), messageType)
-	return filepath.Join(dir, fileName), nil
+// DeleteBefore implements MessageStore.DeleteBefore
+func (s *diskMessageStore) DeleteBefore(sequence *big.Int) error {
+	// This pattern must be similar to the filenames generated by fileName
+	files, err := filepath.Glob(filepath.Join(s.dir, "geth_istanbul_sequence_*_round_*_type_*"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		fields := strings.Split(strings.TrimPrefix(filepath.Base(file), "geth_istanbul_sequence_"), "_")
+		fileSequence, ok := new(big.Int).SetString(fields[0], 10)
+		if !ok || fileSequence.Cmp(sequence) >= 0 {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			log.Error("Failed to delete file", "file", file, "err", err)
+			continue
+		}
+		log.Debug("Deleted file", "file", file)
+	}
+	return nil
+}
+
+// SaveRoundState implements MessageStore.SaveRoundState
+func (s *diskMessageStore) SaveRoundState(data []byte) error {
+	fileName := filepath.Join(s.dir, roundStateFileName)
+	err := writeToDisk(fileName, data)
+	log.Debug("diskMessageStore/wrote round state to the disk", "file", fileName, "error", err)
+	return err
+}
+
+// LoadRoundState implements MessageStore.LoadRoundState
+func (s *diskMessageStore) LoadRoundState() ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, roundStateFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// DeleteRoundState implements MessageStore.DeleteRoundState
+func (s *diskMessageStore) DeleteRoundState() error {
+	err := os.Remove(filepath.Join(s.dir, roundStateFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// memoryMessageStore is a MessageStore that doesn't survive restarts, for tests and validators
+// whose data directory isn't writable.
+type memoryMessageStore struct {
+	mu         sync.Mutex
+	messages   map[memoryMessageKey][]byte
+	roundState []byte
+}
+
+type memoryMessageKey struct {
+	sequence string
+	round    string
+	code     uint64
+}
+
+// NewMemoryMessageStore returns a MessageStore keeping its messages in memory
+func NewMemoryMessageStore() MessageStore {
+	return &memoryMessageStore{messages: make(map[memoryMessageKey][]byte)}
+}
+
+// Save implements MessageStore.Save
+func (s *memoryMessageStore) Save(view *istanbul.View, code uint64, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages[memoryMessageKey{view.Sequence.String(), view.Round.String(), code}] = common.CopyBytes(data)
+	return nil
+}
+
+// Load implements MessageStore.Load
+func (s *memoryMessageStore) Load(view *istanbul.View, code uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return common.CopyBytes(s.messages[memoryMessageKey{view.Sequence.String(), view.Round.String(), code}]), nil
+}
+
+// Delete implements MessageStore.Delete
+func (s *memoryMessageStore) Delete(view *istanbul.View) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.messages {
+		if key.sequence == view.Sequence.String() && key.round == view.Round.String() {
+			delete(s.messages, key)
+		}
+	}
+	return nil
+}
+
+// DeleteBefore implements MessageStore.DeleteBefore
+func (s *memoryMessageStore) DeleteBefore(sequence *big.Int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.messages {
+		if keySequence, ok := new(big.Int).SetString(key.sequence, 10); ok && keySequence.Cmp(sequence) < 0 {
+			delete(s.messages, key)
+		}
+	}
+	return nil
+}
+
+// SaveRoundState implements MessageStore.SaveRoundState
+func (s *memoryMessageStore) SaveRoundState(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roundState = common.CopyBytes(data)
+	return nil
+}
+
+// LoadRoundState implements MessageStore.LoadRoundState
+func (s *memoryMessageStore) LoadRoundState() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return common.CopyBytes(s.roundState), nil
+}
+
+// DeleteRoundState implements MessageStore.DeleteRoundState
+func (s *memoryMessageStore) DeleteRoundState() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roundState = nil
+	return nil
 }
 
 func writeToDisk(filePath string, data []byte) error {
@@ -17,14 +17,16 @@
 package core
 
 import (
+	"math/big"
 	"reflect"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/log"
 )
 
 func (c *core) sendPrepare() {
-	logger := c.logger.New("state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "sendPrepare")
+	logger := c.NewLogger("func", "sendPrepare")
 
 	sub := c.current.Subject()
 	encodedSubject, err := Encode(sub)
@@ -40,76 +42,119 @@ func (c *core) sendPrepare() {
 }
 
 func (c *core) verifyPreparedCertificate(preparedCertificate istanbul.PreparedCertificate) error {
-	logger := c.logger.New("state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "verifyPreparedCertificate")
-
 	// Validate the attached proposal
-	if _, err := c.backend.Verify(preparedCertificate.Proposal); err != nil {
+	if _, err := c.verifyProposal(preparedCertificate.Proposal); err != nil {
 		return errInvalidPreparedCertificateProposal
 	}
 
-	if len(preparedCertificate.PrepareOrCommitMessages) > c.valSet.Size() || len(preparedCertificate.PrepareOrCommitMessages) < c.valSet.MinQuorumSize() {
-		return errInvalidPreparedCertificateNumMsgs
+	sequence, err := verifyPreparedCertificateMessages(preparedCertificate, c.valSet, c.checkCachedMessageSignature, c.config.CommittedSealHasher)
+	if err != nil {
+		return err
+	}
+	// Verify the certificate is for the proper sequence.
+	if sequence.Cmp(c.currentView().Sequence) != 0 {
+		return errInvalidPreparedCertificateMsgView
+	}
+	return nil
+}
+
+// VerifyPreparedCertificate checks that the PREPARE and COMMIT messages of the given certificate
+// are for its proposal and a single sequence, and are signed by a quorum of the given validators.
+// Unlike the core method it does not verify the proposal itself or the sequence it was prepared in.
+// The committed seals of the COMMIT messages are verified with the given hash-to-curve suite.
+func VerifyPreparedCertificate(preparedCertificate istanbul.PreparedCertificate, valSet istanbul.ValidatorSet, hasher istanbul.CommittedSealHasher) error {
+	checkSignature := func(data []byte, message *istanbul.Message) (common.Address, error) {
+		return istanbul.CheckValidatorSignature(valSet, data, message.Signature)
+	}
+	_, err := verifyPreparedCertificateMessages(preparedCertificate, valSet, checkSignature, hasher)
+	return err
+}
+
+// verifyPreparedCertificateMessages verifies the messages of a PREPARED certificate against the
+// validator set, using checkSignature to recover their signers, and returns the sequence they were
+// sent for. A certificate may mix PREPARE and COMMIT messages, as a COMMIT implies its sender
+// prepared, but only if they were all sent in the same round.
+func verifyPreparedCertificateMessages(preparedCertificate istanbul.PreparedCertificate, valSet istanbul.ValidatorSet, checkSignature func([]byte, *istanbul.Message) (common.Address, error), hasher istanbul.CommittedSealHasher) (*big.Int, error) {
+	if len(preparedCertificate.PrepareOrCommitMessages) > valSet.Size() || len(preparedCertificate.PrepareOrCommitMessages) < valSet.MinQuorumSize() {
+		return nil, errInvalidPreparedCertificateNumMsgs
 	}
 
+	var sequence *big.Int
+	// the round of the certificate's PREPARE and COMMIT messages respectively
+	rounds := make(map[uint64]*big.Int)
 	seen := make(map[common.Address]bool)
 	for _, message := range preparedCertificate.PrepareOrCommitMessages {
 		data, err := message.PayloadNoSig()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// Verify message signed by a validator
-		signer, err := c.validateFn(data, message.Signature)
+		signer, err := checkSignature(data, &message)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		if signer != message.Address {
-			return errInvalidPreparedCertificateMsgSignature
+			return nil, errInvalidPreparedCertificateMsgSignature
 		}
 
 		// Check for duplicate messages
 		if seen[signer] {
-			return errInvalidPreparedCertificateDuplicate
+			return nil, errInvalidPreparedCertificateDuplicate
 		}
 		seen[signer] = true
 
 		// Check that the message is a PREPARE or COMMIT message
 		if message.Code != istanbul.MsgPrepare && message.Code != istanbul.MsgCommit {
-			return errInvalidPreparedCertificateMsgCode
+			return nil, errInvalidPreparedCertificateMsgCode
 		}
 
 		var subject *istanbul.Subject
 		if err := message.Decode(&subject); err != nil {
-			logger.Error("Failed to decode message in PREPARED certificate", "err", err)
-			return err
+			log.Error("Failed to decode message in PREPARED certificate", "err", err)
+			return nil, err
+		}
+
+		// Verify all messages are for the same sequence.
+		if sequence == nil {
+			sequence = subject.View.Sequence
+		} else if subject.View.Sequence.Cmp(sequence) != 0 {
+			return nil, errInvalidPreparedCertificateMsgView
 		}
 
-		// Verify message for the proper sequence.
-		if subject.View.Sequence.Cmp(c.currentView().Sequence) != 0 {
-			return errInvalidPreparedCertificateMsgView
+		// Verify all messages of a code are for the same round, and that it's the round of the
+		// messages of the other code.
+		if round, ok := rounds[message.Code]; !ok {
+			rounds[message.Code] = subject.View.Round
+		} else if subject.View.Round.Cmp(round) != 0 {
+			return nil, errInvalidPreparedCertificateMsgView
+		}
+		prepareRound, commitRound := rounds[istanbul.MsgPrepare], rounds[istanbul.MsgCommit]
+		if prepareRound != nil && commitRound != nil && prepareRound.Cmp(commitRound) != 0 {
+			return nil, errInvalidPreparedCertificateMsgMix
 		}
 
 		// Verify message for the proper proposal.
 		if subject.Digest != preparedCertificate.Proposal.Hash() {
-			return errInvalidPreparedCertificateDigestMismatch
+			return nil, errInvalidPreparedCertificateDigestMismatch
 		}
 
 		// If COMMIT message, verify valid committed seal.
 		if message.Code == istanbul.MsgCommit {
-			_, src := c.valSet.GetByAddress(signer)
-			err := c.verifyCommittedSeal(subject.Digest, message.CommittedSeal, src)
+			_, src := valSet.GetByAddress(signer)
+			err := verifyCommittedSeal(subject.Digest, message.CommittedSeal, src, hasher.UseComposite())
 			if err != nil {
-				logger.Error("Commit seal did not contain signature from message signer.", "err", err)
-				return err
+				log.Error("Commit seal did not contain signature from message signer.", "err", err)
+				return nil, err
 			}
 		}
 	}
-	return nil
+	return sequence, nil
 }
 
 func (c *core) handlePrepare(msg *istanbul.Message) error {
-	logger := c.logger.New("state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "handlePrepare", "tag", "handleMsg")
+	logger := c.NewLogger("func", "handlePrepare", "tag", "handleMsg")
 	// Decode PREPARE message
 	var prepare *istanbul.Subject
 	err := msg.Decode(&prepare)
@@ -118,6 +163,9 @@ func (c *core) handlePrepare(msg *istanbul.Message) error {
 	}
 
 	if err := c.checkMessage(istanbul.MsgPrepare, prepare.View); err != nil {
+		if err == errOldMessage {
+			return c.acceptOldRoundMessage(msg, prepare)
+		}
 		return err
 	}
 
@@ -137,9 +185,12 @@ func (c *core) handlePrepare(msg *istanbul.Message) error {
 		if err := c.current.CreateAndSetPreparedCertificate(minQuorumSize); err != nil {
 			return err
 		}
+		if err := c.saveRoundStateToDisk(); err != nil {
+			logger.Error("Failed to write round state to the disk", "err", err)
+		}
 		logger.Trace("Got quorum prepares or commits", "tag", "stateTransition", "commits", c.current.Commits, "prepares", c.current.Prepares)
 		c.setState(StatePrepared)
-		c.sendCommit()
+		c.deferCommit()
 	}
 
 	return nil
@@ -147,7 +198,7 @@ func (c *core) handlePrepare(msg *istanbul.Message) error {
 
 // verifyPrepare verifies if the received PREPARE message is equivalent to our subject
 func (c *core) verifyPrepare(prepare *istanbul.Subject) error {
-	logger := c.logger.New("state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "verifyPrepare")
+	logger := c.NewLogger("func", "verifyPrepare")
 
 	sub := c.current.Subject()
 	if !reflect.DeepEqual(prepare, sub) {
@@ -159,7 +210,7 @@ func (c *core) verifyPrepare(prepare *istanbul.Subject) error {
 }
 
 func (c *core) acceptPrepare(msg *istanbul.Message) error {
-	logger := c.logger.New("from", msg.Address, "state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "acceptPrepare")
+	logger := c.NewLogger("from", msg.Address, "func", "acceptPrepare")
 
 	// Add the PREPARE message to current round state
 	if err := c.current.Prepares.Add(msg); err != nil {
@@ -169,3 +220,72 @@ func (c *core) acceptPrepare(msg *istanbul.Message) error {
 
 	return nil
 }
+
+// acceptOldRoundMessage gathers a PREPARE or COMMIT message sent in one of the OldRoundTolerance
+// rounds before the current one, as gossip may deliver it just after we moved on. Only messages
+// for the proposal of the current round are kept, and only while we hold no prepared certificate
+// from their round or a later one. Once a quorum of them is gathered for a round, they become our
+// prepared certificate, which our round changes carry on. A certificate can't mix rounds, so they
+// never count toward the certificate of the current round. It returns errOldMessage if the
+// message isn't kept.
+func (c *core) acceptOldRoundMessage(msg *istanbul.Message, subject *istanbul.Subject) error {
+	tolerance := new(big.Int).SetUint64(c.config.OldRoundTolerance)
+	if tolerance.Sign() == 0 || subject.View.Sequence.Cmp(c.current.Sequence()) != 0 {
+		return errOldMessage
+	}
+	if behind := new(big.Int).Sub(c.current.Round(), subject.View.Round); behind.Sign() <= 0 || behind.Cmp(tolerance) > 0 {
+		return errOldMessage
+	}
+	proposal := c.current.Proposal()
+	if proposal == nil || subject.Digest != proposal.Hash() {
+		return errOldMessage
+	}
+	held := c.current.PreparedCertificate()
+	if view := held.View(); view != nil && view.Round.Cmp(subject.View.Round) >= 0 {
+		return errOldMessage
+	}
+	_, validator := c.valSet.GetByAddress(msg.Address)
+	if validator == nil {
+		return errInvalidValidatorAddress
+	}
+	if msg.Code == istanbul.MsgCommit {
+		if err := verifyCommittedSeal(subject.Digest, msg.CommittedSeal, validator, c.config.CommittedSealHasher.UseComposite()); err != nil {
+			return errInvalidCommittedSeal
+		}
+	}
+
+	// Rounds that fell out of the tolerance can't be completed anymore
+	oldest := new(big.Int).Sub(c.current.Round(), tolerance)
+	for round := range c.oldRoundMessages {
+		if oldest.Cmp(new(big.Int).SetUint64(round)) > 0 {
+			delete(c.oldRoundMessages, round)
+		}
+	}
+	round := subject.View.Round.Uint64()
+	messages := c.oldRoundMessages[round]
+	if messages == nil {
+		messages = newMessageSet(c.valSet)
+		c.oldRoundMessages[round] = messages
+	}
+	if messages.Get(msg.Address) != nil {
+		return nil
+	}
+	if err := messages.Add(msg); err != nil {
+		return err
+	}
+	if messages.Size() < c.valSet.MinQuorumSize() {
+		return nil
+	}
+
+	preparedCertificate := istanbul.PreparedCertificate{Proposal: proposal}
+	for _, message := range messages.Values() {
+		preparedCertificate.PrepareOrCommitMessages = append(preparedCertificate.PrepareOrCommitMessages, *message)
+	}
+	c.current.SetPreparedCertificate(preparedCertificate)
+	delete(c.oldRoundMessages, round)
+	c.NewLogger("func", "acceptOldRoundMessage").Info("Prepared certificate gathered from late messages of an earlier round", "round", round, "hash", proposal.Hash())
+	if err := c.saveRoundStateToDisk(); err != nil {
+		c.NewLogger("func", "acceptOldRoundMessage").Error("Failed to write round state to the disk", "err", err)
+	}
+	return nil
+}
@@ -20,6 +20,7 @@ import (
 	"math/big"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
@@ -88,6 +89,20 @@ func TestVerifyPreparedCertificate(t *testing.T) {
 			}(),
 			errInvalidPreparedCertificateDigestMismatch,
 		},
+		{
+			// Invalid PREPARED certificate, PREPARE and COMMIT messages for different rounds
+			func() istanbul.PreparedCertificate {
+				preparedCertificate := sys.getPreparedCertificate(t, view, proposal)
+				nextRound := istanbul.View{Round: big.NewInt(1), Sequence: view.Sequence}
+				commit, err := sys.backends[1].getCommitMessage(nextRound, proposal)
+				if err != nil {
+					t.Fatalf("failed to create commit: %v", err)
+				}
+				preparedCertificate.PrepareOrCommitMessages[1] = commit
+				return preparedCertificate
+			}(),
+			errInvalidPreparedCertificateMsgMix,
+		},
 		{
 			// Empty certificate
 			istanbul.EmptyPreparedCertificate(),
@@ -105,6 +120,157 @@ func TestVerifyPreparedCertificate(t *testing.T) {
 	}
 }
 
+func TestVerifyPreparedCertificateSignatureCache(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	view := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+	preparedCertificate := sys.getPreparedCertificate(t, view, makeBlock(0))
+
+	c := sys.backends[0].engine.(*core)
+	validateCount := 0
+	c.validateFn = func(data []byte, sig []byte) (common.Address, error) {
+		validateCount++
+		return c.checkValidatorSignature(data, sig)
+	}
+
+	// The same messages verified twice only have their signatures checked once
+	for i := 0; i < 2; i++ {
+		if err := c.verifyPreparedCertificate(preparedCertificate); err != nil {
+			t.Fatalf("failed to verify prepared certificate: %v", err)
+		}
+	}
+	if want := len(preparedCertificate.PrepareOrCommitMessages); validateCount != want {
+		t.Errorf("signature check count mismatch: have %v, want %v", validateCount, want)
+	}
+
+	// A message with a different signature is checked again
+	message := preparedCertificate.PrepareOrCommitMessages[0]
+	message.Signature = preparedCertificate.PrepareOrCommitMessages[1].Signature
+	data, err := message.PayloadNoSig()
+	if err != nil {
+		t.Fatalf("failed to encode message: %v", err)
+	}
+	if signer, err := c.checkCachedMessageSignature(data, &message); err == nil && signer == message.Address {
+		t.Errorf("message with a mismatched signature was accepted")
+	}
+
+	// Once the cache is cleared, as when a new sequence starts, signatures are checked again
+	c.verifiedSignatures.Purge()
+	validateCount = 0
+	if err := c.verifyPreparedCertificate(preparedCertificate); err != nil {
+		t.Fatalf("failed to verify prepared certificate: %v", err)
+	}
+	if want := len(preparedCertificate.PrepareOrCommitMessages); validateCount != want {
+		t.Errorf("signature check count mismatch after purge: have %v, want %v", validateCount, want)
+	}
+}
+
+func TestVerifyPreparedCertificateStandalone(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+	sys := NewTestSystemWithBackend(N, F)
+	view := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+	futureView := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(10),
+	}
+	proposal := makeBlock(0)
+
+	testCases := []struct {
+		certificate istanbul.PreparedCertificate
+		expectedErr error
+	}{
+		{
+			// Valid PREPARED certificate
+			sys.getPreparedCertificate(t, view, proposal),
+			nil,
+		},
+		{
+			// Valid PREPARED certificate for a sequence other than the current one
+			sys.getPreparedCertificate(t, futureView, proposal),
+			nil,
+		},
+		{
+			// Invalid PREPARED certificate, duplicate message
+			func() istanbul.PreparedCertificate {
+				preparedCertificate := sys.getPreparedCertificate(t, view, proposal)
+				preparedCertificate.PrepareOrCommitMessages[1] = preparedCertificate.PrepareOrCommitMessages[0]
+				return preparedCertificate
+			}(),
+			errInvalidPreparedCertificateDuplicate,
+		},
+		{
+			// Invalid PREPARED certificate, messages from different sequences
+			func() istanbul.PreparedCertificate {
+				preparedCertificate := sys.getPreparedCertificate(t, view, proposal)
+				futureCertificate := sys.getPreparedCertificate(t, futureView, proposal)
+				preparedCertificate.PrepareOrCommitMessages[1] = futureCertificate.PrepareOrCommitMessages[1]
+				return preparedCertificate
+			}(),
+			errInvalidPreparedCertificateMsgView,
+		},
+		{
+			// Invalid PREPARED certificate, includes preprepare message
+			func() istanbul.PreparedCertificate {
+				preparedCertificate := sys.getPreparedCertificate(t, view, proposal)
+				testInvalidMsg, _ := sys.backends[0].getRoundChangeMessage(view, sys.getPreparedCertificate(t, view, proposal))
+				preparedCertificate.PrepareOrCommitMessages[0] = testInvalidMsg
+				return preparedCertificate
+			}(),
+			errInvalidPreparedCertificateMsgCode,
+		},
+		{
+			// Invalid PREPARED certificate, hash mismatch
+			func() istanbul.PreparedCertificate {
+				preparedCertificate := sys.getPreparedCertificate(t, view, proposal)
+				preparedCertificate.PrepareOrCommitMessages[1] = preparedCertificate.PrepareOrCommitMessages[0]
+				preparedCertificate.Proposal = makeBlock(1)
+				return preparedCertificate
+			}(),
+			errInvalidPreparedCertificateDigestMismatch,
+		},
+		{
+			// Invalid PREPARED certificate, PREPARE and COMMIT messages for different rounds
+			func() istanbul.PreparedCertificate {
+				preparedCertificate := sys.getPreparedCertificate(t, view, proposal)
+				nextRound := istanbul.View{Round: big.NewInt(1), Sequence: view.Sequence}
+				commit, err := sys.backends[1].getCommitMessage(nextRound, proposal)
+				if err != nil {
+					t.Fatalf("failed to create commit: %v", err)
+				}
+				preparedCertificate.PrepareOrCommitMessages[1] = commit
+				return preparedCertificate
+			}(),
+			errInvalidPreparedCertificateMsgMix,
+		},
+		{
+			// Empty certificate
+			istanbul.EmptyPreparedCertificate(),
+			errInvalidPreparedCertificateNumMsgs,
+		},
+	}
+	for _, test := range testCases {
+		for _, backend := range sys.backends {
+			err := VerifyPreparedCertificate(test.certificate, backend.peers, istanbul.DirectHasher)
+			if err != test.expectedErr {
+				t.Errorf("error mismatch: have %v, want %v", err, test.expectedErr)
+			}
+		}
+	}
+
+	// A validator set without the signers rejects the certificate
+	otherSys := NewTestSystemWithBackend(N, F)
+	err := VerifyPreparedCertificate(sys.getPreparedCertificate(t, view, proposal), otherSys.backends[0].peers, istanbul.DirectHasher)
+	if err != istanbul.ErrUnauthorizedAddress {
+		t.Errorf("error mismatch: have %v, want %v", err, istanbul.ErrUnauthorizedAddress)
+	}
+}
+
 func TestHandlePrepare(t *testing.T) {
 	N := uint64(4)
 	F := uint64(1)
@@ -499,3 +665,154 @@ func TestVerifyPrepare(t *testing.T) {
 		}
 	}
 }
+
+func TestHandlePrepareCommitBroadcastDelay(t *testing.T) {
+	view := &istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+
+	testCases := []struct {
+		name      string
+		delay     uint64                    // configured CommitBroadcastDelay, in milliseconds
+		wantDelay func(*core) time.Duration // delay before the COMMIT is broadcast
+	}{
+		{"no delay", 0, func(*core) time.Duration { return 0 }},
+		{"delay", 100, func(*core) time.Duration { return 100 * time.Millisecond }},
+		{"delay capped by the round timeout", 3600 * 1000, func(c *core) time.Duration {
+			return c.roundChangeTimerTimeout(view) / maxCommitBroadcastDelayDivisor
+		}},
+	}
+	for _, test := range testCases {
+		sys := NewTestSystemWithBackend(4, 1)
+		clock := newFakeClock()
+		for _, backend := range sys.backends {
+			c := backend.engine.(*core)
+			c.valSet = backend.peers
+			c.current = newTestRoundState(view, c.valSet)
+			c.clock = clock
+		}
+		closer := sys.Run(false)
+
+		v0 := sys.backends[0]
+		r0 := v0.engine.(*core)
+		r0.state = StatePreprepared
+		config := *istanbul.DefaultConfig
+		config.CommitBroadcastDelay = test.delay
+		r0.config = &config
+		sub := v0.EventMux().Subscribe(commitBroadcastEvent{})
+
+		for i := range sys.backends {
+			m, _ := Encode(r0.current.Subject())
+			if err := r0.handlePrepare(&istanbul.Message{
+				Code:    istanbul.MsgPrepare,
+				Msg:     m,
+				Address: r0.valSet.GetByIndex(uint64(i)).Address(),
+			}); err != nil {
+				t.Fatalf("%s: failed to handle prepare: %v", test.name, err)
+			}
+		}
+		if r0.state != StatePrepared {
+			t.Fatalf("%s: state mismatch: have %v, want %v", test.name, r0.state, StatePrepared)
+		}
+
+		wantDelay := test.wantDelay(r0)
+		if wantDelay > 0 {
+			if len(v0.sentMsgs) != 0 {
+				t.Errorf("%s: COMMIT broadcast before the delay", test.name)
+			}
+			clock.Advance(wantDelay - time.Millisecond)
+			select {
+			case <-sub.Chan():
+				t.Errorf("%s: COMMIT broadcast scheduled before the delay", test.name)
+			case <-time.After(50 * time.Millisecond):
+			}
+			clock.Advance(time.Millisecond)
+			select {
+			case ev := <-sub.Chan():
+				r0.handleCommitBroadcast(ev.Data.(commitBroadcastEvent).view)
+			case <-time.After(time.Second):
+				t.Fatalf("%s: COMMIT broadcast not scheduled after the delay", test.name)
+			}
+			if wantDelay >= r0.roundChangeTimerTimeout(view) {
+				t.Errorf("%s: COMMIT broadcast after the round timeout", test.name)
+			}
+		}
+		sub.Unsubscribe()
+		closer()
+
+		if len(v0.sentMsgs) != 1 {
+			t.Fatalf("%s: sent messages mismatch: have %v, want 1", test.name, len(v0.sentMsgs))
+		}
+		msg := new(istanbul.Message)
+		if err := msg.FromPayload(v0.sentMsgs[0], nil); err != nil || msg.Code != istanbul.MsgCommit {
+			t.Errorf("%s: message code mismatch: have %v, want %v (err %v)", test.name, msg.Code, istanbul.MsgCommit, err)
+		}
+	}
+}
+
+func TestOldRoundTolerance(t *testing.T) {
+	view := &istanbul.View{Round: big.NewInt(1), Sequence: big.NewInt(1)}
+	oldView := istanbul.View{Round: big.NewInt(0), Sequence: big.NewInt(1)}
+
+	for _, tolerance := range []uint64{0, 1} {
+		sys := NewTestSystemWithBackend(4, 1)
+		c := sys.backends[0].engine.(*core)
+		config := *istanbul.DefaultConfig
+		config.OldRoundTolerance = tolerance
+		c.config = &config
+		c.current = newTestRoundState(view, c.valSet)
+		c.state = StatePreprepared
+		proposal := c.current.Proposal()
+
+		// A late message for another proposal is always old
+		msg, err := sys.backends[1].getPrepareMessage(oldView, makeBlock(2).Hash())
+		if err != nil {
+			t.Fatalf("failed to create prepare message: %v", err)
+		}
+		if err := c.handlePrepare(&msg); err != errOldMessage {
+			t.Errorf("tolerance %d: error mismatch for another proposal: have %v, want %v", tolerance, err, errOldMessage)
+		}
+
+		// A quorum of late PREPAREs and COMMITs for the current proposal
+		for i, backend := range sys.backends[1:] {
+			var want error
+			if tolerance == 0 {
+				want = errOldMessage
+			}
+			var msg istanbul.Message
+			var err error
+			if i == 2 {
+				msg, err = backend.getCommitMessage(oldView, proposal)
+				if err == nil {
+					err = c.handleCommit(&msg)
+				}
+			} else {
+				msg, err = backend.getPrepareMessage(oldView, proposal.Hash())
+				if err == nil {
+					err = c.handlePrepare(&msg)
+				}
+			}
+			if err != want {
+				t.Errorf("tolerance %d: error mismatch for message %d: have %v, want %v", tolerance, i, err, want)
+			}
+		}
+
+		preparedCertificate := c.current.PreparedCertificate()
+		if tolerance == 0 {
+			if !preparedCertificate.IsEmpty() {
+				t.Errorf("tolerance 0: prepared certificate mismatch: have %v, want none", preparedCertificate)
+			}
+			continue
+		}
+		if v := preparedCertificate.View(); v == nil || v.Cmp(&oldView) != 0 {
+			t.Fatalf("tolerance %d: prepared certificate view mismatch: have %v, want %v", tolerance, v, oldView)
+		}
+		if err := c.verifyPreparedCertificate(preparedCertificate); err != nil {
+			t.Errorf("tolerance %d: failed to verify the prepared certificate: %v", tolerance, err)
+		}
+		if c.current.Prepares.Size() != 0 || c.current.Commits.Size() != 0 {
+			t.Errorf("tolerance %d: late messages counted in the current round", tolerance)
+		}
+	}
+}
@@ -18,50 +18,139 @@ package core
 
 import (
 	"github.com/ethereum/go-ethereum/log"
+	"math/big"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/core/types"
 )
 
 func (c *core) sendPreprepare(request *istanbul.Request, roundChangeCertificate istanbul.RoundChangeCertificate) {
-	logger := c.logger.New("state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "sendPreprepare")
+	logger := c.NewLogger("func", "sendPreprepare")
 
 	// If I'm the proposer and I have the same sequence with the proposal
-	if c.current.Sequence().Cmp(request.Proposal.Number()) == 0 && c.isProposer() {
-		preprepare, err := c.getPreprepareMessage(request, roundChangeCertificate, logger)
+	if c.current.Sequence().Cmp(request.Proposal.Number()) == 0 && c.isProposer() && !c.proposerWarmingUp() {
+		if c.config.AsyncProposalAssembly {
+			c.assemblePreprepareAsync(request, roundChangeCertificate)
+			return
+		}
+		preprepare, err := c.getPreprepareMessage(c.currentView(), request, roundChangeCertificate, nil, logger)
 		if err != nil {
 			logger.Error("Failed to prepare message")
 			return
 		}
+		c.broadcastPreprepare(preprepare, logger)
+	}
+}
 
-		msg := &istanbul.Message{
-			Code: istanbul.MsgPreprepare,
-			Msg:  preprepare,
-		}
-		logger.Trace("Sending pre-prepare", "msg", msg)
-		c.broadcast(msg)
+func (c *core) broadcastPreprepare(preprepare []byte, logger log.Logger) {
+	msg := &istanbul.Message{
+		Code: istanbul.MsgPreprepare,
+		Msg:  preprepare,
+	}
+	logger.Trace("Sending pre-prepare", "msg", msg)
+	c.broadcast(msg)
+	c.stopProposerSelfCheckTimer()
+	c.newPreprepareResendTimer()
+}
+
+// proposalAssembly is a preprepare being assembled in a worker, which is cancelled once the view
+// it was assembled for is left.
+type proposalAssembly struct {
+	view   *istanbul.View
+	cancel chan struct{}
+}
+
+// assemblePreprepareAsync encodes and persists the preprepare for the current view in a worker,
+// which hands it back to the consensus goroutine to be broadcast as a proposalAssembledEvent. An
+// assembly in progress for an older view is cancelled.
+func (c *core) assemblePreprepareAsync(request *istanbul.Request, roundChangeCertificate istanbul.RoundChangeCertificate) {
+	c.cancelProposalAssembly()
+	assembly := &proposalAssembly{
+		view:   c.currentView(),
+		cancel: make(chan struct{}),
+	}
+	c.proposalAssembly = assembly
+	logger := c.NewLogger("func", "assemblePreprepareAsync")
+	go func() {
+		preprepare, err := c.getPreprepareMessage(assembly.view, request, roundChangeCertificate, assembly.cancel, logger)
+		c.sendEvent(proposalAssembledEvent{
+			assembly:   assembly,
+			preprepare: preprepare,
+			err:        err,
+		})
+	}()
+}
+
+// cancelProposalAssembly signals the preprepare assembly in progress, if any, to stop. Its result
+// will be discarded.
+func (c *core) cancelProposalAssembly() {
+	if c.proposalAssembly != nil {
+		close(c.proposalAssembly.cancel)
+		c.proposalAssembly = nil
 	}
 }
 
+// handleProposalAssembled broadcasts the preprepare assembled in a worker, unless its assembly
+// was cancelled or the view has moved on since.
+func (c *core) handleProposalAssembled(ev proposalAssembledEvent) {
+	logger := c.NewLogger("func", "handleProposalAssembled")
+
+	if c.current == nil || c.proposalAssembly != ev.assembly || ev.assembly.view.Cmp(c.currentView()) != 0 {
+		logger.Debug("Discarding stale preprepare", "view", ev.assembly.view, "err", ev.err)
+		return
+	}
+	c.proposalAssembly = nil
+	if ev.err != nil {
+		logger.Error("Failed to prepare message", "err", ev.err)
+		return
+	}
+	c.broadcastPreprepare(ev.preprepare, logger)
+}
+
+// resendPreprepare re-broadcasts the preprepare we sent for the given view if it's still the
+// current one and we haven't got a quorum of prepares, in case some validators missed it. This is
+// done at most once per round, a round change takes over if the round still stalls.
+func (c *core) resendPreprepare(view *istanbul.View) {
+	if c.current == nil || view.Cmp(c.currentView()) != 0 || c.state.Cmp(StatePrepared) >= 0 || !c.isProposer() {
+		return
+	}
+	if c.preprepareResent != nil && c.preprepareResent.Cmp(view) == 0 {
+		return
+	}
+	logger := c.NewLogger("func", "resendPreprepare")
+
+	preprepare, err := c.messageStore.Load(view, istanbul.MsgPreprepare)
+	if err != nil || preprepare == nil {
+		logger.Warn("Failed to get the preprepare to resend from the message store", "err", err)
+		return
+	}
+	c.preprepareResent = view
+	logger.Info("Resending preprepare without a quorum of prepares", "prepares", c.current.Prepares.Size())
+	c.rebroadcast(&istanbul.Message{
+		Code: istanbul.MsgPreprepare,
+		Msg:  preprepare,
+	})
+}
+
+// getPreprepareMessage returns the preprepare for the view, reusing the one persisted for it if
+// any. It gives up with errProposalAssemblyCancelled once cancel is closed, if not nil.
 func (c *core) getPreprepareMessage(
+	curView *istanbul.View,
 	request *istanbul.Request,
 	roundChangeCertificate istanbul.RoundChangeCertificate,
+	cancel <-chan struct{},
 	logger log.Logger) ([]byte, error) {
-	curView := c.currentView()
-	messageType := istanbul.MsgPreprepare
-	roundNumber := c.current.Round()
-	sequenceNumber := c.current.Sequence()
-	existingPreparedMessage, err := c.getPreprepareMessageFromDisk(
-		messageType, roundNumber, sequenceNumber)
+	existingPreparedMessage, err := c.messageStore.Load(curView, istanbul.MsgPreprepare)
 	if err != nil {
-		logger.Error("Failed to get prepared message from disk", "view", curView)
+		logger.Error("Failed to get prepared message from the message store", "view", curView)
 		return nil, err
 	}
 
 	if existingPreparedMessage != nil {
-		logger.Info("Got previously prepared messaged from the disk", "msg", existingPreparedMessage)
+		logger.Info("Got previously prepared messaged from the message store", "msg", existingPreparedMessage)
 		return existingPreparedMessage, nil
 	}
 
@@ -74,16 +163,30 @@ func (c *core) getPreprepareMessage(
 		logger.Error("Failed to encode", "view", curView)
 		return nil, err
 	}
-	err2 := c.savePrepareMessageToDisk(messageType, roundNumber, sequenceNumber, preprepare)
+	select {
+	case <-cancel:
+		return nil, errProposalAssemblyCancelled
+	default:
+	}
+	err2 := c.messageStore.Save(curView, istanbul.MsgPreprepare, preprepare)
 	if err2 != nil {
-		logger.Error("Failed to write prepare message to the disk", "msg", preprepare)
+		logger.Error("Failed to write prepare message to the message store", "msg", preprepare)
 		return nil, err2
 	}
 	return preprepare, nil
 }
 
+// proposerForView returns the proposer of the given view of the current sequence.
+func (c *core) proposerForView(view *istanbul.View) (common.Address, error) {
+	if c.current != nil && c.valSet != nil && view.Cmp(c.currentView()) == 0 {
+		return c.valSet.GetProposer().Address(), nil
+	}
+	_, proposer, err := c.validatorSetForView(view)
+	return proposer, err
+}
+
 func (c *core) handlePreprepare(msg *istanbul.Message) error {
-	logger := c.logger.New("from", msg.Address, "state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "handlePreprepare", "tag", "handleMsg")
+	logger := c.NewLogger("from", msg.Address, "func", "handlePreprepare", "tag", "handleMsg")
 	logger.Trace("Got pre-prepare message", "msg", msg)
 
 	// Decode PRE-PREPARE
@@ -93,6 +196,14 @@ func (c *core) handlePreprepare(msg *istanbul.Message) error {
 		return errFailedDecodePreprepare
 	}
 
+	// Reject preprepares of the current sequence from anyone but the proposer of their view before
+	// verifying their round change certificate or proposal. Those of other sequences are checked
+	// for old blocks below, or once backlogged preprepares of a future sequence become current.
+	if proposer, err := c.proposerForView(preprepare.View); err == nil && proposer != msg.Address {
+		logger.Warn("Ignore preprepare from the non-proposer of its view", "view", preprepare.View, "proposer", proposer)
+		return errPreprepareNotFromProposer
+	}
+
 	// If round > 0, handle the ROUND CHANGE certificate. If round = 0, it should not have a ROUND CHANGE certificate
 	if preprepare.View.Round.Cmp(common.Big0) > 0 {
 		if !preprepare.HasRoundChangeCertificate() {
@@ -139,16 +250,62 @@ func (c *core) handlePreprepare(msg *istanbul.Message) error {
 	// Check if the message comes from current proposer
 	if !c.valSet.IsProposer(msg.Address) {
 		logger.Warn("Ignore preprepare messages from non-proposer")
-		return errNotFromProposer
+		return errPreprepareNotFromProposer
+	}
+
+	// Reject proposals that don't respect the minimum spacing from the parent block
+	if err := c.verifyProposalTimestamp(preprepare); err != nil {
+		logger.Warn("Proposal violates the block period floor, sending round change", "err", err)
+		c.sendNextRoundChange(RoundChangeInvalidProposal)
+		return err
+	}
+
+	// Reject proposals from proposers whose clock runs too far ahead of ours
+	if err := c.verifyProposalFutureSkew(preprepare.Proposal); err != nil {
+		logger.Warn("Proposal timestamp too far in the future, sending round change", "err", err)
+		c.sendNextRoundChange(RoundChangeInvalidProposal)
+		return err
+	}
+
+	// Reject proposals with more transactions than allowed
+	if err := c.verifyProposalTransactionCount(preprepare.Proposal); err != nil {
+		logger.Warn("Proposal exceeds the transaction limit, sending round change", "err", err)
+		c.sendNextRoundChange(RoundChangeInvalidProposal)
+		return err
+	}
+
+	c.reportProposalSize(preprepare.Proposal, logger)
+
+	// Reject proposals that are known bad blocks
+	if c.backend.HasBadProposal(preprepare.Proposal.Hash()) {
+		c.badProposalCounter.Inc(1)
+		logger.Debug("Rejecting preprepare for a bad block", "proposer", msg.Address, "hash", preprepare.Proposal.Hash(), "number", preprepare.Proposal.Number())
+		return errBadProposal
 	}
 
-	// Verify the proposal we received
-	if duration, err := c.backend.Verify(preprepare.Proposal); err != nil {
+	// Verify the proposal we received, in a worker if enabled and it isn't known to be valid yet
+	if c.config.AsyncProposalVerification && !c.verifiedProposals.Contains(preprepare.Proposal.Hash()) {
+		if c.pendingVerification != nil && c.pendingVerification.Cmp(preprepare.View) == 0 {
+			return errVerificationPending
+		}
+		c.verifyProposalAsync(msg, preprepare)
+		return errMessageQueued
+	}
+	duration, err := c.verifyProposal(preprepare.Proposal)
+	return c.handleVerifiedPreprepare(msg, preprepare, duration, err)
+}
+
+// handleVerifiedPreprepare accepts the preprepare and sends a prepare if its proposal was
+// successfully verified.
+func (c *core) handleVerifiedPreprepare(msg *istanbul.Message, preprepare *istanbul.Preprepare, duration time.Duration, err error) error {
+	logger := c.NewLogger("from", msg.Address, "func", "handleVerifiedPreprepare", "tag", "handleMsg")
+
+	if err != nil {
 		logger.Warn("Failed to verify proposal", "err", err, "duration", duration)
 		// if it's a future block, we will handle it again after the duration
 		if err == consensus.ErrFutureBlock {
 			c.stopFuturePreprepareTimer()
-			c.futurePreprepareTimer = time.AfterFunc(duration, func() {
+			c.futurePreprepareTimer = c.clock.AfterFunc(duration, func() {
 				c.sendEvent(backlogEvent{
 					msg: msg,
 				})
@@ -167,7 +324,126 @@ func (c *core) handlePreprepare(msg *istanbul.Message) error {
 	return nil
 }
 
+// verifyProposalAsync verifies the proposal of the preprepare in a worker, which hands the result
+// back to the consensus goroutine as a proposalVerifiedEvent. A verification in progress for an
+// older view is superseded, its result will be discarded.
+func (c *core) verifyProposalAsync(msg *istanbul.Message, preprepare *istanbul.Preprepare) {
+	c.pendingVerification = &istanbul.View{
+		Sequence: new(big.Int).Set(preprepare.View.Sequence),
+		Round:    new(big.Int).Set(preprepare.View.Round),
+	}
+	go func() {
+		duration, err := c.backend.Verify(preprepare.Proposal)
+		c.sendEvent(proposalVerifiedEvent{
+			msg:        msg,
+			preprepare: preprepare,
+			duration:   duration,
+			err:        err,
+		})
+	}()
+}
+
+// handleProposalVerified applies the result of an asynchronous proposal verification, unless the
+// view has moved on or another preprepare superseded it since. An invalid proposal triggers a
+// round change.
+func (c *core) handleProposalVerified(ev proposalVerifiedEvent) {
+	logger := c.NewLogger("from", ev.msg.Address, "func", "handleProposalVerified")
+
+	view := ev.preprepare.View
+	if c.current == nil || c.pendingVerification == nil || c.pendingVerification.Cmp(view) != 0 || c.currentView().Cmp(view) != 0 {
+		logger.Debug("Discarding stale proposal verification", "view", view, "hash", ev.preprepare.Proposal.Hash(), "err", ev.err)
+		c.recordQueuedMsg(ev.msg, errOldMessage)
+		return
+	}
+	c.pendingVerification = nil
+
+	if ev.err == nil {
+		c.verifiedProposals.Add(ev.preprepare.Proposal.Hash(), true)
+	}
+	err := c.handleVerifiedPreprepare(ev.msg, ev.preprepare, ev.duration, ev.err)
+	c.recordQueuedMsg(ev.msg, err)
+	if err != nil && err != consensus.ErrFutureBlock {
+		logger.Warn("Invalid proposal, sending round change", "err", err)
+		c.sendNextRoundChange(RoundChangeInvalidProposal)
+	}
+}
+
+// verifyProposalTimestamp checks that the proposal's timestamp is at least the block period in
+// effect seconds after its parent's timestamp, if enabled in the config.
+func (c *core) verifyProposalTimestamp(preprepare *istanbul.Preprepare) error {
+	if !c.config.EnforceBlockPeriodFloor {
+		return nil
+	}
+	if c.config.SkipBlockPeriodFloorOnCatchUp && preprepare.View.Round.Cmp(common.Big0) > 0 {
+		return nil
+	}
+
+	block, ok := preprepare.Proposal.(*types.Block)
+	if !ok {
+		return nil
+	}
+	lastProposal, _ := c.backend.LastProposal()
+	parent, ok := lastProposal.(*types.Block)
+	if !ok || new(big.Int).Add(parent.Number(), common.Big1).Cmp(block.Number()) != 0 {
+		return nil
+	}
+
+	minTime := new(big.Int).Add(parent.Time(), new(big.Int).SetUint64(c.effectiveBlockPeriod()))
+	if block.Time().Cmp(minTime) < 0 {
+		return errProposalTooEarly
+	}
+	return nil
+}
+
+// verifyProposalFutureSkew checks that the proposal's timestamp is at most MaxProposalFutureSkew
+// seconds ahead of the local clock, if enabled in the config.
+func (c *core) verifyProposalFutureSkew(proposal istanbul.Proposal) error {
+	if c.config.MaxProposalFutureSkew == 0 {
+		return nil
+	}
+	block, ok := proposal.(*types.Block)
+	if !ok {
+		return nil
+	}
+	maxTime := new(big.Int).SetInt64(c.clock.Now().Unix())
+	maxTime.Add(maxTime, new(big.Int).SetUint64(c.config.MaxProposalFutureSkew))
+	if block.Time().Cmp(maxTime) > 0 {
+		return errProposalTooFarInFuture
+	}
+	return nil
+}
+
+// verifyProposalTransactionCount checks that the proposal doesn't carry more than
+// MaxTransactionsPerBlock transactions, if enabled in the config.
+func (c *core) verifyProposalTransactionCount(proposal istanbul.Proposal) error {
+	if c.config.MaxTransactionsPerBlock == 0 {
+		return nil
+	}
+	block, ok := proposal.(*types.Block)
+	if !ok {
+		return nil
+	}
+	if uint64(len(block.Transactions())) > c.config.MaxTransactionsPerBlock {
+		return errTooManyTransactions
+	}
+	return nil
+}
+
+// reportProposalSize records the serialized size of the proposal, and reports it if it exceeds
+// ProposalSizeSoftLimit as an early sign of proposals getting rejected for their size.
+func (c *core) reportProposalSize(proposal istanbul.Proposal, logger log.Logger) {
+	block, ok := proposal.(*types.Block)
+	if !ok {
+		return
+	}
+	size := uint64(block.Size())
+	c.proposalSizeHistogram.Update(int64(size))
+	if c.config.ProposalSizeSoftLimit > 0 && size > c.config.ProposalSizeSoftLimit {
+		logger.Debug("Proposal size exceeds the soft limit", "size", size, "soft_limit", c.config.ProposalSizeSoftLimit, "hard_limit", c.config.MaxMessageSize, "hash", block.Hash())
+	}
+}
+
 func (c *core) acceptPreprepare(preprepare *istanbul.Preprepare) {
-	c.consensusTimestamp = time.Now()
+	c.consensusTimestamp = c.clock.Now()
 	c.current.SetPreprepare(preprepare)
 }
@@ -20,9 +20,15 @@ import (
 	"bytes"
 	"math/big"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 )
 
 func newTestPreprepare(v *istanbul.View) *istanbul.Preprepare {
@@ -86,7 +92,7 @@ func TestHandlePreprepare(t *testing.T) {
 				return istanbul.RoundChangeCertificate{}
 			},
 			makeBlock(1),
-			errNotFromProposer,
+			errPreprepareNotFromProposer,
 			false,
 		},
 		{
@@ -138,6 +144,7 @@ func TestHandlePreprepare(t *testing.T) {
 		},
 		{
 			// ROUND CHANGE certificate missing
+			// Round is N+1 to match the correct proposer.
 			func() *testSystem {
 				sys := NewTestSystemWithBackend(N, F)
 
@@ -145,7 +152,7 @@ func TestHandlePreprepare(t *testing.T) {
 					c := backend.engine.(*core)
 					c.valSet = backend.peers
 					c.state = StatePreprepared
-					c.current.SetRound(big.NewInt(1))
+					c.current.SetRound(big.NewInt(int64(N)))
 				}
 				return sys
 			}(),
@@ -158,6 +165,7 @@ func TestHandlePreprepare(t *testing.T) {
 		},
 		{
 			// ROUND CHANGE certificate invalid, duplicate messages.
+			// Round is N+1 to match the correct proposer.
 			func() *testSystem {
 				sys := NewTestSystemWithBackend(N, F)
 
@@ -165,7 +173,7 @@ func TestHandlePreprepare(t *testing.T) {
 					c := backend.engine.(*core)
 					c.valSet = backend.peers
 					c.state = StatePreprepared
-					c.current.SetRound(big.NewInt(1))
+					c.current.SetRound(big.NewInt(int64(N)))
 				}
 				return sys
 			}(),
@@ -181,6 +189,7 @@ func TestHandlePreprepare(t *testing.T) {
 		},
 		{
 			// ROUND CHANGE certificate contains PREPARED certificate for a different block.
+			// Round is N+1 to match the correct proposer.
 			func() *testSystem {
 				sys := NewTestSystemWithBackend(N, F)
 
@@ -188,7 +197,7 @@ func TestHandlePreprepare(t *testing.T) {
 					c := backend.engine.(*core)
 					c.valSet = backend.peers
 					c.state = StatePreprepared
-					c.current.SetRound(big.NewInt(1))
+					c.current.SetRound(big.NewInt(int64(N)))
 					c.current.SetPreprepare(&istanbul.Preprepare{
 						View: &istanbul.View{
 							Round:    big.NewInt(1),
@@ -343,7 +352,7 @@ OUTER:
 
 			if expectedCode == istanbul.MsgCommit {
 				_, srcValidator := c.valSet.GetByAddress(v.address)
-				if err := c.verifyCommittedSeal(subject.Digest, decodedMsg.CommittedSeal, srcValidator); err != nil {
+				if err := verifyCommittedSeal(subject.Digest, decodedMsg.CommittedSeal, srcValidator, false); err != nil {
 					t.Errorf("invalid seal.  verify commmited seal error: %v, subject: %v, committedSeal: %v", err, expectedSubject, decodedMsg.CommittedSeal)
 				}
 			} else {
@@ -354,3 +363,485 @@ OUTER:
 		}
 	}
 }
+
+// makeBlockWithTimeAndTxs returns a block with the given number and timestamp, carrying count
+// transactions.
+func makeBlockWithTimeAndTxs(number, time int64, count int) *types.Block {
+	header := &types.Header{
+		Difficulty: big.NewInt(0),
+		Number:     big.NewInt(number),
+		Time:       big.NewInt(time),
+	}
+	txs := make([]*types.Transaction, count)
+	for i := range txs {
+		txs[i] = types.NewTransaction(uint64(i), common.Address{}, big.NewInt(0), 0, big.NewInt(0), nil, nil, nil)
+	}
+	return types.NewBlock(header, txs, nil, nil, nil)
+}
+
+// handlePreprepareFromProposer makes validator 1 handle a PREPREPARE of the given proposal sent by
+// the proposer, validator 0, in its current view.
+func handlePreprepareFromProposer(sys *testSystem, proposal istanbul.Proposal) error {
+	c := sys.backends[1].engine.(*core)
+	m, _ := Encode(&istanbul.Preprepare{
+		View:     c.currentView(),
+		Proposal: proposal,
+	})
+	return c.handlePreprepare(&istanbul.Message{
+		Code:    istanbul.MsgPreprepare,
+		Msg:     m,
+		Address: sys.backends[0].Address(),
+	})
+}
+
+func TestHandlePreprepareProposalChecks(t *testing.T) {
+	now := int64(1000)
+	enforceBlockPeriodFloor := func(config *istanbul.Config) { config.EnforceBlockPeriodFloor = true }
+	limitTransactions := func(config *istanbul.Config) { config.MaxTransactionsPerBlock = 2 }
+	limitFutureSkew := func(config *istanbul.Config) { config.MaxProposalFutureSkew = 15 }
+
+	testCases := []struct {
+		name        string
+		configure   func(config *istanbul.Config)
+		proposal    istanbul.Proposal
+		expectedErr error
+	}{
+		{"sent before the block period elapsed", enforceBlockPeriodFloor, makeBlockWithTimeAndTxs(1, 0, 0), errProposalTooEarly},
+		{"exactly one block period after the parent", enforceBlockPeriodFloor, makeBlockWithTimeAndTxs(1, 1, 0), nil},
+		{"within the transaction limit", limitTransactions, makeBlockWithTimeAndTxs(1, 0, 2), nil},
+		{"exceeding the transaction limit", limitTransactions, makeBlockWithTimeAndTxs(1, 0, 3), errTooManyTransactions},
+		{"30s in the future", limitFutureSkew, makeBlockWithTimeAndTxs(1, now+30, 0), errProposalTooFarInFuture},
+		{"5s in the future", limitFutureSkew, makeBlockWithTimeAndTxs(1, now+5, 0), nil},
+	}
+
+	for _, test := range testCases {
+		sys := NewTestSystemWithBackend(4, 1)
+		config := *istanbul.DefaultConfig
+		test.configure(&config)
+		clock := newFakeClock()
+		clock.Advance(time.Duration(now) * time.Second)
+		for _, backend := range sys.backends {
+			c := backend.engine.(*core)
+			c.config = &config
+			c.clock = clock
+		}
+		closer := sys.Run(false)
+		err := handlePreprepareFromProposer(sys, test.proposal)
+		closer()
+		if err != test.expectedErr {
+			t.Errorf("%s: error mismatch: have %v, want %v", test.name, err, test.expectedErr)
+		}
+
+		v1 := sys.backends[1]
+		if len(v1.sentMsgs) != 1 {
+			t.Fatalf("%s: the number of sent messages mismatch: have %v, want 1", test.name, len(v1.sentMsgs))
+		}
+		decodedMsg := new(istanbul.Message)
+		if err := decodedMsg.FromPayload(v1.sentMsgs[0], nil); err != nil {
+			t.Errorf("%s: failed to decode sent message: %v", test.name, err)
+		}
+		expectedCode := istanbul.MsgPrepare
+		if test.expectedErr != nil {
+			expectedCode = istanbul.MsgRoundChange
+		}
+		if decodedMsg.Code != expectedCode {
+			t.Errorf("%s: message code mismatch: have %v, want %v", test.name, decodedMsg.Code, expectedCode)
+		}
+	}
+}
+
+func TestProposalTimestampWithBlockPeriodSetOnChain(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[1].engine.(*core)
+	config := *istanbul.DefaultConfig
+	config.EnforceBlockPeriodFloor = true
+	config.BlockPeriod = 1
+	c.config = &config
+	// The chain set a longer block period for the current epoch
+	c.blockPeriod = 2
+	c.blockPeriodEpoch = 1
+
+	view := &istanbul.View{Round: big.NewInt(0), Sequence: big.NewInt(1)}
+	if err := c.verifyProposalTimestamp(&istanbul.Preprepare{View: view, Proposal: makeBlockWithTimeAndTxs(1, 1, 0)}); err != errProposalTooEarly {
+		t.Errorf("error mismatch before the on-chain block period: have %v, want %v", err, errProposalTooEarly)
+	}
+	if err := c.verifyProposalTimestamp(&istanbul.Preprepare{View: view, Proposal: makeBlockWithTimeAndTxs(1, 2, 0)}); err != nil {
+		t.Errorf("error mismatch after the on-chain block period: have %v, want nil", err)
+	}
+}
+
+func TestHandlePreprepareProposalSizeSoftLimit(t *testing.T) {
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = false }()
+
+	proposal := makeBlock(1)
+	testCases := []struct {
+		softLimit uint64
+		reported  bool
+	}{
+		{0, false},
+		{uint64(proposal.Size()), false},
+		{uint64(proposal.Size()) - 1, true},
+	}
+	for i, test := range testCases {
+		sys := NewTestSystemWithBackend(4, 1)
+		closer := sys.Run(false)
+
+		c := sys.backends[1].engine.(*core)
+		config := *c.config
+		config.ProposalSizeSoftLimit = test.softLimit
+		c.config = &config
+		c.proposalSizeHistogram = metrics.NewHistogram(metrics.NewUniformSample(10))
+
+		reported := false
+		c.logger = log.New()
+		c.logger.SetHandler(log.FuncHandler(func(r *log.Record) error {
+			if r.Msg == "Proposal size exceeds the soft limit" {
+				reported = true
+			}
+			return nil
+		}))
+
+		if err := handlePreprepareFromProposer(sys, proposal); err != nil {
+			t.Errorf("test %d: failed to handle preprepare: %v", i, err)
+		}
+		if c.current.Proposal() == nil || c.current.Proposal().Hash() != proposal.Hash() {
+			t.Errorf("test %d: proposal not accepted", i)
+		}
+		if reported != test.reported {
+			t.Errorf("test %d: soft limit report mismatch: have %v, want %v", i, reported, test.reported)
+		}
+		if max := c.proposalSizeHistogram.Max(); max != int64(proposal.Size()) {
+			t.Errorf("test %d: recorded size mismatch: have %v, want %v", i, max, proposal.Size())
+		}
+		closer()
+	}
+}
+
+func TestHandlePreprepareBadProposal(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	v1 := sys.backends[1]
+	c := v1.engine.(*core)
+
+	proposal := makeBlock(1)
+	v1.badProposals = map[common.Hash]bool{proposal.Hash(): true}
+
+	if err := handlePreprepareFromProposer(sys, proposal); err != errBadProposal {
+		t.Errorf("error mismatch: have %v, want %v", err, errBadProposal)
+	}
+	if v1.verifyCount != 0 {
+		t.Errorf("bad proposal was verified by the backend")
+	}
+	if c.state != StateAcceptRequest {
+		t.Errorf("state mismatch: have %v, want %v", c.state, StateAcceptRequest)
+	}
+}
+
+func TestHandlePreprepareFromNonProposer(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	v1 := sys.backends[1]
+	v2 := sys.backends[2]
+	c := v1.engine.(*core)
+	if _, proposer, _ := c.ValidatorSetForView(c.currentView()); proposer == v2.Address() {
+		t.Fatalf("sender is the proposer of the view")
+	}
+
+	m, _ := Encode(&istanbul.Preprepare{
+		View:     c.currentView(),
+		Proposal: makeBlock(1),
+	})
+	err := c.handlePreprepare(&istanbul.Message{
+		Code:    istanbul.MsgPreprepare,
+		Msg:     m,
+		Address: v2.Address(),
+	})
+	if err != errPreprepareNotFromProposer {
+		t.Errorf("error mismatch: have %v, want %v", err, errPreprepareNotFromProposer)
+	}
+	if v1.verifyCount != 0 {
+		t.Errorf("proposal of a non-proposer was verified by the backend")
+	}
+	if c.current.Proposal() != nil {
+		t.Errorf("preprepare of a non-proposer was accepted")
+	}
+
+	// A preprepare for a later round of the sequence is rejected before its round change
+	// certificate is looked at
+	view := &istanbul.View{Sequence: c.current.Sequence(), Round: big.NewInt(1)}
+	_, proposer, err := c.ValidatorSetForView(view)
+	if err != nil {
+		t.Fatalf("failed to get the proposer of round 1: %v", err)
+	}
+	var sender common.Address
+	for _, b := range sys.backends {
+		if b.Address() != proposer {
+			sender = b.Address()
+			break
+		}
+	}
+	m, _ = Encode(&istanbul.Preprepare{
+		View:     view,
+		Proposal: makeBlock(1),
+	})
+	err = c.handlePreprepare(&istanbul.Message{
+		Code:    istanbul.MsgPreprepare,
+		Msg:     m,
+		Address: sender,
+	})
+	if err != errPreprepareNotFromProposer {
+		t.Errorf("error mismatch for round 1: have %v, want %v", err, errPreprepareNotFromProposer)
+	}
+}
+
+func TestHandlePreprepareAsyncVerification(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	v0 := sys.backends[0]
+	v1 := sys.backends[1]
+	c := v1.engine.(*core)
+	config := *c.config
+	config.AsyncProposalVerification = true
+	c.config = &config
+
+	// A slow verifier, blocking until released
+	release := make(chan struct{})
+	v1.verifyFn = func(istanbul.Proposal) (time.Duration, error) {
+		<-release
+		return 0, nil
+	}
+
+	closer := sys.Run(true)
+	defer closer()
+
+	view := istanbul.View{
+		Round:    big.NewInt(0),
+		Sequence: big.NewInt(1),
+	}
+	m, _ := Encode(&istanbul.Preprepare{
+		View:     &view,
+		Proposal: makeBlock(1),
+	})
+	msg, err := v0.finalizeAndReturnMessage(&istanbul.Message{
+		Code: istanbul.MsgPreprepare,
+		Msg:  m,
+	})
+	if err != nil {
+		t.Fatalf("failed to create preprepare message: %v", err)
+	}
+	payload, _ := msg.Payload()
+	v1.events.Post(istanbul.MessageEvent{Payload: payload})
+
+	// The consensus goroutine keeps handling events while the proposal is verified
+	v1.events.Post(istanbul.RequestEvent{Proposal: makeBlock(5)})
+	<-time.After(200 * time.Millisecond)
+	if size := c.PendingRequests().Size; size != 1 {
+		t.Errorf("pending requests mismatch while verifying: have %v, want 1", size)
+	}
+	if c.current.Proposal() != nil {
+		t.Errorf("preprepare accepted before its proposal was verified")
+	}
+
+	close(release)
+	<-time.After(200 * time.Millisecond)
+	if proposal := c.current.Proposal(); proposal == nil || proposal.Hash() != makeBlock(1).Hash() {
+		t.Errorf("preprepare not accepted after its proposal was verified")
+	}
+}
+
+func TestHandleProposalVerified(t *testing.T) {
+	oldView := &istanbul.View{Round: big.NewInt(0), Sequence: big.NewInt(1)}
+	newView := &istanbul.View{Round: big.NewInt(1), Sequence: big.NewInt(1)}
+
+	testCases := []struct {
+		name      string
+		pending   *istanbul.View // view of the verification in progress
+		current   *istanbul.View
+		result    *istanbul.View // view of the verification result
+		err       error
+		wantState State
+		wantCode  uint64 // code of the message sent, if any
+		wantSent  bool
+	}{
+		{"valid proposal", oldView, oldView, oldView, nil, StatePreprepared, istanbul.MsgPrepare, true},
+		{"invalid proposal", oldView, oldView, oldView, errInvalidProposal, StateAcceptRequest, istanbul.MsgRoundChange, true},
+		{"view moved on", oldView, newView, oldView, nil, StateAcceptRequest, 0, false},
+		{"superseded by a newer preprepare", newView, newView, oldView, nil, StateAcceptRequest, 0, false},
+	}
+	for _, test := range testCases {
+		sys := NewTestSystemWithBackend(4, 1)
+		closer := sys.Run(false)
+
+		v0 := sys.backends[0]
+		v1 := sys.backends[1]
+		c := v1.engine.(*core)
+		c.current.SetRound(test.current.Round)
+		c.pendingVerification = test.pending
+
+		c.handleProposalVerified(proposalVerifiedEvent{
+			msg:        &istanbul.Message{Code: istanbul.MsgPreprepare, Address: v0.Address()},
+			preprepare: &istanbul.Preprepare{View: test.result, Proposal: makeBlock(1)},
+			err:        test.err,
+		})
+		closer()
+
+		if c.state != test.wantState {
+			t.Errorf("%s: state mismatch: have %v, want %v", test.name, c.state, test.wantState)
+		}
+		if sent := len(v1.sentMsgs) > 0; sent != test.wantSent {
+			t.Errorf("%s: sent mismatch: have %v, want %v", test.name, sent, test.wantSent)
+			continue
+		}
+		if test.wantSent {
+			msg := new(istanbul.Message)
+			if err := msg.FromPayload(v1.sentMsgs[0], nil); err != nil || msg.Code != test.wantCode {
+				t.Errorf("%s: message code mismatch: have %v, want %v (err %v)", test.name, msg.Code, test.wantCode, err)
+			}
+		}
+	}
+}
+
+// This tests that the proposer unblocks the round by resending its preprepare when the first one
+// is dropped by the broadcast interceptor, without waiting for a round change.
+func TestResendPreprepareOnPrepareStall(t *testing.T) {
+	// Initialize the system with a nil round state so that we properly start round 0.
+	sys := NewTestSystemWithBackendAndCurrentRoundState(4, 1, func(vset istanbul.ValidatorSet) *roundState { return nil })
+
+	clock := newFakeClock()
+	var dropped int32
+	dropFirstPreprepare := func(valSet istanbul.ValidatorSet, payload []byte) bool {
+		msg := new(istanbul.Message)
+		if err := msg.FromPayload(payload, nil); err != nil || msg.Code != istanbul.MsgPreprepare {
+			return false
+		}
+		return atomic.CompareAndSwapInt32(&dropped, 0, 1)
+	}
+	for _, b := range sys.backends {
+		c := b.engine.(*core)
+		config := *c.config
+		config.PreprepareResendPercent = 50
+		c.config = &config
+		c.clock = clock
+		c.SetBroadcastInterceptor(dropFirstPreprepare)
+	}
+
+	newBlocks := sys.backends[3].EventMux().Subscribe(istanbul.FinalCommittedEvent{})
+	defer newBlocks.Unsubscribe()
+
+	closer := sys.Run(true)
+	defer closer()
+	for i, b := range sys.backends {
+		b.NewRequest(makeBlockWithDifficulty(1, int64(i)))
+	}
+
+	// Nothing is committed without the preprepare
+	select {
+	case <-newBlocks.Chan():
+		t.Fatalf("committed a block without a preprepare")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if atomic.LoadInt32(&dropped) == 0 {
+		t.Fatalf("no preprepare was dropped")
+	}
+
+	// The proposer resends its preprepare halfway through the round, well before the round change
+	clock.Advance(sys.backends[0].engine.(*core).CurrentRoundTimeout() / 2)
+	select {
+	case <-newBlocks.Chan():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("did not commit a block after resending the preprepare")
+	}
+	for _, b := range sys.backends {
+		for _, payload := range b.sentMessages() {
+			msg := new(istanbul.Message)
+			if err := msg.FromPayload(payload, nil); err == nil && msg.Code == istanbul.MsgRoundChange {
+				t.Fatalf("block committed after a round change")
+			}
+		}
+	}
+}
+
+// blockingMessageStore is a MessageStore whose loads block until released.
+type blockingMessageStore struct {
+	MessageStore
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingMessageStore) Load(view *istanbul.View, code uint64) ([]byte, error) {
+	s.loading <- struct{}{}
+	<-s.release
+	return s.MessageStore.Load(view, code)
+}
+
+// This tests that a preprepare still being assembled when the proposer moves to a higher round is
+// never broadcast.
+func TestCancelProposalAssemblyOnRoundChange(t *testing.T) {
+	// Initialize the system with a nil round state so that we properly start round 0.
+	sys := NewTestSystemWithBackendAndCurrentRoundState(4, 1, func(vset istanbul.ValidatorSet) *roundState { return nil })
+
+	clock := newFakeClock()
+	loading := make(chan struct{}, len(sys.backends))
+	release := make(chan struct{})
+	for _, b := range sys.backends {
+		c := b.engine.(*core)
+		config := *c.config
+		config.AsyncProposalAssembly = true
+		c.config = &config
+		c.clock = clock
+		c.SetMessageStore(&blockingMessageStore{
+			MessageStore: NewMemoryMessageStore(),
+			loading:      loading,
+			release:      release,
+		})
+	}
+
+	closer := sys.Run(true)
+	for i, b := range sys.backends {
+		b.NewRequest(makeBlockWithDifficulty(1, int64(i)))
+	}
+
+	select {
+	case <-loading:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the proposer did not start assembling its preprepare")
+	}
+
+	// A round change certificate for round 1 arrives mid-assembly
+	view := istanbul.View{Round: big.NewInt(1), Sequence: big.NewInt(1)}
+	for _, b := range sys.backends[1:] {
+		msg, err := b.getRoundChangeMessage(view, istanbul.EmptyPreparedCertificate())
+		if err != nil {
+			t.Fatalf("failed to create ROUND CHANGE message: %v", err)
+		}
+		payload, _ := msg.Payload()
+		for _, r := range sys.backends {
+			r.events.Post(istanbul.MessageEvent{Payload: payload})
+		}
+	}
+	<-time.After(500 * time.Millisecond)
+	close(release)
+	<-time.After(500 * time.Millisecond)
+	// The sent messages are recorded by the engines, so stop them before reading
+	closer()
+
+	for _, b := range sys.backends {
+		for _, payload := range b.sentMsgs {
+			msg := new(istanbul.Message)
+			if err := msg.FromPayload(payload, nil); err != nil || msg.Code != istanbul.MsgPreprepare {
+				continue
+			}
+			var preprepare *istanbul.Preprepare
+			if err := msg.Decode(&preprepare); err != nil {
+				t.Fatalf("failed to decode preprepare: %v", err)
+			}
+			if preprepare.View.Round.Sign() == 0 {
+				t.Fatalf("stale preprepare for round 0 broadcast after the round change")
+			}
+		}
+	}
+}
@@ -17,17 +17,14 @@
 package core
 
 import (
+	"math/big"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
 )
 
 func (c *core) handleRequest(request *istanbul.Request) error {
-	logger := c.logger.New("state", c.state, "func", "handleRequest")
-	if c.current != nil {
-		logger = logger.New("cur_seq", c.current.Sequence(), "cur_round", c.current.Round())
-	} else {
-		logger = logger.New("cur_seq", 0, "cur_round", -1)
-	}
+	logger := c.NewLogger("func", "handleRequest")
 
 	if err := c.checkRequestMsg(request); err != nil {
 		if err == errInvalidMessage {
@@ -40,10 +37,25 @@ func (c *core) handleRequest(request *istanbul.Request) error {
 
 	logger.Trace("handleRequest", "number", request.Proposal.Number(), "hash", request.Proposal.Hash())
 
+	c.stopEmptyBlockTimer()
 	c.current.pendingRequest = request
 	// Must go through startNewRound to send proposals for round > 0 to ensure a round change certificate is generated.
 	if c.state == StateAcceptRequest && c.current.Round().Cmp(common.Big0) == 0 {
-		c.sendPreprepare(request, istanbul.RoundChangeCertificate{})
+		// Hold back empty blocks on top of an empty parent until EmptyBlockPeriod has passed
+		if delay := c.emptyBlockDelay(request.Proposal); delay > 0 {
+			logger.Trace("Delaying empty proposal", "number", request.Proposal.Number(), "delay", delay)
+			c.emptyBlockTimer = c.clock.AfterFunc(delay, func() {
+				c.sendEvent(istanbul.RequestEvent{
+					Proposal: request.Proposal,
+				})
+			})
+			return nil
+		}
+		if c.isSoleValidator() {
+			c.commitAsSoleValidator(request)
+		} else {
+			c.sendPreprepare(request, istanbul.RoundChangeCertificate{})
+		}
 	}
 	return nil
 }
@@ -67,14 +79,72 @@ func (c *core) checkRequestMsg(request *istanbul.Request) error {
 }
 
 func (c *core) storeRequestMsg(request *istanbul.Request) {
-	logger := c.logger.New("state", c.state, "cur_seq", c.current.Sequence(), "cur_round", c.current.Round(), "func", "storeRequestMsg")
+	logger := c.NewLogger("func", "storeRequestMsg")
 
 	logger.Trace("Store future request", "number", request.Proposal.Number(), "hash", request.Proposal.Hash())
 
 	c.pendingRequestsMu.Lock()
 	defer c.pendingRequestsMu.Unlock()
 
-	c.pendingRequests.Push(request, -request.Proposal.Number().Int64())
+	priority := -request.Proposal.Number().Int64()
+	if c.config != nil && c.config.MaxPendingRequests > 0 && uint64(c.pendingRequests.Size()) >= c.config.MaxPendingRequests {
+		c.droppedRequestCounter.Inc(1)
+		if !c.dropLowestPriorityRequest(priority) {
+			logger.Debug("Pending requests queue full, dropping request", "number", request.Proposal.Number(), "hash", request.Proposal.Hash())
+			return
+		}
+		logger.Debug("Pending requests queue full, dropped the lowest-priority request", "number", request.Proposal.Number(), "hash", request.Proposal.Hash())
+	}
+	c.pendingRequests.Push(request, priority)
+}
+
+// dropLowestPriorityRequest makes room in the pending requests queue for a request of the given
+// priority by dropping the lowest-priority request, unless that request doesn't rank below it.
+// It returns whether a request was dropped. The caller must hold pendingRequestsMu.
+func (c *core) dropLowestPriorityRequest(priority int64) bool {
+	type entry struct {
+		data     interface{}
+		priority int64
+	}
+	entries := make([]entry, 0, c.pendingRequests.Size())
+	for !c.pendingRequests.Empty() {
+		data, prio := c.pendingRequests.Pop()
+		entries = append(entries, entry{data, prio})
+	}
+	dropped := len(entries) > 0 && entries[len(entries)-1].priority < priority
+	if dropped {
+		entries = entries[:len(entries)-1]
+	}
+	for _, e := range entries {
+		c.pendingRequests.Push(e.data, e.priority)
+	}
+	return dropped
+}
+
+// PendingRequests implements core.Engine.PendingRequests
+func (c *core) PendingRequests() PendingRequestsInfo {
+	c.roundStateMu.RLock()
+	defer c.roundStateMu.RUnlock()
+	c.pendingRequestsMu.Lock()
+	defer c.pendingRequestsMu.Unlock()
+
+	info := PendingRequestsInfo{Size: c.pendingRequests.Size()}
+	if c.pendingRequests.Empty() {
+		return info
+	}
+	m, _ := c.pendingRequests.Peek()
+	if r, ok := m.(*istanbul.Request); ok {
+		round := new(big.Int)
+		if c.current != nil {
+			round.Set(c.current.Round())
+		}
+		info.Head = &istanbul.View{
+			Round:    round,
+			Sequence: new(big.Int).Set(r.Proposal.Number()),
+		}
+		info.HeadHash = r.Proposal.Hash()
+	}
+	return info
 }
 
 func (c *core) processPendingRequests() {
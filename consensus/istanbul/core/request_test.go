@@ -23,8 +23,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/prque"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
 )
@@ -113,6 +115,20 @@ func TestStoreRequestMsg(t *testing.T) {
 		t.Errorf("the size of pending requests mismatch: have %v, want %v", c.pendingRequests.Size(), len(requests))
 	}
 
+	info := c.PendingRequests()
+	if info.Size != len(requests) {
+		t.Errorf("the size of pending requests info mismatch: have %v, want %v", info.Size, len(requests))
+	}
+	if info.Head == nil || info.Head.Sequence.Cmp(requests[0].Proposal.Number()) != 0 {
+		t.Errorf("the head of pending requests mismatch: have %v, want sequence %v", info.Head, requests[0].Proposal.Number())
+	}
+	if info.HeadHash != requests[0].Proposal.Hash() {
+		t.Errorf("the head hash of pending requests mismatch: have %v, want %v", info.HeadHash, requests[0].Proposal.Hash())
+	}
+	if c.pendingRequests.Size() != len(requests) {
+		t.Errorf("inspecting pending requests changed the queue size: have %v, want %v", c.pendingRequests.Size(), len(requests))
+	}
+
 	c.current.sequence = big.NewInt(3)
 
 	c.subscribeEvents()
@@ -135,3 +151,147 @@ func TestStoreRequestMsg(t *testing.T) {
 		t.Error("unexpected timeout occurs")
 	}
 }
+
+func TestMaxPendingRequests(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+	config := *istanbul.DefaultConfig
+	config.MaxPendingRequests = 3
+	c.config = &config
+
+	// Overfill the queue with requests in no particular order
+	for _, number := range []int64{6, 4, 9, 5, 8, 2, 7, 3} {
+		c.storeRequestMsg(&istanbul.Request{Proposal: makeBlock(number)})
+	}
+	if size := c.pendingRequests.Size(); uint64(size) != config.MaxPendingRequests {
+		t.Fatalf("the size of pending requests mismatch: have %v, want %v", size, config.MaxPendingRequests)
+	}
+
+	// The highest-priority requests are kept, best first
+	for _, want := range []int64{2, 3, 4} {
+		m, _ := c.pendingRequests.Pop()
+		if number := m.(*istanbul.Request).Proposal.Number().Int64(); number != want {
+			t.Errorf("request number mismatch: have %v, want %v", number, want)
+		}
+	}
+}
+
+func TestEmptyBlockDelay(t *testing.T) {
+	makeBlockAt := func(number int64, time int64, txs []*types.Transaction) *types.Block {
+		header := &types.Header{
+			Difficulty: big.NewInt(0),
+			Number:     big.NewInt(number),
+			Time:       big.NewInt(time),
+		}
+		return types.NewBlock(header, txs, nil, nil, nil)
+	}
+	txs := []*types.Transaction{types.NewTransaction(0, common.Address{}, big.NewInt(0), 0, big.NewInt(0), nil, nil, nil)}
+
+	sys := NewTestSystemWithBackend(4, 1)
+	backend := sys.backends[0]
+	c := backend.engine.(*core)
+	config := *istanbul.DefaultConfig
+	config.BlockPeriod = 1
+	config.EmptyBlockPeriod = 5
+	c.config = &config
+
+	now := time.Now().Unix()
+	emptyParent := makeBlockAt(1, now, nil)
+	fullParent := makeBlockAt(1, now, txs)
+	emptyChild := makeBlockAt(2, now+1, nil)
+	fullChild := makeBlockAt(2, now+1, txs)
+
+	testCases := []struct {
+		name     string
+		parent   *types.Block
+		proposal *types.Block
+		delayed  bool
+	}{
+		{"empty block on empty parent", emptyParent, emptyChild, true},
+		{"block with transactions on empty parent", emptyParent, fullChild, false},
+		{"empty block on parent with transactions", fullParent, emptyChild, false},
+		{"block with transactions on parent with transactions", fullParent, fullChild, false},
+	}
+	for _, test := range testCases {
+		backend.committedMsgs = []testCommittedMsgs{{commitProposal: test.parent}}
+		delay := c.emptyBlockDelay(test.proposal)
+		if !test.delayed && delay != 0 {
+			t.Errorf("%s: delay mismatch: have %v, want 0", test.name, delay)
+		}
+		if test.delayed && (delay <= 3*time.Second || delay > 5*time.Second) {
+			t.Errorf("%s: delay mismatch: have %v, want about 5s", test.name, delay)
+		}
+	}
+
+	// Empty blocks are not held back when EmptyBlockPeriod doesn't exceed BlockPeriod
+	config.EmptyBlockPeriod = config.BlockPeriod
+	backend.committedMsgs = []testCommittedMsgs{{commitProposal: emptyParent}}
+	if delay := c.emptyBlockDelay(emptyChild); delay != 0 {
+		t.Errorf("delay mismatch with EmptyBlockPeriod disabled: have %v, want 0", delay)
+	}
+}
+
+func TestEmptyBlockCadence(t *testing.T) {
+	makeEmptyBlockAt := func(number int64, time int64) *types.Block {
+		header := &types.Header{
+			Difficulty: big.NewInt(0),
+			Number:     big.NewInt(number),
+			Time:       big.NewInt(time),
+		}
+		return types.NewBlock(header, nil, nil, nil, nil)
+	}
+
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	var backend *testSystemBackend
+	for _, b := range sys.backends {
+		if b.engine.(*core).isProposer() {
+			backend = b
+		}
+	}
+	c := backend.engine.(*core)
+	clock := newFakeClock()
+	c.clock = clock
+	config := *istanbul.DefaultConfig
+	config.BlockPeriod = 1
+	config.EmptyBlockPeriod = 5
+	c.config = &config
+
+	sub := backend.EventMux().Subscribe(istanbul.RequestEvent{})
+	defer sub.Unsubscribe()
+
+	// An empty block on top of an empty parent is only proposed EmptyBlockPeriod after the parent
+	parentTime := clock.Now().Unix()
+	backend.committedMsgs = []testCommittedMsgs{{commitProposal: makeEmptyBlockAt(0, parentTime)}}
+	request := &istanbul.Request{Proposal: makeEmptyBlockAt(1, parentTime+1)}
+	if err := c.handleRequest(request); err != nil {
+		t.Fatalf("failed to handle request: %v", err)
+	}
+	clock.Advance(time.Duration(config.EmptyBlockPeriod)*time.Second - time.Millisecond)
+	select {
+	case <-sub.Chan():
+		t.Fatalf("empty proposal released before EmptyBlockPeriod")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(backend.sentMsgs) != 0 {
+		t.Fatalf("sent message count mismatch before EmptyBlockPeriod: have %v, want 0", len(backend.sentMsgs))
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case event := <-sub.Chan():
+		if ev := event.Data.(istanbul.RequestEvent); ev.Proposal.Hash() != request.Proposal.Hash() {
+			t.Fatalf("released proposal mismatch: have %v, want %v", ev.Proposal.Hash(), request.Proposal.Hash())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("empty proposal not released after EmptyBlockPeriod")
+	}
+	if err := c.handleRequest(request); err != nil {
+		t.Fatalf("failed to handle released request: %v", err)
+	}
+	if len(backend.sentMsgs) != 1 {
+		t.Fatalf("sent message count mismatch after EmptyBlockPeriod: have %v, want 1", len(backend.sentMsgs))
+	}
+}
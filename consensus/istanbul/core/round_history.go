@@ -0,0 +1,87 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// roundHistorySize is the number of finished sequences whose final round is kept to compute the
+// round change rate.
+const roundHistorySize = 1024
+
+// roundHistoryEntry is the round a sequence was finished in, and when.
+type roundHistoryEntry struct {
+	sequence uint64
+	round    uint64
+	time     time.Time
+}
+
+// roundHistory is a ring buffer of the final rounds of the last sequences finished by the core.
+type roundHistory struct {
+	mu      sync.Mutex
+	entries []roundHistoryEntry
+	next    int  // index of the next entry to overwrite
+	full    bool // whether the buffer wrapped around
+}
+
+func newRoundHistory(size int) *roundHistory {
+	return &roundHistory{entries: make([]roundHistoryEntry, size)}
+}
+
+// add records the final round of a sequence, evicting the oldest entry if the buffer is full.
+func (h *roundHistory) add(entry roundHistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries[h.next] = entry
+	h.next++
+	if h.next == len(h.entries) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// rate returns the average number of round changes per sequence among the sequences finished
+// since the given time, 0 if none was.
+func (h *roundHistory) rate(since time.Time) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := h.entries[:h.next]
+	if h.full {
+		entries = h.entries
+	}
+	var sequences, rounds uint64
+	for _, entry := range entries {
+		if entry.time.Before(since) {
+			continue
+		}
+		sequences++
+		rounds += entry.round
+	}
+	if sequences == 0 {
+		return 0
+	}
+	return float64(rounds) / float64(sequences)
+}
+
+// RoundChangeRate implements core.Engine.RoundChangeRate
+func (c *core) RoundChangeRate(window time.Duration) float64 {
+	return c.roundHistory.rate(c.clock.Now().Add(-window))
+}
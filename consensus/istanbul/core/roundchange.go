@@ -18,27 +18,44 @@ package core
 
 import (
 	"math/big"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/metrics"
 )
 
 // sendNextRoundChange sends the ROUND CHANGE message with current round + 1
-func (c *core) sendNextRoundChange() {
+func (c *core) sendNextRoundChange(reason RoundChangeReason) {
+	if c.current == nil {
+		c.NewLogger("func", "sendNextRoundChange").Warn("Cannot send out the round change before the round state is initialized")
+		return
+	}
 	cv := c.currentView()
-	c.sendRoundChange(new(big.Int).Add(cv.Round, common.Big1))
+	c.sendRoundChange(new(big.Int).Add(cv.Round, common.Big1), reason)
 }
 
-// sendRoundChange sends the ROUND CHANGE message with the given round
-func (c *core) sendRoundChange(round *big.Int) {
-	logger := c.logger.New("state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "sendRoundChange", "target round", round)
+// sendRoundChange sends the ROUND CHANGE message with the given round, recording why
+func (c *core) sendRoundChange(round *big.Int, reason RoundChangeReason) {
+	logger := c.NewLogger("func", "sendRoundChange", "target round", round, "reason", reason)
+
+	if c.current == nil {
+		logger.Warn("Cannot send out the round change before the round state is initialized")
+		return
+	}
 
 	cv := c.currentView()
 	if cv.Round.Cmp(round) >= 0 {
 		logger.Error("Cannot send out the round change")
 		return
 	}
+	// A round change for this round or a later one was already broadcast in this sequence
+	if sent := c.roundChangeSent; sent != nil && sent.Sequence.Cmp(cv.Sequence) == 0 && sent.Round.Cmp(round) >= 0 {
+		logger.Debug("Round change already sent", "sent_round", sent.Round)
+		return
+	}
 
 	nextView := &istanbul.View{
 		// The round number we'd like to transfer to.
@@ -61,10 +78,19 @@ func (c *core) sendRoundChange(round *big.Int) {
 		Code: istanbul.MsgRoundChange,
 		Msg:  payload,
 	})
+	c.roundChangeSent = nextView
+
+	c.lastRoundChangeMu.Lock()
+	c.lastRoundChange = &RoundChangeInfo{
+		Reason: reason.String(),
+		View:   nextView,
+		Time:   uint64(c.clock.Now().Unix()),
+	}
+	c.lastRoundChangeMu.Unlock()
 }
 
 func (c *core) handleRoundChangeCertificate(proposal istanbul.Subject, roundChangeCertificate istanbul.RoundChangeCertificate) error {
-	logger := c.logger.New("state", c.state, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "handleRoundChangeCertificate")
+	logger := c.NewLogger("func", "handleRoundChangeCertificate")
 
 	if len(roundChangeCertificate.RoundChangeMessages) > c.valSet.Size() || len(roundChangeCertificate.RoundChangeMessages) < c.valSet.MinQuorumSize() {
 		return errInvalidRoundChangeCertificateNumMsgs
@@ -81,7 +107,7 @@ func (c *core) handleRoundChangeCertificate(proposal istanbul.Subject, roundChan
 			return err
 		}
 
-		signer, err := c.validateFn(data, message.Signature)
+		signer, err := c.checkCachedMessageSignature(data, &message)
 		if err != nil {
 			return err
 		}
@@ -149,7 +175,7 @@ func (c *core) handleRoundChangeCertificate(proposal istanbul.Subject, roundChan
 }
 
 func (c *core) handleRoundChange(msg *istanbul.Message) error {
-	logger := c.logger.New("state", c.state, "from", msg.Address, "cur_round", c.current.Round(), "cur_seq", c.current.Sequence(), "func", "handleRoundChange", "tag", "handleMsg")
+	logger := c.NewLogger("from", msg.Address, "func", "handleRoundChange", "tag", "handleMsg")
 
 	// Decode ROUND CHANGE message
 	var rc *istanbul.RoundChange
@@ -190,7 +216,7 @@ func (c *core) handleRoundChange(msg *istanbul.Message) error {
 	// On quorum round change messages we go to the next round immediately.
 	if num == c.valSet.F()+1 {
 		logger.Trace("Got f+1 round change messages, sending own round change message and waiting for next round.")
-		c.waitForDesiredRound(roundView.Round)
+		c.waitForDesiredRound(roundView.Round, RoundChangePeers)
 	} else if num == c.valSet.MinQuorumSize() {
 		logger.Trace("Got quorum round change messages, starting new round.")
 		c.startNewRound(roundView.Round)
@@ -200,18 +226,29 @@ func (c *core) handleRoundChange(msg *istanbul.Message) error {
 
 // ----------------------------------------------------------------------------
 
-func newRoundChangeSet(valSet istanbul.ValidatorSet) *roundChangeSet {
+func newRoundChangeSet(valSet istanbul.ValidatorSet, clock Clock, formationTimer metrics.Timer, maxMessages uint64) *roundChangeSet {
 	return &roundChangeSet{
-		validatorSet: valSet,
-		roundChanges: make(map[uint64]*messageSet),
-		mu:           new(sync.Mutex),
+		validatorSet:   valSet,
+		maxMessages:    maxMessages,
+		roundChanges:   make(map[uint64]*messageSet),
+		firstSeen:      make(map[uint64]time.Time),
+		clock:          clock,
+		formationTimer: formationTimer,
+		mu:             new(sync.Mutex),
 	}
 }
 
 type roundChangeSet struct {
 	validatorSet istanbul.ValidatorSet
 	roundChanges map[uint64]*messageSet
-	mu           *sync.Mutex
+	// when the first ROUND CHANGE message of each round without a certificate yet was added
+	firstSeen map[uint64]time.Time
+	clock     Clock
+	// the time from the first ROUND CHANGE message of a round to its certificate
+	formationTimer metrics.Timer
+	// the number of messages kept across all rounds, 0 for no limit
+	maxMessages uint64
+	mu          *sync.Mutex
 }
 
 // Add adds the round and message into round change set
@@ -227,9 +264,69 @@ func (rcs *roundChangeSet) Add(r *big.Int, msg *istanbul.Message) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if rcs.roundChanges[round].Size() == 1 {
+		rcs.firstSeen[round] = rcs.clock.Now()
+	}
+	rcs.evict(round)
+	// The message itself is evicted if its sender has a higher round
+	if rcs.roundChanges[round] == nil {
+		return 0, nil
+	}
 	return rcs.roundChanges[round].Size(), nil
 }
 
+// evict deletes the messages of each validator below its highest round, then the lowest rounds
+// other than keep, until the number of messages across all rounds is back under maxMessages, so that
+// a validator sending many rounds can't crowd out the others. The caller must hold mu.
+func (rcs *roundChangeSet) evict(keep uint64) {
+	if rcs.maxMessages == 0 {
+		return
+	}
+	total := uint64(0)
+	for _, rms := range rcs.roundChanges {
+		total += uint64(rms.Size())
+	}
+	if total <= rcs.maxMessages {
+		return
+	}
+
+	highest := make(map[common.Address]uint64)
+	for round, rms := range rcs.roundChanges {
+		for _, msg := range rms.Values() {
+			if r, ok := highest[msg.Address]; !ok || round > r {
+				highest[msg.Address] = round
+			}
+		}
+	}
+	for round, rms := range rcs.roundChanges {
+		for _, msg := range rms.Values() {
+			if highest[msg.Address] != round {
+				rms.remove(msg.Address)
+				total--
+			}
+		}
+		if rms.Size() == 0 {
+			delete(rcs.roundChanges, round)
+			delete(rcs.firstSeen, round)
+		}
+	}
+
+	for total > rcs.maxMessages {
+		lowest, found := uint64(0), false
+		for k := range rcs.roundChanges {
+			if k != keep && (!found || k < lowest) {
+				lowest, found = k, true
+			}
+		}
+		if !found {
+			return
+		}
+		total -= uint64(rcs.roundChanges[lowest].Size())
+		delete(rcs.roundChanges, lowest)
+		delete(rcs.firstSeen, lowest)
+	}
+}
+
 // Clear deletes the messages with smaller round
 func (rcs *roundChangeSet) Clear(round *big.Int) {
 	rcs.mu.Lock()
@@ -238,8 +335,44 @@ func (rcs *roundChangeSet) Clear(round *big.Int) {
 	for k, rms := range rcs.roundChanges {
 		if len(rms.Values()) == 0 || k < round.Uint64() {
 			delete(rcs.roundChanges, k)
+			delete(rcs.firstSeen, k)
+		}
+	}
+}
+
+// messages returns the ROUND CHANGE messages received for the given round
+func (rcs *roundChangeSet) messages(r *big.Int) []istanbul.Message {
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+
+	rms := rcs.roundChanges[r.Uint64()]
+	if rms == nil {
+		return nil
+	}
+	messages := make([]istanbul.Message, 0, rms.Size())
+	for _, message := range rms.Values() {
+		messages = append(messages, *message)
+	}
+	return messages
+}
+
+// allMessages returns the ROUND CHANGE messages of all rounds, from the lowest round up
+func (rcs *roundChangeSet) allMessages() []istanbul.Message {
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+
+	rounds := make([]uint64, 0, len(rcs.roundChanges))
+	for round := range rcs.roundChanges {
+		rounds = append(rounds, round)
+	}
+	sort.Slice(rounds, func(i, j int) bool { return rounds[i] < rounds[j] })
+	var messages []istanbul.Message
+	for _, round := range rounds {
+		for _, message := range rcs.roundChanges[round].Values() {
+			messages = append(messages, *message)
 		}
 	}
+	return messages
 }
 
 // MaxRound returns the max round which the number of messages is equal or larger than num
@@ -270,6 +403,11 @@ func (rcs *roundChangeSet) getCertificate(r *big.Int, quorumSize int) (istanbul.
 		for i, message := range rcs.roundChanges[round].Values() {
 			messages[i] = *message
 		}
+		// Only the first certificate of a round measures its formation
+		if firstSeen, ok := rcs.firstSeen[round]; ok {
+			rcs.formationTimer.Update(rcs.clock.Now().Sub(firstSeen))
+			delete(rcs.firstSeen, round)
+		}
 		return istanbul.RoundChangeCertificate{
 			RoundChangeMessages: messages,
 		}, nil
@@ -17,19 +17,23 @@
 package core
 
 import (
+	"fmt"
 	"math/big"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
 	"github.com/ethereum/go-ethereum/consensus/istanbul/validator"
+	"github.com/ethereum/go-ethereum/metrics"
 )
 
 func TestRoundChangeSet(t *testing.T) {
 	vals, _, _ := generateValidators(4)
 	vset := validator.NewSet(vals, istanbul.RoundRobin)
-	rc := newRoundChangeSet(vset)
+	rc := newRoundChangeSet(vset, realClock{}, metrics.NilTimer{}, 0)
 
 	view := &istanbul.View{
 		Sequence: big.NewInt(1),
@@ -93,6 +97,224 @@ func TestRoundChangeSet(t *testing.T) {
 	}
 }
 
+func TestRoundChangeSetEviction(t *testing.T) {
+	vals, _, _ := generateValidators(4)
+	vset := validator.NewSet(vals, istanbul.RoundRobin)
+	add := func(rc *roundChangeSet, round int64, addr common.Address) int {
+		view := &istanbul.View{Sequence: big.NewInt(1), Round: big.NewInt(round)}
+		m, _ := Encode(&istanbul.Subject{View: view, Digest: common.Hash{}})
+		num, err := rc.Add(view.Round, &istanbul.Message{
+			Code:    istanbul.MsgRoundChange,
+			Msg:     m,
+			Address: addr,
+		})
+		if err != nil {
+			t.Fatalf("failed to add round change of round %d: %v", round, err)
+		}
+		return num
+	}
+	size := func(rc *roundChangeSet) int {
+		total := 0
+		for _, rms := range rc.roundChanges {
+			total += rms.Size()
+		}
+		return total
+	}
+
+	// Room for the messages of all validators in three rounds
+	rc := newRoundChangeSet(vset, realClock{}, metrics.NilTimer{}, uint64(3*vset.Size()))
+	for round := int64(1); round <= 10; round++ {
+		for _, v := range vset.List() {
+			add(rc, round, v.Address())
+		}
+	}
+	if total := size(rc); total > 3*vset.Size() {
+		t.Errorf("retained messages mismatch: have %d, want at most %d", total, 3*vset.Size())
+	}
+	if maxRound := rc.MaxRound(vset.Size()); maxRound == nil || maxRound.Uint64() != 10 {
+		t.Errorf("max round mismatch: have %v, want 10", maxRound)
+	}
+
+	// A validator sending many rounds only keeps its highest one rather than evicting the others
+	rc = newRoundChangeSet(vset, realClock{}, metrics.NilTimer{}, uint64(vset.Size()))
+	for _, v := range vset.List()[1:] {
+		add(rc, 1, v.Address())
+	}
+	spammer := vset.GetByIndex(0).Address()
+	for round := int64(1); round <= 10; round++ {
+		add(rc, round, spammer)
+	}
+	if rms := rc.roundChanges[1]; rms == nil || rms.Size() != vset.Size()-1 || rms.Get(spammer) != nil {
+		t.Errorf("round 1 mismatch: have %v, want the messages of all validators but the spammer", rms)
+	}
+	for round := uint64(2); round < 10; round++ {
+		if _, ok := rc.roundChanges[round]; ok {
+			t.Errorf("superseded round %d retained", round)
+		}
+	}
+	if rms := rc.roundChanges[10]; rms == nil || rms.Get(spammer) == nil {
+		t.Errorf("round 10 mismatch: have %v, want the message of the spammer", rms)
+	}
+
+	// A message superseded by a higher round of its sender is evicted right away
+	if num := add(rc, 2, spammer); num != 0 {
+		t.Errorf("round 2 messages mismatch: have %d, want 0", num)
+	}
+	if rms := rc.roundChanges[10]; rms == nil || rms.Get(spammer) == nil {
+		t.Errorf("round 10 mismatch: have %v, want the message of the spammer", rms)
+	}
+}
+
+func TestRoundChangeCertificateFormationTimer(t *testing.T) {
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = false }()
+
+	vals, _, _ := generateValidators(4)
+	vset := validator.NewSet(vals, istanbul.RoundRobin)
+	clock := newFakeClock()
+	timer := metrics.NewTimer()
+	rc := newRoundChangeSet(vset, clock, timer, 0)
+
+	round := big.NewInt(1)
+	m, _ := Encode(&istanbul.RoundChange{
+		View:                &istanbul.View{Sequence: big.NewInt(1), Round: round},
+		PreparedCertificate: istanbul.EmptyPreparedCertificate(),
+	})
+	for i, v := range vset.List() {
+		if i == vset.MinQuorumSize() {
+			break
+		}
+		if _, err := rc.getCertificate(round, vset.MinQuorumSize()); err == nil {
+			t.Fatalf("got a certificate from %d round change messages", i)
+		}
+		rc.Add(round, &istanbul.Message{
+			Code:    istanbul.MsgRoundChange,
+			Msg:     m,
+			Address: v.Address(),
+		})
+		clock.Advance(time.Second)
+	}
+	if have := timer.Count(); have != 0 {
+		t.Fatalf("formation recorded before the certificate: have %d, want 0", have)
+	}
+
+	// The time from the first message to the certificate is recorded once per round
+	for i := 0; i < 2; i++ {
+		if _, err := rc.getCertificate(round, vset.MinQuorumSize()); err != nil {
+			t.Fatalf("failed to get the certificate: %v", err)
+		}
+	}
+	if have := timer.Count(); have != 1 {
+		t.Fatalf("formation count mismatch: have %d, want 1", have)
+	}
+	if have, want := time.Duration(timer.Max()), time.Duration(vset.MinQuorumSize())*time.Second; have != want {
+		t.Errorf("formation time mismatch: have %v, want %v", have, want)
+	}
+}
+
+func TestSendRoundChangeOnce(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	v0 := sys.backends[0]
+	c := v0.engine.(*core)
+	roundChanges := func() []*istanbul.RoundChange {
+		var rcs []*istanbul.RoundChange
+		for _, payload := range v0.sentMsgs {
+			msg := new(istanbul.Message)
+			if err := msg.FromPayload(payload, nil); err != nil || msg.Code != istanbul.MsgRoundChange {
+				continue
+			}
+			var rc *istanbul.RoundChange
+			if err := msg.Decode(&rc); err != nil {
+				t.Fatalf("failed to decode round change: %v", err)
+			}
+			rcs = append(rcs, rc)
+		}
+		return rcs
+	}
+
+	// Asking for round 1 several times broadcasts a single round change
+	c.waitForDesiredRound(big.NewInt(1), RoundChangeTimeout)
+	c.waitForDesiredRound(big.NewInt(1), RoundChangeTimeout)
+	c.sendNextRoundChange(RoundChangeTimeout)
+	if rcs := roundChanges(); len(rcs) != 1 || rcs[0].View.Round.Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("round changes mismatch: have %v, want one for round 1", rcs)
+	}
+
+	// A later round is still broadcast
+	c.waitForDesiredRound(big.NewInt(2), RoundChangeTimeout)
+	if rcs := roundChanges(); len(rcs) != 2 || rcs[1].View.Round.Cmp(big.NewInt(2)) != 0 {
+		t.Errorf("round changes mismatch: have %v, want a second one for round 2", rcs)
+	}
+	c.stopTimer()
+}
+
+func TestLastRoundChangeReason(t *testing.T) {
+	testCases := []struct {
+		name    string
+		trigger func(c *core)
+		reason  string
+	}{
+		{
+			"timeout",
+			func(c *core) { c.handleTimeoutMsg(c.currentView()) },
+			"Timeout",
+		},
+		{
+			"manual",
+			func(c *core) { c.waitForDesiredRound(big.NewInt(1), RoundChangeManual) },
+			"Manual",
+		},
+		{
+			"proposer self check",
+			func(c *core) { c.handleProposerSelfCheck(c.currentView()) },
+			"ProposerSelfCheck",
+		},
+		{
+			"commit failure",
+			func(c *core) {
+				// A proposal for the wrong sequence is refused at commit time
+				c.current.SetPreprepare(&istanbul.Preprepare{View: c.currentView(), Proposal: makeBlock(2)})
+				c.commit()
+			},
+			"CommitFailure",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			sys := NewTestSystemWithBackend(4, 1)
+			closer := sys.Run(false)
+			defer closer()
+
+			var c *core
+			for _, backend := range sys.backends {
+				if proposer := backend.engine.(*core); proposer.isProposer() {
+					c = proposer
+				}
+			}
+			if info := c.LastRoundChange(); info != nil {
+				t.Fatalf("last round change mismatch: have %v, want nil", info)
+			}
+
+			test.trigger(c)
+			info := c.LastRoundChange()
+			if info == nil {
+				t.Fatalf("no round change recorded")
+			}
+			if info.Reason != test.reason {
+				t.Errorf("reason mismatch: have %v, want %v", info.Reason, test.reason)
+			}
+			if info.View.Round.Cmp(big.NewInt(1)) != 0 || info.View.Sequence.Cmp(c.current.Sequence()) != 0 {
+				t.Errorf("view mismatch: have %v, want round 1 of sequence %v", info.View, c.current.Sequence())
+			}
+			c.stopTimer()
+		})
+	}
+}
+
 func TestHandleRoundChangeCertificate(t *testing.T) {
 	N := uint64(4) // replica 0 is the proposer, it will send messages to others
 	F := uint64(1)
@@ -157,6 +379,110 @@ func TestHandleRoundChangeCertificate(t *testing.T) {
 	}
 }
 
+func TestGetPreprepareWithRoundChangeCertificate(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+	view := istanbul.View{
+		Round:    big.NewInt(1),
+		Sequence: big.NewInt(1),
+	}
+	otherSequenceView := istanbul.View{
+		Round:    big.NewInt(1),
+		Sequence: big.NewInt(2),
+	}
+
+	testCases := []struct {
+		views       []istanbul.View
+		expectedErr error
+	}{
+		{
+			// All messages for the current sequence
+			[]istanbul.View{view, view, view},
+			nil,
+		},
+		{
+			// One message replayed from a different sequence
+			[]istanbul.View{view, view, otherSequenceView},
+			errInvalidRoundChangeCertificateSequence,
+		},
+	}
+	for i, test := range testCases {
+		sys := NewTestSystemWithBackend(N, F)
+		c := sys.backends[0].engine.(*core)
+		for j, v := range test.views {
+			msg, err := sys.backends[j].getRoundChangeMessage(v, istanbul.EmptyPreparedCertificate())
+			if err != nil {
+				t.Fatalf("failed to create ROUND CHANGE message: %v", err)
+			}
+			c.roundChangeSet.Add(view.Round, &msg)
+		}
+
+		_, _, err := c.getPreprepareWithRoundChangeCertificate(view.Round)
+		if err != test.expectedErr {
+			t.Errorf("error mismatch for test case %v: have %v, want %v", i, err, test.expectedErr)
+		}
+	}
+}
+
+func TestGetPreprepareWithConflictingPreparedCertificates(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+	view := istanbul.View{
+		Round:    big.NewInt(2),
+		Sequence: big.NewInt(1),
+	}
+	round0 := istanbul.View{Round: big.NewInt(0), Sequence: big.NewInt(1)}
+	round1 := istanbul.View{Round: big.NewInt(1), Sequence: big.NewInt(1)}
+	proposal := makeBlock(1)
+	otherProposal := makeBlockWithDifficulty(1, 2)
+
+	type preparedAt struct {
+		view     istanbul.View
+		proposal istanbul.Proposal
+	}
+	testCases := []struct {
+		name         string
+		certificates []preparedAt
+		expectedErr  error
+	}{
+		{
+			"same proposal in the highest round",
+			[]preparedAt{{round1, proposal}, {round1, proposal}, {round0, otherProposal}},
+			nil,
+		},
+		{
+			"conflicting proposals in the highest round",
+			[]preparedAt{{round1, proposal}, {round0, proposal}, {round1, otherProposal}},
+			errConflictingPreparedCertificates,
+		},
+		{
+			"conflicting proposals superseded by a higher round",
+			[]preparedAt{{round0, proposal}, {round0, otherProposal}, {round1, proposal}},
+			nil,
+		},
+	}
+	for _, test := range testCases {
+		sys := NewTestSystemWithBackend(N, F)
+		c := sys.backends[0].engine.(*core)
+		for j, prepared := range test.certificates {
+			certificate := sys.getPreparedCertificate(t, prepared.view, prepared.proposal)
+			msg, err := sys.backends[j].getRoundChangeMessage(view, certificate)
+			if err != nil {
+				t.Fatalf("failed to create ROUND CHANGE message: %v", err)
+			}
+			c.roundChangeSet.Add(view.Round, &msg)
+		}
+
+		request, _, err := c.getPreprepareWithRoundChangeCertificate(view.Round)
+		if err != test.expectedErr {
+			t.Errorf("%s: error mismatch: have %v, want %v", test.name, err, test.expectedErr)
+		}
+		if err == nil && request.Proposal.Hash() != proposal.Hash() {
+			t.Errorf("%s: proposal mismatch: have %v, want %v", test.name, request.Proposal.Hash(), proposal.Hash())
+		}
+	}
+}
+
 func TestHandleRoundChange(t *testing.T) {
 	N := uint64(4) // replica 0 is the proposer, it will send messages to others
 	F := uint64(1) // F does not affect tests
@@ -472,3 +798,220 @@ func TestPreparedCertificatePersistsThroughRoundChanges(t *testing.T) {
 	}
 	close(sys.quit)
 }
+
+// This tests that the validators recover with a round change when every PREPARE of the first round
+// is dropped by the broadcast interceptor.
+func TestRoundChangeAfterDroppedPrepares(t *testing.T) {
+	// Initialize the system with a nil round state so that we properly start round 0.
+	sys := NewTestSystemWithBackendAndCurrentRoundState(4, 1, func(vset istanbul.ValidatorSet) *roundState { return nil })
+
+	clock := newFakeClock()
+	var dropped int32
+	dropFirstRoundPrepares := func(valSet istanbul.ValidatorSet, payload []byte) bool {
+		msg := new(istanbul.Message)
+		if err := msg.FromPayload(payload, nil); err != nil || msg.Code != istanbul.MsgPrepare {
+			return false
+		}
+		var subject *istanbul.Subject
+		if err := msg.Decode(&subject); err != nil || subject.View.Round.Sign() != 0 {
+			return false
+		}
+		atomic.AddInt32(&dropped, 1)
+		return true
+	}
+	for _, b := range sys.backends {
+		c := b.engine.(*core)
+		c.clock = clock
+		c.SetBroadcastInterceptor(dropFirstRoundPrepares)
+	}
+
+	newBlocks := sys.backends[3].EventMux().Subscribe(istanbul.FinalCommittedEvent{})
+	defer newBlocks.Unsubscribe()
+
+	closer := sys.Run(true)
+	defer closer()
+	for i, b := range sys.backends {
+		b.NewRequest(makeBlockWithDifficulty(1, int64(i)))
+	}
+
+	// Nothing is committed in round 0
+	select {
+	case <-newBlocks.Chan():
+		t.Fatalf("committed a block without PREPAREs")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if atomic.LoadInt32(&dropped) == 0 {
+		t.Fatalf("no PREPARE was dropped")
+	}
+
+	// Time out round 0, the block is committed in round 1
+	clock.Advance(sys.backends[0].engine.(*core).CurrentRoundTimeout())
+	select {
+	case <-newBlocks.Chan():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("did not commit a block after the round change")
+	}
+	roundChanges := 0
+	for _, payload := range sys.backends[3].sentMsgs {
+		msg := new(istanbul.Message)
+		if err := msg.FromPayload(payload, nil); err == nil && msg.Code == istanbul.MsgRoundChange {
+			roundChanges++
+		}
+	}
+	if roundChanges == 0 {
+		t.Errorf("block committed without a round change")
+	}
+}
+
+// This tests that a validator starting after the others timed out their first round catches up
+// with their round change through view sync, instead of waiting for its own round change timer.
+func TestViewSyncCatchUpOnLateStart(t *testing.T) {
+	for _, requestViewSync := range []bool{false, true} {
+		t.Run(fmt.Sprintf("requestViewSync=%v", requestViewSync), func(t *testing.T) {
+			// Initialize the system with a nil round state so that we properly start round 0.
+			sys := NewTestSystemWithBackendAndCurrentRoundState(4, 1, func(vset istanbul.ValidatorSet) *roundState { return nil })
+
+			clock := newFakeClock()
+			for _, b := range sys.backends {
+				c := b.engine.(*core)
+				config := *c.config
+				config.RequestViewSync = requestViewSync
+				c.config = &config
+				c.clock = clock
+				c.messageTrace = newMessageTrace(100)
+			}
+
+			// Manually start the validators, the third one late and the last one never
+			go sys.listen()
+			early, late := sys.backends[:2], sys.backends[2]
+			started := append([]*testSystemBackend{}, early...)
+			stopped := false
+			stop := func() {
+				if stopped {
+					return
+				}
+				stopped = true
+				for _, b := range started {
+					b.engine.Stop()
+				}
+				close(sys.quit)
+			}
+			defer func() {
+				stop()
+				for _, b := range sys.backends {
+					os.RemoveAll(b.dataDir)
+				}
+			}()
+			for _, b := range started {
+				b.engine.Start()
+			}
+
+			// The first two validators time out round 0, but are short of a quorum to move to round 1
+			clock.Advance(sys.backends[0].engine.(*core).CurrentRoundTimeout())
+			for _, from := range early {
+				waitForRoundChange(t, early, from.Address(), 1)
+			}
+
+			started = append(started, late)
+			late.engine.Start()
+			if requestViewSync {
+				// The late validator joins the round change, which gives everyone a quorum for round 1
+				waitForRoundChange(t, started, late.Address(), 1)
+			}
+			stop()
+
+			want := big.NewInt(0)
+			if requestViewSync {
+				want = big.NewInt(1)
+			}
+			for i, b := range started {
+				state, err := b.engine.(*core).getRoundStateFromDisk()
+				if err != nil || state == nil {
+					t.Fatalf("backend %d: failed to load the round state: %v", i, err)
+				}
+				if round := state.Round(); round.Cmp(want) != 0 {
+					t.Errorf("backend %d: round mismatch: have %v, want %v", i, round, want)
+				}
+			}
+			// The view sync responses only went to the late validator
+			for i, b := range early {
+				for _, record := range b.engine.(*core).MessageTrace() {
+					if record.Code == istanbul.MsgViewSyncResponse {
+						t.Errorf("backend %d: got a view sync response from %v", i, record.From.Hex())
+					}
+				}
+			}
+		})
+	}
+}
+
+// waitForRoundChange waits until each of the given backends handled a ROUND CHANGE for the given
+// round from the given validator, as recorded in their message trace.
+func waitForRoundChange(t *testing.T, backends []*testSystemBackend, from common.Address, round int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, b := range backends {
+		for !hasTraceRecord(b.engine.(*core), istanbul.MsgRoundChange, from, round) {
+			if time.Now().After(deadline) {
+				t.Fatalf("backend %v did not handle the round change for round %d from %v", b.Address().Hex(), round, from.Hex())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// hasTraceRecord returns whether the core accepted a message with the given code and round from
+// the given validator.
+func hasTraceRecord(c *core, code uint64, from common.Address, round int64) bool {
+	for _, record := range c.MessageTrace() {
+		if record.Code == code && record.From == from && record.Accepted && record.View != nil && record.View.Round.Int64() == round {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRoundGap(t *testing.T) {
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = false }()
+
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	c := sys.backends[0].engine.(*core)
+	c.roundGapGauge = metrics.NewGauge()
+	c.current = newTestRoundState(&istanbul.View{Round: big.NewInt(1), Sequence: big.NewInt(1)}, c.valSet)
+	c.current.SetDesiredRound(big.NewInt(1))
+	defer c.stopTimer()
+
+	// Waiting for round 5 from round 1
+	c.waitForDesiredRound(big.NewInt(5), RoundChangeTimeout)
+	if gap := c.roundGapGauge.Value(); gap != 4 {
+		t.Errorf("gauge mismatch while waiting: have %v, want %v", gap, 4)
+	}
+	if gap := c.Health().RoundGap; gap != 4 {
+		t.Errorf("health round gap mismatch while waiting: have %v, want %v", gap, 4)
+	}
+
+	// A quorum of round changes moves the node to round 5
+	view := istanbul.View{Round: big.NewInt(5), Sequence: big.NewInt(1)}
+	for _, backend := range sys.backends[1:] {
+		msg, err := backend.getRoundChangeMessage(view, istanbul.EmptyPreparedCertificate())
+		if err != nil {
+			t.Fatalf("failed to create round change message: %v", err)
+		}
+		if err := c.handleRoundChange(&msg); err != nil {
+			t.Fatalf("failed to handle round change: %v", err)
+		}
+	}
+	if round := c.current.Round(); round.Cmp(big.NewInt(5)) != 0 {
+		t.Fatalf("round mismatch: have %v, want %v", round, 5)
+	}
+	if gap := c.roundGapGauge.Value(); gap != 0 {
+		t.Errorf("gauge mismatch after the round change: have %v, want %v", gap, 0)
+	}
+	if gap := c.Health().RoundGap; gap != 0 {
+		t.Errorf("health round gap mismatch after the round change: have %v, want %v", gap, 0)
+	}
+}
@@ -30,7 +30,7 @@ import (
 func newRoundState(view *istanbul.View, validatorSet istanbul.ValidatorSet, preprepare *istanbul.Preprepare, pendingRequest *istanbul.Request, preparedCertificate istanbul.PreparedCertificate, hasBadProposal func(hash common.Hash) bool) *roundState {
 	return &roundState{
 		round:               view.Round,
-		desiredRound:        view.Round,
+		desiredRound:        new(big.Int).Set(view.Round),
 		sequence:            view.Sequence,
 		Preprepare:          preprepare,
 		Prepares:            newMessageSet(validatorSet),
@@ -148,6 +148,13 @@ func (s *roundState) SetPreparedCertificate(preparedCertificate istanbul.Prepare
 	s.preparedCertificate = preparedCertificate
 }
 
+func (s *roundState) PreparedCertificate() istanbul.PreparedCertificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.preparedCertificate
+}
+
 func (s *roundState) CreateAndSetPreparedCertificate(quorumSize int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -176,6 +183,28 @@ func (s *roundState) CreateAndSetPreparedCertificate(quorumSize int) error {
 	}
 }
 
+// Hash returns a deterministic hash over the view, the pending request digest and the
+// prepared certificate digest of the round state. It is used to detect corruption of
+// the round state persisted to disk.
+func (s *roundState) Hash() common.Hash {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.hash()
+}
+
+func (s *roundState) hash() common.Hash {
+	var pendingRequestDigest common.Hash
+	if s.pendingRequest != nil && s.pendingRequest.Proposal != nil {
+		pendingRequestDigest = s.pendingRequest.Proposal.Hash()
+	}
+	return istanbul.RLPHash([]interface{}{
+		&istanbul.View{Round: s.round, Sequence: s.sequence},
+		pendingRequestDigest,
+		istanbul.RLPHash(&s.preparedCertificate),
+	})
+}
+
 func (s *roundState) getPrepareOrCommitSize() int {
 	result := s.Prepares.Size() + s.Commits.Size()
 
@@ -17,7 +17,14 @@
 package core
 
 import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
 	"sync"
+	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
@@ -36,3 +43,270 @@ func newTestRoundState(view *istanbul.View, validatorSet istanbul.ValidatorSet)
 		},
 	}
 }
+
+func TestRoundStateHashPersistence(t *testing.T) {
+	sys := NewTestSystemWithBackend(1, 0)
+	close := sys.Run(false)
+	defer close()
+
+	c := sys.backends[0].engine.(*core)
+	c.current.pendingRequest = &istanbul.Request{Proposal: makeBlock(1)}
+	hash := c.current.Hash()
+	if hash != c.current.Hash() {
+		t.Fatalf("round state hash is not deterministic")
+	}
+
+	if err := c.saveRoundStateToDisk(); err != nil {
+		t.Fatalf("failed to save round state: %v", err)
+	}
+	state, err := c.getRoundStateFromDisk()
+	if err != nil {
+		t.Fatalf("failed to load round state: %v", err)
+	}
+	if state.Hash() != hash {
+		t.Errorf("hash mismatch: have %v, want %v", state.Hash(), hash)
+	}
+
+	// A different view must produce a different hash
+	state.SetRound(big.NewInt(1))
+	if state.Hash() == hash {
+		t.Errorf("hash did not change with the view")
+	}
+
+	// Flip a byte in the persisted blob
+	fileName := filepath.Join(c.backend.GetDataDir(), roundStateFileName)
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("failed to read round state: %v", err)
+	}
+	i := bytes.Index(data, hash[:])
+	if i < 0 {
+		t.Fatalf("hash not found in persisted round state")
+	}
+	data[i] ^= 0xff
+	if err := ioutil.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatalf("failed to write round state: %v", err)
+	}
+
+	if _, err := c.getRoundStateFromDisk(); err != errCorruptRoundState {
+		t.Errorf("error mismatch: have %v, want %v", err, errCorruptRoundState)
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("corrupt round state was not discarded")
+	}
+	if state, err := c.getRoundStateFromDisk(); state != nil || err != nil {
+		t.Errorf("expected no round state after discarding, have %v, %v", state, err)
+	}
+}
+
+func TestResumePersistedRoundState(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	closer := sys.Run(false)
+	defer closer()
+
+	backend := sys.backends[1]
+	c := backend.engine.(*core)
+	proposal := makeBlock(1)
+	view := istanbul.View{Sequence: big.NewInt(1), Round: big.NewInt(2)}
+	c.current.SetRound(view.Round)
+	c.current.SetPreparedCertificate(sys.getPreparedCertificate(t, view, proposal))
+	if err := c.saveRoundStateToDisk(); err != nil {
+		t.Fatalf("failed to save round state: %v", err)
+	}
+
+	// Restart the engine, which starts from round 0 of the same sequence
+	c.current = nil
+	c.Start()
+	c.Stop()
+
+	if len(backend.sentMsgs) == 0 {
+		t.Fatalf("no round change sent after resuming")
+	}
+	msg := new(istanbul.Message)
+	if err := msg.FromPayload(backend.sentMsgs[len(backend.sentMsgs)-1], nil); err != nil {
+		t.Fatalf("failed to decode sent message: %v", err)
+	}
+	var rc *istanbul.RoundChange
+	if err := msg.Decode(&rc); err != nil || msg.Code != istanbul.MsgRoundChange {
+		t.Fatalf("sent message is not a round change: code %v, err %v", msg.Code, err)
+	}
+	if rc.View.Round.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("round change round mismatch: have %v, want 3", rc.View.Round)
+	}
+	if rc.PreparedCertificate.IsEmpty() || rc.PreparedCertificate.Proposal.Hash() != proposal.Hash() {
+		t.Errorf("persisted prepared certificate was not resumed")
+	}
+	if info := c.LastRoundChange(); info == nil || info.Reason != RoundChangeResumed.String() {
+		t.Errorf("round change reason mismatch: have %v, want %v", info, RoundChangeResumed)
+	}
+}
+
+func TestMessageStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "istanbul-message-store")
+	if err != nil {
+		t.Fatalf("failed to create data dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]MessageStore{
+		"memory": NewMemoryMessageStore(),
+		"disk":   NewDiskMessageStore(dir),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			view := &istanbul.View{Sequence: big.NewInt(1), Round: big.NewInt(0)}
+			otherView := &istanbul.View{Sequence: big.NewInt(1), Round: big.NewInt(1)}
+
+			if data, err := store.Load(view, istanbul.MsgPreprepare); data != nil || err != nil {
+				t.Fatalf("expected no message before saving, have %x, %v", data, err)
+			}
+			for _, msg := range []struct {
+				view *istanbul.View
+				code uint64
+				data []byte
+			}{
+				{view, istanbul.MsgPreprepare, []byte("preprepare")},
+				{view, istanbul.MsgCommit, []byte("commit")},
+				{otherView, istanbul.MsgPreprepare, []byte("other preprepare")},
+				// Replaces the first one
+				{view, istanbul.MsgPreprepare, []byte("new preprepare")},
+			} {
+				if err := store.Save(msg.view, msg.code, msg.data); err != nil {
+					t.Fatalf("failed to save message: %v", err)
+				}
+			}
+			if data, _ := store.Load(view, istanbul.MsgPreprepare); !bytes.Equal(data, []byte("new preprepare")) {
+				t.Errorf("preprepare mismatch: have %q, want %q", data, "new preprepare")
+			}
+			if data, _ := store.Load(view, istanbul.MsgCommit); !bytes.Equal(data, []byte("commit")) {
+				t.Errorf("commit mismatch: have %q, want %q", data, "commit")
+			}
+
+			// Deleting a view deletes all of its messages, and only them
+			if err := store.Delete(view); err != nil {
+				t.Fatalf("failed to delete view: %v", err)
+			}
+			for _, code := range []uint64{istanbul.MsgPreprepare, istanbul.MsgCommit} {
+				if data, err := store.Load(view, code); data != nil || err != nil {
+					t.Errorf("expected no message with code %d after deleting, have %x, %v", code, data, err)
+				}
+			}
+			if data, _ := store.Load(otherView, istanbul.MsgPreprepare); !bytes.Equal(data, []byte("other preprepare")) {
+				t.Errorf("other view's preprepare mismatch: have %q, want %q", data, "other preprepare")
+			}
+
+			if data, err := store.LoadRoundState(); data != nil || err != nil {
+				t.Fatalf("expected no round state before saving, have %x, %v", data, err)
+			}
+			if err := store.SaveRoundState([]byte("round state")); err != nil {
+				t.Fatalf("failed to save round state: %v", err)
+			}
+			if data, _ := store.LoadRoundState(); !bytes.Equal(data, []byte("round state")) {
+				t.Errorf("round state mismatch: have %q, want %q", data, "round state")
+			}
+			if err := store.DeleteRoundState(); err != nil {
+				t.Fatalf("failed to delete round state: %v", err)
+			}
+			if data, err := store.LoadRoundState(); data != nil || err != nil {
+				t.Errorf("expected no round state after deleting, have %x, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestMessageStoreCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "istanbul-message-store")
+	if err != nil {
+		t.Fatalf("failed to create data dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]MessageStore{
+		"memory": NewMemoryMessageStore(),
+		"disk":   NewDiskMessageStore(dir),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			sys := NewTestSystemWithBackend(1, 0)
+			closer := sys.Run(false)
+			defer closer()
+
+			// Sequence 5 is finalized, sequence 6 is the current one
+			backend := sys.backends[0]
+			backend.committedMsgs = []testCommittedMsgs{{commitProposal: makeBlock(5)}}
+			c := backend.engine.(*core)
+			clock := newFakeClock()
+			c.clock = clock
+			config := *c.config
+			config.MessageStoreCompactionInterval = 1000
+			c.config = &config
+			c.SetMessageStore(store)
+
+			views := make(map[int64]*istanbul.View)
+			for _, sequence := range []int64{3, 5, 6, 7} {
+				views[sequence] = &istanbul.View{Sequence: big.NewInt(sequence), Round: big.NewInt(1)}
+				if err := store.Save(views[sequence], istanbul.MsgPreprepare, []byte("preprepare")); err != nil {
+					t.Fatalf("failed to save message: %v", err)
+				}
+			}
+
+			c.startMessageStoreCompaction()
+			defer c.stopMessageStoreCompaction()
+			// Let the compaction schedule its first pass
+			<-time.After(50 * time.Millisecond)
+			clock.Advance(time.Second)
+			<-time.After(100 * time.Millisecond)
+
+			for sequence, view := range views {
+				data, err := store.Load(view, istanbul.MsgPreprepare)
+				if err != nil {
+					t.Fatalf("failed to load message: %v", err)
+				}
+				if stored, want := data != nil, sequence > 5; stored != want {
+					t.Errorf("sequence %d: stored mismatch: have %v, want %v", sequence, stored, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryMessageStorePersistence(t *testing.T) {
+	sys := NewTestSystemWithBackend(1, 0)
+	close := sys.Run(false)
+	defer close()
+
+	c := sys.backends[0].engine.(*core)
+	store := NewMemoryMessageStore()
+	c.SetMessageStore(store)
+	c.current.pendingRequest = &istanbul.Request{Proposal: makeBlock(1)}
+
+	if err := c.saveRoundStateToDisk(); err != nil {
+		t.Fatalf("failed to save round state: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(c.backend.GetDataDir(), roundStateFileName)); !os.IsNotExist(err) {
+		t.Errorf("round state was written to the data dir")
+	}
+	state, err := c.getRoundStateFromDisk()
+	if err != nil {
+		t.Fatalf("failed to load round state: %v", err)
+	}
+	if state.Hash() != c.current.Hash() {
+		t.Errorf("hash mismatch: have %v, want %v", state.Hash(), c.current.Hash())
+	}
+
+	// The preprepare of a view is saved once and reused
+	preprepare, err := c.getPreprepareMessage(c.currentView(), c.current.pendingRequest, istanbul.RoundChangeCertificate{}, nil, c.logger)
+	if err != nil {
+		t.Fatalf("failed to get preprepare: %v", err)
+	}
+	if stored, _ := store.Load(c.currentView(), istanbul.MsgPreprepare); !bytes.Equal(stored, preprepare) {
+		t.Errorf("stored preprepare mismatch")
+	}
+	again, err := c.getPreprepareMessage(c.currentView(), &istanbul.Request{Proposal: makeBlock(2)}, istanbul.RoundChangeCertificate{}, nil, c.logger)
+	if err != nil {
+		t.Fatalf("failed to get preprepare: %v", err)
+	}
+	if !bytes.Equal(again, preprepare) {
+		t.Errorf("preprepare of the view was not reused")
+	}
+}
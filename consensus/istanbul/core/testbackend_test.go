@@ -18,12 +18,14 @@ package core
 
 import (
 	"crypto/ecdsa"
+	"errors"
 	"math"
 	"math/big"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -49,8 +51,26 @@ type testSystemBackend struct {
 	peers  istanbul.ValidatorSet
 	events *event.TypeMux
 
+	mu            sync.Mutex // guards the records below, which the engine's goroutines all update
 	committedMsgs []testCommittedMsgs
 	sentMsgs      [][]byte // store the message when Send is called by core
+	commitErr     error    // error returned by Commit, if set
+	commitErrs    int      // number of calls to Commit returning commitErr before it is cleared, 0 for all of them
+	verifyCount   int      // number of times Verify is called by core
+
+	nilLastProposals int // number of calls to LastProposal returning no proposal
+
+	signErr error // error returned by Sign, if set
+
+	// replaces the default verification if set, and isn't counted in verifyCount
+	verifyFn func(proposal istanbul.Proposal) (time.Duration, error)
+
+	blockPeriod    uint64 // block period returned by BlockPeriod
+	blockPeriodErr error  // error returned by BlockPeriod, if set
+
+	badProposals map[common.Hash]bool // hashes reported as bad blocks by HasBadProposal
+
+	registeredKeys map[common.Address][]byte // BLS public keys returned by RegisteredBLSPublicKeys instead of the validator set's
 
 	key     ecdsa.PrivateKey
 	blsKey  []byte
@@ -89,31 +109,54 @@ func (self *testSystemBackend) EventMux() *event.TypeMux {
 }
 
 func (self *testSystemBackend) Send(message []byte, target common.Address) error {
-	testLogger.Info("enqueuing a message...", "address", self.Address())
-	self.sentMsgs = append(self.sentMsgs, message)
-	self.sys.queuedMessage <- istanbul.MessageEvent{
-		Payload: message,
+	testLogger.Info("sending a message...", "address", self.Address(), "target", target)
+	self.recordSent(message)
+	for _, backend := range self.sys.backends {
+		if backend.Address() == target {
+			go backend.EventMux().Post(istanbul.MessageEvent{Payload: message})
+		}
 	}
 	return nil
 }
 
 func (self *testSystemBackend) Broadcast(valSet istanbul.ValidatorSet, message []byte) error {
 	testLogger.Info("enqueuing a message...", "address", self.Address())
-	self.sentMsgs = append(self.sentMsgs, message)
-	self.sys.queuedMessage <- istanbul.MessageEvent{
-		Payload: message,
-	}
+	self.recordSent(message)
+	self.sys.enqueue(message)
 	return nil
 }
 func (self *testSystemBackend) Gossip(valSet istanbul.ValidatorSet, message []byte, msgCode uint64, ignoreCache bool) error {
+	testLogger.Info("enqueuing a gossiped message...", "address", self.Address())
+	self.recordSent(message)
+	self.sys.enqueue(message)
 	return nil
 }
 
-func (self *testSystemBackend) SignBlockHeader(data []byte) ([]byte, error) {
+func (self *testSystemBackend) recordSent(message []byte) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.sentMsgs = append(self.sentMsgs, message)
+}
+
+// sentMessages returns a copy of the messages sent so far, safe to read while the engine runs.
+func (self *testSystemBackend) sentMessages() [][]byte {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return append([][]byte(nil), self.sentMsgs...)
+}
+
+// addCommitted records a proposal as committed, as if it was inserted while the engine runs.
+func (self *testSystemBackend) addCommitted(msg testCommittedMsgs) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.committedMsgs = append(self.committedMsgs, msg)
+}
+
+func (self *testSystemBackend) SignBlockHeader(data []byte, useComposite bool) ([]byte, error) {
 	privateKey, _ := bls.DeserializePrivateKey(self.blsKey)
 	defer privateKey.Destroy()
 
-	signature, _ := privateKey.SignMessage(data, []byte{}, false)
+	signature, _ := privateKey.SignMessage(data, []byte{}, useComposite)
 	defer signature.Destroy()
 	signatureBytes, _ := signature.Serialize()
 
@@ -122,7 +165,16 @@ func (self *testSystemBackend) SignBlockHeader(data []byte) ([]byte, error) {
 
 func (self *testSystemBackend) Commit(proposal istanbul.Proposal, bitmap *big.Int, seals []byte) error {
 	testLogger.Info("commit message", "address", self.Address())
-	self.committedMsgs = append(self.committedMsgs, testCommittedMsgs{
+	if err := self.commitErr; err != nil {
+		if self.commitErrs > 0 {
+			self.commitErrs--
+			if self.commitErrs == 0 {
+				self.commitErr = nil
+			}
+		}
+		return err
+	}
+	self.addCommitted(testCommittedMsgs{
 		commitProposal: proposal,
 		bitmap:         bitmap,
 		committedSeals: seals,
@@ -134,10 +186,17 @@ func (self *testSystemBackend) Commit(proposal istanbul.Proposal, bitmap *big.In
 }
 
 func (self *testSystemBackend) Verify(proposal istanbul.Proposal) (time.Duration, error) {
+	if self.verifyFn != nil {
+		return self.verifyFn(proposal)
+	}
+	self.verifyCount++
 	return 0, nil
 }
 
 func (self *testSystemBackend) Sign(data []byte) ([]byte, error) {
+	if self.signErr != nil {
+		return nil, self.signErr
+	}
 	hashData := crypto.Keccak256(data)
 	return crypto.Sign(hashData, &self.key)
 }
@@ -161,10 +220,16 @@ func (self *testSystemBackend) NewRequest(request istanbul.Proposal) {
 }
 
 func (self *testSystemBackend) HasBadProposal(hash common.Hash) bool {
-	return false
+	return self.badProposals[hash]
 }
 
 func (self *testSystemBackend) LastProposal() (istanbul.Proposal, common.Address) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.nilLastProposals > 0 {
+		self.nilLastProposals--
+		return nil, common.Address{}
+	}
 	l := len(self.committedMsgs)
 	if l > 0 {
 		testLogger.Info("have proposal for block", "num", l)
@@ -287,6 +352,32 @@ func (self *testSystemBackend) GetDataDir() string {
 	return self.dataDir
 }
 
+func (self *testSystemBackend) RegisteredBLSPublicKeys(addrs []common.Address) ([][]byte, error) {
+	keys := make([][]byte, len(addrs))
+	for i, addr := range addrs {
+		if key, ok := self.registeredKeys[addr]; ok {
+			keys[i] = key
+			continue
+		}
+		_, val := self.peers.GetByAddress(addr)
+		if val == nil {
+			return nil, errors.New("unregistered validator")
+		}
+		keys[i] = val.BLSPublicKey()
+	}
+	return keys, nil
+}
+
+func (self *testSystemBackend) BlockPeriod(number uint64) (uint64, error) {
+	if self.blockPeriodErr != nil {
+		return 0, self.blockPeriodErr
+	}
+	if self.blockPeriod == 0 {
+		return 0, errors.New("block period not set")
+	}
+	return self.blockPeriod, nil
+}
+
 // ==============================================
 //
 // define the struct that need to be provided for integration tests.
@@ -333,8 +424,8 @@ func generateValidators(n int) ([]istanbul.ValidatorData, [][]byte, []*ecdsa.Pri
 }
 
 func newTestValidatorSet(n int) istanbul.ValidatorSet {
-	validators, _, _ := generateValidators(n)
-	return validator.NewSet(validators, istanbul.RoundRobin)
+	valSet, _ := validator.NewTestValidatorSet(n)
+	return valSet
 }
 
 func NewTestSystemWithBackend(n, f uint64) *testSystem {
@@ -367,7 +458,7 @@ func NewTestSystemWithBackendAndCurrentRoundState(n, f uint64, getRoundState fun
 		core := New(backend, config).(*core)
 		core.state = StateAcceptRequest
 		core.current = getRoundState(vset)
-		core.roundChangeSet = newRoundChangeSet(vset)
+		core.roundChangeSet = newRoundChangeSet(vset, core.clock, core.roundChangeFormationTimer, core.config.MaxRoundChangeMessages)
 		core.valSet = vset
 		core.logger = testLogger
 		core.validateFn = backend.CheckValidatorSignature
@@ -378,6 +469,15 @@ func NewTestSystemWithBackendAndCurrentRoundState(n, f uint64, getRoundState fun
 	return sys
 }
 
+// enqueue queues a message for delivery to all the backends, dropping it once the system
+// stopped listening so that engines being stopped don't block broadcasting
+func (t *testSystem) enqueue(message []byte) {
+	select {
+	case t.queuedMessage <- istanbul.MessageEvent{Payload: message}:
+	case <-t.quit:
+	}
+}
+
 // listen will consume messages from queue and deliver a message to core
 func (t *testSystem) listen() {
 	for {
@@ -398,13 +498,14 @@ func (t *testSystem) listen() {
 //
 // Given a true for core if you want to initialize core engine.
 func (t *testSystem) Run(core bool) func() {
+	// Listen first, as an engine may broadcast while starting
+	go t.listen()
 	for _, b := range t.backends {
 		if core {
 			b.engine.Start() // start Istanbul core
 		}
 	}
 
-	go t.listen()
 	closer := func() { t.stop(core) }
 	return closer
 }
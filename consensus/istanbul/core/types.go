@@ -17,8 +17,13 @@
 package core
 
 import (
+	"io"
+	"math/big"
+	"time"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
@@ -27,6 +32,160 @@ type Engine interface {
 	Stop() error
 	CurrentView() *istanbul.View
 	SetAddress(common.Address)
+	// ForceRoundChange makes the node wait for the given round and send a round change for it
+	ForceRoundChange(round *big.Int) error
+	// SubscribeCommitted registers a subscription for the proposals committed by consensus
+	SubscribeCommitted(ch chan<- istanbul.CommittedEvent) event.Subscription
+	// PendingRequests returns the depth and head of the queue of requests waiting for their sequence
+	PendingRequests() PendingRequestsInfo
+	// IsCatchingUp returns whether the node is catching up with blocks committed without it rather
+	// than taking part in consensus for each sequence
+	IsCatchingUp() bool
+	// ValidatorSetForView returns the ordered validators of the current sequence and the proposer of
+	// the given view, which must be for the current sequence
+	ValidatorSetForView(view *istanbul.View) ([]common.Address, common.Address, error)
+	// Health returns a summary of the node's consensus liveness
+	Health() HealthInfo
+	// LatestFinalized returns the last finalized proposal and the view it was committed in, or nils
+	// if none was finalized since startup. The view is nil for chain heads imported without this
+	// node's consensus, e.g. by the downloader
+	LatestFinalized() (istanbul.Proposal, *istanbul.View)
+	// LastRoundChange returns why and for which view the node last sent a ROUND CHANGE, or nil if
+	// it hasn't since startup
+	LastRoundChange() *RoundChangeInfo
+	// DidParticipate returns whether the given validator contributed a committed seal to the last
+	// proposal committed by consensus
+	DidParticipate(addr common.Address) (bool, error)
+	// MissingFromLastCommit returns the validators that didn't contribute a committed seal to the
+	// last proposal committed by consensus
+	MissingFromLastCommit() ([]common.Address, error)
+	// CurrentRoundTimeout returns how long the node waits in the current round before sending a
+	// round change
+	CurrentRoundTimeout() time.Duration
+	// RoundChangeRate returns the average number of round changes per sequence among the sequences
+	// finished within the given window
+	RoundChangeRate(window time.Duration) float64
+	// MessageTrace returns the records of the last consensus messages handled, oldest first
+	MessageTrace() []MessageTraceRecord
+	// SetBroadcastInterceptor installs a hook called with every outgoing broadcast, or removes it
+	// if nil. It must be set before the engine is started.
+	SetBroadcastInterceptor(interceptor BroadcastInterceptor)
+	// SetMessageStore replaces the store the consensus messages and round state are persisted in,
+	// the data directory by default. It must be set before the engine is started.
+	SetMessageStore(store MessageStore)
+	// SetMessageSink tees every consensus message received or broadcast to the writer, as a stream
+	// of MessageSinkRecords for replay, or stops if nil. It must be set before the engine is started.
+	SetMessageSink(sink io.Writer)
+	// ExportState returns the round state and ROUND CHANGE messages, for a standby validator to
+	// resume from with ImportState.
+	ExportState() ([]byte, error)
+	// ImportState resumes from the exported state of another validator on the same chain head. It
+	// must be called before the engine is started.
+	ImportState(data []byte) error
+}
+
+// BroadcastInterceptor is called with every message the core broadcasts before it is handed to the
+// backend. It may inspect or delay the message, and drops it by returning true.
+type BroadcastInterceptor func(valSet istanbul.ValidatorSet, payload []byte) (drop bool)
+
+// MessageStore persists what a validator must not contradict after a restart: the messages it
+// sent for a view, such as its preprepare, and its round state.
+type MessageStore interface {
+	// Save stores the message with the given code for a view, replacing the previous one
+	Save(view *istanbul.View, code uint64, data []byte) error
+	// Load returns the message with the given code stored for a view, or nil if there is none
+	Load(view *istanbul.View, code uint64) ([]byte, error)
+	// Delete removes all the messages stored for a view
+	Delete(view *istanbul.View) error
+	// DeleteBefore removes all the messages stored for the sequences below the given one
+	DeleteBefore(sequence *big.Int) error
+	// SaveRoundState stores the encoded round state, replacing the previous one
+	SaveRoundState(data []byte) error
+	// LoadRoundState returns the stored round state, or nil if there is none
+	LoadRoundState() ([]byte, error)
+	// DeleteRoundState removes the stored round state
+	DeleteRoundState() error
+}
+
+// MessageTraceRecord is a compact record of a consensus message handled by the core
+type MessageTraceRecord struct {
+	Code     uint64         `json:"code"`
+	View     *istanbul.View `json:"view"` // nil if the message couldn't be decoded
+	From     common.Address `json:"from"`
+	Accepted bool           `json:"accepted"`
+	Error    string         `json:"error,omitempty"` // Why the message was rejected or deferred
+}
+
+// HealthInfo summarizes the consensus liveness of the node
+type HealthInfo struct {
+	State                  string   `json:"state"`
+	Sequence               *big.Int `json:"sequence"`
+	Round                  *big.Int `json:"round"`
+	DesiredRound           *big.Int `json:"desiredRound"`
+	SecondsSinceLastCommit *uint64  `json:"secondsSinceLastCommit"` // nil if no sequence was committed since startup
+	IsProposer             bool     `json:"isProposer"`
+	RoundChangeInProgress  bool     `json:"roundChangeInProgress"` // Whether the node is waiting for a round it sent a round change for
+	RoundGap               uint64   `json:"roundGap"`              // How many rounds the desired round is ahead of the current round
+}
+
+// RoundChangeInfo describes the last ROUND CHANGE sent by the node
+type RoundChangeInfo struct {
+	Reason string         `json:"reason"`
+	View   *istanbul.View `json:"view"` // The view the node asked to move to
+	Time   uint64         `json:"time"` // Unix time the ROUND CHANGE was sent at
+}
+
+// RoundChangeReason is what made the node send a ROUND CHANGE
+type RoundChangeReason uint64
+
+const (
+	// RoundChangeTimeout is sent when the round timed out
+	RoundChangeTimeout RoundChangeReason = iota
+	// RoundChangePeers is sent on receiving f+1 ROUND CHANGEs for a higher round
+	RoundChangePeers
+	// RoundChangeManual is sent when forced through ForceRoundChange
+	RoundChangeManual
+	// RoundChangeProposerSelfCheck is sent by a proposer that failed to propose in time
+	RoundChangeProposerSelfCheck
+	// RoundChangeProposerWarmup is sent by a proposer giving up its turn during the warmup
+	RoundChangeProposerWarmup
+	// RoundChangeInvalidProposal is sent on receiving a preprepare with an invalid proposal
+	RoundChangeInvalidProposal
+	// RoundChangeCommitFailure is sent when the proposal couldn't be committed
+	RoundChangeCommitFailure
+	// RoundChangeResumed is sent when resuming from a persisted or imported round state, to leave
+	// the view whose messages may already have been signed before
+	RoundChangeResumed
+)
+
+func (r RoundChangeReason) String() string {
+	switch r {
+	case RoundChangeTimeout:
+		return "Timeout"
+	case RoundChangePeers:
+		return "Peers"
+	case RoundChangeManual:
+		return "Manual"
+	case RoundChangeProposerSelfCheck:
+		return "ProposerSelfCheck"
+	case RoundChangeProposerWarmup:
+		return "ProposerWarmup"
+	case RoundChangeInvalidProposal:
+		return "InvalidProposal"
+	case RoundChangeCommitFailure:
+		return "CommitFailure"
+	case RoundChangeResumed:
+		return "Resumed"
+	default:
+		return "Unknown"
+	}
+}
+
+// PendingRequestsInfo describes the queue of requests waiting for their sequence
+type PendingRequestsInfo struct {
+	Size     int            `json:"size"`
+	Head     *istanbul.View `json:"head"`     // Sequence of the highest-priority request in the current round, nil if the queue is empty
+	HeadHash common.Hash    `json:"headHash"` // Hash of the proposal of the highest-priority request
 }
 
 type State uint64
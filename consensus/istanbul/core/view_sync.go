@@ -0,0 +1,183 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+)
+
+// sendViewSyncRequest asks the other validators for the view they want to move to, at most once
+// per view. It lets a validator that started late or missed the ROUND CHANGE messages of its
+// sequence catch up without waiting for its own round change timer.
+func (c *core) sendViewSyncRequest() {
+	if !c.config.RequestViewSync || c.current == nil {
+		return
+	}
+	logger := c.NewLogger("func", "sendViewSyncRequest")
+
+	view := c.currentView()
+	if c.viewSyncRequested != nil && c.viewSyncRequested.Cmp(view) == 0 {
+		return
+	}
+	c.viewSyncRequested = view
+
+	encodedRequest, err := Encode(&istanbul.ViewSyncRequest{View: view})
+	if err != nil {
+		logger.Error("Failed to encode view sync request", "view", view, "err", err)
+		return
+	}
+	logger.Debug("Requesting view sync")
+	c.rebroadcast(&istanbul.Message{
+		Code: istanbul.MsgViewSyncRequest,
+		Msg:  encodedRequest,
+	})
+}
+
+// requestViewSyncForFutureMessage requests a view sync when a message for a later round of the
+// current sequence is backlogged, a sign that the other validators moved on without us.
+func (c *core) requestViewSyncForFutureMessage(msg *istanbul.Message) {
+	if c.current == nil {
+		return
+	}
+	view := messageView(msg)
+	if view == nil || view.Sequence == nil || view.Round == nil {
+		return
+	}
+	if view.Sequence.Cmp(c.current.Sequence()) == 0 && view.Round.Cmp(c.current.Round()) > 0 {
+		c.sendViewSyncRequest()
+	}
+}
+
+// handleViewSyncRequest answers a view sync request for the current sequence with our desired
+// round and the ROUND CHANGE messages that justify it, if it's ahead of the requester's round.
+func (c *core) handleViewSyncRequest(msg *istanbul.Message) error {
+	logger := c.NewLogger("from", msg.Address, "func", "handleViewSyncRequest", "tag", "handleMsg")
+
+	if msg.Address == c.address {
+		return nil
+	}
+
+	var request *istanbul.ViewSyncRequest
+	if err := msg.Decode(&request); err != nil {
+		logger.Error("Failed to decode view sync request", "err", err)
+		return errInvalidMessage
+	}
+	if request.View == nil || request.View.Sequence == nil || request.View.Round == nil {
+		return errInvalidMessage
+	}
+	// The other validators only help with the round, falling behind in sequences is for the downloader
+	if request.View.Sequence.Cmp(c.current.Sequence()) != 0 {
+		logger.Trace("Ignoring view sync request for another sequence", "request_view", request.View)
+		return nil
+	}
+
+	desiredRound := c.current.DesiredRound()
+	if desiredRound.Cmp(request.View.Round) <= 0 {
+		return nil
+	}
+	roundChanges := c.roundChangeSet.messages(desiredRound)
+	// Once the desired round is reached the round change set is cleared, but the preprepare of the
+	// round carries the certificate the round was started with
+	if len(roundChanges) == 0 && desiredRound.Cmp(c.current.Round()) == 0 && c.current.Preprepare != nil && c.current.Preprepare.HasRoundChangeCertificate() {
+		roundChanges = c.current.Preprepare.RoundChangeCertificate.RoundChangeMessages
+	}
+	if len(roundChanges) == 0 {
+		return nil
+	}
+
+	encodedResponse, err := Encode(&istanbul.ViewSyncResponse{
+		View: &istanbul.View{
+			Sequence: c.current.Sequence(),
+			Round:    desiredRound,
+		},
+		RoundChangeCertificate: istanbul.RoundChangeCertificate{RoundChangeMessages: roundChanges},
+	})
+	if err != nil {
+		logger.Error("Failed to encode view sync response", "err", err)
+		return nil
+	}
+	logger.Debug("Answering view sync request", "request_view", request.View, "desired_round", desiredRound, "round_changes", len(roundChanges))
+	c.send(&istanbul.Message{
+		Code: istanbul.MsgViewSyncResponse,
+		Msg:  encodedResponse,
+	}, msg.Address)
+	return nil
+}
+
+// handleViewSyncResponse verifies the ROUND CHANGE messages of a view sync response and handles
+// them as if they had been received directly, moving to their round once there are enough of them.
+func (c *core) handleViewSyncResponse(msg *istanbul.Message) error {
+	logger := c.NewLogger("from", msg.Address, "func", "handleViewSyncResponse", "tag", "handleMsg")
+
+	if msg.Address == c.address {
+		return nil
+	}
+
+	var response *istanbul.ViewSyncResponse
+	if err := msg.Decode(&response); err != nil {
+		logger.Error("Failed to decode view sync response", "err", err)
+		return errInvalidMessage
+	}
+	if response.View == nil || response.View.Sequence == nil || response.View.Round == nil {
+		return errInvalidMessage
+	}
+	if response.View.Sequence.Cmp(c.current.Sequence()) != 0 {
+		return errInvalidViewSyncSequence
+	}
+	if response.View.Round.Cmp(c.current.DesiredRound()) <= 0 {
+		return errOldMessage
+	}
+
+	// Verify the whole certificate before handling any of its messages
+	roundChanges := response.RoundChangeCertificate.RoundChangeMessages
+	if len(roundChanges) > c.valSet.Size() {
+		return errInvalidRoundChangeCertificateNumMsgs
+	}
+	for i := range roundChanges {
+		message := &roundChanges[i]
+		if message.Code != istanbul.MsgRoundChange {
+			return errInvalidViewSyncMsgCode
+		}
+		data, err := message.PayloadNoSig()
+		if err != nil {
+			return err
+		}
+		signer, err := c.checkCachedMessageSignature(data, message)
+		if err != nil {
+			return err
+		}
+		if signer != message.Address {
+			return errInvalidViewSyncMsgSignature
+		}
+		var roundChange *istanbul.RoundChange
+		if err := message.Decode(&roundChange); err != nil {
+			return errInvalidMessage
+		}
+		if roundChange.View == nil || roundChange.View.Sequence == nil || roundChange.View.Sequence.Cmp(c.current.Sequence()) != 0 {
+			return errInvalidViewSyncSequence
+		}
+	}
+
+	logger.Debug("Handling view sync response", "view", response.View, "round_changes", len(roundChanges))
+	for i := range roundChanges {
+		// Messages we already have or that are no longer relevant are expected
+		if err := c.handleRoundChange(&roundChanges[i]); err != nil {
+			logger.Trace("Skipping round change from view sync response", "round_change_from", roundChanges[i].Address, "err", err)
+		}
+	}
+	return nil
+}
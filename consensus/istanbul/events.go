@@ -16,6 +16,8 @@
 
 package istanbul
 
+import "math/big"
+
 // RequestEvent is posted to propose a proposal
 type RequestEvent struct {
 	Proposal Proposal
@@ -29,3 +31,12 @@ type MessageEvent struct {
 // FinalCommittedEvent is posted when a proposal is committed
 type FinalCommittedEvent struct {
 }
+
+// CommittedEvent is sent to the subscribers of the committed feed when consensus has successfully
+// committed a proposal
+type CommittedEvent struct {
+	Proposal       Proposal
+	Bitmap         *big.Int
+	AggregatedSeal []byte
+	View           *View
+}
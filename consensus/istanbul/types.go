@@ -264,11 +264,66 @@ func (b *Subject) String() string {
 	return fmt.Sprintf("{View: %v, Digest: %v}", b.View, b.Digest.String())
 }
 
+// ViewSyncRequest asks the other validators for the view they want to move to, carrying the
+// view of the requesting validator.
+type ViewSyncRequest struct {
+	View *View
+}
+
+// EncodeRLP serializes b into the Ethereum RLP format.
+func (b *ViewSyncRequest) EncodeRLP(w io.Writer) error {
+	return rlp.Encode(w, []interface{}{b.View})
+}
+
+// DecodeRLP implements rlp.Decoder, and load the consensus fields from a RLP stream.
+func (b *ViewSyncRequest) DecodeRLP(s *rlp.Stream) error {
+	var request struct {
+		View *View
+	}
+
+	if err := s.Decode(&request); err != nil {
+		return err
+	}
+	b.View = request.View
+	return nil
+}
+
+// ViewSyncResponse answers a view sync request with the view a validator wants to move to and
+// the ROUND CHANGE messages it has for that view, which carry their prepared certificates.
+type ViewSyncResponse struct {
+	View                   *View
+	RoundChangeCertificate RoundChangeCertificate
+}
+
+// EncodeRLP serializes b into the Ethereum RLP format.
+func (b *ViewSyncResponse) EncodeRLP(w io.Writer) error {
+	return rlp.Encode(w, []interface{}{b.View, &b.RoundChangeCertificate})
+}
+
+// DecodeRLP implements rlp.Decoder, and load the consensus fields from a RLP stream.
+func (b *ViewSyncResponse) DecodeRLP(s *rlp.Stream) error {
+	var response struct {
+		View                   *View
+		RoundChangeCertificate RoundChangeCertificate
+	}
+
+	if err := s.Decode(&response); err != nil {
+		return err
+	}
+	b.View, b.RoundChangeCertificate = response.View, response.RoundChangeCertificate
+	return nil
+}
+
+// ConsensusMsgCode is the p2p message code consensus messages are sent with
+const ConsensusMsgCode = 0x11
+
 const (
 	MsgPreprepare uint64 = iota
 	MsgPrepare
 	MsgCommit
 	MsgRoundChange
+	MsgViewSyncRequest
+	MsgViewSyncResponse
 )
 
 type Message struct {
@@ -65,6 +65,18 @@ func CheckValidatorSignature(valSet ValidatorSet, data []byte, sig []byte) (comm
 	return common.Address{}, ErrUnauthorizedAddress
 }
 
+// MinQuorumSizeForN returns the minimum number of validators, out of a validator set of size n,
+// needed to reach a quorum. It matches ValidatorSet.MinQuorumSize.
+func MinQuorumSizeForN(n int) int {
+	return (2*n + 2) / 3
+}
+
+// MaxFaultyForN returns the maximum number of faulty validators tolerated by a validator set of
+// size n. It matches ValidatorSet.F.
+func MaxFaultyForN(n int) int {
+	return (n+2)/3 - 1
+}
+
 // Retrieves the block number within an epoch.  The return value will be 1-based.
 // There is a special case if the number == 0.  It is basically the last block of the 0th epoch, and should have a value of epochSize
 func GetNumberWithinEpoch(number uint64, epochSize uint64) uint64 {
@@ -106,6 +106,8 @@ type ValidatorSet interface {
 	Policy() ProposerPolicy
 	// Get the minimum quorum size
 	MinQuorumSize() int
+	// Set the validators that recently signed a commit, nil if all are considered active
+	SetActiveValidators(active map[common.Address]bool)
 }
 
 // ----------------------------------------------------------------------------
@@ -52,6 +52,9 @@ type defaultSet struct {
 	proposer    istanbul.Validator
 	validatorMu sync.RWMutex
 	selector    istanbul.ProposalSelector
+
+	// validators that recently signed a commit, skipped by the RoundRobinWithSkip policy if missing
+	active map[common.Address]bool
 }
 
 func newDefaultSet(validators []istanbul.ValidatorData, policy istanbul.ProposerPolicy) *defaultSet {
@@ -70,6 +73,8 @@ func newDefaultSet(validators []istanbul.ValidatorData, policy istanbul.Proposer
 	valSet.selector = roundRobinProposer
 	if policy == istanbul.Sticky {
 		valSet.selector = stickyProposer
+	} else if policy == istanbul.RoundRobinWithSkip {
+		valSet.selector = valSet.roundRobinWithSkipProposer
 	}
 
 	return valSet
@@ -201,6 +206,37 @@ func stickyProposer(valSet istanbul.ValidatorSet, proposer common.Address, round
 	return filteredList[pick]
 }
 
+// roundRobinWithSkipProposer rotates the proposer like roundRobinProposer, but only among the
+// active validators. It falls back to roundRobinProposer if no validator is active.
+func (valSet *defaultSet) roundRobinWithSkipProposer(vs istanbul.ValidatorSet, proposer common.Address, round uint64) istanbul.Validator {
+	if vs.Size() == 0 {
+		return nil
+	}
+	start := uint64(0)
+	if !emptyAddress(proposer) {
+		start = calcSeed(vs, proposer, 0) + 1
+	}
+
+	filteredList := vs.FilteredList()
+	active := make([]istanbul.Validator, 0, len(filteredList))
+	for i := range filteredList {
+		val := filteredList[(start+uint64(i))%uint64(len(filteredList))]
+		if valSet.active == nil || valSet.active[val.Address()] {
+			active = append(active, val)
+		}
+	}
+	if len(active) == 0 {
+		return roundRobinProposer(vs, proposer, round)
+	}
+	return active[round%uint64(len(active))]
+}
+
+func (valSet *defaultSet) SetActiveValidators(active map[common.Address]bool) {
+	valSet.validatorMu.Lock()
+	defer valSet.validatorMu.Unlock()
+	valSet.active = active
+}
+
 func (valSet *defaultSet) AddValidators(validators []istanbul.ValidatorData) bool {
 	newValidators := make([]istanbul.Validator, 0, len(validators))
 	newAddressesMap := make(map[common.Address]bool)
@@ -273,7 +309,9 @@ func (valSet *defaultSet) Copy() istanbul.ValidatorSet {
 		})
 	}
 
-	return NewSet(validators, valSet.policy)
+	newValSet := NewSet(validators, valSet.policy)
+	newValSet.SetActiveValidators(valSet.active)
+	return newValSet
 }
 
 func (valSet *defaultSet) F() int { return int(math.Ceil(float64(valSet.Size())/3)) - 1 }
@@ -37,6 +37,7 @@ func TestValidatorSet(t *testing.T) {
 	testNormalValSet(t)
 	testEmptyValSet(t)
 	testStickyProposer(t)
+	testRoundRobinWithSkipProposer(t)
 	testAddAndRemoveValidator(t)
 	testQuorumSizes(t)
 }
@@ -230,6 +231,88 @@ func testStickyProposer(t *testing.T) {
 	}
 }
 
+func testRoundRobinWithSkipProposer(t *testing.T) {
+	validators, _ := generateValidators(4)
+	valSet := newDefaultSet(validators, istanbul.RoundRobinWithSkip)
+	vals := valSet.List()
+	lastProposer := vals[0].Address()
+
+	testCases := []struct {
+		active    map[common.Address]bool
+		proposers []istanbul.Validator // expected proposers for rounds 0, 1, 2, ...
+	}{
+		{
+			// no uptime signal, plain round robin
+			nil,
+			[]istanbul.Validator{vals[1], vals[2], vals[3], vals[0]},
+		},
+		{
+			// all validators active, plain round robin
+			map[common.Address]bool{vals[0].Address(): true, vals[1].Address(): true, vals[2].Address(): true, vals[3].Address(): true},
+			[]istanbul.Validator{vals[1], vals[2], vals[3], vals[0]},
+		},
+		{
+			// offline validators are skipped
+			map[common.Address]bool{vals[0].Address(): true, vals[3].Address(): true},
+			[]istanbul.Validator{vals[3], vals[0], vals[3]},
+		},
+		{
+			// a single active validator proposes every round
+			map[common.Address]bool{vals[2].Address(): true},
+			[]istanbul.Validator{vals[2], vals[2]},
+		},
+		{
+			// all validators offline, falls back to plain round robin
+			map[common.Address]bool{},
+			[]istanbul.Validator{vals[1], vals[2], vals[3], vals[0]},
+		},
+	}
+	for i, test := range testCases {
+		valSet.SetActiveValidators(test.active)
+		for round, expected := range test.proposers {
+			valSet.CalcProposer(lastProposer, uint64(round))
+			if val := valSet.GetProposer(); !reflect.DeepEqual(val, expected) {
+				t.Errorf("test %d round %d: proposer mismatch: have %v, want %v", i, round, val, expected)
+			}
+		}
+	}
+
+	// The uptime signal survives copying the validator set
+	valSet.SetActiveValidators(map[common.Address]bool{vals[3].Address(): true})
+	copied := valSet.Copy()
+	copied.CalcProposer(lastProposer, 0)
+	if val := copied.GetProposer(); val.Address() != vals[3].Address() {
+		t.Errorf("proposer mismatch after copy: have %v, want %v", val, vals[3])
+	}
+}
+
+func TestSimulateProposer(t *testing.T) {
+	validators, _ := generateValidators(4)
+	for _, policy := range []istanbul.ProposerPolicy{istanbul.RoundRobin, istanbul.Sticky, istanbul.RoundRobinWithSkip} {
+		valSet := newDefaultSet(validators, policy)
+		live := valSet.Copy()
+		proposer := valSet.GetProposer()
+
+		lastProposers := []common.Address{{}}
+		for _, val := range valSet.List() {
+			lastProposers = append(lastProposers, val.Address())
+		}
+		for _, lastProposer := range lastProposers {
+			for round := uint64(0); round < 10; round++ {
+				simulated := SimulateProposer(valSet, lastProposer, round)
+				live.CalcProposer(lastProposer, round)
+				if want := live.GetProposer().Address(); simulated != want {
+					t.Errorf("policy %v, last proposer %v, round %d: proposer mismatch: have %v, want %v", policy, lastProposer.Hex(), round, simulated.Hex(), want.Hex())
+				}
+			}
+		}
+		// The simulations leave the proposer of the set untouched
+		if val := valSet.GetProposer(); !reflect.DeepEqual(val, proposer) {
+			t.Errorf("policy %v: proposer changed by simulation: have %v, want %v", policy, val, proposer)
+		}
+	}
+}
+
 func generateValidators(n int) ([]istanbul.ValidatorData, [][]byte) {
 	vals := make([]istanbul.ValidatorData, 0)
 	keys := make([][]byte, 0)
@@ -269,3 +352,45 @@ func testQuorumSizes(t *testing.T) {
 		}
 	}
 }
+
+func TestQuorumSizeForN(t *testing.T) {
+	var vals []istanbul.ValidatorData
+	for n := 1; n <= 300; n++ {
+		vals = append(vals, istanbul.ValidatorData{Address: common.BigToAddress(big.NewInt(int64(n)))})
+		valSet := NewSet(vals, istanbul.RoundRobin)
+		if have, want := istanbul.MinQuorumSizeForN(n), valSet.MinQuorumSize(); have != want {
+			t.Errorf("quorum size mismatch for %d validators: have %d, want %d", n, have, want)
+		}
+		if have, want := istanbul.MaxFaultyForN(n), valSet.F(); have != want {
+			t.Errorf("max faulty mismatch for %d validators: have %d, want %d", n, have, want)
+		}
+	}
+}
+
+func TestNewTestValidatorSet(t *testing.T) {
+	valSet, keys := NewTestValidatorSet(4)
+	if valSet.Size() != 4 || len(keys) != 4 {
+		t.Fatalf("size mismatch: have %v validators and %v keys, want 4", valSet.Size(), len(keys))
+	}
+	for i, key := range keys {
+		val := valSet.GetByIndex(uint64(i))
+		if addr := crypto.PubkeyToAddress(key.PublicKey); val.Address() != addr {
+			t.Errorf("address mismatch for validator %d: have %v, want %v", i, val.Address(), addr)
+		}
+		blsPrivateKey, _ := blscrypto.ECDSAToBLS(key)
+		blsPublicKey, _ := blscrypto.PrivateToPublic(blsPrivateKey)
+		if !reflect.DeepEqual(val.BLSPublicKey(), blsPublicKey) {
+			t.Errorf("BLS public key mismatch for validator %d", i)
+		}
+	}
+
+	// The same seed gives the same validators, a different seed different ones
+	again, _ := NewTestValidatorSet(4)
+	if !reflect.DeepEqual(valSet.List(), again.List()) {
+		t.Errorf("validator sets differ for the same seed")
+	}
+	other, _ := NewTestValidatorSetWithSeed(4, 2)
+	if reflect.DeepEqual(valSet.List(), other.List()) {
+		t.Errorf("validator sets match for different seeds")
+	}
+}
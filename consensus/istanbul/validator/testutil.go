@@ -0,0 +1,71 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package validator
+
+import (
+	"crypto/ecdsa"
+	"math/rand"
+
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/bls"
+)
+
+// testValidatorSetSeed is the seed used by NewTestValidatorSet
+const testValidatorSetSeed = 1
+
+// NewTestValidatorSet returns a round robin validator set of n validators and their ECDSA private
+// keys, in the same order as the set. The BLS keys of the validators are derived from the ECDSA
+// keys with blscrypto.ECDSAToBLS. The same keys are returned on every call.
+func NewTestValidatorSet(n int) (istanbul.ValidatorSet, []*ecdsa.PrivateKey) {
+	return NewTestValidatorSetWithSeed(n, testValidatorSetSeed)
+}
+
+// NewTestValidatorSetWithSeed is like NewTestValidatorSet, but generates the keys from the given seed.
+func NewTestValidatorSetWithSeed(n int, seed int64) (istanbul.ValidatorSet, []*ecdsa.PrivateKey) {
+	source := rand.New(rand.NewSource(seed))
+	validators := make([]istanbul.ValidatorData, n)
+	keys := make([]*ecdsa.PrivateKey, n)
+	for i := 0; i < n; i++ {
+		keys[i] = generateTestKey(source)
+		blsPrivateKey, err := blscrypto.ECDSAToBLS(keys[i])
+		if err != nil {
+			panic(err)
+		}
+		blsPublicKey, err := blscrypto.PrivateToPublic(blsPrivateKey)
+		if err != nil {
+			panic(err)
+		}
+		validators[i] = istanbul.ValidatorData{
+			Address:      crypto.PubkeyToAddress(keys[i].PublicKey),
+			BLSPublicKey: blsPublicKey,
+		}
+	}
+	return NewSet(validators, istanbul.RoundRobin), keys
+}
+
+// generateTestKey reads an ECDSA private key from the given source. ecdsa.GenerateKey can't be
+// used, as it doesn't read deterministically from its source.
+func generateTestKey(source *rand.Rand) *ecdsa.PrivateKey {
+	for {
+		b := make([]byte, 32)
+		source.Read(b)
+		if key, err := crypto.ToECDSA(b); err == nil {
+			return key
+		}
+	}
+}
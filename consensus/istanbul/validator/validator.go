@@ -45,6 +45,17 @@ func ExtractValidators(extraData []byte) []istanbul.ValidatorData {
 	return validators
 }
 
+// SimulateProposer returns the proposer of the given round after lastProposer, as CalcProposer would
+// select it, without changing the proposer of valSet.
+func SimulateProposer(valSet istanbul.ValidatorSet, lastProposer common.Address, round uint64) common.Address {
+	simulated := valSet.Copy()
+	simulated.CalcProposer(lastProposer, round)
+	if proposer := simulated.GetProposer(); proposer != nil {
+		return proposer.Address()
+	}
+	return common.Address{}
+}
+
 // Check whether the extraData is presented in prescribed form
 func ValidExtraData(extraData []byte) bool {
 	return len(extraData)%common.AddressLength == 0
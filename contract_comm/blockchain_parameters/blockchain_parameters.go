@@ -23,9 +23,11 @@ import (
 
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/contract_comm"
+	contract_errors "github.com/ethereum/go-ethereum/contract_comm/errors"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/params"
 )
 
@@ -51,10 +53,94 @@ const (
 			"payable": false,
 			"stateMutability": "view",
 			"type": "function"
+	},
+	{
+			"constant": true,
+			"inputs": [],
+			"name": "getRecommendedMinimumClientVersion",
+			"outputs": [
+			  {
+				"name": "major",
+				"type": "uint256"
+			  },
+			  {
+				"name": "minor",
+				"type": "uint256"
+			  },
+			  {
+				"name": "patch",
+				"type": "uint256"
+			  }
+			],
+			"payable": false,
+			"stateMutability": "view",
+			"type": "function"
+	},
+	{
+			"constant": true,
+			"inputs": [],
+			"name": "getBlockPeriod",
+			"outputs": [
+			  {
+				"name": "",
+				"type": "uint256"
+			  }
+			],
+			"payable": false,
+			"stateMutability": "view",
+			"type": "function"
+	},
+	{
+			"constant": true,
+			"inputs": [],
+			"name": "getEpochSize",
+			"outputs": [
+			  {
+				"name": "",
+				"type": "uint256"
+			  }
+			],
+			"payable": false,
+			"stateMutability": "view",
+			"type": "function"
+	},
+	{
+			"constant": true,
+			"inputs": [],
+			"name": "getUptimeLookbackWindow",
+			"outputs": [
+			  {
+				"name": "",
+				"type": "uint256"
+			  }
+			],
+			"payable": false,
+			"stateMutability": "view",
+			"type": "function"
 	}]`
 )
 
-var blockchainParametersABI abi.ABI
+// versionStatus is how the client version compares to the minimum versions required on chain
+type versionStatus int
+
+const (
+	versionUpToDate versionStatus = iota
+	versionBelowRecommended
+	versionBelowHard
+)
+
+const (
+	maxVersionCheckInterval      = 60 * time.Minute // Maximum interval between version checks after repeated failures
+	versionCheckSummaryInterval  = 60 * time.Minute // Interval between summary warnings while version checks keep failing
+	versionCheckFailureThreshold = 3                // Number of consecutive failures after which the check backs off
+)
+
+var (
+	blockchainParametersABI abi.ABI
+
+	versionCheckFailuresGauge    = metrics.NewRegisteredGauge("contract_comm/blockchain_parameters/versioncheck/failures", nil)
+	versionCheckBreakerOpenGauge = metrics.NewRegisteredGauge("contract_comm/blockchain_parameters/versioncheck/breakeropen", nil)
+)
 
 func init() {
 	var err error
@@ -64,13 +150,29 @@ func init() {
 	}
 }
 
-func GetMinimumVersion(header *types.Header, state vm.StateDB) (*params.VersionInfo, error) {
+// GetMinimumVersion returns the hard minimum client version, below which the client shuts down, and
+// the recommended minimum client version, below which it only warns. The recommended version is nil
+// if the contract only exposes the hard minimum.
+func GetMinimumVersion(header *types.Header, state vm.StateDB) (*params.VersionInfo, *params.VersionInfo, error) {
+	hard, err := getVersion("getMinimumClientVersion", header, state)
+	if err != nil {
+		return nil, nil, err
+	}
+	recommended, err := getVersion("getRecommendedMinimumClientVersion", header, state)
+	if err != nil {
+		log.Trace("No recommended minimum client version, only enforcing the hard minimum", "err", err)
+		recommended = nil
+	}
+	return hard, recommended, nil
+}
+
+func getVersion(funcName string, header *types.Header, state vm.StateDB) (*params.VersionInfo, error) {
 	version := [3]*big.Int{big.NewInt(0), big.NewInt(0), big.NewInt(0)}
 	var err error
 	_, err = contract_comm.MakeStaticCall(
 		params.BlockchainParametersRegistryId,
 		blockchainParametersABI,
-		"getMinimumClientVersion",
+		funcName,
 		[]interface{}{},
 		&version,
 		params.MaxGasForGetGasPriceMinimum,
@@ -83,26 +185,153 @@ func GetMinimumVersion(header *types.Header, state vm.StateDB) (*params.VersionI
 	return &params.VersionInfo{version[0].Uint64(), version[1].Uint64(), version[2].Uint64()}, nil
 }
 
-func CheckMinimumVersion(header *types.Header, state vm.StateDB) {
-	version, err := GetMinimumVersion(header, state)
+// GetBlockPeriod returns the block period in seconds set in the BlockchainParameters contract.
+// An error is returned if the contract doesn't provide one.
+func GetBlockPeriod(header *types.Header, state vm.StateDB) (uint64, error) {
+	return getPositiveUint64("getBlockPeriod", contract_errors.ErrInvalidBlockPeriod, header, state)
+}
+
+// GetEpochSize returns the number of blocks per epoch set in the BlockchainParameters contract.
+// An error is returned if the contract doesn't provide one.
+func GetEpochSize(header *types.Header, state vm.StateDB) (uint64, error) {
+	return getPositiveUint64("getEpochSize", contract_errors.ErrInvalidEpochSize, header, state)
+}
+
+// GetLookbackWindow returns the number of blocks over which validator uptime is measured, as set
+// in the BlockchainParameters contract. An error is returned if the contract doesn't provide one.
+func GetLookbackWindow(header *types.Header, state vm.StateDB) (uint64, error) {
+	return getPositiveUint64("getUptimeLookbackWindow", contract_errors.ErrInvalidLookbackWindow, header, state)
+}
+
+// getPositiveUint64 calls a BlockchainParameters getter returning a single uint256, and returns
+// errInvalid if the value is zero or doesn't fit in a uint64.
+func getPositiveUint64(funcName string, errInvalid error, header *types.Header, state vm.StateDB) (uint64, error) {
+	var value *big.Int
+	_, err := contract_comm.MakeStaticCall(
+		params.BlockchainParametersRegistryId,
+		blockchainParametersABI,
+		funcName,
+		[]interface{}{},
+		&value,
+		params.MaxGasForGetGasPriceMinimum,
+		header,
+		state,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if value == nil || value.Sign() <= 0 || !value.IsUint64() {
+		return 0, errInvalid
+	}
+	return value.Uint64(), nil
+}
+
+// checkVersion compares the current version to the hard and, if present, recommended minimum versions.
+func checkVersion(current, hard, recommended *params.VersionInfo) versionStatus {
+	if current.Cmp(hard) == -1 {
+		return versionBelowHard
+	}
+	if recommended != nil && current.Cmp(recommended) == -1 {
+		return versionBelowRecommended
+	}
+	return versionUpToDate
+}
+
+func CheckMinimumVersion(header *types.Header, state vm.StateDB) error {
+	hard, recommended, err := GetMinimumVersion(header, state)
 
 	if err != nil {
-		log.Warn("Error checking client version", "err", err, "contract id", params.BlockchainParametersRegistryId)
-		return
+		return err
 	}
 
-	if params.CurrentVersionInfo.Cmp(version) == -1 {
+	switch checkVersion(params.CurrentVersionInfo, hard, recommended) {
+	case versionBelowHard:
 		time.Sleep(10 * time.Second)
-		log.Crit("Client version older than required", "current", params.Version, "required", version)
+		log.Crit("Client version older than required", "current", params.Version, "required", hard)
+	case versionBelowRecommended:
+		log.Warn("Client version older than recommended, please upgrade", "current", params.Version, "recommended", recommended, "required", hard)
+	}
+
+	return nil
+}
+
+// versionCheckBreaker backs off the version check polling interval after repeated failures,
+// and collapses the resulting warnings into a periodic summary.
+type versionCheckBreaker struct {
+	failures    int
+	interval    time.Duration
+	lastSummary time.Time
+}
+
+func newVersionCheckBreaker() *versionCheckBreaker {
+	return &versionCheckBreaker{interval: versionCheckInterval}
+}
+
+func (b *versionCheckBreaker) isOpen() bool {
+	return b.failures >= versionCheckFailureThreshold
+}
+
+// record updates the breaker with the result of a version check and returns the interval
+// to wait before the next check.
+func (b *versionCheckBreaker) record(err error) time.Duration {
+	if err == nil {
+		if b.isOpen() {
+			log.Info("Client version check succeeded again, resetting interval", "failures", b.failures)
+		}
+		b.failures = 0
+		b.interval = versionCheckInterval
+	} else {
+		b.failures++
+		if !b.isOpen() {
+			log.Warn("Error checking client version", "err", err, "contract id", params.BlockchainParametersRegistryId)
+		} else {
+			b.interval *= 2
+			if b.interval > maxVersionCheckInterval {
+				b.interval = maxVersionCheckInterval
+			}
+			if time.Since(b.lastSummary) >= versionCheckSummaryInterval {
+				log.Warn("Client version check keeps failing, backing off", "failures", b.failures, "interval", b.interval, "err", err, "contract id", params.BlockchainParametersRegistryId)
+				b.lastSummary = time.Now()
+			}
+		}
 	}
 
+	versionCheckFailuresGauge.Update(int64(b.failures))
+	if b.isOpen() {
+		versionCheckBreakerOpenGauge.Update(1)
+	} else {
+		versionCheckBreakerOpenGauge.Update(0)
+	}
+	return b.interval
+}
+
+// VersionCheckConfig configures the background check of the client version against the minimum
+// versions set in the BlockchainParameters contract.
+type VersionCheckConfig struct {
+	Disabled bool // Skip the check entirely, for nodes that don't validate such as RPC endpoints or indexers
 }
 
-func SpawnCheck() {
+var (
+	// checkMinimumVersionFn is the check run periodically by SpawnCheck, replaced in tests
+	checkMinimumVersionFn = CheckMinimumVersion
+	// versionCheckInterval is the interval between version checks while they succeed, replaced in tests
+	versionCheckInterval = 60 * time.Second
+)
+
+// SpawnCheck starts checking the client version in the background unless the check is disabled,
+// and returns whether it was started.
+func SpawnCheck(config VersionCheckConfig) bool {
+	if config.Disabled {
+		log.Info("Client version check disabled")
+		return false
+	}
 	go func() {
+		breaker := newVersionCheckBreaker()
+		interval := versionCheckInterval
 		for {
-			time.Sleep(60 * time.Second)
-			CheckMinimumVersion(nil, nil)
+			time.Sleep(interval)
+			interval = breaker.record(checkMinimumVersionFn(nil, nil))
 		}
 	}()
+	return true
 }
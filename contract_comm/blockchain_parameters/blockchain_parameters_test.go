@@ -0,0 +1,144 @@
+// Copyright 2017 The Celo Authors
+// This file is part of the celo library.
+//
+// The celo library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The celo library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the celo library. If not, see <http://www.gnu.org/licenses/>.
+
+package blockchain_parameters
+
+import (
+	"math/big"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/contract_comm"
+	contract_errors "github.com/ethereum/go-ethereum/contract_comm/errors"
+	"github.com/ethereum/go-ethereum/contract_comm/internal/testutil"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestCheckVersion(t *testing.T) {
+	current := &params.VersionInfo{Major: 1, Minor: 2, Patch: 3}
+
+	testCases := []struct {
+		name        string
+		hard        *params.VersionInfo
+		recommended *params.VersionInfo
+		want        versionStatus
+	}{
+		{"up to date", &params.VersionInfo{Major: 1, Minor: 0, Patch: 0}, &params.VersionInfo{Major: 1, Minor: 2, Patch: 3}, versionUpToDate},
+		{"below recommended", &params.VersionInfo{Major: 1, Minor: 0, Patch: 0}, &params.VersionInfo{Major: 1, Minor: 3, Patch: 0}, versionBelowRecommended},
+		{"below hard", &params.VersionInfo{Major: 2, Minor: 0, Patch: 0}, &params.VersionInfo{Major: 2, Minor: 1, Patch: 0}, versionBelowHard},
+		{"single tier up to date", &params.VersionInfo{Major: 1, Minor: 2, Patch: 3}, nil, versionUpToDate},
+		{"single tier below hard", &params.VersionInfo{Major: 1, Minor: 2, Patch: 4}, nil, versionBelowHard},
+	}
+	for _, test := range testCases {
+		if have := checkVersion(current, test.hard, test.recommended); have != test.want {
+			t.Errorf("%s: status mismatch: have %v, want %v", test.name, have, test.want)
+		}
+	}
+}
+
+func TestSpawnCheck(t *testing.T) {
+	defer func(fn func(*types.Header, vm.StateDB) error, interval time.Duration) {
+		checkMinimumVersionFn = fn
+		versionCheckInterval = interval
+	}(checkMinimumVersionFn, versionCheckInterval)
+
+	versionCheckInterval = time.Millisecond
+	called := make(chan struct{}, 1)
+	checkMinimumVersionFn = func(*types.Header, vm.StateDB) error {
+		called <- struct{}{}
+		// Park the check loop, so that it doesn't outlive the stubs of this test
+		select {}
+	}
+
+	// Disabled, nothing is spawned or called over many check intervals
+	goroutines := runtime.NumGoroutine()
+	if SpawnCheck(VersionCheckConfig{Disabled: true}) {
+		t.Fatalf("version check spawned while disabled")
+	}
+	select {
+	case <-called:
+		t.Fatalf("version check called while disabled")
+	case <-time.After(50 * versionCheckInterval):
+	}
+	if have := runtime.NumGoroutine(); have > goroutines {
+		t.Errorf("goroutine count grew while the version check is disabled: have %d, want at most %d", have, goroutines)
+	}
+
+	// Enabled, the check runs after an interval
+	if !SpawnCheck(VersionCheckConfig{}) {
+		t.Fatalf("version check not spawned while enabled")
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatalf("version check not called while enabled")
+	}
+}
+
+func TestGetEpochSizeAndLookbackWindow(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	contractAddress := common.HexToAddress("0x1234")
+	statedb.SetCode(params.RegistrySmartContractAddress, testutil.ReturnCode(contractAddress.Hash()))
+
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(0),
+		Difficulty: big.NewInt(0),
+	}
+	contract_comm.SetInternalEVMHandler(testutil.NewChainContext(header, statedb))
+
+	getters := []struct {
+		name       string
+		get        func(*types.Header, vm.StateDB) (uint64, error)
+		errInvalid error
+	}{
+		{"epoch size", GetEpochSize, contract_errors.ErrInvalidEpochSize},
+		{"lookback window", GetLookbackWindow, contract_errors.ErrInvalidLookbackWindow},
+	}
+	testCases := []struct {
+		value   common.Hash
+		want    uint64
+		invalid bool
+	}{
+		{common.BigToHash(big.NewInt(17280)), 17280, false},
+		{common.Hash{}, 0, true},
+		{common.BigToHash(new(big.Int).Lsh(common.Big1, 64)), 0, true},
+	}
+	for _, getter := range getters {
+		for _, test := range testCases {
+			statedb.SetCode(contractAddress, testutil.ReturnCode(test.value))
+			have, err := getter.get(header, statedb)
+			if test.invalid {
+				if err != getter.errInvalid {
+					t.Errorf("%s %v: error mismatch: have %v, want %v", getter.name, test.value.Big(), err, getter.errInvalid)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s %v: failed to get value: %v", getter.name, test.value.Big(), err)
+			}
+			if have != test.want {
+				t.Errorf("%s: value mismatch: have %v, want %v", getter.name, have, test.want)
+			}
+		}
+	}
+}
@@ -9,4 +9,12 @@ var (
 	ErrSmartContractNotDeployed      = errors.New("registered contract not deployed")
 	ErrRegistryContractNotDeployed   = errors.New("contract registry not deployed")
 	ErrNoInternalEvmHandlerSingleton = errors.New("No internalEvmHandlerSingleton set for contract communication")
+	// ErrUncopyableState is returned when a dry run is requested against a state that cannot be copied
+	ErrUncopyableState = errors.New("state cannot be copied for a dry run")
+	// ErrInvalidBlockPeriod is returned when the BlockchainParameters contract returns a zero or out of range block period
+	ErrInvalidBlockPeriod = errors.New("invalid block period")
+	// ErrInvalidEpochSize is returned when the BlockchainParameters contract returns a zero or out of range epoch size
+	ErrInvalidEpochSize = errors.New("invalid epoch size")
+	// ErrInvalidLookbackWindow is returned when the BlockchainParameters contract returns a zero or out of range lookback window
+	ErrInvalidLookbackWindow = errors.New("invalid lookback window")
 )
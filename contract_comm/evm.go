@@ -17,8 +17,11 @@
 package contract_comm
 
 import (
+	"context"
 	"math/big"
 	"reflect"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
@@ -28,14 +31,85 @@ import (
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/params"
+	lru "github.com/hashicorp/golang-lru"
 )
 
 var (
-	emptyMessage                = types.NewMessage(common.HexToAddress("0x0"), nil, 0, common.Big0, 0, common.Big0, nil, nil, []byte{}, false)
+	systemCaller                = common.HexToAddress("0x0")
+	emptyMessage                = types.NewMessage(systemCaller, nil, 0, common.Big0, 0, common.Big0, nil, nil, []byte{}, false)
 	internalEvmHandlerSingleton *InternalEVMHandler
+
+	// regAddrCache caches the addresses resolved from the registry per (registry id, block hash)
+	regAddrCache, _       = lru.New(regAddrCacheSize)
+	regAddrCacheHitMeter  = metrics.NewRegisteredMeter("contract_comm/registry/cache/hits", nil)
+	regAddrCacheMissMeter = metrics.NewRegisteredMeter("contract_comm/registry/cache/misses", nil)
 )
 
+// registryContractNames names the registered contracts in the metrics of the internal calls to them
+var registryContractNames = map[[32]byte]string{
+	params.AttestationsRegistryId:         "Attestations",
+	params.LockedGoldRegistryId:           "LockedGold",
+	params.ElectionRegistryId:             "Election",
+	params.GasCurrencyWhitelistRegistryId: "GasCurrencyWhitelist",
+	params.GasPriceMinimumRegistryId:      "GasPriceMinimum",
+	params.GoldTokenRegistryId:            "GoldToken",
+	params.GovernanceRegistryId:           "Governance",
+	params.ReserveRegistryId:              "Reserve",
+	params.RandomRegistryId:               "Random",
+	params.SortedOraclesRegistryId:        "SortedOracles",
+	params.ValidatorsRegistryId:           "Validators",
+	params.BlockchainParametersRegistryId: "BlockchainParameters",
+}
+
+// internalCallMetrics are the metrics of the internal EVM calls to a contract function
+type internalCallMetrics struct {
+	timer   metrics.Timer     // duration of the calls
+	errors  metrics.Counter   // calls that failed or reverted
+	gasUsed metrics.Histogram // gas used by the calls
+}
+
+var (
+	internalCallMetricsMu     sync.Mutex
+	internalCallMetricsByName = make(map[string]*internalCallMetrics)
+)
+
+// getInternalCallMetrics returns the metrics of the internal calls to the function of the contract,
+// registered under core/evm/internal/<contract>/<function>.
+func getInternalCallMetrics(contract string, funcName string) *internalCallMetrics {
+	name := "core/evm/internal/" + contract + "/" + funcName
+	internalCallMetricsMu.Lock()
+	defer internalCallMetricsMu.Unlock()
+	m, ok := internalCallMetricsByName[name]
+	if !ok {
+		m = &internalCallMetrics{
+			timer:   metrics.NewRegisteredTimer(name+"/duration", nil),
+			errors:  metrics.NewRegisteredCounter(name+"/errors", nil),
+			gasUsed: metrics.NewRegisteredHistogram(name+"/gasused", nil, metrics.NewExpDecaySample(1028, 0.015)),
+		}
+		internalCallMetricsByName[name] = m
+	}
+	return m
+}
+
+// regAddrCacheSize is the number of resolved registry addresses kept, enough for all registry ids
+// over the few blocks looked up concurrently.
+const regAddrCacheSize = 256
+
+type regAddrCacheKey struct {
+	registryId [32]byte
+	blockHash  common.Hash
+}
+
+// regAddrCacheEntry is a resolved registry address, valid as long as the registry contract's code
+// and storage are unchanged.
+type regAddrCacheEntry struct {
+	address             common.Address
+	registryStorageHash common.Hash
+	registryCodeHash    common.Hash
+}
+
 // TODO(kevjue) - Figure out a way to not have duplicated code between this file and core/evm.go
 // ChainContext supports retrieving chain data and consensus parameters
 // from the blockchain to be used during transaction processing.
@@ -78,6 +152,7 @@ func NewEVMContext(msg types.Message, header *types.Header, chain ChainContext,
 		Difficulty:  new(big.Int).Set(header.Difficulty),
 		GasLimit:    header.GasLimit,
 		GasPrice:    new(big.Int).Set(msg.GasPrice()),
+		GasCurrency: msg.GasCurrency(),
 		Header:      header,
 	}
 }
@@ -126,31 +201,186 @@ type InternalEVMHandler struct {
 }
 
 func MakeStaticCall(registryId [32]byte, abi abi.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, header *types.Header, state vm.StateDB) (uint64, error) {
-	return makeCallWithContractId(registryId, abi, funcName, args, returnObj, gas, nil, header, state, false)
+	return MakeStaticCallWithContext(context.Background(), registryId, abi, funcName, args, returnObj, gas, header, state)
+}
+
+// MakeStaticCallWithContext is like MakeStaticCall, but aborts the EVM execution once ctx is done.
+func MakeStaticCallWithContext(ctx context.Context, registryId [32]byte, abi abi.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, header *types.Header, state vm.StateDB) (uint64, error) {
+	return makeCallWithContractId(ctx, systemCaller, nil, registryId, abi, funcName, args, returnObj, gas, nil, header, state, false)
+}
+
+// MakeStaticCallFrom is like MakeStaticCall, but uses the given caller as both msg.sender and tx.origin.
+func MakeStaticCallFrom(caller common.Address, registryId [32]byte, abi abi.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, header *types.Header, state vm.StateDB) (uint64, error) {
+	return makeCallWithContractId(context.Background(), caller, nil, registryId, abi, funcName, args, returnObj, gas, nil, header, state, false)
 }
 
 func MakeCall(registryId [32]byte, abi abi.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, value *big.Int, header *types.Header, state vm.StateDB) (uint64, error) {
-	return makeCallWithContractId(registryId, abi, funcName, args, returnObj, gas, value, header, state, true)
+	return makeCallWithContractId(context.Background(), systemCaller, nil, registryId, abi, funcName, args, returnObj, gas, value, header, state, true)
+}
+
+// MakeCallWithFeeCurrency is like MakeCall, but on behalf of a transaction paying its fees in
+// feeCurrency, so that the gas of the call is accounted for in that currency.
+func MakeCallWithFeeCurrency(feeCurrency *common.Address, registryId [32]byte, abi abi.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, value *big.Int, header *types.Header, state vm.StateDB) (uint64, error) {
+	return makeCallWithContractId(context.Background(), systemCaller, feeCurrency, registryId, abi, funcName, args, returnObj, gas, value, header, state, true)
+}
+
+// StateDiff summarizes the changes a call made, or would have made, to the state.
+type StateDiff struct {
+	TouchedAccounts []common.Address            // Accounts written to by the call, in the order first written
+	BalanceDeltas   map[common.Address]*big.Int // Non-zero balance changes of the touched accounts
+}
+
+// MakeCallDryRun is like MakeCall, but runs the call against a copy of the state which is discarded
+// afterwards, leaving the given state untouched. It returns a summary of the changes the call would
+// have made.
+func MakeCallDryRun(registryId [32]byte, abi abi.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, value *big.Int, header *types.Header, stateDB vm.StateDB) (uint64, *StateDiff, error) {
+	if internalEvmHandlerSingleton == nil {
+		return 0, nil, errors.ErrNoInternalEvmHandlerSingleton
+	}
+	if stateDB == nil || reflect.ValueOf(stateDB).IsNil() {
+		var err error
+		stateDB, err = internalEvmHandlerSingleton.chain.State()
+		if err != nil {
+			log.Error("Error in retrieving the state from the blockchain", "err", err)
+			return 0, nil, err
+		}
+	}
+	original, ok := stateDB.(*state.StateDB)
+	if !ok {
+		return 0, nil, errors.ErrUncopyableState
+	}
+
+	dryRun := &recordingStateDB{StateDB: original.Copy(), touched: make(map[common.Address]bool)}
+	gasLeft, err := makeCallWithContractId(context.Background(), systemCaller, nil, registryId, abi, funcName, args, returnObj, gas, value, header, dryRun, true)
+	if err != nil {
+		return gasLeft, nil, err
+	}
+
+	diff := &StateDiff{
+		TouchedAccounts: dryRun.touchedAccounts,
+		BalanceDeltas:   make(map[common.Address]*big.Int),
+	}
+	for _, addr := range dryRun.touchedAccounts {
+		delta := new(big.Int).Sub(dryRun.GetBalance(addr), original.GetBalance(addr))
+		if delta.Sign() != 0 {
+			diff.BalanceDeltas[addr] = delta
+		}
+	}
+	return gasLeft, diff, nil
+}
+
+// recordingStateDB records the accounts written to through it.
+type recordingStateDB struct {
+	*state.StateDB
+	touched         map[common.Address]bool
+	touchedAccounts []common.Address
+}
+
+func (r *recordingStateDB) touch(addr common.Address) {
+	if !r.touched[addr] {
+		r.touched[addr] = true
+		r.touchedAccounts = append(r.touchedAccounts, addr)
+	}
+}
+
+func (r *recordingStateDB) CreateAccount(addr common.Address) {
+	r.touch(addr)
+	r.StateDB.CreateAccount(addr)
+}
+
+func (r *recordingStateDB) SubBalance(addr common.Address, amount *big.Int) {
+	r.touch(addr)
+	r.StateDB.SubBalance(addr, amount)
+}
+
+func (r *recordingStateDB) AddBalance(addr common.Address, amount *big.Int) {
+	r.touch(addr)
+	r.StateDB.AddBalance(addr, amount)
+}
+
+func (r *recordingStateDB) SetNonce(addr common.Address, nonce uint64) {
+	r.touch(addr)
+	r.StateDB.SetNonce(addr, nonce)
+}
+
+func (r *recordingStateDB) SetCode(addr common.Address, code []byte) {
+	r.touch(addr)
+	r.StateDB.SetCode(addr, code)
+}
+
+func (r *recordingStateDB) SetState(addr common.Address, key, value common.Hash) {
+	r.touch(addr)
+	r.StateDB.SetState(addr, key, value)
+}
+
+func (r *recordingStateDB) Suicide(addr common.Address) bool {
+	r.touch(addr)
+	return r.StateDB.Suicide(addr)
 }
 
 func MakeStaticCallWithAddress(scAddress common.Address, abi abi.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, header *types.Header, state vm.StateDB) (uint64, error) {
-	return executeEVMFunction(scAddress, abi, funcName, args, returnObj, gas, nil, header, state, false)
+	return executeEVMFunction(context.Background(), systemCaller, nil, scAddress, scAddress.Hex(), abi, funcName, args, returnObj, gas, nil, header, state, false)
 }
 
 func MakeCallWithAddress(scAddress common.Address, abi abi.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, value *big.Int, header *types.Header, state vm.StateDB) (uint64, error) {
-	return executeEVMFunction(scAddress, abi, funcName, args, returnObj, gas, value, header, state, true)
+	return executeEVMFunction(context.Background(), systemCaller, nil, scAddress, scAddress.Hex(), abi, funcName, args, returnObj, gas, value, header, state, true)
 }
 
 func GetRegisteredAddress(registryId [32]byte, header *types.Header, state vm.StateDB) (*common.Address, error) {
-	vmevm, err := createEVM(header, state)
+	vmevm, err := createEVM(systemCaller, nil, header, state)
 	if err != nil {
 		return nil, err
 	}
+
+	// Reuse the address resolved earlier in the same block, unless the registry changed since
+	key := regAddrCacheKey{registryId: registryId, blockHash: vmevm.GetHeader().Hash()}
+	codeHash, storageHash, cacheable := registryHashes(vmevm.GetStateDB())
+	if cacheable {
+		if cached, ok := regAddrCache.Get(key); ok {
+			entry := cached.(*regAddrCacheEntry)
+			if entry.registryCodeHash == codeHash && entry.registryStorageHash == storageHash {
+				regAddrCacheHitMeter.Mark(1)
+				address := entry.address
+				return &address, nil
+			}
+		}
+		regAddrCacheMissMeter.Mark(1)
+	}
+
 	scAddress, err := vm.GetRegisteredAddressWithEvm(registryId, vmevm)
+	if err == nil && cacheable {
+		regAddrCache.Add(key, &regAddrCacheEntry{
+			address:             *scAddress,
+			registryStorageHash: storageHash,
+			registryCodeHash:    codeHash,
+		})
+	}
 	return scAddress, err
 }
 
-func createEVM(header *types.Header, state vm.StateDB) (*vm.EVM, error) {
+// OnEpochChange is called by the consensus engine when the chain enters the given epoch, at which
+// governance changes commonly take effect. It drops the cached registry lookups, so that the next
+// reads go to the contracts.
+func OnEpochChange(epochNumber uint64) {
+	log.Debug("Flushing the registry address cache for the new epoch", "epoch", epochNumber, "entries", regAddrCache.Len())
+	regAddrCache.Purge()
+}
+
+// registryHashes returns the code hash and storage root of the registry contract. Lookups are only
+// cacheable against a full state with a deployed registry.
+func registryHashes(stateDB vm.StateDB) (codeHash common.Hash, storageHash common.Hash, ok bool) {
+	statedb, ok := stateDB.(*state.StateDB)
+	if !ok {
+		return common.Hash{}, common.Hash{}, false
+	}
+	storage := statedb.StorageTrie(params.RegistrySmartContractAddress)
+	if storage == nil {
+		return common.Hash{}, common.Hash{}, false
+	}
+	return statedb.GetCodeHash(params.RegistrySmartContractAddress), storage.Hash(), true
+}
+
+func createEVM(caller common.Address, feeCurrency *common.Address, header *types.Header, state vm.StateDB) (*vm.EVM, error) {
 	// Normally, when making an evm call, we should use the current block's state.  However,
 	// there are times (e.g. retrieving the set of validators when an epoch ends) that we need
 	// to call the evm using the currently mined block.  In that case, the header and state params
@@ -174,25 +404,59 @@ func createEVM(header *types.Header, state vm.StateDB) (*vm.EVM, error) {
 	}
 
 	// The EVM Context requires a msg, but the actual field values don't really matter for this case.
-	// Putting in zero values.
-	context := NewEVMContext(emptyMessage, header, internalEvmHandlerSingleton.chain, nil)
+	// Putting in zero values, except for the sender which is used as the origin and the currency the
+	// fees are paid in.
+	msg := emptyMessage
+	if caller != systemCaller || feeCurrency != nil {
+		msg = types.NewMessage(caller, nil, 0, common.Big0, 0, common.Big0, feeCurrency, nil, []byte{}, false)
+	}
+	context := NewEVMContext(msg, header, internalEvmHandlerSingleton.chain, nil)
 	evm := vm.NewEVM(context, state, internalEvmHandlerSingleton.chain.Config(), *internalEvmHandlerSingleton.chain.GetVMConfig())
 
 	return evm, nil
 }
 
-func executeEVMFunction(scAddress common.Address, abi abi.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, value *big.Int, header *types.Header, state vm.StateDB, mutateState bool) (uint64, error) {
-	vmevm, err := createEVM(header, state)
+// executeEVMFunction calls the function of the contract at scAddress, recording the call in the
+// metrics of the given contract name. The gas of the call is accounted for in feeCurrency, the
+// native currency if nil.
+func executeEVMFunction(ctx context.Context, caller common.Address, feeCurrency *common.Address, scAddress common.Address, contract string, abi abi.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, value *big.Int, header *types.Header, state vm.StateDB, mutateState bool) (uint64, error) {
+	vmevm, err := createEVM(caller, feeCurrency, header, state)
 	if err != nil {
 		return 0, err
 	}
 
+	// Abort the EVM execution if the context is cancelled before the call returns
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				vmevm.Cancel()
+			case <-done:
+			}
+		}()
+	}
+
 	var gasLeft uint64
 
+	start := time.Now()
 	if mutateState {
-		gasLeft, err = vmevm.CallFromSystem(scAddress, abi, funcName, args, returnObj, gas, value)
+		gasLeft, err = vmevm.CallFrom(vm.AccountRef(caller), scAddress, abi, funcName, args, returnObj, gas, value)
 	} else {
-		gasLeft, err = vmevm.StaticCallFromSystem(scAddress, abi, funcName, args, returnObj, gas)
+		gasLeft, err = vmevm.StaticCallFrom(vm.AccountRef(caller), scAddress, abi, funcName, args, returnObj, gas)
+	}
+	if metrics.Enabled {
+		m := getInternalCallMetrics(contract, funcName)
+		m.timer.UpdateSince(start)
+		m.gasUsed.Update(int64(gas - gasLeft))
+		if err != nil || ctx.Err() != nil {
+			m.errors.Inc(1)
+		}
+	}
+	if ctx.Err() != nil {
+		log.Warn("EVM function call aborted", "funcName", funcName, "err", ctx.Err())
+		return gasLeft, ctx.Err()
 	}
 	if err != nil {
 		log.Error("Error when invoking evm function", "err", err)
@@ -216,7 +480,7 @@ func SetInternalEVMHandler(chain ChainContext) {
 	}
 }
 
-func makeCallWithContractId(registryId [32]byte, abi abi.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, value *big.Int, header *types.Header, state vm.StateDB, shouldMutate bool) (uint64, error) {
+func makeCallWithContractId(ctx context.Context, caller common.Address, feeCurrency *common.Address, registryId [32]byte, abi abi.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, value *big.Int, header *types.Header, state vm.StateDB, shouldMutate bool) (uint64, error) {
 	scAddress, err := GetRegisteredAddress(registryId, header, state)
 
 	if err != nil {
@@ -232,5 +496,9 @@ func makeCallWithContractId(registryId [32]byte, abi abi.ABI, funcName string, a
 		}
 	}
 
-	return executeEVMFunction(*scAddress, abi, funcName, args, returnObj, gas, value, header, state, shouldMutate)
+	contract, ok := registryContractNames[registryId]
+	if !ok {
+		contract = scAddress.Hex()
+	}
+	return executeEVMFunction(ctx, caller, feeCurrency, *scAddress, contract, abi, funcName, args, returnObj, gas, value, header, state, shouldMutate)
 }
@@ -0,0 +1,336 @@
+// Copyright 2017 The Celo Authors
+// This file is part of the celo library.
+//
+// The celo library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The celo library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the celo library. If not, see <http://www.gnu.org/licenses/>.
+
+package contract_comm
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/contract_comm/internal/testutil"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+const loopABIString = `[{
+	"constant": true,
+	"inputs": [],
+	"name": "loop",
+	"outputs": [],
+	"payable": false,
+	"stateMutability": "view",
+	"type": "function"
+}]`
+
+func TestExecuteEVMFunctionCancel(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	contractAddress := common.HexToAddress("0x1234")
+	// JUMPDEST PUSH1 0x00 JUMP, i.e. loop forever
+	statedb.SetCode(contractAddress, []byte{0x5b, 0x60, 0x00, 0x56})
+
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(0),
+		Difficulty: big.NewInt(0),
+	}
+	internalEvmHandlerSingleton = &InternalEVMHandler{chain: testutil.NewChainContext(header, statedb)}
+	defer func() { internalEvmHandlerSingleton = nil }()
+
+	loopABI, err := abi.JSON(strings.NewReader(loopABIString))
+	if err != nil {
+		t.Fatalf("failed to parse ABI: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = executeEVMFunction(ctx, systemCaller, nil, contractAddress, "Loop", loopABI, "loop", []interface{}{}, nil, 1000000000000000, nil, header, statedb, false)
+	if err != context.DeadlineExceeded {
+		t.Errorf("error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("call took too long to abort: %v", elapsed)
+	}
+}
+
+func TestInternalCallMetrics(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	stopAddress := common.HexToAddress("0x1234")
+	revertAddress := common.HexToAddress("0x5678")
+	// STOP
+	statedb.SetCode(stopAddress, []byte{0x00})
+	// PUSH1 0x00 PUSH1 0x00 REVERT
+	statedb.SetCode(revertAddress, []byte{0x60, 0x00, 0x60, 0x00, 0xfd})
+
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(0),
+		Difficulty: big.NewInt(0),
+	}
+	internalEvmHandlerSingleton = &InternalEVMHandler{chain: testutil.NewChainContext(header, statedb)}
+	metrics.Enabled = true
+	defer func() {
+		internalEvmHandlerSingleton = nil
+		metrics.Enabled = false
+	}()
+
+	loopABI, err := abi.JSON(strings.NewReader(loopABIString))
+	if err != nil {
+		t.Fatalf("failed to parse ABI: %v", err)
+	}
+	call := func(address common.Address, contract string) error {
+		_, err := executeEVMFunction(context.Background(), systemCaller, nil, address, contract, loopABI, "loop", []interface{}{}, nil, 100000, nil, header, statedb, false)
+		return err
+	}
+	if err := call(stopAddress, "Stop"); err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	if err := call(revertAddress, "Revert"); err == nil {
+		t.Fatalf("reverting call succeeded")
+	}
+
+	for _, test := range []struct {
+		contract string
+		errors   int64
+	}{{"Stop", 0}, {"Revert", 1}} {
+		name := "core/evm/internal/" + test.contract + "/loop"
+		if timer, ok := metrics.DefaultRegistry.Get(name + "/duration").(metrics.Timer); !ok || timer.Count() != 1 {
+			t.Errorf("%s: call duration not recorded", test.contract)
+		}
+		if gasUsed, ok := metrics.DefaultRegistry.Get(name + "/gasused").(metrics.Histogram); !ok || gasUsed.Count() != 1 {
+			t.Errorf("%s: gas used not recorded", test.contract)
+		}
+		if errors, ok := metrics.DefaultRegistry.Get(name + "/errors").(metrics.Counter); !ok || errors.Count() != test.errors {
+			t.Errorf("%s: error count mismatch, want %d", test.contract, test.errors)
+		}
+	}
+}
+
+// registryCode returns the code of a registry resolving every id to the given address
+func registryCode(address common.Address) []byte {
+	// PUSH20 address PUSH1 0x00 MSTORE PUSH1 0x20 PUSH1 0x00 RETURN
+	code := append([]byte{0x73}, address.Bytes()...)
+	return append(code, 0x60, 0x00, 0x52, 0x60, 0x20, 0x60, 0x00, 0xf3)
+}
+
+func TestGetRegisteredAddressCache(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	first := common.HexToAddress("0x1111")
+	second := common.HexToAddress("0x2222")
+	statedb.SetCode(params.RegistrySmartContractAddress, registryCode(first))
+
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(0),
+		Difficulty: big.NewInt(0),
+	}
+	internalEvmHandlerSingleton = &InternalEVMHandler{chain: testutil.NewChainContext(header, statedb)}
+	regAddrCache.Purge()
+	defer func() {
+		internalEvmHandlerSingleton = nil
+		regAddrCache.Purge()
+	}()
+
+	lookup := func() common.Address {
+		address, err := GetRegisteredAddress(params.GoldTokenRegistryId, header, statedb)
+		if err != nil {
+			t.Fatalf("failed to get registered address: %v", err)
+		}
+		return *address
+	}
+
+	if address := lookup(); address != first {
+		t.Errorf("address mismatch: have %v, want %v", address, first)
+	}
+	if regAddrCache.Len() != 1 {
+		t.Errorf("cache size mismatch: have %v, want %v", regAddrCache.Len(), 1)
+	}
+
+	// Lookups within the same block are served from the cache
+	key := regAddrCacheKey{registryId: params.GoldTokenRegistryId, blockHash: header.Hash()}
+	cached, _ := regAddrCache.Get(key)
+	entry := *cached.(*regAddrCacheEntry)
+	entry.address = second
+	regAddrCache.Add(key, &entry)
+	if address := lookup(); address != second {
+		t.Errorf("cached address mismatch: have %v, want %v", address, second)
+	}
+
+	// A change to the registry's storage invalidates the cache
+	statedb.SetState(params.RegistrySmartContractAddress, common.Hash{}, common.HexToHash("0x01"))
+	if address := lookup(); address != first {
+		t.Errorf("address mismatch after storage change: have %v, want %v", address, first)
+	}
+
+	// A change to the registry's code invalidates the cache
+	statedb.SetCode(params.RegistrySmartContractAddress, registryCode(second))
+	if address := lookup(); address != second {
+		t.Errorf("address mismatch after code change: have %v, want %v", address, second)
+	}
+
+	// A new block gets its own entry
+	header = &types.Header{
+		Number:     big.NewInt(2),
+		Time:       big.NewInt(0),
+		Difficulty: big.NewInt(0),
+	}
+	lookup()
+	if regAddrCache.Len() != 2 {
+		t.Errorf("cache size mismatch: have %v, want %v", regAddrCache.Len(), 2)
+	}
+}
+
+func TestOnEpochChange(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	registered := common.HexToAddress("0x1111")
+	statedb.SetCode(params.RegistrySmartContractAddress, registryCode(registered))
+
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(0),
+		Difficulty: big.NewInt(0),
+	}
+	internalEvmHandlerSingleton = &InternalEVMHandler{chain: testutil.NewChainContext(header, statedb)}
+	regAddrCache.Purge()
+	defer func() {
+		internalEvmHandlerSingleton = nil
+		regAddrCache.Purge()
+	}()
+
+	lookup := func() common.Address {
+		address, err := GetRegisteredAddress(params.GoldTokenRegistryId, header, statedb)
+		if err != nil {
+			t.Fatalf("failed to get registered address: %v", err)
+		}
+		return *address
+	}
+	lookup()
+
+	// Stale the cached address
+	stale := common.HexToAddress("0x2222")
+	key := regAddrCacheKey{registryId: params.GoldTokenRegistryId, blockHash: header.Hash()}
+	cached, _ := regAddrCache.Get(key)
+	entry := *cached.(*regAddrCacheEntry)
+	entry.address = stale
+	regAddrCache.Add(key, &entry)
+	if address := lookup(); address != stale {
+		t.Fatalf("cached address mismatch: have %v, want %v", address, stale)
+	}
+
+	// The next read after an epoch change goes to the registry
+	OnEpochChange(2)
+	if address := lookup(); address != registered {
+		t.Errorf("address mismatch after epoch change: have %v, want %v", address, registered)
+	}
+}
+
+const setABIString = `[{
+	"constant": false,
+	"inputs": [],
+	"name": "set",
+	"outputs": [],
+	"payable": true,
+	"stateMutability": "payable",
+	"type": "function"
+}]`
+
+func TestMakeCallDryRun(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	contractAddress := common.HexToAddress("0x1234")
+	statedb.SetCode(params.RegistrySmartContractAddress, registryCode(contractAddress))
+	// PUSH1 0x01 PUSH1 0x00 SSTORE STOP
+	statedb.SetCode(contractAddress, []byte{0x60, 0x01, 0x60, 0x00, 0x55, 0x00})
+	statedb.SetBalance(systemCaller, big.NewInt(100))
+
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(0),
+		Difficulty: big.NewInt(0),
+	}
+	internalEvmHandlerSingleton = &InternalEVMHandler{chain: testutil.NewChainContext(header, statedb)}
+	defer func() { internalEvmHandlerSingleton = nil }()
+
+	setABI, err := abi.JSON(strings.NewReader(setABIString))
+	if err != nil {
+		t.Fatalf("failed to parse ABI: %v", err)
+	}
+
+	root := statedb.IntermediateRoot(true)
+	_, diff, err := MakeCallDryRun(params.GoldTokenRegistryId, setABI, "set", []interface{}{}, nil, 1000000, big.NewInt(10), header, statedb)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if have := statedb.IntermediateRoot(true); have != root {
+		t.Errorf("state root changed by the dry run: have %v, want %v", have, root)
+	}
+	if have := statedb.GetState(contractAddress, common.Hash{}); have != (common.Hash{}) {
+		t.Errorf("storage changed by the dry run: have %v", have)
+	}
+
+	touched := make(map[common.Address]bool)
+	for _, addr := range diff.TouchedAccounts {
+		touched[addr] = true
+	}
+	if !touched[contractAddress] || !touched[systemCaller] {
+		t.Errorf("touched accounts mismatch: have %v, want %v and %v", diff.TouchedAccounts, systemCaller, contractAddress)
+	}
+	if delta := diff.BalanceDeltas[contractAddress]; delta == nil || delta.Cmp(big.NewInt(10)) != 0 {
+		t.Errorf("balance delta mismatch for %v: have %v, want %v", contractAddress, delta, 10)
+	}
+	if delta := diff.BalanceDeltas[systemCaller]; delta == nil || delta.Cmp(big.NewInt(-10)) != 0 {
+		t.Errorf("balance delta mismatch for %v: have %v, want %v", systemCaller, delta, -10)
+	}
+}
+
+func TestCreateEVMFeeCurrency(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(0),
+		Difficulty: big.NewInt(0),
+	}
+	internalEvmHandlerSingleton = &InternalEVMHandler{chain: testutil.NewChainContext(header, statedb)}
+	defer func() { internalEvmHandlerSingleton = nil }()
+
+	evm, err := createEVM(systemCaller, nil, header, statedb)
+	if err != nil {
+		t.Fatalf("failed to create EVM: %v", err)
+	}
+	if evm.GasCurrency != nil {
+		t.Errorf("gas currency mismatch: have %v, want nil", evm.GasCurrency.Hex())
+	}
+
+	feeCurrency := common.HexToAddress("0xfee")
+	evm, err = createEVM(systemCaller, &feeCurrency, header, statedb)
+	if err != nil {
+		t.Fatalf("failed to create EVM: %v", err)
+	}
+	if evm.GasCurrency == nil || *evm.GasCurrency != feeCurrency {
+		t.Errorf("gas currency mismatch: have %v, want %v", evm.GasCurrency, feeCurrency.Hex())
+	}
+	if evm.Origin != systemCaller {
+		t.Errorf("origin mismatch: have %v, want %v", evm.Origin.Hex(), systemCaller.Hex())
+	}
+}
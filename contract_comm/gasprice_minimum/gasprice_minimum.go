@@ -114,6 +114,8 @@ func GetGasPriceSuggestion(currency *common.Address, header *types.Header, state
 	return new(big.Int).Mul(gasPriceMinimum, suggestionMultiplier), err
 }
 
+// GetGasPriceMinimum returns the gas price minimum for the given fee currency, or the native currency
+// if nil, falling back to FallbackGasPriceMinimum when the contracts are not deployed yet.
 func GetGasPriceMinimum(currency *common.Address, header *types.Header, state vm.StateDB) (*big.Int, error) {
 	var currencyAddress *common.Address
 	var err error
@@ -136,23 +138,42 @@ func GetGasPriceMinimum(currency *common.Address, header *types.Header, state vm
 		currencyAddress = currency
 	}
 
+	gasPriceMinimum, err := GetGasPriceMinimumFloor(header, state, currencyAddress)
+	if err != nil {
+		return FallbackGasPriceMinimum, err
+	}
+
+	return gasPriceMinimum, err
+}
+
+// GetGasPriceMinimumFloor returns the gas price minimum set in the GasPriceMinimum contract for the
+// given fee currency, or the native currency if nil. Unlike GetGasPriceMinimum it doesn't fall back
+// to a default, ErrRegistryContractNotDeployed or ErrSmartContractNotDeployed is returned if the
+// contracts are not deployed yet.
+func GetGasPriceMinimumFloor(header *types.Header, state vm.StateDB, feeCurrency *common.Address) (*big.Int, error) {
+	if feeCurrency == nil {
+		nativeCurrency, err := contract_comm.GetRegisteredAddress(params.GoldTokenRegistryId, header, state)
+		if err != nil {
+			return nil, err
+		}
+		feeCurrency = nativeCurrency
+	}
+
 	var gasPriceMinimum *big.Int
-	_, err = contract_comm.MakeStaticCall(
+	_, err := contract_comm.MakeStaticCall(
 		params.GasPriceMinimumRegistryId,
 		gasPriceMinimumABI,
 		"getGasPriceMinimum",
-		[]interface{}{currencyAddress},
+		[]interface{}{feeCurrency},
 		&gasPriceMinimum,
 		params.MaxGasForGetGasPriceMinimum,
 		header,
 		state,
 	)
-
 	if err != nil {
-		return FallbackGasPriceMinimum, err
+		return nil, err
 	}
-
-	return gasPriceMinimum, err
+	return gasPriceMinimum, nil
 }
 
 func UpdateGasPriceMinimum(header *types.Header, state vm.StateDB) (*big.Int, error) {
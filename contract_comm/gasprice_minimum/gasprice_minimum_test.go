@@ -0,0 +1,78 @@
+// Copyright 2017 The Celo Authors
+// This file is part of the celo library.
+//
+// The celo library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The celo library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the celo library. If not, see <http://www.gnu.org/licenses/>.
+
+package gasprice_minimum
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/contract_comm"
+	"github.com/ethereum/go-ethereum/contract_comm/errors"
+	"github.com/ethereum/go-ethereum/contract_comm/internal/testutil"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestGetGasPriceMinimumFloor(t *testing.T) {
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(0),
+		Difficulty: big.NewInt(0),
+	}
+	contract_comm.SetInternalEVMHandler(testutil.NewChainContext(header, nil))
+
+	contractAddress := common.HexToAddress("0x1234")
+	feeCurrency := common.HexToAddress("0x5678")
+	minimum := big.NewInt(500000000)
+
+	testCases := []struct {
+		name     string
+		registry []byte // code of the registry, which resolves all contracts to the same address
+		currency *common.Address
+		want     *big.Int
+		wantErr  error
+	}{
+		{"registry not deployed", nil, nil, nil, errors.ErrRegistryContractNotDeployed},
+		{"contract not deployed", testutil.ReturnCode(common.Hash{}), &feeCurrency, nil, errors.ErrSmartContractNotDeployed},
+		{"native currency", testutil.ReturnCode(contractAddress.Hash()), nil, minimum, nil},
+		{"alternative fee currency", testutil.ReturnCode(contractAddress.Hash()), &feeCurrency, minimum, nil},
+	}
+	for _, test := range testCases {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+		statedb.SetCode(params.RegistrySmartContractAddress, test.registry)
+		statedb.SetCode(contractAddress, testutil.ReturnCode(common.BigToHash(minimum)))
+
+		have, err := GetGasPriceMinimumFloor(header, statedb, test.currency)
+		if err != test.wantErr {
+			t.Errorf("%s: error mismatch: have %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+		if test.want != nil && (have == nil || have.Cmp(test.want) != 0) {
+			t.Errorf("%s: gas price minimum mismatch: have %v, want %v", test.name, have, test.want)
+		}
+
+		// GetGasPriceMinimum falls back to the default when the contracts are not deployed
+		if test.wantErr != nil && test.currency == nil {
+			if fallback, err := GetGasPriceMinimum(test.currency, header, statedb); err != nil || fallback != FallbackGasPriceMinimum {
+				t.Errorf("%s: fallback mismatch: have %v (err %v), want %v", test.name, fallback, err, FallbackGasPriceMinimum)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 The Celo Authors
+// This file is part of the celo library.
+//
+// The celo library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The celo library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the celo library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package testutil contains the fixtures shared by the tests of the contract_comm packages.
+package testutil
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// ChainContext is a chain context for the internal EVM handler whose current header and state
+// are fixed.
+type ChainContext struct {
+	header *types.Header
+	state  *state.StateDB
+}
+
+// NewChainContext returns a chain context with the given current header and state.
+func NewChainContext(header *types.Header, state *state.StateDB) *ChainContext {
+	return &ChainContext{header: header, state: state}
+}
+
+func (c *ChainContext) Engine() consensus.Engine                    { return ethash.NewFaker() }
+func (c *ChainContext) GetHeader(common.Hash, uint64) *types.Header { return nil }
+func (c *ChainContext) GetVMConfig() *vm.Config                     { return &vm.Config{} }
+func (c *ChainContext) CurrentHeader() *types.Header                { return c.header }
+func (c *ChainContext) State() (*state.StateDB, error)              { return c.state, nil }
+func (c *ChainContext) Config() *params.ChainConfig                 { return params.TestChainConfig }
+
+// ReturnCode returns contract code that returns the given word for any call.
+func ReturnCode(word common.Hash) []byte {
+	// PUSH32 word PUSH1 0x00 MSTORE PUSH1 0x20 PUSH1 0x00 RETURN
+	code := append([]byte{0x7f}, word.Bytes()...)
+	return append(code, 0x60, 0x00, 0x52, 0x60, 0x20, 0x60, 0x00, 0xf3)
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestNewEVMContextGasCurrency(t *testing.T) {
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(0),
+		Difficulty: big.NewInt(0),
+	}
+	author := common.HexToAddress("0x1")
+	gasCurrency := common.HexToAddress("0x2")
+
+	msg := types.NewMessage(common.Address{}, nil, 0, big.NewInt(0), 0, big.NewInt(1), &gasCurrency, nil, nil, false)
+	context := NewEVMContext(msg, header, nil, &author)
+	if context.GasCurrency == nil || *context.GasCurrency != gasCurrency {
+		t.Errorf("gas currency mismatch: have %v, want %v", context.GasCurrency, gasCurrency)
+	}
+
+	msg = types.NewMessage(common.Address{}, nil, 0, big.NewInt(0), 0, big.NewInt(1), nil, nil, nil, false)
+	context = NewEVMContext(msg, header, nil, &author)
+	if context.GasCurrency != nil {
+		t.Errorf("gas currency mismatch: have %v, want nil", context.GasCurrency)
+	}
+}
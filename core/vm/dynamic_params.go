@@ -34,15 +34,6 @@ const (
 
 var getAddressForFuncABI, _ = abi.JSON(strings.NewReader(getAddressForABI))
 
-// TODO(kevjue) - Re-Enable caching of the retrieved registered address
-// See this commit for the removed code for caching:  https://github.com/celo-org/geth/commit/43a275273c480d307a3d2b3c55ca3b3ee31ec7dd.
-
-type regAddrCacheEntry struct {
-	address             *common.Address
-	registryStorageHash common.Hash
-	registryCodeHash    common.Hash
-}
-
 func GetRegisteredAddressWithEvm(registryId [32]byte, evm *EVM) (*common.Address, error) {
 	evm.DontMeterGas = true
 	defer func() { evm.DontMeterGas = false }()
@@ -89,8 +89,9 @@ type Context struct {
 	GetHash GetHashFunc
 
 	// Message information
-	Origin   common.Address // Provides information for ORIGIN
-	GasPrice *big.Int       // Provides information for GASPRICE
+	Origin      common.Address  // Provides information for ORIGIN
+	GasPrice    *big.Int        // Provides information for GASPRICE
+	GasCurrency *common.Address // Currency the message pays fees in, nil means native currency
 
 	// Block information
 	Coinbase    common.Address // Provides information for COINBASE
@@ -547,16 +548,26 @@ func (evm *EVM) TobinTransfer(db StateDB, sender, recipient common.Address, gas
 }
 
 func (evm *EVM) StaticCallFromSystem(contractAddress common.Address, abi abipkg.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64) (uint64, error) {
+	return evm.StaticCallFrom(systemCaller, contractAddress, abi, funcName, args, returnObj, gas)
+}
+
+func (evm *EVM) CallFromSystem(contractAddress common.Address, abi abipkg.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, value *big.Int) (uint64, error) {
+	return evm.CallFrom(systemCaller, contractAddress, abi, funcName, args, returnObj, gas, value)
+}
+
+// StaticCallFrom is like StaticCallFromSystem, but the call is made with the given caller as msg.sender.
+func (evm *EVM) StaticCallFrom(caller ContractRef, contractAddress common.Address, abi abipkg.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64) (uint64, error) {
 	staticCall := func(transactionData []byte) ([]byte, uint64, error) {
-		return evm.StaticCall(systemCaller, contractAddress, transactionData, gas)
+		return evm.StaticCall(caller, contractAddress, transactionData, gas)
 	}
 
 	return evm.handleABICall(abi, funcName, args, returnObj, staticCall)
 }
 
-func (evm *EVM) CallFromSystem(contractAddress common.Address, abi abipkg.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, value *big.Int) (uint64, error) {
+// CallFrom is like CallFromSystem, but the call is made with the given caller as msg.sender.
+func (evm *EVM) CallFrom(caller ContractRef, contractAddress common.Address, abi abipkg.ABI, funcName string, args []interface{}, returnObj interface{}, gas uint64, value *big.Int) (uint64, error) {
 	call := func(transactionData []byte) ([]byte, uint64, error) {
-		return evm.Call(systemCaller, contractAddress, transactionData, gas, value)
+		return evm.Call(caller, contractAddress, transactionData, gas, value)
 	}
 	return evm.handleABICall(abi, funcName, args, returnObj, call)
 }
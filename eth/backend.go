@@ -247,6 +247,7 @@ func CreateConsensusEngine(ctx *node.ServiceContext, chainConfig *params.ChainCo
 			config.Istanbul.Epoch = chainConfig.Istanbul.Epoch
 		}
 		config.Istanbul.ProposerPolicy = istanbul.ProposerPolicy(chainConfig.Istanbul.ProposerPolicy)
+		config.Istanbul.CommittedSealHasher = istanbul.CommittedSealHasher(chainConfig.Istanbul.CommittedSealHasher)
 		dataDir := getDataDirOrFail(ctx)
 		return istanbulBackend.New(&config.Istanbul, db, dataDir)
 	}
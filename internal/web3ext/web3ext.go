@@ -791,6 +791,76 @@ web3._extend({
 			name: 'discard',
 			call: 'istanbul_discard',
 			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'forceRoundChange',
+			call: 'istanbul_forceRoundChange',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'getPendingRequests',
+			call: 'istanbul_getPendingRequests',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'getValidatorSetForView',
+			call: 'istanbul_getValidatorSetForView',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'getProposerSchedule',
+			call: 'istanbul_getProposerSchedule',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'simulateProposer',
+			call: 'istanbul_simulateProposer',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'health',
+			call: 'istanbul_health',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'isCatchingUp',
+			call: 'istanbul_isCatchingUp',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'didParticipate',
+			call: 'istanbul_didParticipate',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'getLatestFinalized',
+			call: 'istanbul_getLatestFinalized',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'getLastRoundChangeReason',
+			call: 'istanbul_getLastRoundChangeReason',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'getMissingFromLastCommit',
+			call: 'istanbul_getMissingFromLastCommit',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'dumpMessageTrace',
+			call: 'istanbul_dumpMessageTrace',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'getCurrentRoundTimeout',
+			call: 'istanbul_getCurrentRoundTimeout',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'getRoundChangeRate',
+			call: 'istanbul_getRoundChangeRate',
+			params: 1
 		})
 	],
 	properties:
@@ -242,8 +242,9 @@ func (c *CliqueConfig) String() string {
 
 // IstanbulConfig is the consensus engine configs for Istanbul based sealing.
 type IstanbulConfig struct {
-	Epoch          uint64 `json:"epoch"`  // Epoch length to reset votes and checkpoint
-	ProposerPolicy uint64 `json:"policy"` // The policy for proposer selection
+	Epoch               uint64 `json:"epoch"`                         // Epoch length to reset votes and checkpoint
+	ProposerPolicy      uint64 `json:"policy"`                        // The policy for proposer selection
+	CommittedSealHasher uint64 `json:"committedSealHasher,omitempty"` // The BLS hash-to-curve suite committed seals are signed and verified with (0 = direct, 1 = composite)
 }
 
 // String implements the stringer interface, returning the consensus engine details.